@@ -0,0 +1,152 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// S3Storage is an S3 compatible bucket, MinIO included
+type S3Storage struct {
+	// Endpoint of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com or http://minio.minio:9000
+	Endpoint string `json:"endpoint"`
+	// Bucket the backups are uploaded to
+	Bucket string `json:"bucket"`
+	// Prefix of the object keys
+	Prefix string `json:"prefix,omitempty"`
+	// CredentialsSecret is the name of a secret holding the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY keys
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// PersistentVolumeClaimStorage is an existing claim the backups are written to
+type PersistentVolumeClaimStorage struct {
+	// ClaimName is the name of the claim, in the namespace of the backup
+	ClaimName string `json:"claimName"`
+}
+
+// BackupStorage is where a backup is stored, exactly one of its fields must be set
+type BackupStorage struct {
+	S3                    *S3Storage                    `json:"s3,omitempty"`
+	PersistentVolumeClaim *PersistentVolumeClaimStorage `json:"persistentVolumeClaim,omitempty"`
+}
+
+// BackupMethod is how a backup is taken
+// +kubebuilder:validation:Enum=Dump;Snapshot
+type BackupMethod string
+
+const (
+	// BackupMethodDump archives the output of mongodump to the storage
+	BackupMethodDump BackupMethod = "Dump"
+	// BackupMethodSnapshot takes a VolumeSnapshot of the claim of a locked secondary member
+	BackupMethodSnapshot BackupMethod = "Snapshot"
+)
+
+// SnapshotOptions configures the VolumeSnapshot of a Snapshot backup
+type SnapshotOptions struct {
+	// VolumeSnapshotClassName is the class of the snapshot, the default class of the driver when unset
+	VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// MongoBackupSpec defines the desired state of MongoBackup
+type MongoBackupSpec struct {
+	// ClusterName is the MongoCluster to back up, in the namespace of the backup
+	ClusterName string `json:"clusterName"`
+	// Method is how the backup is taken
+	// +kubebuilder:default=Dump
+	Method BackupMethod `json:"method,omitempty"`
+	// Storage is where the archive is stored, required by the Dump method
+	Storage BackupStorage `json:"storage,omitempty"`
+	// Snapshot configures the Snapshot method
+	Snapshot *SnapshotOptions `json:"snapshot,omitempty"`
+}
+
+// MongoBackupPhase is the progress of a backup
+type MongoBackupPhase string
+
+const (
+	// MongoBackupPending means the backup Job has not been created yet
+	MongoBackupPending MongoBackupPhase = "Pending"
+	// MongoBackupRunning means the backup Job is running
+	MongoBackupRunning MongoBackupPhase = "Running"
+	// MongoBackupCompleted means the archive has been stored
+	MongoBackupCompleted MongoBackupPhase = "Completed"
+	// MongoBackupFailed means the backup will not be retried
+	MongoBackupFailed MongoBackupPhase = "Failed"
+)
+
+// OplogTimestamp is a BSON timestamp of the oplog
+type OplogTimestamp struct {
+	// T is the number of seconds since the epoch
+	T uint32 `json:"t"`
+	// I orders the operations of the same second
+	I uint32 `json:"i"`
+}
+
+// MongoBackupStatus defines the observed state of MongoBackup
+type MongoBackupStatus struct {
+	// Phase of the backup
+	Phase MongoBackupPhase `json:"phase,omitempty"`
+	// Message explains the phase
+	Message string `json:"message,omitempty"`
+	// JobName is the Job running the backup
+	JobName string `json:"jobName,omitempty"`
+	// Location of the archive, as s3://bucket/key or pvc://claim/path
+	Location string `json:"location,omitempty"`
+	// StartTime is when the backup Job was created
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the backup completed or failed
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Duration of the backup
+	Duration string `json:"duration,omitempty"`
+	// SizeBytes is the size of the compressed archive
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// OplogTimestamp is the point in time the archive is consistent with
+	OplogTimestamp *OplogTimestamp `json:"oplogTimestamp,omitempty"`
+	// SnapshotName is the VolumeSnapshot taken by the Snapshot method
+	SnapshotName string `json:"snapshotName,omitempty"`
+	// LockedMember is the member locked while its claim is snapshotted, empty once it is unlocked
+	LockedMember string `json:"lockedMember,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.sizeBytes`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MongoBackup is the Schema for the mongobackups API
+type MongoBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MongoBackupSpec   `json:"spec,omitempty"`
+	Status MongoBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MongoBackupList contains a list of MongoBackup
+type MongoBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MongoBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MongoBackup{}, &MongoBackupList{})
+}
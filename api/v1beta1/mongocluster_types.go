@@ -20,10 +20,37 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// ScaleDownPolicy tells what happens to the volume of a member removed by a scale down
+// +kubebuilder:validation:Enum=Retain;Delete
+type ScaleDownPolicy string
+
+const (
+	// ScaleDownRetain keeps the claim, the member gets its data back if the cluster is scaled up again
+	ScaleDownRetain ScaleDownPolicy = "Retain"
+	// ScaleDownDelete deletes the claim once the member has left the replica set
+	ScaleDownDelete ScaleDownPolicy = "Delete"
+)
+
+// DeletionPolicy tells what happens to the volumes of the members when the MongoCluster is deleted
+// +kubebuilder:validation:Enum=Retain;Delete
+type DeletionPolicy string
+
+const (
+	// DeletionRetain keeps the claims, a cluster created again under the same name gets its data back
+	DeletionRetain DeletionPolicy = "Retain"
+	// DeletionDelete deletes the claims along with the cluster, and the data with them
+	DeletionDelete DeletionPolicy = "Delete"
+)
+
 type Storage struct {
 	// Size of the persistent volume claim
 	Size             string `json:"size"`
 	StorageClassName string `json:"storageClassName,omitempty"`
+	// ScaleDownPolicy tells whether the claim of a removed member is retained or deleted
+	ScaleDownPolicy ScaleDownPolicy `json:"scaleDownPolicy,omitempty"`
+	// DeletionPolicy tells whether the claims of the members are retained or deleted with the cluster
+	// +kubebuilder:default=Retain
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
 }
 
 type ResourcesRequestLimit struct {
@@ -43,6 +70,250 @@ type Resources struct {
 type MongoAuth struct {
 	Password           string `json:"password,omitempty"`
 	ExistingSecretName string `json:"existingSecret,omitempty"`
+	// Rotation rotates the generated admin password and the keyfile of the cluster, it cannot be
+	// combined with password or existingSecret
+	Rotation *CredentialRotation `json:"rotation,omitempty"`
+	// Mechanisms accepted by the members, SCRAM-SHA-256 only when empty. The operator authenticates
+	// with SCRAM-SHA-256, which must stay listed. MONGODB-X509 requires spec.tls in preferTLS or
+	// requireTLS with certificates requested or issued by the operator: the members then authenticate
+	// each other with their certificate instead of the keyfile, and MongoUsers may authenticate with
+	// one. It cannot be added or removed once the cluster exists
+	// +listType=set
+	Mechanisms []AuthMechanism `json:"mechanisms,omitempty"`
+}
+
+// AuthMechanism is a mechanism clients authenticate with
+// +kubebuilder:validation:Enum=SCRAM-SHA-256;MONGODB-X509
+type AuthMechanism string
+
+const (
+	AuthMechanismSCRAM AuthMechanism = "SCRAM-SHA-256"
+	AuthMechanismX509  AuthMechanism = "MONGODB-X509"
+)
+
+// HasMechanism tells whether the members accept the mechanism.
+func (a MongoAuth) HasMechanism(mechanism AuthMechanism) bool {
+	if len(a.Mechanisms) == 0 {
+		return mechanism == AuthMechanismSCRAM
+	}
+	for _, m := range a.Mechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateCredentialsAnnotation starts a rotation of the credentials of a cluster with spec.auth.rotation
+// whenever its value changes
+const RotateCredentialsAnnotation = "apps.esgi.fr/rotate-credentials"
+
+// CredentialRotation rotates the credentials every interval, or when the RotateCredentialsAnnotation
+// of the cluster changes
+type CredentialRotation struct {
+	// Interval between two rotations, e.g. 2160h for 90 days. Without it credentials are only rotated
+	// through the annotation
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// TLSMode is the net.tls.mode of the members and the routers
+// +kubebuilder:validation:Enum=allowTLS;preferTLS;requireTLS
+type TLSMode string
+
+const (
+	// TLSModeAllow accepts TLS connections without using TLS between members
+	TLSModeAllow TLSMode = "allowTLS"
+	// TLSModePrefer uses TLS between members and still accepts connections without TLS
+	TLSModePrefer TLSMode = "preferTLS"
+	// TLSModeRequire only accepts TLS connections
+	TLSModeRequire TLSMode = "requireTLS"
+)
+
+// TLSModes lists the modes in the order an existing cluster moves through them, one step at a time
+var TLSModes = []TLSMode{"", TLSModeAllow, TLSModePrefer, TLSModeRequire}
+
+// IssuerReference is the cert-manager issuer the certificates are requested from
+type IssuerReference struct {
+	// Name of the issuer
+	Name string `json:"name"`
+	// Kind of the issuer
+	// +kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	// +kubebuilder:default=Issuer
+	Kind string `json:"kind,omitempty"`
+	// Group of the issuer
+	// +kubebuilder:default=cert-manager.io
+	Group string `json:"group,omitempty"`
+}
+
+// TLS encrypts the connections of the clients and between the members. Without an issuer nor an
+// existing secret, the operator issues the certificates from a CA of its own, kept in the <name>-ca
+// secret, and renews them before they expire
+type TLS struct {
+	// Mode of the members and routers. TLS is enabled on an existing cluster with allowTLS, then
+	// preferTLS, then requireTLS, one step at a time so that members keep talking to each other while
+	// they restart
+	// +kubebuilder:default=requireTLS
+	Mode TLSMode `json:"mode,omitempty"`
+	// IssuerRef requests a certificate for every member, and one for the routers, from a cert-manager
+	// issuer, which must issue a ca.crt along with them
+	IssuerRef *IssuerReference `json:"issuerRef,omitempty"`
+	// ExistingSecretName is a secret holding tls.crt, tls.key and ca.crt, its certificate must be valid
+	// for the hosts of every member and router
+	ExistingSecretName string `json:"existingSecret,omitempty"`
+}
+
+// ServiceType is the way the members and the routers are exposed
+// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+type ServiceType string
+
+const (
+	// ServiceTypeClusterIP only exposes the cluster inside of Kubernetes
+	ServiceTypeClusterIP ServiceType = "ClusterIP"
+	// ServiceTypeNodePort exposes every member, or the routers, on a port of every node
+	ServiceTypeNodePort ServiceType = "NodePort"
+	// ServiceTypeLoadBalancer exposes every member, or the routers, through a load balancer
+	ServiceTypeLoadBalancer ServiceType = "LoadBalancer"
+)
+
+// ServiceOptions configures the services of the members, and the service of the routers of a sharded
+// cluster. The headless service the members find each other through is always created
+type ServiceOptions struct {
+	// Type of the services
+	// +kubebuilder:default=ClusterIP
+	Type ServiceType `json:"type,omitempty"`
+	// Annotations added to the services, to configure the load balancer for instance
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Labels added to the services
+	Labels map[string]string `json:"labels,omitempty"`
+	// LoadBalancerSourceRanges restricts the clients of a LoadBalancer to these CIDRs
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+}
+
+// ExternalAccess exposes every member outside of Kubernetes on a service of its own, and advertises
+// the external addresses as a replica set horizon. Clients reaching the members through their external
+// hostname over TLS are given the external addresses by the members, clients inside of Kubernetes keep
+// the internal ones. The horizon is selected through SNI, so members are only reachable by a hostname,
+// not an IP address
+type ExternalAccess struct {
+	// Type of the external services
+	// +kubebuilder:validation:Enum=NodePort;LoadBalancer
+	// +kubebuilder:default=LoadBalancer
+	Type ServiceType `json:"type,omitempty"`
+	// Hostnames of the members, in the order of their index, each resolving to the external service of
+	// its member. One is required for each member, clients select their horizon by this name
+	Hostnames []string `json:"hostnames,omitempty"`
+	// HorizonName is the name of the horizon in the replica set configuration
+	// +kubebuilder:default=external
+	HorizonName string `json:"horizonName,omitempty"`
+	// Annotations added to the external services, to configure the load balancer for instance
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// LoadBalancerSourceRanges restricts the external clients of a LoadBalancer to these CIDRs
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+}
+
+// MemberOptions overrides the replica set settings of one member
+type MemberOptions struct {
+	// Index is the ordinal of the member pod
+	// +kubebuilder:validation:Minimum=0
+	Index int32 `json:"index"`
+	// Priority of the member in elections, 0 makes it unelectable. Defaults to 1, and to 0 for
+	// hidden, delayed, arbiter and non voting members
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000
+	Priority *int32 `json:"priority,omitempty"`
+	// Votes is 1 for a voting member and 0 otherwise, defaults to 1
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1
+	Votes *int32 `json:"votes,omitempty"`
+	// Hidden members are not advertised to clients
+	Hidden bool `json:"hidden,omitempty"`
+	// SecondaryDelaySecs makes the member apply operations that many seconds after the primary
+	// +kubebuilder:validation:Minimum=0
+	SecondaryDelaySecs int64 `json:"secondaryDelaySecs,omitempty"`
+	// Tags of the member, used by read preferences and write concerns
+	Tags map[string]string `json:"tags,omitempty"`
+	// Arbiter members vote in elections but hold no data
+	Arbiter bool `json:"arbiter,omitempty"`
+}
+
+// Bootstrap is the data a new cluster starts with, exactly one of its fields must be set
+type Bootstrap struct {
+	// Archive is a mongodump archive restored once the cluster is available. Unlike a snapshot or a
+	// clone, the users and roles of the archive are not restored, mongorestore cannot keep the admin
+	// user of this cluster while restoring the others. They have to be recreated, e.g. with MongoUser
+	// and MongoRole resources
+	Archive *RestoreSource `json:"archive,omitempty"`
+	// VolumeSnapshotName is a VolumeSnapshot, e.g. the one of a MongoBackup with the Snapshot method,
+	// the claims of the members are provisioned from. All the users and roles of the source are kept,
+	// the admin user takes the password of this cluster
+	VolumeSnapshotName string `json:"volumeSnapshotName,omitempty"`
+	// ClusterName is a live MongoCluster, in the namespace of the cluster, the first member is initially
+	// synced from before the replica set is initiated. All the users and roles of the source are kept,
+	// the admin user takes the password of this cluster. Sharded clusters and clusters mounting
+	// spec.tls.existingSecret cannot be synced from
+	ClusterName string `json:"clusterName,omitempty"`
+}
+
+// Sharding describes the topology of a sharded cluster
+type Sharding struct {
+	// Shards is the number of shard replica sets
+	// +kubebuilder:validation:Minimum=1
+	Shards int32 `json:"shards,omitempty"`
+	// MembersPerShard is the number of members of every shard replica set
+	// +kubebuilder:validation:Minimum=1
+	MembersPerShard int32 `json:"membersPerShard,omitempty"`
+	// ConfigServers is the number of members of the config server replica set
+	// +kubebuilder:validation:Minimum=1
+	ConfigServers int32 `json:"configServers,omitempty"`
+	// Routers is the number of mongos replicas
+	// +kubebuilder:validation:Minimum=1
+	Routers int32 `json:"routers,omitempty"`
+}
+
+// BackupRetention limits the archives kept for a backup schedule, an archive is deleted as soon as
+// one of the limits is exceeded
+type BackupRetention struct {
+	// Count is the number of most recent archives kept, 0 keeps them all
+	// +kubebuilder:validation:Minimum=0
+	Count int32 `json:"count,omitempty"`
+	// Days is the age in days after which an archive is deleted, 0 keeps them all
+	// +kubebuilder:validation:Minimum=0
+	Days int32 `json:"days,omitempty"`
+}
+
+// BackupSchedule backs the cluster up periodically
+type BackupSchedule struct {
+	// Name of the schedule, it prefixes the archives of the schedule
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// Schedule in cron format, e.g. "0 3 * * *"
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+	// Storage is where the archives are stored
+	Storage BackupStorage `json:"storage"`
+	// Retention of the archives of the schedule
+	Retention BackupRetention `json:"retention,omitempty"`
+	// Suspend stops scheduling new backups
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// OplogArchive copies the oplog to a backup storage, so that a restore can roll a backup forward
+type OplogArchive struct {
+	// Storage is where the oplog chunks are stored
+	Storage BackupStorage `json:"storage"`
+	// Schedule in cron format of the archiving runs, it bounds the data lost on a disaster. Defaults to
+	// every 5 minutes
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Backup configures the backups the operator takes on its own
+type Backup struct {
+	// Schedules are run as CronJobs dumping the cluster from a secondary
+	// +listType=map
+	// +listMapKey=name
+	Schedules []BackupSchedule `json:"schedules,omitempty"`
+	// OplogArchive continuously archives the oplog for point in time recovery
+	OplogArchive *OplogArchive `json:"oplogArchive,omitempty"`
 }
 
 // MongoClusterSpec defines the desired state of MongoCluster
@@ -53,16 +324,234 @@ type MongoClusterSpec struct {
 	Storage      Storage   `json:"storage,omitempty"`
 	Resources    Resources `json:"resources,omitempty"`
 	Auth         MongoAuth `json:"auth,omitempty"`
+	// Members overrides the settings of individual members, of every shard when the cluster is sharded
+	// +listType=map
+	// +listMapKey=index
+	Members []MemberOptions `json:"members,omitempty"`
+	// Sharding turns the cluster into a sharded cluster, Replicas is ignored when it is set
+	Sharding *Sharding `json:"sharding,omitempty"`
+	// Backup schedules the backups of the cluster, sharded clusters are not supported
+	Backup Backup `json:"backup,omitempty"`
+	// Bootstrap fills a new cluster with the data of a backup or of another cluster, it cannot be
+	// changed once the cluster exists. Sharded clusters are not supported
+	Bootstrap *Bootstrap `json:"bootstrap,omitempty"`
+	// TLS encrypts the connections of the clients and between the members
+	TLS *TLS `json:"tls,omitempty"`
+	// Service configures the way the members, or the routers of a sharded cluster, are exposed
+	Service ServiceOptions `json:"service,omitempty"`
+	// ExternalAccess exposes the members outside of Kubernetes through a replica set horizon. It
+	// requires TLS, the certificates must be valid for the external hostnames. Sharded clusters are
+	// not supported, their routers are exposed through spec.service
+	ExternalAccess *ExternalAccess `json:"externalAccess,omitempty"`
+}
+
+// MongoClusterPhase is a short summary of the conditions of a MongoCluster
+type MongoClusterPhase string
+
+const (
+	// MongoClusterPending means no member is ready yet
+	MongoClusterPending MongoClusterPhase = "Pending"
+	// MongoClusterInitializing means members are up but the replica set is not initiated yet
+	MongoClusterInitializing MongoClusterPhase = "Initializing"
+	// MongoClusterUpdating means the cluster is available while the operator applies changes
+	MongoClusterUpdating MongoClusterPhase = "Updating"
+	// MongoClusterRunning means the cluster is available and matches its spec
+	MongoClusterRunning MongoClusterPhase = "Running"
+	// MongoClusterDegraded means the last reconcile failed or a member is unhealthy
+	MongoClusterDegraded MongoClusterPhase = "Degraded"
+)
+
+// Condition types reported on a MongoCluster
+const (
+	// ConditionAvailable is true when the replica set has a primary accepting writes
+	ConditionAvailable = "Available"
+	// ConditionProgressing is true while the operator is moving the cluster towards its spec
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is true when the last reconcile failed or a member is unhealthy
+	ConditionDegraded = "Degraded"
+	// ConditionReplicaSetInitialized is true once replSetInitiate has been run
+	ConditionReplicaSetInitialized = "ReplicaSetInitialized"
+	// ConditionOplogArchiveContinuous is false when the last oplog archiving run found that entries had
+	// been dropped from the oplog before being archived
+	ConditionOplogArchiveContinuous = "OplogArchiveContinuous"
+)
+
+// MemberStatus is the state of one replica set member
+type MemberStatus struct {
+	// Name of the pod running the member
+	Name string `json:"name"`
+	// Host advertised by the member in the replica set configuration
+	Host string `json:"host"`
+	// State of the member in the replica set (PRIMARY, SECONDARY, RECOVERING...)
+	State string `json:"state,omitempty"`
+	// Healthy is false when the member cannot be reached by the rest of the set
+	Healthy bool `json:"healthy"`
+	// OptimeLagSeconds is how far the last applied operation of the member is behind the primary
+	OptimeLagSeconds int64 `json:"optimeLagSeconds,omitempty"`
+	// ExternalHost is the address the member advertises to the clients outside of Kubernetes
+	ExternalHost string `json:"externalHost,omitempty"`
+}
+
+// ShardStatus is the state of one replica set of a sharded cluster
+type ShardStatus struct {
+	// Name of the replica set
+	Name string `json:"name"`
+	// ReadyMembers is the number of member pods ready
+	ReadyMembers int32 `json:"readyMembers,omitempty"`
+	// Primary is the host of the primary, empty when the replica set has none
+	Primary string `json:"primary,omitempty"`
+	// Healthy is true when the replica set has a primary and all its members are healthy
+	Healthy bool `json:"healthy"`
+	// Registered is true once the shard has been added to the cluster, always false for config servers
+	Registered bool `json:"registered,omitempty"`
+}
+
+// ScheduledBackupStatus is the outcome of the last run of a backup schedule
+type ScheduledBackupStatus struct {
+	// Name of the schedule
+	Name string `json:"name"`
+	// LastScheduleTime is when the last backup Job was started
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// LastSuccessfulTime is when the last successful backup completed
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// LastJobName is the last backup Job that finished
+	LastJobName string `json:"lastJobName,omitempty"`
+	// LastResult is Completed or Failed
+	LastResult MongoBackupPhase `json:"lastResult,omitempty"`
+	// Message explains a failure
+	Message string `json:"message,omitempty"`
+	// Location of the archive of the last successful backup, as s3://bucket/key or pvc://claim/path
+	Location string `json:"location,omitempty"`
+	// SizeBytes is the size of the archive of the last successful backup
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// OplogTimestamp is the point in time the archive of the last successful backup is consistent with
+	OplogTimestamp *OplogTimestamp `json:"oplogTimestamp,omitempty"`
+}
+
+// OplogArchiveStatus is the progress of the oplog archiving
+type OplogArchiveStatus struct {
+	// LastJobName is the last archiving Job that finished
+	LastJobName string `json:"lastJobName,omitempty"`
+	// LastTimestamp is the last oplog entry archived
+	LastTimestamp *OplogTimestamp `json:"lastTimestamp,omitempty"`
+	// LastGapFrom is the last entry archived before the last gap found in the archive
+	LastGapFrom *OplogTimestamp `json:"lastGapFrom,omitempty"`
+	// LastGapTo is the first entry archived after the last gap found in the archive
+	LastGapTo *OplogTimestamp `json:"lastGapTo,omitempty"`
+}
+
+// BootstrapPhase is the progress of the bootstrap of a cluster
+type BootstrapPhase string
+
+const (
+	// BootstrapRunning means the data is being loaded
+	BootstrapRunning BootstrapPhase = "Running"
+	// BootstrapCompleted means the cluster holds the data of its source
+	BootstrapCompleted BootstrapPhase = "Completed"
+	// BootstrapFailed means the bootstrap will not be retried, the cluster runs without the data
+	BootstrapFailed BootstrapPhase = "Failed"
+)
+
+// BootstrapStatus is the progress of the bootstrap of a cluster
+type BootstrapStatus struct {
+	// Phase of the bootstrap
+	Phase BootstrapPhase `json:"phase,omitempty"`
+	// Message explains the phase
+	Message string `json:"message,omitempty"`
+	// CompletionTime is when the bootstrap completed or failed
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// CredentialRotationPhase is the step of the credential rotation in progress
+type CredentialRotationPhase string
+
+const (
+	// RotationIdle is when no rotation is in progress
+	RotationIdle CredentialRotationPhase = ""
+	// RotationPassword is while the new admin password is applied to the replica sets
+	RotationPassword CredentialRotationPhase = "RotatingPassword"
+	// RotationAddingKey is while the members restart with both the previous and the new key
+	RotationAddingKey CredentialRotationPhase = "AddingKey"
+	// RotationRemovingKey is while the members restart with the new key only
+	RotationRemovingKey CredentialRotationPhase = "RemovingKey"
+)
+
+// CredentialRotationStatus is the progress of the credential rotation
+type CredentialRotationStatus struct {
+	// Phase of the rotation in progress, empty when there is none
+	Phase CredentialRotationPhase `json:"phase,omitempty"`
+	// LastRotationTime is when the last rotation completed
+	LastRotationTime *metav1.Time `json:"lastRotationTime,omitempty"`
+	// LastTrigger is the value of the annotation the last rotation was started for
+	LastTrigger string `json:"lastTrigger,omitempty"`
+}
+
+// BindingReference points to the secret a workload binds to, as defined by the servicebinding.io
+// Provisioned Service duck type
+type BindingReference struct {
+	// Name of the secret in the namespace of the cluster
+	Name string `json:"name"`
+}
+
+// ServiceNodePort is the node port allocated to a service, kept when the service is recreated
+type ServiceNodePort struct {
+	// Name of the service
+	Name string `json:"name"`
+	// NodePort of the mongodb port of the service
+	NodePort int32 `json:"nodePort"`
 }
 
 // MongoClusterStatus defines the observed state of MongoCluster
 type MongoClusterStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase summarizes the conditions of the cluster
+	Phase MongoClusterPhase `json:"phase,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// ReadyMembers is the number of member pods ready
+	ReadyMembers int32 `json:"readyMembers,omitempty"`
+	// UpdatedMembers is the number of member pods running the current pod template
+	UpdatedMembers int32 `json:"updatedMembers,omitempty"`
+	// Conditions are the latest observations of the cluster state
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Members lists the replica set members, of every replica set when the cluster is sharded
+	Members []MemberStatus `json:"members,omitempty"`
+	// ConfigServer is the state of the config server replica set of a sharded cluster
+	ConfigServer *ShardStatus `json:"configServer,omitempty"`
+	// Shards is the state of the shard replica sets of a sharded cluster
+	Shards []ShardStatus `json:"shards,omitempty"`
+	// ReadyRouters is the number of mongos pods ready
+	ReadyRouters int32 `json:"readyRouters,omitempty"`
+	// Backups is the outcome of the backup schedules
+	// +listType=map
+	// +listMapKey=name
+	Backups []ScheduledBackupStatus `json:"backups,omitempty"`
+	// OplogArchive is the progress of the oplog archiving
+	OplogArchive *OplogArchiveStatus `json:"oplogArchive,omitempty"`
+	// Bootstrap is the progress of the bootstrap of the cluster
+	Bootstrap *BootstrapStatus `json:"bootstrap,omitempty"`
+	// ConnectionSecretName is the secret holding the hosts and the admin credentials of the cluster
+	ConnectionSecretName string `json:"connectionSecretName,omitempty"`
+	// Binding is the servicebinding.io secret of the cluster, which makes the MongoCluster a
+	// Provisioned Service that ServiceBinding resources can reference directly
+	Binding *BindingReference `json:"binding,omitempty"`
+	// Rotation is the progress of the credential rotation
+	Rotation *CredentialRotationStatus `json:"rotation,omitempty"`
+	// NodePorts are the node ports allocated to the services of the members and routers, once
+	// allocated they are requested again whenever a service is recreated
+	// +listType=map
+	// +listMapKey=name
+	NodePorts []ServiceNodePort `json:"nodePorts,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.spec.replicas`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyMembers`
+//+kubebuilder:printcolumn:name="Updated",type=integer,JSONPath=`.status.updatedMembers`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // MongoCluster is the Schema for the mongoclusters API
 type MongoCluster struct {
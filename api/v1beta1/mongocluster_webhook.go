@@ -18,13 +18,20 @@ package v1beta1
 
 import (
 	"context"
+	"fmt"
 	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"strings"
 )
 
 const (
@@ -37,6 +44,22 @@ const (
 	DEFAULT_MEMORY_REQUEST     = "256Mi"
 	DEFAULT_DATABASE           = "mongo"
 	DEFAULT_STORAGE_CLASS_NAME = "standard"
+	DEFAULT_IMAGE              = "paulb314/mongo:5.0.6-8"
+)
+
+// LEGACY_IMAGE is the image published before its scripts configured TLS and x509 membership
+// authentication, members running it would start without them.
+const LEGACY_IMAGE = "paulb314/mongo:5.0.6"
+
+const DEFAULT_OPLOG_ARCHIVE_SCHEDULE = "*/5 * * * *"
+
+const DEFAULT_HORIZON_NAME = "external"
+
+const (
+	DEFAULT_SHARDS            = 1
+	DEFAULT_MEMBERS_PER_SHARD = 3
+	DEFAULT_CONFIG_SERVERS    = 3
+	DEFAULT_ROUTERS           = 2
 )
 
 // log is for logging in this package.
@@ -61,39 +84,90 @@ var _ webhook.Defaulter = &MongoCluster{}
 // Default implements webhook.Defaulter so a webhook will be registered for the type
 func (r *MongoCluster) Default() {
 	mongoclusterlog.Info("default", "name", r.Name)
+	if r.Spec.Image == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No image specified, defaulting to %s", DEFAULT_IMAGE))
+		r.Spec.Image = DEFAULT_IMAGE
+	}
 	if r.Spec.Replicas < 1 {
-		mongoclusterlog.Info("No replicas specified, defaulting to %s", DEFAULT_REPLICAS_NUMBER)
+		mongoclusterlog.Info(fmt.Sprintf("No replicas specified, defaulting to %d", DEFAULT_REPLICAS_NUMBER))
 		r.Spec.Replicas = DEFAULT_REPLICAS_NUMBER
 	}
 	if r.Spec.Storage.Size == "" {
-		mongoclusterlog.Info("No storage size specified, defaulting to %s", DEFAULT_STORAGE_SIZE)
+		mongoclusterlog.Info(fmt.Sprintf("No storage size specified, defaulting to %s", DEFAULT_STORAGE_SIZE))
 		r.Spec.Storage.Size = DEFAULT_STORAGE_SIZE
 	}
 	if r.Spec.Storage.StorageClassName == "" {
-		mongoclusterlog.Info("No storage class name specified, defaulting to %s", DEFAULT_STORAGE_CLASS_NAME)
+		mongoclusterlog.Info(fmt.Sprintf("No storage class name specified, defaulting to %s", DEFAULT_STORAGE_CLASS_NAME))
 		r.Spec.Storage.StorageClassName = DEFAULT_STORAGE_CLASS
 	}
+	if r.Spec.Storage.ScaleDownPolicy == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No scale down policy specified, defaulting to %s", ScaleDownRetain))
+		r.Spec.Storage.ScaleDownPolicy = ScaleDownRetain
+	}
+	if r.Spec.Storage.DeletionPolicy == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No deletion policy specified, defaulting to %s", DeletionRetain))
+		r.Spec.Storage.DeletionPolicy = DeletionRetain
+	}
 	if r.Spec.Resources.CPU.Request == "" {
-		mongoclusterlog.Info("No Request request specified, defaulting to %s", DEFAULT_CPU_REQUEST)
+		mongoclusterlog.Info(fmt.Sprintf("No Request request specified, defaulting to %s", DEFAULT_CPU_REQUEST))
 		r.Spec.Resources.CPU.Request = DEFAULT_CPU_REQUEST
 	}
 	if r.Spec.Resources.CPU.Limit == "" {
-		mongoclusterlog.Info("No CPU request specified, defaulting to %s", DEFAULT_CPU_LIMIT)
+		mongoclusterlog.Info(fmt.Sprintf("No CPU request specified, defaulting to %s", DEFAULT_CPU_LIMIT))
 		r.Spec.Resources.CPU.Limit = DEFAULT_CPU_LIMIT
 	}
 	if r.Spec.Resources.Memory.Request == "" {
-		mongoclusterlog.Info("No memory request specified, defaulting to %s", DEFAULT_MEMORY_REQUEST)
-		r.Spec.Resources.Memory.Request = DEFAULT_CPU_LIMIT
+		mongoclusterlog.Info(fmt.Sprintf("No memory request specified, defaulting to %s", DEFAULT_MEMORY_REQUEST))
+		r.Spec.Resources.Memory.Request = DEFAULT_MEMORY_REQUEST
 	}
 
 	if r.Spec.Resources.Memory.Limit == "" {
-		mongoclusterlog.Info("No memory limit specified, defaulting to %s", DEFAULT_MEMORY_LIMIT)
+		mongoclusterlog.Info(fmt.Sprintf("No memory limit specified, defaulting to %s", DEFAULT_MEMORY_LIMIT))
 		r.Spec.Resources.Memory.Limit = DEFAULT_MEMORY_LIMIT
 	}
 	if r.Spec.DatabaseName == "" {
-		mongoclusterlog.Info("No database specified, defaulting to %s", DEFAULT_DATABASE)
+		mongoclusterlog.Info(fmt.Sprintf("No database specified, defaulting to %s", DEFAULT_DATABASE))
 		r.Spec.DatabaseName = DEFAULT_DATABASE
 	}
+	if r.Spec.Sharding != nil {
+		r.defaultSharding()
+	}
+	if r.Spec.Backup.OplogArchive != nil && r.Spec.Backup.OplogArchive.Schedule == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No oplog archive schedule specified, defaulting to %s", DEFAULT_OPLOG_ARCHIVE_SCHEDULE))
+		r.Spec.Backup.OplogArchive.Schedule = DEFAULT_OPLOG_ARCHIVE_SCHEDULE
+	}
+	if r.Spec.Service.Type == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No service type specified, defaulting to %s", ServiceTypeClusterIP))
+		r.Spec.Service.Type = ServiceTypeClusterIP
+	}
+	if r.Spec.ExternalAccess != nil && r.Spec.ExternalAccess.Type == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No external service type specified, defaulting to %s", ServiceTypeLoadBalancer))
+		r.Spec.ExternalAccess.Type = ServiceTypeLoadBalancer
+	}
+	if r.Spec.ExternalAccess != nil && r.Spec.ExternalAccess.HorizonName == "" {
+		mongoclusterlog.Info(fmt.Sprintf("No horizon name specified, defaulting to %s", DEFAULT_HORIZON_NAME))
+		r.Spec.ExternalAccess.HorizonName = DEFAULT_HORIZON_NAME
+	}
+}
+
+func (r *MongoCluster) defaultSharding() {
+	sharding := r.Spec.Sharding
+	if sharding.Shards < 1 {
+		mongoclusterlog.Info(fmt.Sprintf("No shards specified, defaulting to %d", DEFAULT_SHARDS))
+		sharding.Shards = DEFAULT_SHARDS
+	}
+	if sharding.MembersPerShard < 1 {
+		mongoclusterlog.Info(fmt.Sprintf("No members per shard specified, defaulting to %d", DEFAULT_MEMBERS_PER_SHARD))
+		sharding.MembersPerShard = DEFAULT_MEMBERS_PER_SHARD
+	}
+	if sharding.ConfigServers < 1 {
+		mongoclusterlog.Info(fmt.Sprintf("No config servers specified, defaulting to %d", DEFAULT_CONFIG_SERVERS))
+		sharding.ConfigServers = DEFAULT_CONFIG_SERVERS
+	}
+	if sharding.Routers < 1 {
+		mongoclusterlog.Info(fmt.Sprintf("No routers specified, defaulting to %d", DEFAULT_ROUTERS))
+		sharding.Routers = DEFAULT_ROUTERS
+	}
 }
 
 // TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
@@ -109,7 +183,35 @@ func (r *MongoCluster) ValidateCreate() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	err = r.validateMembers(nil)
+	if err != nil {
+		return err
+	}
+	err = r.validateBackup()
+	if err != nil {
+		return err
+	}
+	err = r.validateBootstrap(nil)
+	if err != nil {
+		return err
+	}
+	err = r.validateTLS(nil)
+	if err != nil {
+		return err
+	}
+	err = r.validateAuthMechanisms(nil)
+	if err != nil {
+		return err
+	}
+	err = r.validateService()
+	if err != nil {
+		return err
+	}
+	err = r.validateExternalAccess()
+	if err != nil {
+		return err
+	}
+	return r.validateResources()
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
@@ -119,7 +221,43 @@ func (r *MongoCluster) ValidateUpdate(old runtime.Object) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	err = r.validateShardingUpdate(old.(*MongoCluster))
+	if err != nil {
+		return err
+	}
+	err = r.validateStorageUpdate(old.(*MongoCluster))
+	if err != nil {
+		return err
+	}
+	err = r.validateMembers(old.(*MongoCluster))
+	if err != nil {
+		return err
+	}
+	err = r.validateBackup()
+	if err != nil {
+		return err
+	}
+	err = r.validateBootstrap(old.(*MongoCluster))
+	if err != nil {
+		return err
+	}
+	err = r.validateTLS(old.(*MongoCluster))
+	if err != nil {
+		return err
+	}
+	err = r.validateAuthMechanisms(old.(*MongoCluster))
+	if err != nil {
+		return err
+	}
+	err = r.validateService()
+	if err != nil {
+		return err
+	}
+	err = r.validateExternalAccess()
+	if err != nil {
+		return err
+	}
+	return r.validateResources()
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
@@ -132,10 +270,15 @@ func (r *MongoCluster) ValidateDelete() error {
 	return nil
 }
 
+// validatePasswordSecret checks that the existing secret exists. A cluster with neither a password
+// nor an existing secret gets a generated password.
 func (r *MongoCluster) validatePasswordSecret() error {
-	if r.Spec.Auth.ExistingSecretName == "" && r.Spec.Auth.Password == "" {
-		return error(errors.NewNotFound(v1api.Resource("secret"), r.Spec.Auth.ExistingSecretName))
-	} else if r.Spec.Auth.ExistingSecretName != "" && r.Spec.Auth.Password == "" {
+	if r.Spec.Auth.Rotation != nil && (r.Spec.Auth.ExistingSecretName != "" || r.Spec.Auth.Password != "") {
+		return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, field.ErrorList{
+			field.Forbidden(field.NewPath("spec", "auth", "rotation"), "only generated passwords are rotated, password and existingSecret must be empty"),
+		})
+	}
+	if r.Spec.Auth.ExistingSecretName != "" && r.Spec.Auth.Password == "" {
 		cli := _manager.GetClient()
 		secret := &v1api.Secret{}
 		ctx := context.Background()
@@ -149,3 +292,355 @@ func (r *MongoCluster) validatePasswordSecret() error {
 	}
 	return nil
 }
+
+func (r *MongoCluster) validateResources() error {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	quantities := []struct {
+		path  *field.Path
+		value string
+	}{
+		{specPath.Child("storage", "size"), r.Spec.Storage.Size},
+		{specPath.Child("resources", "cpu", "request"), r.Spec.Resources.CPU.Request},
+		{specPath.Child("resources", "cpu", "limit"), r.Spec.Resources.CPU.Limit},
+		{specPath.Child("resources", "memory", "request"), r.Spec.Resources.Memory.Request},
+		{specPath.Child("resources", "memory", "limit"), r.Spec.Resources.Memory.Limit},
+	}
+	parsed := map[string]resource.Quantity{}
+	for _, quantity := range quantities {
+		if quantity.value == "" {
+			continue
+		}
+		value, err := resource.ParseQuantity(quantity.value)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(quantity.path, quantity.value, err.Error()))
+			continue
+		}
+		parsed[quantity.path.String()] = value
+	}
+	for _, kind := range []string{"cpu", "memory"} {
+		request, hasRequest := parsed[specPath.Child("resources", kind, "request").String()]
+		limit, hasLimit := parsed[specPath.Child("resources", kind, "limit").String()]
+		if hasRequest && hasLimit && request.Cmp(limit) > 0 {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("resources", kind, "request"), request.String(), "must be less than or equal to the limit"))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// validateShardingUpdate rejects the changes the operator cannot carry out: turning a replica set into
+// a sharded cluster or back, and removing shards, which would need their chunks to be drained first.
+func (r *MongoCluster) validateShardingUpdate(old *MongoCluster) error {
+	var allErrs field.ErrorList
+	shardingPath := field.NewPath("spec", "sharding")
+	if (old.Spec.Sharding == nil) != (r.Spec.Sharding == nil) {
+		allErrs = append(allErrs, field.Forbidden(shardingPath, "cannot be added to or removed from an existing cluster"))
+	} else if r.Spec.Sharding != nil && r.Spec.Sharding.Shards < old.Spec.Sharding.Shards {
+		allErrs = append(allErrs, field.Invalid(shardingPath.Child("shards"), r.Spec.Sharding.Shards, "shards cannot be removed"))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// validateStorageUpdate rejects changes to the size and the class of the claims, the claim template of
+// a StatefulSet cannot be changed and the claims of the existing members would be left as they are.
+func (r *MongoCluster) validateStorageUpdate(old *MongoCluster) error {
+	var allErrs field.ErrorList
+	storagePath := field.NewPath("spec", "storage")
+	oldSize, oldErr := resource.ParseQuantity(old.Spec.Storage.Size)
+	size, err := resource.ParseQuantity(r.Spec.Storage.Size)
+	if oldErr == nil && err == nil && size.Cmp(oldSize) != 0 {
+		allErrs = append(allErrs, field.Forbidden(storagePath.Child("size"), fmt.Sprintf("cannot be changed from %s, the claims of the members are immutable", old.Spec.Storage.Size)))
+	}
+	if old.Spec.Storage.StorageClassName != "" && r.Spec.Storage.StorageClassName != old.Spec.Storage.StorageClassName {
+		allErrs = append(allErrs, field.Forbidden(storagePath.Child("storageClassName"), fmt.Sprintf("cannot be changed from %s, the claims of the members are immutable", old.Spec.Storage.StorageClassName)))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+const MAX_VOTING_MEMBERS = 7
+
+// getMemberCount is the number of members of the replica sets spec.members applies to.
+func (r *MongoCluster) getMemberCount() int32 {
+	if r.Spec.Sharding != nil {
+		return r.Spec.Sharding.MembersPerShard
+	}
+	return r.Spec.Replicas
+}
+
+// validateMembers checks the member overrides against the replica set rules of MongoDB. The first
+// member initiates the replica set, so it has to stay an electable data bearing member, and a member
+// that already holds data cannot be turned into an arbiter, nor an arbiter into a data bearing member.
+func (r *MongoCluster) validateMembers(old *MongoCluster) error {
+	var allErrs field.ErrorList
+	membersPath := field.NewPath("spec", "members")
+	memberCount := r.getMemberCount()
+	oldArbiters := map[int32]bool{}
+	if old != nil {
+		for _, member := range old.Spec.Members {
+			oldArbiters[member.Index] = member.Arbiter
+		}
+	}
+	indexes := map[int32]bool{}
+	arbiters := 0
+	nonVoting := int32(0)
+	for i, member := range r.Spec.Members {
+		path := membersPath.Index(i)
+		if indexes[member.Index] {
+			allErrs = append(allErrs, field.Duplicate(path.Child("index"), member.Index))
+		}
+		indexes[member.Index] = true
+		if member.Index >= memberCount {
+			allErrs = append(allErrs, field.Invalid(path.Child("index"), member.Index, fmt.Sprintf("must be lower than the number of members %d", memberCount)))
+			continue
+		}
+		explicitPriority := member.Priority != nil && *member.Priority > 0
+		votes := member.Votes == nil || *member.Votes > 0
+		if !votes {
+			nonVoting++
+		}
+		if !votes && explicitPriority {
+			allErrs = append(allErrs, field.Invalid(path.Child("priority"), *member.Priority, "must be 0 for a non voting member"))
+		}
+		if (member.Hidden || member.SecondaryDelaySecs > 0 || member.Arbiter) && explicitPriority {
+			allErrs = append(allErrs, field.Invalid(path.Child("priority"), *member.Priority, "must be 0 for hidden, delayed and arbiter members"))
+		}
+		if member.Arbiter {
+			arbiters++
+			if member.Hidden || member.SecondaryDelaySecs > 0 || len(member.Tags) > 0 {
+				allErrs = append(allErrs, field.Invalid(path.Child("arbiter"), member.Arbiter, "an arbiter holds no data and cannot be hidden, delayed or tagged"))
+			}
+			if !votes {
+				allErrs = append(allErrs, field.Invalid(path.Child("votes"), *member.Votes, "an arbiter must vote"))
+			}
+		}
+		if member.Index == 0 && (member.Arbiter || member.Hidden || member.SecondaryDelaySecs > 0 || !votes || (member.Priority != nil && *member.Priority == 0)) {
+			allErrs = append(allErrs, field.Invalid(path, member.Index, "the first member initiates the replica set and must be an electable data bearing member"))
+		}
+		if old != nil && member.Index < old.getMemberCount() && oldArbiters[member.Index] != member.Arbiter {
+			allErrs = append(allErrs, field.Forbidden(path.Child("arbiter"), "cannot be changed on an existing member"))
+		}
+	}
+	if old != nil {
+		for index, arbiter := range oldArbiters {
+			if arbiter && !indexes[index] && index < old.getMemberCount() && index < memberCount {
+				allErrs = append(allErrs, field.Forbidden(membersPath, fmt.Sprintf("member %d cannot stop being an arbiter", index)))
+			}
+		}
+	}
+	if arbiters > 1 {
+		allErrs = append(allErrs, field.Invalid(membersPath, arbiters, "at most one arbiter is supported"))
+	}
+	if voting := memberCount - nonVoting; voting > MAX_VOTING_MEMBERS {
+		allErrs = append(allErrs, field.Invalid(membersPath, voting, fmt.Sprintf("at most %d members can vote, set votes to 0 on the others", MAX_VOTING_MEMBERS)))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// MAX_CRON_JOB_NAME_LENGTH leaves room for the suffix the CronJob controller appends to the Job names.
+const MAX_CRON_JOB_NAME_LENGTH = 52
+
+// validateBackup checks that every schedule has a single destination and that the name of its
+// CronJob, <cluster>-backup-<schedule>, is valid.
+func (r *MongoCluster) validateBackup() error {
+	var allErrs field.ErrorList
+	schedulesPath := field.NewPath("spec", "backup", "schedules")
+	if r.Spec.Sharding != nil && len(r.Spec.Backup.Schedules) > 0 {
+		allErrs = append(allErrs, field.Forbidden(schedulesPath, "backups of sharded clusters are not supported"))
+	}
+	if oplogArchive := r.Spec.Backup.OplogArchive; oplogArchive != nil {
+		path := field.NewPath("spec", "backup", "oplogArchive")
+		if r.Spec.Sharding != nil {
+			allErrs = append(allErrs, field.Forbidden(path, "oplog archiving of sharded clusters is not supported"))
+		}
+		if (oplogArchive.Storage.S3 == nil) == (oplogArchive.Storage.PersistentVolumeClaim == nil) {
+			allErrs = append(allErrs, field.Invalid(path.Child("storage"), oplogArchive.Storage, "exactly one of s3 and persistentVolumeClaim must be set"))
+		}
+		if len(r.Name)+len("-oplog") > MAX_CRON_JOB_NAME_LENGTH {
+			allErrs = append(allErrs, field.Invalid(path, r.Name, "the cluster name is too long to archive its oplog"))
+		}
+	}
+	for i, schedule := range r.Spec.Backup.Schedules {
+		path := schedulesPath.Index(i)
+		if (schedule.Storage.S3 == nil) == (schedule.Storage.PersistentVolumeClaim == nil) {
+			allErrs = append(allErrs, field.Invalid(path.Child("storage"), schedule.Storage, "exactly one of s3 and persistentVolumeClaim must be set"))
+		}
+		if length := len(r.Name) + len("-backup-") + len(schedule.Name); length > MAX_CRON_JOB_NAME_LENGTH {
+			allErrs = append(allErrs, field.TooLong(path.Child("name"), schedule.Name, MAX_CRON_JOB_NAME_LENGTH-len(r.Name)-len("-backup-")))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// validateBootstrap checks that a single source is given and, on update, that the bootstrap did not
+// change since it only applies when the cluster is created.
+func (r *MongoCluster) validateBootstrap(old *MongoCluster) error {
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "bootstrap")
+	if old != nil && !equality.Semantic.DeepEqual(r.Spec.Bootstrap, old.Spec.Bootstrap) {
+		allErrs = append(allErrs, field.Forbidden(path, "cannot be changed on an existing cluster"))
+	}
+	if bootstrap := r.Spec.Bootstrap; bootstrap != nil && old == nil {
+		if r.Spec.Sharding != nil {
+			allErrs = append(allErrs, field.Forbidden(path, "bootstrapping sharded clusters is not supported"))
+		}
+		sources := 0
+		if bootstrap.Archive != nil {
+			sources++
+		}
+		if bootstrap.VolumeSnapshotName != "" {
+			sources++
+		}
+		if bootstrap.ClusterName != "" {
+			sources++
+		}
+		if sources != 1 {
+			allErrs = append(allErrs, field.Invalid(path, bootstrap, "exactly one of archive, volumeSnapshotName and clusterName must be set"))
+		}
+		if bootstrap.ClusterName == r.Name {
+			allErrs = append(allErrs, field.Invalid(path.Child("clusterName"), bootstrap.ClusterName, "a cluster cannot be cloned from itself"))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// validateTLS checks that the certificates come from a single source and, on update, that the mode
+// moves one step at a time through TLSModes: members restarted with requireTLS would not reach the
+// members still running without TLS.
+func (r *MongoCluster) validateTLS(old *MongoCluster) error {
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "tls")
+	if tls := r.Spec.TLS; tls != nil && tls.IssuerRef != nil && tls.ExistingSecretName != "" {
+		allErrs = append(allErrs, field.Invalid(path, tls, "issuerRef and existingSecret cannot both be set"))
+	}
+	if r.Spec.TLS != nil && r.Spec.Image == LEGACY_IMAGE {
+		allErrs = append(allErrs, field.Forbidden(path, fmt.Sprintf("the image %s does not configure TLS, use %s", LEGACY_IMAGE, DEFAULT_IMAGE)))
+	}
+	if old != nil {
+		from, to := getTLSModeStep(old.Spec.TLS), getTLSModeStep(r.Spec.TLS)
+		if to-from > 1 || from-to > 1 {
+			allErrs = append(allErrs, field.Forbidden(path.Child("mode"), fmt.Sprintf("the mode of an existing cluster moves one step at a time through allowTLS, preferTLS and requireTLS, from %q", TLSModes[from])))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// getTLSModeStep returns the index of the mode in TLSModes, a missing mode stands for requireTLS.
+func getTLSModeStep(tls *TLS) int {
+	if tls == nil {
+		return 0
+	}
+	for i, mode := range TLSModes[1:] {
+		if mode == tls.Mode {
+			return i + 1
+		}
+	}
+	return len(TLSModes) - 1
+}
+
+// validateAuthMechanisms checks that the operator can still authenticate, and that x509 authentication
+// has certificates it can rely on. Members cannot switch between the keyfile and x509 membership
+// authentication one at a time, so MONGODB-X509 is set when the cluster is created.
+func (r *MongoCluster) validateAuthMechanisms(old *MongoCluster) error {
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "auth", "mechanisms")
+	if !r.Spec.Auth.HasMechanism(AuthMechanismSCRAM) {
+		allErrs = append(allErrs, field.Invalid(path, r.Spec.Auth.Mechanisms, "SCRAM-SHA-256 is required, the operator authenticates with it"))
+	}
+	if r.Spec.Auth.HasMechanism(AuthMechanismX509) {
+		tls := r.Spec.TLS
+		if tls == nil || (tls.Mode != "" && tls.Mode != TLSModePrefer && tls.Mode != TLSModeRequire) {
+			allErrs = append(allErrs, field.Invalid(path, r.Spec.Auth.Mechanisms, "MONGODB-X509 requires spec.tls.mode to be preferTLS or requireTLS"))
+		} else if tls.ExistingSecretName != "" {
+			allErrs = append(allErrs, field.Invalid(path, r.Spec.Auth.Mechanisms, "MONGODB-X509 requires certificates issued for each client, spec.tls.existingSecret cannot be used"))
+		}
+		if r.Spec.Image == LEGACY_IMAGE {
+			allErrs = append(allErrs, field.Forbidden(path, fmt.Sprintf("the image %s does not configure x509 membership authentication, use %s", LEGACY_IMAGE, DEFAULT_IMAGE)))
+		}
+	}
+	if old != nil && old.Spec.Auth.HasMechanism(AuthMechanismX509) != r.Spec.Auth.HasMechanism(AuthMechanismX509) {
+		allErrs = append(allErrs, field.Forbidden(path, "MONGODB-X509 cannot be added or removed once the cluster exists"))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// validateService checks the source ranges, which only restrict the clients of a LoadBalancer.
+func (r *MongoCluster) validateService() error {
+	service := r.Spec.Service
+	allErrs := validateSourceRanges(field.NewPath("spec", "service", "loadBalancerSourceRanges"), service.Type, service.LoadBalancerSourceRanges)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+// validateExternalAccess checks that the members can be given an external hostname. Horizons are
+// selected through SNI, which TLS clients only send for hostnames.
+func (r *MongoCluster) validateExternalAccess() error {
+	externalAccess := r.Spec.ExternalAccess
+	if externalAccess == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "externalAccess")
+	if r.Spec.Sharding != nil {
+		allErrs = append(allErrs, field.Forbidden(path, "sharded clusters are not supported, expose the routers through spec.service"))
+	}
+	if r.Spec.TLS == nil {
+		allErrs = append(allErrs, field.Invalid(path, r.Name, "requires spec.tls, the horizon of a client is selected through SNI"))
+	}
+	hostnamesPath := path.Child("hostnames")
+	if len(externalAccess.Hostnames) == 0 {
+		allErrs = append(allErrs, field.Required(hostnamesPath, "the members are advertised under these hostnames, neither node ports nor load balancers publish one reliably"))
+	} else if int32(len(externalAccess.Hostnames)) != r.Spec.Replicas {
+		allErrs = append(allErrs, field.Invalid(hostnamesPath, externalAccess.Hostnames, fmt.Sprintf("must have one hostname for each of the %d members", r.Spec.Replicas)))
+	}
+	for i, hostname := range externalAccess.Hostnames {
+		if net.ParseIP(hostname) != nil {
+			allErrs = append(allErrs, field.Invalid(hostnamesPath.Index(i), hostname, "must be a hostname, TLS clients send no SNI for IP addresses"))
+		} else if messages := validation.IsDNS1123Subdomain(hostname); len(messages) > 0 {
+			allErrs = append(allErrs, field.Invalid(hostnamesPath.Index(i), hostname, strings.Join(messages, ", ")))
+		}
+	}
+	allErrs = append(allErrs, validateSourceRanges(path.Child("loadBalancerSourceRanges"), externalAccess.Type, externalAccess.LoadBalancerSourceRanges)...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("MongoCluster").GroupKind(), r.Name, allErrs)
+}
+
+func validateSourceRanges(path *field.Path, serviceType ServiceType, sourceRanges []string) field.ErrorList {
+	var allErrs field.ErrorList
+	if len(sourceRanges) > 0 && serviceType != ServiceTypeLoadBalancer {
+		allErrs = append(allErrs, field.Forbidden(path, "only applies to the LoadBalancer type"))
+	}
+	for i, sourceRange := range sourceRanges {
+		if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Index(i), sourceRange, "must be a CIDR such as 10.0.0.0/8"))
+		}
+	}
+	return allErrs
+}
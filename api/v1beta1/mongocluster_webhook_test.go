@@ -0,0 +1,216 @@
+package v1beta1
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("MongoCluster webhook", func() {
+	int32Ptr := func(value int32) *int32 { return &value }
+
+	// newCluster returns a defaulted cluster of the given size, the changes made by the spec are
+	// validated on top of it. It has a password, clusters without a password or a secret are rejected.
+	newCluster := func(replicas int32) *MongoCluster {
+		cluster := &MongoCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: "mongo", Namespace: "default"},
+			Spec:       MongoClusterSpec{Replicas: replicas, Auth: MongoAuth{Password: "password"}},
+		}
+		cluster.Default()
+		return cluster
+	}
+
+	Describe("members", func() {
+		It("accepts at most 7 voting members", func() {
+			cluster := newCluster(8)
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("at most 7 members can vote")))
+			cluster.Spec.Members = []MemberOptions{{Index: 7, Votes: int32Ptr(0)}}
+			Expect(cluster.ValidateCreate()).To(Succeed())
+		})
+
+		It("requires non voting members to have no priority", func() {
+			cluster := newCluster(3)
+			cluster.Spec.Members = []MemberOptions{{Index: 2, Votes: int32Ptr(0), Priority: int32Ptr(1)}}
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("must be 0 for a non voting member")))
+		})
+
+		It("keeps the first member electable", func() {
+			for _, member := range []MemberOptions{
+				{Index: 0, Arbiter: true},
+				{Index: 0, Hidden: true},
+				{Index: 0, Votes: int32Ptr(0)},
+				{Index: 0, Priority: int32Ptr(0)},
+			} {
+				cluster := newCluster(3)
+				cluster.Spec.Members = []MemberOptions{member}
+				Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("the first member initiates the replica set")))
+			}
+		})
+
+		It("accepts a single voting arbiter holding no data", func() {
+			cluster := newCluster(3)
+			cluster.Spec.Members = []MemberOptions{{Index: 2, Arbiter: true}}
+			Expect(cluster.ValidateCreate()).To(Succeed())
+
+			cluster.Spec.Members = []MemberOptions{{Index: 1, Arbiter: true}, {Index: 2, Arbiter: true}}
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("at most one arbiter")))
+
+			cluster.Spec.Members = []MemberOptions{{Index: 2, Arbiter: true, Hidden: true}}
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("cannot be hidden, delayed or tagged")))
+
+			cluster.Spec.Members = []MemberOptions{{Index: 2, Arbiter: true, Votes: int32Ptr(0)}}
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("an arbiter must vote")))
+		})
+
+		It("does not turn an existing member into an arbiter or back", func() {
+			old := newCluster(3)
+			cluster := old.DeepCopy()
+			cluster.Spec.Members = []MemberOptions{{Index: 2, Arbiter: true}}
+			Expect(cluster.ValidateUpdate(old)).To(MatchError(ContainSubstring("cannot be changed on an existing member")))
+			Expect(old.ValidateUpdate(cluster)).To(MatchError(ContainSubstring("member 2 cannot stop being an arbiter")))
+
+			cluster.Spec.Replicas = 4
+			cluster.Spec.Members = []MemberOptions{{Index: 3, Arbiter: true}}
+			Expect(cluster.ValidateUpdate(old)).To(Succeed())
+		})
+	})
+
+	Describe("storage", func() {
+		It("keeps the size and the class of the claims", func() {
+			old := newCluster(3)
+			cluster := old.DeepCopy()
+			cluster.Spec.Storage.Size = "20Gi"
+			Expect(cluster.validateStorageUpdate(old)).To(MatchError(ContainSubstring("spec.storage.size: Forbidden")))
+
+			cluster = old.DeepCopy()
+			cluster.Spec.Storage.StorageClassName = "fast"
+			Expect(cluster.validateStorageUpdate(old)).To(MatchError(ContainSubstring("spec.storage.storageClassName: Forbidden")))
+
+			cluster = old.DeepCopy()
+			cluster.Spec.Storage.DeletionPolicy = DeletionDelete
+			Expect(cluster.validateStorageUpdate(old)).To(Succeed())
+		})
+	})
+
+	Describe("resources", func() {
+		DescribeTable("checks the quantities of the spec",
+			func(update func(cluster *MongoCluster), message string) {
+				cluster := newCluster(3)
+				update(cluster)
+				if message == "" {
+					Expect(cluster.validateResources()).To(Succeed())
+				} else {
+					Expect(cluster.validateResources()).To(MatchError(ContainSubstring(message)))
+				}
+			},
+			Entry("an unparsable storage size", func(cluster *MongoCluster) { cluster.Spec.Storage.Size = "ten gigs" },
+				"spec.storage.size: Invalid value"),
+			Entry("an unparsable cpu request", func(cluster *MongoCluster) { cluster.Spec.Resources.CPU.Request = "1 core" },
+				"spec.resources.cpu.request: Invalid value"),
+			Entry("an unparsable memory limit", func(cluster *MongoCluster) { cluster.Spec.Resources.Memory.Limit = "1GB" },
+				"spec.resources.memory.limit: Invalid value"),
+			Entry("a cpu request greater than the limit", func(cluster *MongoCluster) { cluster.Spec.Resources.CPU.Request = "2" },
+				"spec.resources.cpu.request: Invalid value: \"2\": must be less than or equal to the limit"),
+			Entry("a memory request greater than the limit", func(cluster *MongoCluster) { cluster.Spec.Resources.Memory.Request = "2Gi" },
+				"spec.resources.memory.request: Invalid value: \"2Gi\": must be less than or equal to the limit"),
+			Entry("a request equal to the limit", func(cluster *MongoCluster) { cluster.Spec.Resources.Memory.Request = "1024Mi" }, ""),
+			Entry("empty values", func(cluster *MongoCluster) {
+				cluster.Spec.Resources = Resources{}
+				cluster.Spec.Resources.CPU.Request = "4"
+			}, ""),
+		)
+	})
+
+	Describe("TLS", func() {
+		withTLS := func(cluster *MongoCluster, mode TLSMode) *MongoCluster {
+			cluster = cluster.DeepCopy()
+			cluster.Spec.TLS = &TLS{Mode: mode}
+			return cluster
+		}
+
+		It("moves an existing cluster one step at a time", func() {
+			cluster := newCluster(3)
+			allow, prefer, require := withTLS(cluster, TLSModeAllow), withTLS(cluster, TLSModePrefer), withTLS(cluster, TLSModeRequire)
+			Expect(allow.ValidateUpdate(cluster)).To(Succeed())
+			Expect(prefer.ValidateUpdate(allow)).To(Succeed())
+			Expect(require.ValidateUpdate(prefer)).To(Succeed())
+			Expect(prefer.ValidateUpdate(require)).To(Succeed())
+			Expect(require.ValidateUpdate(cluster)).To(MatchError(ContainSubstring("one step at a time")))
+			Expect(prefer.ValidateUpdate(cluster)).To(MatchError(ContainSubstring("one step at a time")))
+			Expect(cluster.ValidateUpdate(prefer)).To(MatchError(ContainSubstring("one step at a time")))
+		})
+
+		It("treats a missing mode as requireTLS", func() {
+			cluster := newCluster(3)
+			Expect(withTLS(cluster, "").ValidateUpdate(withTLS(cluster, TLSModePrefer))).To(Succeed())
+			Expect(withTLS(cluster, "").ValidateUpdate(withTLS(cluster, TLSModeAllow))).To(MatchError(ContainSubstring("one step at a time")))
+		})
+
+		It("takes the certificates from a single source", func() {
+			cluster := withTLS(newCluster(3), TLSModeRequire)
+			cluster.Spec.TLS.IssuerRef = &IssuerReference{Name: "issuer"}
+			cluster.Spec.TLS.ExistingSecretName = "mongo-tls"
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("issuerRef and existingSecret cannot both be set")))
+		})
+
+		It("refuses the legacy image, whose scripts do not configure TLS", func() {
+			cluster := withTLS(newCluster(3), TLSModeRequire)
+			Expect(cluster.ValidateCreate()).To(Succeed())
+			cluster.Spec.Image = LEGACY_IMAGE
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("does not configure TLS")))
+			Expect(newCluster(3).ValidateCreate()).To(Succeed())
+		})
+
+		It("refuses x509 membership authentication on the legacy image", func() {
+			cluster := withTLS(newCluster(3), TLSModeRequire)
+			cluster.Spec.Auth.Mechanisms = []AuthMechanism{AuthMechanismSCRAM, AuthMechanismX509}
+			Expect(cluster.ValidateCreate()).To(Succeed())
+			cluster.Spec.Image = LEGACY_IMAGE
+			Expect(cluster.validateAuthMechanisms(nil)).To(MatchError(ContainSubstring("does not configure x509 membership authentication")))
+		})
+	})
+
+	Describe("external access", func() {
+		newExposedCluster := func(serviceType ServiceType, hostnames ...string) *MongoCluster {
+			cluster := newCluster(3)
+			cluster.Spec.TLS = &TLS{Mode: TLSModeRequire}
+			cluster.Spec.ExternalAccess = &ExternalAccess{Type: serviceType, Hostnames: hostnames}
+			cluster.Default()
+			return cluster
+		}
+
+		It("accepts a hostname for each member", func() {
+			Expect(newExposedCluster(ServiceTypeLoadBalancer, "a.example.com", "b.example.com", "c.example.com").ValidateCreate()).To(Succeed())
+			Expect(newExposedCluster(ServiceTypeNodePort, "a.example.com", "b.example.com", "c.example.com").ValidateCreate()).To(Succeed())
+		})
+
+		It("requires the hostnames with every service type", func() {
+			Expect(newExposedCluster(ServiceTypeLoadBalancer).ValidateCreate()).To(MatchError(ContainSubstring("spec.externalAccess.hostnames: Required value")))
+			Expect(newExposedCluster(ServiceTypeNodePort).ValidateCreate()).To(MatchError(ContainSubstring("spec.externalAccess.hostnames: Required value")))
+			Expect(newExposedCluster(ServiceTypeLoadBalancer, "a.example.com").ValidateCreate()).To(MatchError(ContainSubstring("must have one hostname for each of the 3 members")))
+		})
+
+		It("rejects IP addresses, which TLS clients send no SNI for", func() {
+			cluster := newExposedCluster(ServiceTypeLoadBalancer, "a.example.com", "b.example.com", "10.0.0.1")
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("must be a hostname")))
+		})
+
+		It("requires TLS and a replica set", func() {
+			cluster := newExposedCluster(ServiceTypeLoadBalancer, "a.example.com", "b.example.com", "c.example.com")
+			cluster.Spec.TLS = nil
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("requires spec.tls")))
+
+			cluster = newExposedCluster(ServiceTypeLoadBalancer, "a.example.com", "b.example.com", "c.example.com")
+			cluster.Spec.Sharding = &Sharding{}
+			cluster.Default()
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("sharded clusters are not supported")))
+		})
+
+		It("only restricts the source ranges of load balancers", func() {
+			cluster := newExposedCluster(ServiceTypeNodePort, "a.example.com", "b.example.com", "c.example.com")
+			cluster.Spec.ExternalAccess.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+			Expect(cluster.ValidateCreate()).To(MatchError(ContainSubstring("only applies to the LoadBalancer type")))
+		})
+	})
+})
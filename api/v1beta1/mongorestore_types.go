@@ -0,0 +1,125 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestoreSource is the archive to restore, either a completed MongoBackup or an explicit location
+type RestoreSource struct {
+	// BackupName is a completed MongoBackup, in the namespace of the restore
+	BackupName string `json:"backupName,omitempty"`
+	// Storage holds the archive when BackupName is not set, the prefix of an S3 storage is ignored
+	Storage *BackupStorage `json:"storage,omitempty"`
+	// Key is the path of the archive in the bucket or in the claim when BackupName is not set
+	Key string `json:"key,omitempty"`
+	// OplogStorage holds the oplog archive replayed up to the target time, defaults to the oplog archive
+	// storage of the cluster
+	OplogStorage *BackupStorage `json:"oplogStorage,omitempty"`
+}
+
+// MongoRestoreSpec defines the desired state of MongoRestore
+type MongoRestoreSpec struct {
+	// ClusterName is the MongoCluster to restore, in the namespace of the restore
+	ClusterName string `json:"clusterName"`
+	// Source is the archive to restore
+	Source RestoreSource `json:"source"`
+	// Drop drops the collections of the cluster before restoring them
+	Drop bool `json:"drop,omitempty"`
+	// NsInclude restricts the restore to the matching namespaces, e.g. "mydb.*". The oplog of the archive
+	// is not replayed when a filter is set
+	NsInclude []string `json:"nsInclude,omitempty"`
+	// NsExclude skips the matching namespaces
+	NsExclude []string `json:"nsExclude,omitempty"`
+	// TargetTime rolls the cluster forward from the archive to the given time by replaying the archived
+	// oplog. Namespaces cannot be filtered then
+	TargetTime *metav1.Time `json:"targetTime,omitempty"`
+}
+
+// ConditionOplogChainComplete is false when the archived oplog does not cover the time between the
+// archive and the target time of the restore
+const ConditionOplogChainComplete = "OplogChainComplete"
+
+// MongoRestorePhase is the progress of a restore
+type MongoRestorePhase string
+
+const (
+	// MongoRestorePending means the restore waits for the cluster or the backup
+	MongoRestorePending MongoRestorePhase = "Pending"
+	// MongoRestoreRunning means the restore Job is running, the cluster is not reconciled meanwhile
+	MongoRestoreRunning MongoRestorePhase = "Running"
+	// MongoRestoreCompleted means the archive has been restored
+	MongoRestoreCompleted MongoRestorePhase = "Completed"
+	// MongoRestoreFailed means the restore will not be retried
+	MongoRestoreFailed MongoRestorePhase = "Failed"
+)
+
+// MongoRestoreStatus defines the observed state of MongoRestore
+type MongoRestoreStatus struct {
+	// Phase of the restore
+	Phase MongoRestorePhase `json:"phase,omitempty"`
+	// Message explains the phase and the current step of a running restore
+	Message string `json:"message,omitempty"`
+	// JobName is the Job running the restore
+	JobName string `json:"jobName,omitempty"`
+	// Location of the restored archive, as s3://bucket/key or pvc://claim/path
+	Location string `json:"location,omitempty"`
+	// StartTime is when the restore Job was created
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the restore completed or failed
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Duration of the restore
+	Duration string `json:"duration,omitempty"`
+	// RestoredDocuments is the number of documents mongorestore inserted
+	RestoredDocuments int64 `json:"restoredDocuments,omitempty"`
+	// FailedDocuments is the number of documents mongorestore could not insert
+	FailedDocuments int64 `json:"failedDocuments,omitempty"`
+	// Conditions are the latest observations of the restore
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Restored",type=integer,JSONPath=`.status.restoredDocuments`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MongoRestore is the Schema for the mongorestores API
+type MongoRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MongoRestoreSpec   `json:"spec,omitempty"`
+	Status MongoRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MongoRestoreList contains a list of MongoRestore
+type MongoRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MongoRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MongoRestore{}, &MongoRestoreList{})
+}
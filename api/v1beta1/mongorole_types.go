@@ -0,0 +1,99 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PrivilegeResource is the resource a privilege applies to, either a database and collection or the
+// cluster
+type PrivilegeResource struct {
+	// Database the privilege applies to, empty for every database
+	Database string `json:"database,omitempty"`
+	// Collection the privilege applies to, empty for every collection of the database
+	Collection string `json:"collection,omitempty"`
+	// Cluster applies the privilege to cluster wide actions, database and collection are then ignored
+	Cluster bool `json:"cluster,omitempty"`
+}
+
+// Privilege allows actions on a resource
+type Privilege struct {
+	// Resource the actions are allowed on
+	Resource PrivilegeResource `json:"resource"`
+	// Actions allowed on the resource, e.g. find or insert
+	// +kubebuilder:validation:MinItems=1
+	Actions []string `json:"actions"`
+}
+
+// MongoRoleSpec defines the desired state of MongoRole
+type MongoRoleSpec struct {
+	// ClusterName is the MongoCluster the role is created on, in the namespace of the role
+	ClusterName string `json:"clusterName"`
+	// RoleName defaults to the name of the MongoRole
+	RoleName string `json:"roleName,omitempty"`
+	// Database the role is defined in
+	// +kubebuilder:default=admin
+	Database string `json:"database,omitempty"`
+	// Privileges granted by the role
+	Privileges []Privilege `json:"privileges,omitempty"`
+	// Roles the role inherits the privileges of
+	Roles []RoleReference `json:"roles,omitempty"`
+}
+
+// MongoRoleStatus defines the observed state of MongoRole
+type MongoRoleStatus struct {
+	// ObservedGeneration is the generation of the spec last applied to the cluster
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RoleName of the role last created on the cluster, the role is dropped when it is renamed
+	RoleName string `json:"roleName,omitempty"`
+	// Database of the role last created on the cluster
+	Database string `json:"database,omitempty"`
+	// Conditions are the latest observations of the role
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Database",type=string,JSONPath=`.spec.database`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MongoRole is the Schema for the mongoroles API
+type MongoRole struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MongoRoleSpec   `json:"spec,omitempty"`
+	Status MongoRoleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MongoRoleList contains a list of MongoRole
+type MongoRoleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MongoRole `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MongoRole{}, &MongoRoleList{})
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RoleReference grants a role, built-in or defined with a MongoRole
+type RoleReference struct {
+	// Name of the role, e.g. readWrite
+	Name string `json:"name"`
+	// Database the role is defined in
+	Database string `json:"database"`
+}
+
+// SecretKeyReference is a key of a secret in the namespace of the resource
+type SecretKeyReference struct {
+	// Name of the secret
+	Name string `json:"name"`
+	// Key of the secret holding the value
+	// +kubebuilder:default=password
+	Key string `json:"key,omitempty"`
+}
+
+// MongoUserSpec defines the desired state of MongoUser
+type MongoUserSpec struct {
+	// ClusterName is the MongoCluster the user is created on, in the namespace of the user
+	ClusterName string `json:"clusterName"`
+	// Username defaults to the name of the MongoUser
+	Username string `json:"username,omitempty"`
+	// Database the user is defined in, which is its authentication database. MONGODB-X509 users are
+	// defined in $external
+	// +kubebuilder:default=admin
+	Database string `json:"database,omitempty"`
+	// Roles granted to the user
+	Roles []RoleReference `json:"roles,omitempty"`
+	// Mechanism the user authenticates with. A MONGODB-X509 user is created in the $external database,
+	// named after the subject of a client certificate issued for it and stored in its certificate
+	// secret, the cluster must accept the mechanism
+	// +kubebuilder:default=SCRAM-SHA-256
+	Mechanism AuthMechanism `json:"mechanism,omitempty"`
+	// PasswordSecretRef is the key of a secret holding the password of the user, required with
+	// SCRAM-SHA-256
+	PasswordSecretRef SecretKeyReference `json:"passwordSecretRef,omitempty"`
+	// ConnectionSecretName is the secret the connection details of the user are written to, defaults to
+	// <cluster>-<user>-connection
+	ConnectionSecretName string `json:"connectionSecretName,omitempty"`
+}
+
+// ConditionSynced is true once the cluster matches the spec of the resource
+const ConditionSynced = "Synced"
+
+// MongoUserStatus defines the observed state of MongoUser
+type MongoUserStatus struct {
+	// ObservedGeneration is the generation of the spec last applied to the cluster
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Username of the user last created on the cluster, the user is dropped when it is renamed
+	Username string `json:"username,omitempty"`
+	// Database of the user last created on the cluster
+	Database string `json:"database,omitempty"`
+	// PasswordSecretVersion is the resource version of the password secret last applied to the cluster
+	PasswordSecretVersion string `json:"passwordSecretVersion,omitempty"`
+	// ConnectionSecretName is the secret holding the connection details of the user
+	ConnectionSecretName string `json:"connectionSecretName,omitempty"`
+	// CertificateSecretName is the secret holding the client certificate of a MONGODB-X509 user
+	CertificateSecretName string `json:"certificateSecretName,omitempty"`
+	// Conditions are the latest observations of the user
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Database",type=string,JSONPath=`.spec.database`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// MongoUser is the Schema for the mongousers API
+type MongoUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MongoUserSpec   `json:"spec,omitempty"`
+	Status MongoUserStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MongoUserList contains a list of MongoUser
+type MongoUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MongoUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MongoUser{}, &MongoUserList{})
+}
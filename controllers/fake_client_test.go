@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+)
+
+const testNamespace = "default"
+
+// testScheme registers the same types as the manager of the operator, the fake API servers of the
+// tests are built on it.
+var testScheme = newTestScheme()
+
+func newTestScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(snapshotv1.AddToScheme(scheme))
+	utilruntime.Must(appsv1beta1.AddToScheme(scheme))
+	return scheme
+}
+
+// newFakeClient returns a fake API server holding the given objects.
+func newFakeClient(objects ...client.Object) client.Client {
+	return fake.NewClientBuilder().WithScheme(testScheme).WithObjects(objects...).Build()
+}
+
+// testReconciler is implemented by every reconciler of the operator, it builds the service of a
+// resource of type O.
+type testReconciler[O client.Object, S any] interface {
+	NewService(ctx context.Context, object O, namespace string) S
+}
+
+// newReconcilerService builds the service of the object the way its reconciler does. newReconciler
+// returns the reconciler on a fake API server holding the object and the given objects.
+func newReconcilerService[O client.Object, S any](object O, objects []client.Object, newReconciler func(client.Client, *runtime.Scheme) testReconciler[O, S]) *S {
+	reconciler := newReconciler(newFakeClient(append(objects, object)...), testScheme)
+	service := reconciler.NewService(context.Background(), object, testNamespace)
+	return &service
+}
+
+func newTestCluster(replicas int32) *appsv1beta1.MongoCluster {
+	return &appsv1beta1.MongoCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "mongo", Namespace: testNamespace, Generation: 1},
+		Spec:       appsv1beta1.MongoClusterSpec{Replicas: replicas},
+	}
+}
+
+// newTestService builds the service of the cluster against a fake API server holding the cluster and
+// the given objects. Every admin client it opens is the fake mongo client.
+func newTestService(cluster *appsv1beta1.MongoCluster, mongo *mongofake.Client, objects ...client.Object) *MongoClusterService {
+	return newReconcilerService(cluster, objects, func(c client.Client, scheme *runtime.Scheme) testReconciler[*appsv1beta1.MongoCluster, MongoClusterService] {
+		return &MongoClusterReconciler{Client: c, Scheme: scheme, MongoAdmin: mongo.Factory()}
+	})
+}
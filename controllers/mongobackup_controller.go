@@ -0,0 +1,95 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	backupFinalizerName = "mongobackup.finalizers.esgi.fr"
+)
+
+// MongoBackupReconciler reconciles a MongoBackup object
+type MongoBackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// MongoAdmin opens the connections used to lock the member of a Snapshot backup
+	MongoAdmin mongoadmin.Factory
+}
+
+var backupLogger = logf.Log.WithName("controller_mongobackup")
+
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongobackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongobackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongobackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;delete
+
+// Reconcile runs the backup Job of a MongoBackup and records its outcome. A backup runs once, it is
+// not retried after it completed or failed. A Snapshot backup deleted while it holds a member locked
+// unlocks it first.
+func (r *MongoBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mongoBackup appsv1beta1.MongoBackup
+	if err := r.Get(ctx, req.NamespacedName, &mongoBackup); err != nil {
+		backupLogger.Error(err, "unable to fetch MongoBackup")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	backupService := r.NewService(ctx, &mongoBackup, req.Namespace)
+
+	if !mongoBackup.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&mongoBackup, backupFinalizerName) {
+			if err := backupService.Delete(); err != nil {
+				return ctrl.Result{}, err
+			}
+			controllerutil.RemoveFinalizer(&mongoBackup, backupFinalizerName)
+			if err := r.Update(ctx, &mongoBackup); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if mongoBackup.Status.Phase == appsv1beta1.MongoBackupCompleted || mongoBackup.Status.Phase == appsv1beta1.MongoBackupFailed {
+		return ctrl.Result{}, nil
+	}
+	if mongoBackup.Spec.Method == appsv1beta1.BackupMethodSnapshot && !controllerutil.ContainsFinalizer(&mongoBackup, backupFinalizerName) {
+		controllerutil.AddFinalizer(&mongoBackup, backupFinalizerName)
+		if err := r.Update(ctx, &mongoBackup); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	result, err := backupService.Run()
+	if statusErr := backupService.UpdateStatus(); statusErr != nil && err == nil {
+		return ctrl.Result{}, statusErr
+	}
+	return result, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MongoBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appsv1beta1.MongoBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strconv"
+)
+
+const (
+	MONGO_BACKUP_JOB_FORMAT       = "%s-backup"
+	MONGO_BACKUP_DUMP_CONTAINER   = "mongodump"
+	MONGO_BACKUP_UPLOAD_CONTAINER = "upload"
+	MONGO_BACKUP_PRUNE_CONTAINER  = "prune"
+	MONGO_BACKUP_UPLOAD_IMAGE     = "minio/mc"
+	MONGO_BACKUP_VOLUME_NAME      = "backup"
+	MONGO_BACKUP_MOUNT_PATH       = "/backup"
+	MONGO_BACKUP_EXTENSION        = ".tar.gz"
+)
+
+var MONGO_BACKUP_BACKOFF_LIMIT int32 = 1
+
+// MONGO_CLIENT_AUTH_SCRIPT sets the AUTH options of the mongo tools and the SHELL_OPTIONS and
+// SHELL_LOGIN of the mongo shell from the connection variables, verifying the certificates of the
+// members against MONGODB_TLS_CA when the cluster uses TLS. The password stays off the command lines:
+// the tools read it from a configuration file and the shell from a file, both in a private directory.
+const MONGO_CLIENT_AUTH_SCRIPT = `AUTH_DIR=$(mktemp -d)
+printf '%s' "$MONGODB_USERNAME" > "$AUTH_DIR/username"
+printf '%s' "$MONGODB_PASSWORD" > "$AUTH_DIR/password"
+printf 'password: "%s"\n' "$(sed 's/[\\"]/\\&/g' "$AUTH_DIR/password")" > "$AUTH_DIR/tools.yaml"
+AUTH=(--username "$MONGODB_USERNAME" --authenticationDatabase admin --config "$AUTH_DIR/tools.yaml")
+SHELL_OPTIONS=()
+SHELL_LOGIN="db.getSiblingDB('admin').auth(cat('$AUTH_DIR/username'), cat('$AUTH_DIR/password'));"
+if [ -n "$MONGODB_TLS_CA" ]; then
+  printf '%s\n' "$MONGODB_TLS_CA" > "$AUTH_DIR/ca.crt"
+  AUTH+=(--tls --tlsCAFile "$AUTH_DIR/ca.crt")
+  SHELL_OPTIONS+=(--tls --tlsCAFile "$AUTH_DIR/ca.crt")
+fi
+`
+
+// MONGO_BACKUP_DUMP_SCRIPT dumps the cluster from a secondary with the oplog entries written during
+// the dump, so that the archive is consistent with the last of them, and leaves the size of the
+// archive and that oplog timestamp in the termination message of the container.
+const MONGO_BACKUP_DUMP_SCRIPT = "set -e\n" + MONGO_CLIENT_AUTH_SCRIPT + `START_TS=$(mongo --quiet --host "$MONGODB_HOSTS" "${SHELL_OPTIONS[@]}" --eval "$SHELL_LOGIN"'db.getMongo().setReadPref("secondaryPreferred"); var ts = db.getSiblingDB("local").oplog.rs.find().sort({$natural: -1}).limit(1).next().ts; print(ts.t + " " + ts.i)')
+DUMP_DIR="$BACKUP_FILE.dump"
+rm -rf "$DUMP_DIR"
+mkdir -p "$DUMP_DIR"
+mongodump --host "$MONGODB_HOSTS" "${AUTH[@]}" --readPreference secondaryPreferred --oplog --out "$DUMP_DIR"
+LAST_TS=$(bsondump --quiet "$DUMP_DIR/oplog.bson" | tail -n 1 | sed -n 's/.*"ts":{"$timestamp":{"t":\([0-9]*\),"i":\([0-9]*\)}}.*/\1 \2/p')
+TS=${LAST_TS:-$START_TS}
+tar czf "$BACKUP_FILE" -C "$DUMP_DIR" .
+rm -rf "$DUMP_DIR"
+SIZE=$(stat -c %s "$BACKUP_FILE")
+printf '{"sizeBytes":%s,"oplogTimestamp":{"t":%s,"i":%s}}' "$SIZE" "${TS% *}" "${TS#* }" > /dev/termination-log
+`
+
+// MONGO_BACKUP_UPLOAD_SCRIPT copies the archive to the bucket with the MinIO client, which talks to
+// any S3 compatible endpoint.
+const MONGO_BACKUP_UPLOAD_SCRIPT = `set -e
+mc alias set store "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+mc cp "$BACKUP_FILE" "store/$S3_BUCKET/$S3_KEY"
+`
+
+// MONGO_BACKUP_S3_PRUNE_SCRIPT runs after the upload and deletes the archives of the same directory
+// that are older than RETENTION_DAYS or beyond the RETENTION_COUNT most recent ones. Archive names
+// sort in the order they were taken.
+const MONGO_BACKUP_S3_PRUNE_SCRIPT = `S3_DIR="store/$S3_BUCKET/$(dirname "$S3_KEY")"
+if [ -n "$RETENTION_DAYS" ]; then
+  mc rm --recursive --force --older-than "${RETENTION_DAYS}d" "$S3_DIR/"
+fi
+if [ -n "$RETENTION_COUNT" ]; then
+  mc ls "$S3_DIR/" | while read -r line; do echo "${line##* }"; done | grep '\.tar\.gz$' | sort -r | tail -n +$((RETENTION_COUNT + 1)) | while read -r name; do
+    mc rm "$S3_DIR/$name"
+  done
+fi
+`
+
+// MONGO_BACKUP_PVC_PRUNE_SCRIPT applies the same retention to the archives stored in a claim.
+const MONGO_BACKUP_PVC_PRUNE_SCRIPT = `set -e
+BACKUP_DIR=$(dirname "$BACKUP_FILE")
+if [ -n "$RETENTION_DAYS" ]; then
+  find "$BACKUP_DIR" -maxdepth 1 -name '*.tar.gz' -mtime +"$RETENTION_DAYS" -delete
+fi
+if [ -n "$RETENTION_COUNT" ]; then
+  ls -1 "$BACKUP_DIR" | grep '\.tar\.gz$' | sort -r | tail -n +$((RETENTION_COUNT + 1)) | while read -r name; do
+    rm -f "$BACKUP_DIR/$name"
+  done
+fi
+`
+
+func getBackupJobName(backupName string) string {
+	return fmt.Sprintf(MONGO_BACKUP_JOB_FORMAT, backupName)
+}
+
+// createBackupJob runs the backup described by the MongoBackup once.
+func (b *MongoBackupService) createBackupJob(mongoCluster *appsv1beta1.MongoCluster) (*batchv1.Job, error) {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getBackupJobName(b.Backup.Name),
+			Namespace: b.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &MONGO_BACKUP_BACKOFF_LIMIT,
+			Template: v1api.PodTemplateSpec{
+				Spec: newBackupPodSpec(mongoCluster, b.Backup.Spec.Storage, b.getBackupKey(), nil),
+			},
+		},
+	}
+	if err := ctrl.SetControllerReference(b.Backup, job, b.Reconciler.Scheme); err != nil {
+		b.Logger.Error(err, "Error setting backup Job owner reference")
+		return nil, err
+	}
+	return job, nil
+}
+
+// newBackupPodSpec writes the archive to key, in the claim or in a scratch volume an upload container
+// sends to the bucket once the dump, run as an init container, succeeded. The key may reference the
+// JOB_NAME variable. When a retention is given, the archives older than it found next to key are
+// deleted after the new one is stored.
+func newBackupPodSpec(mongoCluster *appsv1beta1.MongoCluster, storage appsv1beta1.BackupStorage, key string, retention *appsv1beta1.BackupRetention) v1api.PodSpec {
+	backupFile := path.Join(MONGO_BACKUP_MOUNT_PATH, key)
+	image := mongoCluster.Spec.Image
+	if image == "" {
+		image = MONGO_CONTAINER_IMAGE
+	}
+	volumeMounts := []v1api.VolumeMount{
+		{
+			Name:      MONGO_BACKUP_VOLUME_NAME,
+			MountPath: MONGO_BACKUP_MOUNT_PATH,
+		},
+	}
+	// JOB_NAME comes first so that the other variables can reference it.
+	commonEnv := []v1api.EnvVar{
+		{
+			Name: "JOB_NAME",
+			ValueFrom: &v1api.EnvVarSource{
+				FieldRef: &v1api.ObjectFieldSelector{FieldPath: "metadata.labels['job-name']"},
+			},
+		},
+		{
+			Name:  "BACKUP_FILE",
+			Value: backupFile,
+		},
+	}
+	if retention != nil {
+		commonEnv = append(commonEnv, getRetentionEnv(*retention)...)
+	}
+	dumpContainer := v1api.Container{
+		Name:         MONGO_BACKUP_DUMP_CONTAINER,
+		Image:        image,
+		Command:      []string{"/bin/bash", "-c"},
+		Args:         []string{MONGO_BACKUP_DUMP_SCRIPT},
+		Env:          append(append([]v1api.EnvVar{}, commonEnv...), getConnectionEnv(mongoCluster)...),
+		VolumeMounts: volumeMounts,
+	}
+	podSpec := v1api.PodSpec{
+		RestartPolicy: v1api.RestartPolicyNever,
+	}
+	if s3 := storage.S3; s3 != nil {
+		uploadScript := MONGO_BACKUP_UPLOAD_SCRIPT
+		if retention != nil {
+			uploadScript += MONGO_BACKUP_S3_PRUNE_SCRIPT
+		}
+		podSpec.InitContainers = []v1api.Container{dumpContainer}
+		podSpec.Containers = []v1api.Container{
+			{
+				Name:    MONGO_BACKUP_UPLOAD_CONTAINER,
+				Image:   MONGO_BACKUP_UPLOAD_IMAGE,
+				Command: []string{"/bin/sh", "-c"},
+				Args:    []string{uploadScript},
+				Env: append(append([]v1api.EnvVar{}, commonEnv...),
+					v1api.EnvVar{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+					v1api.EnvVar{Name: "S3_BUCKET", Value: s3.Bucket},
+					v1api.EnvVar{Name: "S3_KEY", Value: key},
+				),
+				EnvFrom: []v1api.EnvFromSource{
+					{
+						SecretRef: &v1api.SecretEnvSource{
+							LocalObjectReference: v1api.LocalObjectReference{Name: s3.CredentialsSecret},
+						},
+					},
+				},
+				VolumeMounts: volumeMounts,
+			},
+		}
+		podSpec.Volumes = []v1api.Volume{
+			{
+				Name:         MONGO_BACKUP_VOLUME_NAME,
+				VolumeSource: v1api.VolumeSource{EmptyDir: &v1api.EmptyDirVolumeSource{}},
+			},
+		}
+		return podSpec
+	}
+	if retention != nil {
+		podSpec.InitContainers = []v1api.Container{dumpContainer}
+		podSpec.Containers = []v1api.Container{
+			{
+				Name:         MONGO_BACKUP_PRUNE_CONTAINER,
+				Image:        image,
+				Command:      []string{"/bin/bash", "-c"},
+				Args:         []string{MONGO_BACKUP_PVC_PRUNE_SCRIPT},
+				Env:          commonEnv,
+				VolumeMounts: volumeMounts,
+			},
+		}
+	} else {
+		podSpec.Containers = []v1api.Container{dumpContainer}
+	}
+	podSpec.Volumes = []v1api.Volume{
+		{
+			Name: MONGO_BACKUP_VOLUME_NAME,
+			VolumeSource: v1api.VolumeSource{
+				PersistentVolumeClaim: &v1api.PersistentVolumeClaimVolumeSource{
+					ClaimName: storage.PersistentVolumeClaim.ClaimName,
+				},
+			},
+		},
+	}
+	return podSpec
+}
+
+// getConnectionEnv gives the replica set seed list and the admin credentials of the cluster to the
+// MONGODB_HOSTS, MONGODB_USERNAME and MONGODB_PASSWORD variables, and its CA to MONGODB_TLS_CA when
+// clients connect with TLS.
+func getConnectionEnv(mongoCluster *appsv1beta1.MongoCluster) []v1api.EnvVar {
+	var hosts []string
+	for i := 0; int32(i) < mongoCluster.Spec.Replicas; i++ {
+		hosts = append(hosts, getMemberHost(mongoCluster.Name, mongoCluster.Namespace, i))
+	}
+	env := []v1api.EnvVar{
+		{
+			Name:  "MONGODB_HOSTS",
+			Value: mongoadmin.ReplicaSetSeedList(mongoCluster.Name, hosts),
+		},
+		{
+			Name:  "MONGODB_USERNAME",
+			Value: MONGODB_DEFAULT_USER,
+		},
+		{
+			Name: "MONGODB_PASSWORD",
+			ValueFrom: &v1api.EnvVarSource{
+				SecretKeyRef: &v1api.SecretKeySelector{
+					LocalObjectReference: v1api.LocalObjectReference{
+						Name: getPasswordSecretName(mongoCluster),
+					},
+					Key: "password",
+				},
+			},
+		},
+	}
+	if useClientTLS(mongoCluster) {
+		env = append(env, v1api.EnvVar{
+			Name: "MONGODB_TLS_CA",
+			ValueFrom: &v1api.EnvVarSource{
+				SecretKeyRef: &v1api.SecretKeySelector{
+					LocalObjectReference: v1api.LocalObjectReference{
+						Name: getTLSCASecretName(mongoCluster),
+					},
+					Key: MONGO_TLS_CA_KEY,
+				},
+			},
+		})
+	}
+	return env
+}
+
+func getRetentionEnv(retention appsv1beta1.BackupRetention) []v1api.EnvVar {
+	var env []v1api.EnvVar
+	if retention.Count > 0 {
+		env = append(env, v1api.EnvVar{Name: "RETENTION_COUNT", Value: strconv.Itoa(int(retention.Count))})
+	}
+	if retention.Days > 0 {
+		env = append(env, v1api.EnvVar{Name: "RETENTION_DAYS", Value: strconv.Itoa(int(retention.Days))})
+	}
+	return env
+}
@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var _ = Describe("MONGO_CLIENT_AUTH_SCRIPT", func() {
+	password := `p"a\ss'word`
+
+	It("keeps the password off the command lines", func() {
+		output := runScript(MONGO_CLIENT_AUTH_SCRIPT+`printf '%s\n' "${AUTH[@]}" "${SHELL_OPTIONS[@]}" "$SHELL_LOGIN"`,
+			"MONGODB_USERNAME=admin", "MONGODB_PASSWORD="+password)
+		Expect(output).NotTo(ContainSubstring("p\"a"))
+		Expect(output).To(ContainSubstring("--config"))
+		Expect(output).NotTo(ContainSubstring("--tls"))
+	})
+
+	It("gives the password to the tools in their configuration file", func() {
+		output := runScript(MONGO_CLIENT_AUTH_SCRIPT+`cat "${AUTH[-1]}"`, "MONGODB_USERNAME=admin", "MONGODB_PASSWORD="+password)
+		config := map[string]string{}
+		Expect(yaml.Unmarshal([]byte(output), &config)).To(Succeed())
+		Expect(config).To(Equal(map[string]string{"password": password}))
+	})
+
+	It("gives the credentials to the shell in private files", func() {
+		output := runScript(MONGO_CLIENT_AUTH_SCRIPT+`stat -c %a "$AUTH_DIR"; cat "$AUTH_DIR/password"`,
+			"MONGODB_USERNAME=admin", "MONGODB_PASSWORD="+password)
+		Expect(output).To(Equal("700\n" + password))
+	})
+
+	It("verifies the members against the CA of the cluster", func() {
+		output := runScript(MONGO_CLIENT_AUTH_SCRIPT+`printf '%s\n' "${AUTH[@]}" "${SHELL_OPTIONS[@]}"; cat "$AUTH_DIR/ca.crt"`,
+			"MONGODB_USERNAME=admin", "MONGODB_PASSWORD="+password, "MONGODB_TLS_CA=ca-bundle")
+		Expect(strings.Count(output, "--tlsCAFile")).To(Equal(2))
+		Expect(output).To(HaveSuffix("ca-bundle\n"))
+	})
+})
+
+var _ = Describe("MongoBackup Job", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var backup *appsv1beta1.MongoBackup
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		backup = &appsv1beta1.MongoBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: testNamespace},
+			Spec: appsv1beta1.MongoBackupSpec{
+				ClusterName: cluster.Name,
+				Storage: appsv1beta1.BackupStorage{
+					S3: &appsv1beta1.S3Storage{Endpoint: "http://minio:9000", Bucket: "backups", Prefix: "mongo", CredentialsSecret: "s3"},
+				},
+			},
+		}
+	})
+
+	It("dumps in an init container and uploads the archive to the bucket", func() {
+		service := newTestBackupService(backup, mongofake.NewClient(), cluster)
+		job, err := service.createBackupJob(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.Name).To(Equal("nightly-backup"))
+		Expect(job.OwnerReferences).To(HaveLen(1))
+		spec := job.Spec.Template.Spec
+		Expect(spec.RestartPolicy).To(Equal(v1api.RestartPolicyNever))
+		Expect(spec.InitContainers).To(HaveLen(1))
+		Expect(spec.InitContainers[0].Name).To(Equal(MONGO_BACKUP_DUMP_CONTAINER))
+		Expect(spec.InitContainers[0].Image).To(Equal(MONGO_CONTAINER_IMAGE))
+		Expect(spec.Containers).To(HaveLen(1))
+		Expect(spec.Containers[0].Name).To(Equal(MONGO_BACKUP_UPLOAD_CONTAINER))
+		Expect(spec.Containers[0].Env).To(ContainElements(
+			v1api.EnvVar{Name: "S3_BUCKET", Value: "backups"},
+			v1api.EnvVar{Name: "S3_KEY", Value: "mongo/default/mongo/nightly.tar.gz"},
+		))
+		Expect(spec.Containers[0].EnvFrom[0].SecretRef.Name).To(Equal("s3"))
+		Expect(spec.Volumes[0].EmptyDir).NotTo(BeNil())
+	})
+
+	It("writes the archive to the claim", func() {
+		backup.Spec.Storage = appsv1beta1.BackupStorage{PersistentVolumeClaim: &appsv1beta1.PersistentVolumeClaimStorage{ClaimName: "backups"}}
+		service := newTestBackupService(backup, mongofake.NewClient(), cluster)
+		job, err := service.createBackupJob(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		spec := job.Spec.Template.Spec
+		Expect(spec.InitContainers).To(BeEmpty())
+		Expect(spec.Containers).To(HaveLen(1))
+		Expect(spec.Containers[0].Env).To(ContainElement(v1api.EnvVar{Name: "BACKUP_FILE", Value: "/backup/default/mongo/nightly.tar.gz"}))
+		Expect(spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("backups"))
+	})
+
+	It("reads the admin password from the secret of the cluster", func() {
+		env := getConnectionEnv(cluster)
+		Expect(env[0]).To(Equal(v1api.EnvVar{Name: "MONGODB_HOSTS", Value: "mongo/" + strings.Join([]string{
+			getMemberHost(cluster.Name, testNamespace, 0),
+			getMemberHost(cluster.Name, testNamespace, 1),
+			getMemberHost(cluster.Name, testNamespace, 2),
+		}, ",")}))
+		Expect(env[2].Name).To(Equal("MONGODB_PASSWORD"))
+		Expect(env[2].Value).To(BeEmpty())
+		Expect(env[2].ValueFrom.SecretKeyRef.Name).To(Equal(getPasswordSecretName(cluster)))
+	})
+
+	It("records the result the dump left in its termination message", func() {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly-backup", Namespace: testNamespace},
+			Status:     batchv1.JobStatus{Succeeded: 1},
+		}
+		pod := newJobPod(job.Name, v1api.PodSucceeded, MONGO_BACKUP_DUMP_CONTAINER, `{"sizeBytes":1024,"oplogTimestamp":{"t":1700000000,"i":3}}`)
+		service := newTestBackupService(backup, mongofake.NewClient(), cluster, job, pod)
+		start := metav1.Now()
+		service.Status.StartTime = &start
+		Expect(service.checkBackupJob(job)).To(Succeed())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupCompleted))
+		Expect(service.Status.SizeBytes).To(BeEquivalentTo(1024))
+		Expect(*service.Status.OplogTimestamp).To(Equal(appsv1beta1.OplogTimestamp{T: 1700000000, I: 3}))
+		Expect(service.Status.Duration).NotTo(BeEmpty())
+	})
+
+	It("fails with the condition of a failed Job", func() {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly-backup", Namespace: testNamespace},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobFailed, Status: v1api.ConditionTrue, Message: "BackoffLimitExceeded"},
+			}},
+		}
+		service := newTestBackupService(backup, mongofake.NewClient(), cluster, job)
+		Expect(service.checkBackupJob(job)).To(Succeed())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupFailed))
+		Expect(service.Status.Message).To(ContainSubstring("BackoffLimitExceeded"))
+	})
+
+	It("creates the Job once and follows it", func() {
+		service := newTestBackupService(backup, mongofake.NewClient(), cluster)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupRunning))
+		Expect(service.Status.Location).To(Equal("s3://backups/mongo/default/mongo/nightly.tar.gz"))
+		_, err = service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupRunning))
+	})
+})
+
+// newTestBackupService builds the service of the backup against a fake API server holding the backup
+// and the given objects.
+func newTestBackupService(backup *appsv1beta1.MongoBackup, mongo *mongofake.Client, objects ...client.Object) *MongoBackupService {
+	return newReconcilerService(backup, objects, func(c client.Client, scheme *runtime.Scheme) testReconciler[*appsv1beta1.MongoBackup, MongoBackupService] {
+		return &MongoBackupReconciler{Client: c, Scheme: scheme, MongoAdmin: mongo.Factory()}
+	})
+}
+
+// newJobPod returns a pod of the Job in the given phase whose container left the termination message.
+func newJobPod(jobName string, phase v1api.PodPhase, container string, message string) *v1api.Pod {
+	return &v1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName + "-pod",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"job-name": jobName},
+		},
+		Status: v1api.PodStatus{
+			Phase: phase,
+			ContainerStatuses: []v1api.ContainerStatus{{
+				Name:  container,
+				State: v1api.ContainerState{Terminated: &v1api.ContainerStateTerminated{Message: message}},
+			}},
+		},
+	}
+}
+
+// runScript runs a bash script of the Jobs with the given variables and returns its output.
+func runScript(script string, env ...string) string {
+	command := exec.Command("bash", "-c", script)
+	command.Env = append([]string{"PATH=" + os.Getenv("PATH"), "TMPDIR=" + GinkgoT().TempDir()}, env...)
+	output, err := command.CombinedOutput()
+	Expect(err).NotTo(HaveOccurred(), string(output))
+	return string(output)
+}
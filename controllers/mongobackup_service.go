@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"path"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+type MongoBackupService struct {
+	Backup     *appsv1beta1.MongoBackup
+	Namespace  string
+	Reconciler *MongoBackupReconciler
+	Context    *context.Context
+	Logger     logr.Logger
+	// Status is the status written back by UpdateStatus
+	Status *appsv1beta1.MongoBackupStatus
+}
+
+// backupResult is the termination message of the dump container.
+type backupResult struct {
+	SizeBytes      int64                      `json:"sizeBytes"`
+	OplogTimestamp appsv1beta1.OplogTimestamp `json:"oplogTimestamp"`
+}
+
+func (r *MongoBackupReconciler) NewService(context context.Context, backup *appsv1beta1.MongoBackup, namespace string) MongoBackupService {
+	return MongoBackupService{
+		Backup:     backup,
+		Namespace:  namespace,
+		Reconciler: r,
+		Context:    &context,
+		Logger:     backupLogger,
+		Status:     backup.Status.DeepCopy(),
+	}
+}
+
+// Run creates the backup Job on the first pass, then follows it until it succeeds or fails. Snapshot
+// backups are taken by runSnapshot instead.
+func (b *MongoBackupService) Run() (ctrl.Result, error) {
+	mongoCluster := &appsv1beta1.MongoCluster{}
+	err := b.Reconciler.Client.Get(*b.Context, types.NamespacedName{Name: b.Backup.Spec.ClusterName, Namespace: b.Namespace}, mongoCluster)
+	if err != nil && errors.IsNotFound(err) {
+		b.Status.Phase = appsv1beta1.MongoBackupPending
+		b.Status.Message = fmt.Sprintf("MongoCluster %s not found", b.Backup.Spec.ClusterName)
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	} else if err != nil {
+		b.Logger.Error(err, "Error getting MongoCluster")
+		return ctrl.Result{}, err
+	}
+	if mongoCluster.Spec.Sharding != nil {
+		b.fail("Backups of sharded clusters are not supported")
+		return ctrl.Result{}, nil
+	}
+	if b.Backup.Spec.Method == appsv1beta1.BackupMethodSnapshot {
+		return b.runSnapshot(mongoCluster)
+	}
+	storage := b.Backup.Spec.Storage
+	if (storage.S3 == nil) == (storage.PersistentVolumeClaim == nil) {
+		b.fail("Exactly one of storage.s3 and storage.persistentVolumeClaim must be set")
+		return ctrl.Result{}, nil
+	}
+
+	job := &batchv1.Job{}
+	jobName := getBackupJobName(b.Backup.Name)
+	err = b.Reconciler.Client.Get(*b.Context, types.NamespacedName{Name: jobName, Namespace: b.Namespace}, job)
+	if err != nil && !errors.IsNotFound(err) {
+		b.Logger.Error(err, "Error getting backup Job")
+		return ctrl.Result{}, err
+	} else if errors.IsNotFound(err) {
+		job, err = b.createBackupJob(mongoCluster)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		b.Logger.Info(fmt.Sprintf("Creating backup Job %s", job.Name))
+		if err := b.Reconciler.Client.Create(*b.Context, job); err != nil {
+			b.Logger.Error(err, "Error creating backup Job")
+			return ctrl.Result{}, err
+		}
+		now := metav1.Now()
+		b.Status.Phase = appsv1beta1.MongoBackupRunning
+		b.Status.Message = fmt.Sprintf("Backing up MongoCluster %s", mongoCluster.Name)
+		b.Status.JobName = job.Name
+		b.Status.Location = b.getBackupLocation()
+		b.Status.StartTime = &now
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, b.checkBackupJob(job)
+}
+
+// checkBackupJob records the outcome of a finished Job, the Job is watched so nothing needs to be
+// done while it runs.
+func (b *MongoBackupService) checkBackupJob(job *batchv1.Job) error {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == v1api.ConditionTrue {
+			b.fail(fmt.Sprintf("Backup Job failed: %s", condition.Message))
+			return nil
+		}
+	}
+	if job.Status.Succeeded == 0 {
+		return nil
+	}
+	result, err := getBackupResult(*b.Context, b.Reconciler.Client, job)
+	if err != nil {
+		b.Logger.Error(err, "Error getting backup result")
+		return err
+	}
+	completionTime := metav1.Now()
+	if job.Status.CompletionTime != nil {
+		completionTime = *job.Status.CompletionTime
+	}
+	b.Status.Phase = appsv1beta1.MongoBackupCompleted
+	b.Status.Message = "Backup completed"
+	b.Status.CompletionTime = &completionTime
+	if b.Status.StartTime != nil {
+		b.Status.Duration = completionTime.Sub(b.Status.StartTime.Time).Round(time.Second).String()
+	}
+	b.Status.SizeBytes = result.SizeBytes
+	b.Status.OplogTimestamp = &result.OplogTimestamp
+	return nil
+}
+
+// getBackupResult reads the termination message the dump container of the successful pod of a backup
+// Job left.
+func getBackupResult(ctx context.Context, c client.Client, job *batchv1.Job) (*backupResult, error) {
+	message, err := getTerminationMessage(ctx, c, job, MONGO_BACKUP_DUMP_CONTAINER, v1api.PodSucceeded)
+	if err != nil {
+		return nil, err
+	}
+	result := &backupResult{}
+	if err := json.Unmarshal([]byte(message), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// terminationMessageNotFoundError tells that the container left no termination message in a pod of the
+// Job, or that no pod of the Job in the phase is left: it was garbage collected or evicted.
+type terminationMessageNotFoundError struct {
+	Container string
+	Job       string
+	PodFound  bool
+}
+
+func (e *terminationMessageNotFoundError) Error() string {
+	if !e.PodFound {
+		return fmt.Sprintf("no pod of Job %s is left", e.Job)
+	}
+	return fmt.Sprintf("no termination message found for container %s of Job %s", e.Container, e.Job)
+}
+
+// getTerminationMessage returns the termination message a container, init containers included, left
+// in a pod of the Job in the given phase.
+func getTerminationMessage(ctx context.Context, c client.Client, job *batchv1.Job, container string, phase v1api.PodPhase) (string, error) {
+	pods := &v1api.PodList{}
+	if err := c.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return "", err
+	}
+	notFound := &terminationMessageNotFoundError{Container: container, Job: job.Name}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != phase {
+			continue
+		}
+		notFound.PodFound = true
+		statuses := append(append([]v1api.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.Name == container && status.State.Terminated != nil && status.State.Terminated.Message != "" {
+				return status.State.Terminated.Message, nil
+			}
+		}
+	}
+	return "", notFound
+}
+
+func (b *MongoBackupService) fail(message string) {
+	now := metav1.Now()
+	b.Status.Phase = appsv1beta1.MongoBackupFailed
+	b.Status.Message = message
+	b.Status.CompletionTime = &now
+}
+
+// getBackupKey is the path of the archive in the bucket or in the claim.
+func (b *MongoBackupService) getBackupKey() string {
+	return getMongoBackupKey(b.Backup)
+}
+
+func getMongoBackupKey(backup *appsv1beta1.MongoBackup) string {
+	prefix := ""
+	if backup.Spec.Storage.S3 != nil {
+		prefix = backup.Spec.Storage.S3.Prefix
+	}
+	return path.Join(prefix, backup.Namespace, backup.Spec.ClusterName, backup.Name+MONGO_BACKUP_EXTENSION)
+}
+
+func (b *MongoBackupService) getBackupLocation() string {
+	return getBackupLocation(b.Backup.Spec.Storage, b.getBackupKey())
+}
+
+// getBackupLocation is the location of the archive stored at key, as s3://bucket/key or pvc://claim/key.
+func getBackupLocation(storage appsv1beta1.BackupStorage, key string) string {
+	if s3 := storage.S3; s3 != nil {
+		return fmt.Sprintf("s3://%s/%s", s3.Bucket, key)
+	}
+	return fmt.Sprintf("pvc://%s/%s", storage.PersistentVolumeClaim.ClaimName, key)
+}
+
+// UpdateStatus writes the status when it changed.
+func (b *MongoBackupService) UpdateStatus() error {
+	if equality.Semantic.DeepEqual(*b.Status, b.Backup.Status) {
+		return nil
+	}
+	b.Backup.Status = *b.Status
+	if err := b.Reconciler.Status().Update(*b.Context, b.Backup); err != nil {
+		b.Logger.Error(err, "Error updating MongoBackup status")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"time"
+)
+
+const (
+	MONGO_BACKUP_SNAPSHOT_FORMAT = "%s-snapshot"
+	MONGO_SNAPSHOT_POLL_DELAY    = 5 * time.Second
+)
+
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create
+
+func getBackupSnapshotName(backupName string) string {
+	return fmt.Sprintf(MONGO_BACKUP_SNAPSHOT_FORMAT, backupName)
+}
+
+// runSnapshot takes a VolumeSnapshot of the claim of a secondary. The member is fsyncLocked until the
+// snapshot has been cut so that the files on its volume are consistent, then the snapshot is followed
+// until it is ready to use. VolumeSnapshots are not watched, the CRDs may not be installed, so every
+// step is polled. The snapshot is looked up before the member is locked, which fails the backup when
+// the CRDs are missing.
+func (b *MongoBackupService) runSnapshot(mongoCluster *appsv1beta1.MongoCluster) (ctrl.Result, error) {
+	snapshotName := getBackupSnapshotName(b.Backup.Name)
+	snapshot := &snapshotv1.VolumeSnapshot{}
+	err := b.Reconciler.Client.Get(*b.Context, types.NamespacedName{Name: snapshotName, Namespace: b.Namespace}, snapshot)
+	if meta.IsNoMatchError(err) {
+		return b.failSnapshot(mongoCluster, "VolumeSnapshots are not supported by the cluster, the snapshot.storage.k8s.io CRDs are missing")
+	} else if err != nil && !errors.IsNotFound(err) {
+		b.Logger.Error(err, "Error getting VolumeSnapshot")
+		return ctrl.Result{}, err
+	} else if errors.IsNotFound(err) {
+		return b.createSnapshot(mongoCluster, snapshotName)
+	}
+
+	if status := snapshot.Status; status != nil && status.Error != nil && status.Error.Message != nil {
+		return b.failSnapshot(mongoCluster, fmt.Sprintf("VolumeSnapshot %s failed: %s", snapshotName, *status.Error.Message))
+	}
+	// The point in time of the snapshot is set once its creationTime is, the writes can resume.
+	if snapshot.Status == nil || snapshot.Status.CreationTime == nil {
+		return ctrl.Result{RequeueAfter: MONGO_SNAPSHOT_POLL_DELAY}, nil
+	}
+	if err := b.unlockMember(mongoCluster); err != nil {
+		return ctrl.Result{}, err
+	}
+	if snapshot.Status.ReadyToUse == nil || !*snapshot.Status.ReadyToUse {
+		b.Status.Message = fmt.Sprintf("Waiting for VolumeSnapshot %s to be ready", snapshotName)
+		return ctrl.Result{RequeueAfter: MONGO_SNAPSHOT_POLL_DELAY}, nil
+	}
+	completionTime := metav1.Now()
+	b.Status.Phase = appsv1beta1.MongoBackupCompleted
+	b.Status.Message = "Backup completed"
+	b.Status.CompletionTime = &completionTime
+	if b.Status.StartTime != nil {
+		b.Status.Duration = completionTime.Sub(b.Status.StartTime.Time).Round(time.Second).String()
+	}
+	if snapshot.Status.RestoreSize != nil {
+		b.Status.SizeBytes = snapshot.Status.RestoreSize.Value()
+	}
+	return ctrl.Result{}, nil
+}
+
+// createSnapshot locks a member, unless a previous pass already did, and snapshots its claim. The
+// member is recorded in the status before it is locked so that a lock is never lost, the backup is
+// Running once the lock has been taken. The backup fails, and the member is unlocked, when the snapshot
+// cannot be created.
+func (b *MongoBackupService) createSnapshot(mongoCluster *appsv1beta1.MongoCluster, snapshotName string) (ctrl.Result, error) {
+	if b.Status.LockedMember == "" {
+		host, err := b.chooseSnapshotMember(mongoCluster)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if host == "" {
+			b.Status.Phase = appsv1beta1.MongoBackupPending
+			b.Status.Message = fmt.Sprintf("No healthy secondary of MongoCluster %s to snapshot", mongoCluster.Name)
+			return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+		}
+		b.Status.LockedMember = host
+		if err := b.UpdateStatus(); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if b.Status.Phase != appsv1beta1.MongoBackupRunning {
+		if err := b.lockMember(mongoCluster); err != nil {
+			return ctrl.Result{}, err
+		}
+		now := metav1.Now()
+		b.Status.Phase = appsv1beta1.MongoBackupRunning
+		b.Status.StartTime = &now
+	}
+	index, ok := getMemberIndex(mongoCluster.Name, b.Status.LockedMember)
+	if !ok {
+		b.fail(fmt.Sprintf("Locked member %s is not part of MongoCluster %s", b.Status.LockedMember, mongoCluster.Name))
+		return ctrl.Result{}, nil
+	}
+	claimName := getPersistentVolumeClaimName(mongoCluster.Name, index)
+	snapshot := &snapshotv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshotName,
+			Namespace: b.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: mongoCluster.Name},
+		},
+		Spec: snapshotv1.VolumeSnapshotSpec{
+			Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &claimName},
+		},
+	}
+	if b.Backup.Spec.Snapshot != nil {
+		snapshot.Spec.VolumeSnapshotClassName = b.Backup.Spec.Snapshot.VolumeSnapshotClassName
+	}
+	b.Logger.Info(fmt.Sprintf("Creating VolumeSnapshot %s of %s", snapshotName, claimName))
+	// A previous pass may have created the snapshot without recording it.
+	if err := b.Reconciler.Client.Create(*b.Context, snapshot); err != nil && !errors.IsAlreadyExists(err) {
+		b.Logger.Error(err, "Error creating VolumeSnapshot")
+		return b.failSnapshot(mongoCluster, fmt.Sprintf("Error creating VolumeSnapshot %s: %s", snapshotName, err))
+	}
+	b.Status.Message = fmt.Sprintf("Snapshotting %s", claimName)
+	b.Status.SnapshotName = snapshotName
+	return ctrl.Result{RequeueAfter: MONGO_SNAPSHOT_POLL_DELAY}, nil
+}
+
+// failSnapshot unlocks the member and fails the backup. Until the backup is Running the member may not
+// have been locked, failing to unlock it then is expected.
+func (b *MongoBackupService) failSnapshot(mongoCluster *appsv1beta1.MongoCluster, message string) (ctrl.Result, error) {
+	if err := b.unlockMember(mongoCluster); err != nil && b.Status.Phase == appsv1beta1.MongoBackupRunning {
+		return ctrl.Result{}, err
+	}
+	b.Status.LockedMember = ""
+	b.fail(message)
+	return ctrl.Result{}, nil
+}
+
+// chooseSnapshotMember prefers a hidden member, which serves no reads, and falls back to any healthy
+// secondary. It returns an empty host when there is none.
+func (b *MongoBackupService) chooseSnapshotMember(mongoCluster *appsv1beta1.MongoCluster) (string, error) {
+	var hosts []string
+	for i := 0; int32(i) < mongoCluster.Spec.Replicas; i++ {
+		hosts = append(hosts, getMemberHost(mongoCluster.Name, mongoCluster.Namespace, i))
+	}
+	adminClient, err := b.newAdminClient(mongoCluster, hosts, mongoCluster.Name)
+	if err != nil {
+		return "", err
+	}
+	defer adminClient.Disconnect(*b.Context)
+	status, err := adminClient.GetReplicaSetStatus(*b.Context)
+	if err != nil {
+		b.Logger.Error(err, "Error getting replica set status")
+		return "", err
+	}
+	hidden := map[string]bool{}
+	for _, member := range mongoCluster.Spec.Members {
+		if member.Hidden {
+			hidden[getMemberHost(mongoCluster.Name, mongoCluster.Namespace, int(member.Index))] = true
+		}
+	}
+	host := ""
+	for _, member := range status.Members {
+		if member.State != mongoadmin.MEMBER_STATE_SECONDARY || member.Health != 1 {
+			continue
+		}
+		if hidden[member.Name] {
+			return member.Name, nil
+		}
+		if host == "" {
+			host = member.Name
+		}
+	}
+	return host, nil
+}
+
+// lockMember fsyncLocks the recorded member. A previous pass may have locked it before failing to
+// record the lock, so the member is unlocked first, which fails when it is not locked.
+func (b *MongoBackupService) lockMember(mongoCluster *appsv1beta1.MongoCluster) error {
+	b.Logger.Info(fmt.Sprintf("Locking member %s", b.Status.LockedMember))
+	adminClient, err := b.newAdminClient(mongoCluster, []string{b.Status.LockedMember}, "")
+	if err != nil {
+		return err
+	}
+	defer adminClient.Disconnect(*b.Context)
+	if err := adminClient.FsyncUnlock(*b.Context); err == nil {
+		b.Logger.Info(fmt.Sprintf("Member %s was already locked", b.Status.LockedMember))
+	}
+	if err := adminClient.FsyncLock(*b.Context); err != nil {
+		b.Logger.Error(err, "Error locking member")
+		return err
+	}
+	return nil
+}
+
+// unlockMember releases the member locked by createSnapshot, if any.
+func (b *MongoBackupService) unlockMember(mongoCluster *appsv1beta1.MongoCluster) error {
+	if b.Status.LockedMember == "" {
+		return nil
+	}
+	b.Logger.Info(fmt.Sprintf("Unlocking member %s", b.Status.LockedMember))
+	adminClient, err := b.newAdminClient(mongoCluster, []string{b.Status.LockedMember}, "")
+	if err != nil {
+		return err
+	}
+	defer adminClient.Disconnect(*b.Context)
+	if err := adminClient.FsyncUnlock(*b.Context); err != nil {
+		b.Logger.Error(err, "Error unlocking member")
+		return err
+	}
+	b.Status.LockedMember = ""
+	return nil
+}
+
+// Delete unlocks the member a Snapshot backup still holds. Until the backup is Running the member
+// may not have been locked, failing to unlock it then is expected.
+func (b *MongoBackupService) Delete() error {
+	if b.Status.LockedMember == "" {
+		return nil
+	}
+	mongoCluster := &appsv1beta1.MongoCluster{}
+	err := b.Reconciler.Client.Get(*b.Context, types.NamespacedName{Name: b.Backup.Spec.ClusterName, Namespace: b.Namespace}, mongoCluster)
+	if err != nil && errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		b.Logger.Error(err, "Error getting MongoCluster")
+		return err
+	}
+	if err := b.unlockMember(mongoCluster); err != nil && b.Status.Phase == appsv1beta1.MongoBackupRunning {
+		return err
+	}
+	return nil
+}
+
+func (b *MongoBackupService) newAdminClient(mongoCluster *appsv1beta1.MongoCluster, hosts []string, replicaSet string) (mongoadmin.Client, error) {
+	adminClient, err := newClusterAdminClient(*b.Context, b.Reconciler.Client, b.Reconciler.MongoAdmin, mongoCluster, hosts, replicaSet)
+	if err != nil {
+		b.Logger.Error(err, "Error connecting to the cluster")
+		return nil, err
+	}
+	return adminClient, nil
+}
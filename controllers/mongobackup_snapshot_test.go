@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// snapshotCacheClient does not find the VolumeSnapshots it holds, as a cache that has not seen them yet.
+type snapshotCacheClient struct {
+	client.Client
+}
+
+func (c snapshotCacheClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*snapshotv1.VolumeSnapshot); ok {
+		return errors.NewNotFound(snapshotv1.Resource("volumesnapshots"), key.Name)
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// snapshotFailingClient fails to create VolumeSnapshots, and to find them when the CRDs are missing.
+type snapshotFailingClient struct {
+	client.Client
+	missingCRDs bool
+}
+
+func (c snapshotFailingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*snapshotv1.VolumeSnapshot); ok && c.missingCRDs {
+		return &meta.NoKindMatchError{GroupKind: snapshotv1.SchemeGroupVersion.WithKind("VolumeSnapshot").GroupKind(), SearchedVersions: []string{"v1"}}
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c snapshotFailingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*snapshotv1.VolumeSnapshot); ok {
+		return errors.NewForbidden(snapshotv1.Resource("volumesnapshots"), obj.GetName(), fmt.Errorf("quota exceeded"))
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+var _ = Describe("MongoBackup Snapshot", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var backup *appsv1beta1.MongoBackup
+	var mongo *mongofake.Client
+	var passwordSecret *v1api.Secret
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Members = []appsv1beta1.MemberOptions{{Index: 2, Hidden: true}}
+		backup = &appsv1beta1.MongoBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: testNamespace},
+			Spec:       appsv1beta1.MongoBackupSpec{ClusterName: cluster.Name, Method: appsv1beta1.BackupMethodSnapshot},
+		}
+		mongo = mongofake.NewClient()
+		mongo.Status = &mongoadmin.ReplicaSetStatus{Members: []mongoadmin.MemberStatus{
+			{Name: getMemberHost(cluster.Name, testNamespace, 0), State: mongoadmin.MEMBER_STATE_PRIMARY, Health: 1},
+			{Name: getMemberHost(cluster.Name, testNamespace, 1), State: mongoadmin.MEMBER_STATE_SECONDARY, Health: 1},
+			{Name: getMemberHost(cluster.Name, testNamespace, 2), State: mongoadmin.MEMBER_STATE_SECONDARY, Health: 1},
+		}}
+		passwordSecret = &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: getPasswordSecretName(cluster), Namespace: testNamespace},
+			Data:       map[string][]byte{"password": []byte("secret")},
+		}
+	})
+
+	getSnapshot := func(service *MongoBackupService) (*snapshotv1.VolumeSnapshot, error) {
+		snapshot := &snapshotv1.VolumeSnapshot{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: "nightly-snapshot", Namespace: testNamespace}, snapshot)
+		return snapshot, err
+	}
+
+	newSnapshot := func(status *snapshotv1.VolumeSnapshotStatus) *snapshotv1.VolumeSnapshot {
+		return &snapshotv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly-snapshot", Namespace: testNamespace},
+			Status:     status,
+		}
+	}
+
+	It("records the hidden member before locking it and snapshots its claim", func() {
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		host := getMemberHost(cluster.Name, testNamespace, 2)
+		Expect(service.Status.LockedMember).To(Equal(host))
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupRunning))
+		Expect(mongo.Locks).To(Equal(1))
+
+		saved := &appsv1beta1.MongoBackup{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: backup.Name, Namespace: testNamespace}, saved)).To(Succeed())
+		Expect(saved.Status.LockedMember).To(Equal(host))
+
+		snapshot, err := getSnapshot(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*snapshot.Spec.Source.PersistentVolumeClaimName).To(Equal(getPersistentVolumeClaimName(cluster.Name, 2)))
+	})
+
+	It("locks the recorded member once when a previous pass did not record the lock", func() {
+		backup.Status.LockedMember = getMemberHost(cluster.Name, testNamespace, 1)
+		mongo.Locks = 1
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(1))
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupRunning))
+
+		mongo.Locks = 0
+		service = newTestBackupService(backup, mongo, cluster, passwordSecret)
+		_, err = service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(1))
+	})
+
+	It("keeps a snapshot created by a previous pass", func() {
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret, newSnapshot(nil))
+		service.Reconciler.Client = snapshotCacheClient{service.Reconciler.Client}
+		result, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{RequeueAfter: MONGO_SNAPSHOT_POLL_DELAY}))
+		Expect(service.Status.SnapshotName).To(Equal("nightly-snapshot"))
+	})
+
+	It("unlocks the member and fails when the snapshot cannot be created", func() {
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		service.Reconciler.Client = snapshotFailingClient{Client: service.Reconciler.Client}
+		result, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+		Expect(mongo.Locks).To(Equal(0))
+		Expect(service.Status.LockedMember).To(BeEmpty())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupFailed))
+		Expect(service.Status.Message).To(ContainSubstring("quota exceeded"))
+	})
+
+	It("fails without locking a member when the VolumeSnapshot CRDs are missing", func() {
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		service.Reconciler.Client = snapshotFailingClient{Client: service.Reconciler.Client, missingCRDs: true}
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(0))
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupFailed))
+		Expect(service.Status.Message).To(ContainSubstring("CRDs are missing"))
+	})
+
+	It("unlocks the member of a running backup when the VolumeSnapshot CRDs are removed", func() {
+		backup.Status = appsv1beta1.MongoBackupStatus{Phase: appsv1beta1.MongoBackupRunning, LockedMember: getMemberHost(cluster.Name, testNamespace, 2)}
+		mongo.Locks = 1
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		service.Reconciler.Client = snapshotFailingClient{Client: service.Reconciler.Client, missingCRDs: true}
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(0))
+		Expect(service.Status.LockedMember).To(BeEmpty())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupFailed))
+	})
+
+	It("unlocks the member once the snapshot has been cut", func() {
+		backup.Status = appsv1beta1.MongoBackupStatus{Phase: appsv1beta1.MongoBackupRunning, LockedMember: getMemberHost(cluster.Name, testNamespace, 2)}
+		mongo.Locks = 1
+		ready := false
+		now := metav1.Now()
+		snapshot := newSnapshot(&snapshotv1.VolumeSnapshotStatus{CreationTime: &now, ReadyToUse: &ready})
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret, snapshot)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(0))
+		Expect(service.Status.LockedMember).To(BeEmpty())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupRunning))
+
+		ready = true
+		size := resource.MustParse("10Gi")
+		snapshot.Status.RestoreSize = &size
+		service = newTestBackupService(backup, mongo, cluster, passwordSecret, snapshot)
+		service.Status.LockedMember = ""
+		_, err = service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupCompleted))
+		Expect(service.Status.SizeBytes).To(Equal(size.Value()))
+	})
+
+	It("unlocks the member of a failed snapshot", func() {
+		backup.Status = appsv1beta1.MongoBackupStatus{Phase: appsv1beta1.MongoBackupRunning, LockedMember: getMemberHost(cluster.Name, testNamespace, 2)}
+		mongo.Locks = 1
+		message := "driver error"
+		snapshot := newSnapshot(&snapshotv1.VolumeSnapshotStatus{Error: &snapshotv1.VolumeSnapshotError{Message: &message}})
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret, snapshot)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(0))
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoBackupFailed))
+		Expect(service.Status.Message).To(ContainSubstring("driver error"))
+	})
+
+	It("unlocks the member when the backup is deleted", func() {
+		now := metav1.Now()
+		backup.DeletionTimestamp = &now
+		backup.Finalizers = []string{backupFinalizerName}
+		backup.Status = appsv1beta1.MongoBackupStatus{Phase: appsv1beta1.MongoBackupRunning, LockedMember: getMemberHost(cluster.Name, testNamespace, 2)}
+		mongo.Locks = 1
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		_, err := service.Reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: backup.Name, Namespace: testNamespace}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Locks).To(Equal(0))
+		err = service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: backup.Name, Namespace: testNamespace}, &appsv1beta1.MongoBackup{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("deletes a backup whose member was recorded but not locked", func() {
+		backup.Status.LockedMember = getMemberHost(cluster.Name, testNamespace, 2)
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		Expect(service.Delete()).To(Succeed())
+	})
+
+	It("holds the snapshot backups until their member is unlocked", func() {
+		service := newTestBackupService(backup, mongo, cluster, passwordSecret)
+		_, err := service.Reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: backup.Name, Namespace: testNamespace}})
+		Expect(err).NotTo(HaveOccurred())
+		saved := &appsv1beta1.MongoBackup{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: backup.Name, Namespace: testNamespace}, saved)).To(Succeed())
+		Expect(saved.Finalizers).To(ContainElement(backupFinalizerName))
+	})
+})
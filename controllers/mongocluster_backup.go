@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"path"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	MONGO_BACKUP_CRON_JOB_FORMAT = "%s-backup-%s"
+	MONGO_CLUSTER_LABEL          = "apps.esgi.fr/cluster"
+	MONGO_BACKUP_SCHEDULE_LABEL  = "apps.esgi.fr/backup-schedule"
+	MONGO_BACKUP_SPEC_ANNOTATION = "apps.esgi.fr/backup-spec-hash"
+)
+
+var MONGO_BACKUP_JOBS_HISTORY_LIMIT int32 = 3
+
+func getBackupCronJobName(clusterName string, scheduleName string) string {
+	return fmt.Sprintf(MONGO_BACKUP_CRON_JOB_FORMAT, clusterName, scheduleName)
+}
+
+// createOrUpdateBackupSchedules reconciles one CronJob per backup schedule, deletes the CronJobs of the
+// schedules removed from the spec and records the outcome of the last run of every schedule.
+func (m *MongoClusterService) createOrUpdateBackupSchedules() error {
+	schedules := m.AppConfig.Spec.Backup.Schedules
+	if m.isSharded() && len(schedules) > 0 {
+		return &invalidSpecError{Field: "backup.schedules", Err: fmt.Errorf("backups of sharded clusters are not supported")}
+	}
+	var statuses []appsv1beta1.ScheduledBackupStatus
+	for _, schedule := range schedules {
+		cronJob, err := m.createOrUpdateBackupCronJob(schedule)
+		if err != nil {
+			return err
+		}
+		status, err := m.getScheduledBackupStatus(schedule, cronJob)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, status)
+	}
+	m.BackupStatuses = statuses
+	return m.deleteRemovedBackupSchedules()
+}
+
+func (m *MongoClusterService) createOrUpdateBackupCronJob(schedule appsv1beta1.BackupSchedule) (*batchv1.CronJob, error) {
+	expectedCronJob, err := m.createBackupCronJob(schedule)
+	if err != nil {
+		m.Logger.Error(err, "Error creating backup CronJob")
+		return nil, err
+	}
+	return m.createOrUpdateCronJob(expectedCronJob)
+}
+
+// createOrUpdateCronJob creates the CronJob or updates it when its spec hash changed.
+func (m *MongoClusterService) createOrUpdateCronJob(expectedCronJob *batchv1.CronJob) (*batchv1.CronJob, error) {
+	actualCronJob := &batchv1.CronJob{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: expectedCronJob.Name, Namespace: m.Namespace}, actualCronJob)
+
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting CronJob")
+		return nil, err
+	} else if errors.IsNotFound(err) {
+		m.Logger.Info(fmt.Sprintf("Creating CronJob %s", expectedCronJob.Name))
+		if err := m.Reconciler.Client.Create(*m.Context, expectedCronJob); err != nil {
+			m.Logger.Error(err, "Error creating CronJob")
+			return nil, err
+		}
+		return expectedCronJob, nil
+	} else if actualCronJob.Annotations[MONGO_BACKUP_SPEC_ANNOTATION] == expectedCronJob.Annotations[MONGO_BACKUP_SPEC_ANNOTATION] {
+		return actualCronJob, nil
+	}
+	m.Logger.Info(fmt.Sprintf("Updating CronJob %s", expectedCronJob.Name))
+	actualCronJob.Annotations = expectedCronJob.Annotations
+	actualCronJob.Labels = expectedCronJob.Labels
+	actualCronJob.Spec = expectedCronJob.Spec
+	if err := m.Reconciler.Client.Update(*m.Context, actualCronJob); err != nil {
+		m.Logger.Error(err, "Error updating CronJob")
+		return nil, err
+	}
+	return actualCronJob, nil
+}
+
+// createBackupCronJob runs the dump of the MongoBackup Jobs on the schedule. Every run writes its own
+// archive, named after the Job, in the directory of the schedule, then prunes that directory.
+func (m *MongoClusterService) createBackupCronJob(schedule appsv1beta1.BackupSchedule) (*batchv1.CronJob, error) {
+	labels := map[string]string{
+		MONGO_CLUSTER_LABEL:         m.AppConfig.Name,
+		MONGO_BACKUP_SCHEDULE_LABEL: schedule.Name,
+	}
+	retention := schedule.Retention
+	spec := batchv1.CronJobSpec{
+		Schedule:                   schedule.Schedule,
+		Suspend:                    &schedule.Suspend,
+		ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+		SuccessfulJobsHistoryLimit: &MONGO_BACKUP_JOBS_HISTORY_LIMIT,
+		FailedJobsHistoryLimit:     &MONGO_BACKUP_JOBS_HISTORY_LIMIT,
+		JobTemplate: batchv1.JobTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: labels,
+			},
+			Spec: batchv1.JobSpec{
+				BackoffLimit: &MONGO_BACKUP_BACKOFF_LIMIT,
+				Template: v1api.PodTemplateSpec{
+					Spec: newBackupPodSpec(m.AppConfig, schedule.Storage, m.getScheduledBackupKey(schedule, "$(JOB_NAME)"), &retention),
+				},
+			},
+		},
+	}
+	return m.newCronJob(getBackupCronJobName(m.AppConfig.Name, schedule.Name), labels, spec)
+}
+
+// newCronJob annotates the CronJob with the hash of its spec, compared on updates.
+func (m *MongoClusterService) newCronJob(name string, labels map[string]string, spec batchv1.CronJobSpec) (*batchv1.CronJob, error) {
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(specBytes)
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				MONGO_BACKUP_SPEC_ANNOTATION: hex.EncodeToString(hash[:])[:16],
+			},
+		},
+		Spec: spec,
+	}
+	if err := ctrl.SetControllerReference(m.AppConfig, cronJob, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting CronJob owner reference")
+		return nil, err
+	}
+	return cronJob, nil
+}
+
+// getScheduledBackupKey is the path of the archive written by the given Job of a schedule.
+func (m *MongoClusterService) getScheduledBackupKey(schedule appsv1beta1.BackupSchedule, jobName string) string {
+	prefix := ""
+	if schedule.Storage.S3 != nil {
+		prefix = schedule.Storage.S3.Prefix
+	}
+	return path.Join(prefix, m.Namespace, m.AppConfig.Name, schedule.Name, jobName+MONGO_BACKUP_EXTENSION)
+}
+
+// getScheduledBackupStatus reports the last Job of the schedule that finished. The status of a Job
+// already reported is kept as is, so that the pods of the Job are only read once.
+func (m *MongoClusterService) getScheduledBackupStatus(schedule appsv1beta1.BackupSchedule, cronJob *batchv1.CronJob) (appsv1beta1.ScheduledBackupStatus, error) {
+	status := appsv1beta1.ScheduledBackupStatus{Name: schedule.Name}
+	for _, previous := range m.AppConfig.Status.Backups {
+		if previous.Name == schedule.Name {
+			status = previous
+		}
+	}
+	status.LastScheduleTime = cronJob.Status.LastScheduleTime
+	lastJob, lastFailure, err := m.getLastFinishedJob(client.MatchingLabels{
+		MONGO_CLUSTER_LABEL:         m.AppConfig.Name,
+		MONGO_BACKUP_SCHEDULE_LABEL: schedule.Name,
+	})
+	if err != nil {
+		return status, err
+	}
+	if lastJob == nil || lastJob.Name == status.LastJobName {
+		return status, nil
+	}
+	status.LastJobName = lastJob.Name
+	if lastFailure != nil {
+		status.LastResult = appsv1beta1.MongoBackupFailed
+		status.Message = fmt.Sprintf("Backup Job failed: %s", lastFailure.Message)
+		return status, nil
+	}
+	result := &backupResult{}
+	found, err := m.getJobResult(lastJob, MONGO_BACKUP_DUMP_CONTAINER, result)
+	if err != nil {
+		return status, err
+	}
+	status.LastResult = appsv1beta1.MongoBackupCompleted
+	status.Message = ""
+	status.LastSuccessfulTime = lastJob.Status.CompletionTime
+	status.Location = getBackupLocation(schedule.Storage, m.getScheduledBackupKey(schedule, lastJob.Name))
+	if !found {
+		status.Message = "Backup completed, the size and the oplog timestamp of the archive are unknown"
+		status.SizeBytes = 0
+		status.OplogTimestamp = nil
+		return status, nil
+	}
+	status.SizeBytes = result.SizeBytes
+	status.OplogTimestamp = &result.OplogTimestamp
+	return status, nil
+}
+
+// getJobResult parses the result the container of the successful pod of a finished Job left as its
+// termination message. The result is read once: a pod garbage collected or evicted since the Job
+// finished, or a container that left no message or an unreadable one, does not come back on the next
+// pass, so false is returned and the Job is reported without its result. Only the errors of the API
+// server are returned.
+func (m *MongoClusterService) getJobResult(job *batchv1.Job, container string, result interface{}) (bool, error) {
+	message, err := getTerminationMessage(*m.Context, m.Reconciler.Client, job, container, v1api.PodSucceeded)
+	if _, notFound := err.(*terminationMessageNotFoundError); notFound {
+		m.Logger.Info(fmt.Sprintf("The result of Job %s is unknown, %s", job.Name, err))
+		return false, nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting Job result")
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(message), result); err != nil {
+		m.Logger.Error(err, fmt.Sprintf("Error parsing the result of Job %s", job.Name))
+		return false, nil
+	}
+	return true, nil
+}
+
+// getLastFinishedJob returns the most recent Job with the labels that succeeded or failed, and the
+// condition of its failure.
+func (m *MongoClusterService) getLastFinishedJob(labels client.MatchingLabels) (*batchv1.Job, *batchv1.JobCondition, error) {
+	jobs := &batchv1.JobList{}
+	if err := m.Reconciler.Client.List(*m.Context, jobs, client.InNamespace(m.Namespace), labels); err != nil {
+		m.Logger.Error(err, "Error listing Jobs")
+		return nil, nil, err
+	}
+	var lastJob *batchv1.Job
+	var lastFailure *batchv1.JobCondition
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		failure := getJobFailure(job)
+		if job.Status.Succeeded == 0 && failure == nil {
+			continue
+		}
+		if lastJob == nil || lastJob.CreationTimestamp.Before(&job.CreationTimestamp) {
+			lastJob, lastFailure = job, failure
+		}
+	}
+	return lastJob, lastFailure, nil
+}
+
+func getJobFailure(job *batchv1.Job) *batchv1.JobCondition {
+	for i, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == v1api.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// deleteRemovedBackupSchedules deletes the CronJobs of the cluster whose schedule is no longer in the
+// spec, the archives they wrote are kept.
+func (m *MongoClusterService) deleteRemovedBackupSchedules() error {
+	scheduled := map[string]bool{}
+	for _, schedule := range m.AppConfig.Spec.Backup.Schedules {
+		scheduled[schedule.Name] = true
+	}
+	cronJobs := &batchv1.CronJobList{}
+	err := m.Reconciler.Client.List(*m.Context, cronJobs, client.InNamespace(m.Namespace),
+		client.MatchingLabels{MONGO_CLUSTER_LABEL: m.AppConfig.Name}, client.HasLabels{MONGO_BACKUP_SCHEDULE_LABEL})
+	if err != nil {
+		m.Logger.Error(err, "Error listing backup CronJobs")
+		return err
+	}
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
+		if scheduled[cronJob.Labels[MONGO_BACKUP_SCHEDULE_LABEL]] {
+			continue
+		}
+		m.Logger.Info(fmt.Sprintf("Deleting backup CronJob %s", cronJob.Name))
+		if err := m.Reconciler.Client.Delete(*m.Context, cronJob, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting backup CronJob")
+			return err
+		}
+	}
+	return nil
+}
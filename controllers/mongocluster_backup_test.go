@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("createOrUpdateBackupSchedules", func() {
+	var cluster *appsv1beta1.MongoCluster
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Backup.Schedules = []appsv1beta1.BackupSchedule{{
+			Name:      "daily",
+			Schedule:  "0 3 * * *",
+			Storage:   appsv1beta1.BackupStorage{PersistentVolumeClaim: &appsv1beta1.PersistentVolumeClaimStorage{ClaimName: "backups"}},
+			Retention: appsv1beta1.BackupRetention{Count: 7},
+		}}
+	})
+
+	getCronJob := func(service *MongoClusterService, name string) (*batchv1.CronJob, error) {
+		cronJob := &batchv1.CronJob{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, cronJob)
+		return cronJob, err
+	}
+
+	newScheduledJob := func(name string, created time.Time, status batchv1.JobStatus) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         testNamespace,
+				CreationTimestamp: metav1.NewTime(created),
+				Labels:            map[string]string{MONGO_CLUSTER_LABEL: cluster.Name, MONGO_BACKUP_SCHEDULE_LABEL: "daily"},
+			},
+			Status: status,
+		}
+	}
+
+	It("runs each schedule as a CronJob pruning the archives of the schedule", func() {
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		cronJob, err := getCronJob(service, "mongo-backup-daily")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cronJob.Spec.Schedule).To(Equal("0 3 * * *"))
+		Expect(cronJob.Spec.ConcurrencyPolicy).To(Equal(batchv1.ForbidConcurrent))
+		Expect(cronJob.Spec.JobTemplate.Labels).To(HaveKeyWithValue(MONGO_BACKUP_SCHEDULE_LABEL, "daily"))
+		spec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+		Expect(spec.InitContainers[0].Env).To(ContainElement(v1api.EnvVar{Name: "BACKUP_FILE", Value: "/backup/default/mongo/daily/$(JOB_NAME).tar.gz"}))
+		Expect(spec.Containers[0].Name).To(Equal(MONGO_BACKUP_PRUNE_CONTAINER))
+		Expect(spec.Containers[0].Env).To(ContainElement(v1api.EnvVar{Name: "RETENTION_COUNT", Value: "7"}))
+		Expect(service.BackupStatuses).To(Equal([]appsv1beta1.ScheduledBackupStatus{{Name: "daily"}}))
+	})
+
+	It("updates the CronJob when the schedule changed", func() {
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		cronJob, err := getCronJob(service, "mongo-backup-daily")
+		Expect(err).NotTo(HaveOccurred())
+		hash := cronJob.Annotations[MONGO_BACKUP_SPEC_ANNOTATION]
+
+		cluster.Spec.Backup.Schedules[0].Schedule = "0 4 * * *"
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		cronJob, err = getCronJob(service, "mongo-backup-daily")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cronJob.Spec.Schedule).To(Equal("0 4 * * *"))
+		Expect(cronJob.Annotations[MONGO_BACKUP_SPEC_ANNOTATION]).NotTo(Equal(hash))
+	})
+
+	It("deletes the CronJob of a removed schedule", func() {
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		cluster.Spec.Backup.Schedules = nil
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		_, err := getCronJob(service, "mongo-backup-daily")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports the last finished run of the schedule", func() {
+		now := time.Now()
+		completion := metav1.NewTime(now)
+		older := newScheduledJob("mongo-backup-daily-1", now.Add(-48*time.Hour), batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+			{Type: batchv1.JobFailed, Status: v1api.ConditionTrue, Message: "BackoffLimitExceeded"},
+		}})
+		last := newScheduledJob("mongo-backup-daily-2", now.Add(-24*time.Hour), batchv1.JobStatus{Succeeded: 1, CompletionTime: &completion})
+		running := newScheduledJob("mongo-backup-daily-3", now, batchv1.JobStatus{Active: 1})
+		pod := newJobPod(last.Name, v1api.PodSucceeded, MONGO_BACKUP_DUMP_CONTAINER, `{"sizeBytes":2048,"oplogTimestamp":{"t":1700000000,"i":1}}`)
+		service := newTestService(cluster, mongofake.NewClient(), older, last, running, pod)
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		Expect(service.BackupStatuses).To(HaveLen(1))
+		status := service.BackupStatuses[0]
+		Expect(status.LastJobName).To(Equal(last.Name))
+		Expect(status.LastResult).To(Equal(appsv1beta1.MongoBackupCompleted))
+		Expect(status.Location).To(Equal("pvc://backups/default/mongo/daily/mongo-backup-daily-2.tar.gz"))
+		Expect(status.SizeBytes).To(BeEquivalentTo(2048))
+	})
+
+	It("reports a run whose pod is gone without its result", func() {
+		now := time.Now()
+		completion := metav1.NewTime(now)
+		job := newScheduledJob("mongo-backup-daily-1", now, batchv1.JobStatus{Succeeded: 1, CompletionTime: &completion})
+		cluster.Status.Backups = []appsv1beta1.ScheduledBackupStatus{{
+			Name: "daily", LastJobName: "mongo-backup-daily-0", SizeBytes: 1024, OplogTimestamp: &appsv1beta1.OplogTimestamp{T: 1700000000, I: 1},
+		}}
+		service := newTestService(cluster, mongofake.NewClient(), job)
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		status := service.BackupStatuses[0]
+		Expect(status.LastJobName).To(Equal(job.Name))
+		Expect(status.LastResult).To(Equal(appsv1beta1.MongoBackupCompleted))
+		Expect(status.LastSuccessfulTime).NotTo(BeNil())
+		Expect(status.Message).To(ContainSubstring("unknown"))
+		Expect(status.SizeBytes).To(BeZero())
+		Expect(status.OplogTimestamp).To(BeNil())
+	})
+
+	It("reports a failed run with the condition of its Job", func() {
+		failed := newScheduledJob("mongo-backup-daily-1", time.Now(), batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+			{Type: batchv1.JobFailed, Status: v1api.ConditionTrue, Message: "BackoffLimitExceeded"},
+		}})
+		service := newTestService(cluster, mongofake.NewClient(), failed)
+		Expect(service.createOrUpdateBackupSchedules()).To(Succeed())
+		Expect(service.BackupStatuses[0].LastResult).To(Equal(appsv1beta1.MongoBackupFailed))
+		Expect(service.BackupStatuses[0].Message).To(ContainSubstring("BackoffLimitExceeded"))
+	})
+
+	It("rejects the schedules of sharded clusters", func() {
+		cluster.Spec.Sharding = &appsv1beta1.Sharding{Shards: 2, MembersPerShard: 3, ConfigServers: 3, Routers: 1}
+		service := newTestService(cluster, mongofake.NewClient())
+		err := service.createOrUpdateBackupSchedules()
+		Expect(err).To(BeAssignableToTypeOf(&invalidSpecError{}))
+	})
+})
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+)
+
+const (
+	MONGO_BINDING_SECRET_FORMAT = "%s-binding"
+	SERVICE_BINDING_TYPE        = "mongodb"
+	SERVICE_BINDING_PROVIDER    = "mongo-cluster"
+	// SERVICE_BINDING_SECRET_TYPE is the secret type recommended by the servicebinding.io specification
+	SERVICE_BINDING_SECRET_TYPE v1api.SecretType = "servicebinding.io/mongodb"
+)
+
+func getBindingSecretName(clusterName string) string {
+	return fmt.Sprintf(MONGO_BINDING_SECRET_FORMAT, clusterName)
+}
+
+// createOrUpdateBindingSecret writes the secret of the servicebinding.io Provisioned Service. It
+// holds the entries of the specification, plus the uri and replicaSet entries the drivers need to
+// reach a replica set. The host is the service clients go through: the headless service of the
+// members, from which the drivers discover the replica set, or the routers of a sharded cluster. The
+// database is the one of the cluster, the user authenticates against admin. With TLS, the CA bundle
+// is added under ca.crt like in the connection secret.
+func (m *MongoClusterService) createOrUpdateBindingSecret() error {
+	passwordSecret, err := m.createPasswordSecret()
+	if err != nil {
+		return err
+	}
+	password := string(passwordSecret.Data["password"])
+	hosts, replicaSet := getClientHosts(m.AppConfig)
+	expectedSecret := &v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getBindingSecretName(m.AppConfig.Name),
+			Namespace: m.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: m.AppConfig.Name},
+		},
+		Type: SERVICE_BINDING_SECRET_TYPE,
+		Data: map[string][]byte{
+			"type":       []byte(SERVICE_BINDING_TYPE),
+			"provider":   []byte(SERVICE_BINDING_PROVIDER),
+			"host":       []byte(getSrvHost(m.AppConfig)),
+			"port":       []byte(strconv.Itoa(int(MONGO_CONTAINER_PORT))),
+			"username":   []byte(MONGODB_DEFAULT_USER),
+			"password":   []byte(password),
+			"database":   []byte(m.AppConfig.Spec.DatabaseName),
+			"replicaSet": []byte(replicaSet),
+			"tls":        []byte(strconv.FormatBool(useClientTLS(m.AppConfig))),
+			"uri":        []byte(getConnectionURI(hosts, replicaSet, MONGODB_DEFAULT_USER, password, m.AppConfig.Spec.DatabaseName, mongoadmin.ADMIN_DATABASE, useClientTLS(m.AppConfig))),
+		},
+	}
+	if err := m.addTLSCA(expectedSecret); err != nil {
+		return err
+	}
+	if err := m.createOrUpdateOwnedSecret(expectedSecret); err != nil {
+		return err
+	}
+	m.Binding = &appsv1beta1.BindingReference{Name: expectedSecret.Name}
+	return nil
+}
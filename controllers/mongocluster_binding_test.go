@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("createOrUpdateBindingSecret", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.DatabaseName = "app"
+		cluster.Spec.Auth.Password = "secret"
+		mongo = mongofake.NewClient()
+	})
+
+	getSecret := func(service *MongoClusterService) *v1api.Secret {
+		secret := &v1api.Secret{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: "mongo-binding", Namespace: testNamespace}, secret)).To(Succeed())
+		return secret
+	}
+
+	It("lays the secret out as a servicebinding.io Provisioned Service", func() {
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateBindingSecret()).To(Succeed())
+
+		secret := getSecret(service)
+		Expect(secret.Type).To(Equal(SERVICE_BINDING_SECRET_TYPE))
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.Data).To(HaveKeyWithValue("type", []byte("mongodb")))
+		Expect(secret.Data).To(HaveKeyWithValue("provider", []byte(SERVICE_BINDING_PROVIDER)))
+		Expect(secret.Data).To(HaveKeyWithValue("host", []byte(getSrvHost(cluster))))
+		Expect(secret.Data).To(HaveKeyWithValue("port", []byte(strconv.Itoa(int(MONGO_CONTAINER_PORT)))))
+		Expect(secret.Data).To(HaveKeyWithValue("username", []byte(MONGODB_DEFAULT_USER)))
+		Expect(secret.Data).To(HaveKeyWithValue("password", []byte("secret")))
+		Expect(secret.Data).To(HaveKeyWithValue("database", []byte("app")))
+		Expect(secret.Data).To(HaveKeyWithValue("replicaSet", []byte("mongo")))
+		Expect(secret.Data).To(HaveKeyWithValue("tls", []byte("false")))
+		Expect(string(secret.Data["uri"])).To(ContainSubstring("/app?authSource=admin&replicaSet=mongo"))
+		Expect(secret.Data).NotTo(HaveKey(MONGO_TLS_CA_KEY))
+	})
+
+	It("binds the workloads of a sharded cluster to its routers", func() {
+		cluster.Spec.Sharding = &appsv1beta1.Sharding{Shards: 2, MembersPerShard: 3, ConfigServers: 3, Routers: 2}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateBindingSecret()).To(Succeed())
+
+		secret := getSecret(service)
+		Expect(string(secret.Data["host"])).To(HavePrefix(getRouterName(cluster.Name) + "."))
+		Expect(secret.Data).To(HaveKeyWithValue("replicaSet", []byte("")))
+	})
+
+	It("adds the TLS entries and the CA bundle of the cluster", func() {
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModePrefer}
+		caSecret := &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: getTLSCASecretName(cluster), Namespace: testNamespace},
+			Data:       map[string][]byte{MONGO_TLS_CA_KEY: []byte("ca")},
+		}
+		service := newTestService(cluster, mongo, caSecret)
+		Expect(service.createOrUpdateBindingSecret()).To(Succeed())
+
+		secret := getSecret(service)
+		Expect(secret.Data).To(HaveKeyWithValue("tls", []byte("true")))
+		Expect(string(secret.Data["uri"])).To(ContainSubstring("tls=true"))
+		Expect(secret.Data).To(HaveKeyWithValue(MONGO_TLS_CA_KEY, []byte("ca")))
+	})
+
+	It("publishes the secret in status.binding", func() {
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateBindingSecret()).To(Succeed())
+		Expect(service.UpdateStatus(ctrl.Result{}, nil)).To(Succeed())
+
+		updated := &appsv1beta1.MongoCluster{}
+		Expect(service.Reconciler.Client.Get(context.Background(), client.ObjectKeyFromObject(cluster), updated)).To(Succeed())
+		Expect(updated.Status.Binding).To(Equal(&appsv1beta1.BindingReference{Name: "mongo-binding"}))
+	})
+})
@@ -0,0 +1,486 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	MONGO_BOOTSTRAP_RESTORE_FORMAT = "%s-bootstrap"
+	MONGO_SEED_FORMAT              = "%s-mongo-seed"
+	MONGO_SEED_HOSTNAME            = "seed"
+)
+
+// MONGO_BOOTSTRAP_EXCLUDED_NAMESPACES are left out of the archive a cluster is bootstrapped from, the
+// admin user of the source would otherwise replace the one of the cluster.
+var MONGO_BOOTSTRAP_EXCLUDED_NAMESPACES = []string{"admin.system.users", "admin.system.roles"}
+
+// MONGO_SEED_SCRIPT runs the seed as a member of the source replica set, with the TLS and
+// authentication settings of the source cluster, the same way run.sh starts its members.
+const MONGO_SEED_SCRIPT = `set -e
+mkdir -p /data/db
+TLS_OPTIONS=""
+if [ -n "$MONGODB_TLS_MODE" ]; then
+  cat /etc/mongo-tls/tls.crt /etc/mongo-tls/tls.key > /tmp/mongod.pem
+  TLS_OPTIONS="--tlsMode $MONGODB_TLS_MODE --tlsCertificateKeyFile /tmp/mongod.pem --tlsCAFile /etc/mongo-tls/ca.crt --tlsAllowConnectionsWithoutCertificates"
+fi
+CLUSTER_AUTH_OPTIONS="--clusterAuthMode keyFile --keyFile /etc/secrets-volume/keyfile"
+if [ "$MONGODB_CLUSTER_AUTH_MODE" = "x509" ]; then
+  CLUSTER_AUTH_OPTIONS="--clusterAuthMode x509"
+fi
+exec /usr/bin/mongod --replSet "$MONGODB_REPLICA_SET" $TLS_OPTIONS --dbpath /data/db --bind_ip 0.0.0.0 $CLUSTER_AUTH_OPTIONS --setParameter authenticationMechanisms=${MONGODB_AUTH_MECHANISMS:-SCRAM-SHA-256} --auth
+`
+
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=create
+
+// bootstrap loads the data of spec.bootstrap into the new cluster once. It returns false while the
+// members must not be created yet, which is only the case while the claim of the first member is
+// seeded from a live cluster.
+func (m *MongoClusterService) bootstrap() (bool, error) {
+	bootstrap := m.AppConfig.Spec.Bootstrap
+	if bootstrap == nil {
+		return true, nil
+	}
+	if status := m.AppConfig.Status.Bootstrap; status != nil && (status.Phase == appsv1beta1.BootstrapCompleted || status.Phase == appsv1beta1.BootstrapFailed) {
+		if bootstrap.ClusterName != "" {
+			return m.deleteSeed(bootstrap.ClusterName)
+		}
+		return true, nil
+	}
+	switch {
+	case bootstrap.VolumeSnapshotName != "":
+		// The claim template of the StatefulSet references the snapshot, see createPersistentVolumeClaim.
+		m.setBootstrapStatus(appsv1beta1.BootstrapCompleted, fmt.Sprintf("Members provisioned from VolumeSnapshot %s", bootstrap.VolumeSnapshotName))
+		return true, nil
+	case bootstrap.Archive != nil:
+		return true, m.bootstrapFromArchive(*bootstrap.Archive)
+	default:
+		return m.seedFromCluster(bootstrap.ClusterName)
+	}
+}
+
+// bootstrapFromArchive hands the archive over to a MongoRestore, which waits for the cluster to be
+// available and pauses it while the archive is restored.
+func (m *MongoClusterService) bootstrapFromArchive(source appsv1beta1.RestoreSource) error {
+	name := fmt.Sprintf(MONGO_BOOTSTRAP_RESTORE_FORMAT, m.AppConfig.Name)
+	restore := &appsv1beta1.MongoRestore{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name, Namespace: m.Namespace}, restore)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting bootstrap MongoRestore")
+		return err
+	} else if errors.IsNotFound(err) {
+		restore = &appsv1beta1.MongoRestore{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: m.Namespace,
+			},
+			Spec: appsv1beta1.MongoRestoreSpec{
+				ClusterName: m.AppConfig.Name,
+				Source:      *source.DeepCopy(),
+				NsExclude:   MONGO_BOOTSTRAP_EXCLUDED_NAMESPACES,
+			},
+		}
+		if err := ctrl.SetControllerReference(m.AppConfig, restore, m.Reconciler.Scheme); err != nil {
+			m.Logger.Error(err, "Error setting MongoRestore owner reference")
+			return err
+		}
+		m.Logger.Info(fmt.Sprintf("Creating MongoRestore %s", name))
+		if err := m.Reconciler.Client.Create(*m.Context, restore); err != nil {
+			m.Logger.Error(err, "Error creating bootstrap MongoRestore")
+			return err
+		}
+		m.setBootstrapStatus(appsv1beta1.BootstrapRunning, fmt.Sprintf("Restoring the archive with MongoRestore %s", name))
+		return nil
+	}
+	switch restore.Status.Phase {
+	case appsv1beta1.MongoRestoreCompleted:
+		m.setBootstrapStatus(appsv1beta1.BootstrapCompleted, fmt.Sprintf("Archive restored by MongoRestore %s", name))
+	case appsv1beta1.MongoRestoreFailed:
+		m.setBootstrapStatus(appsv1beta1.BootstrapFailed, fmt.Sprintf("MongoRestore %s failed: %s", name, restore.Status.Message))
+	default:
+		m.setBootstrapStatus(appsv1beta1.BootstrapRunning, fmt.Sprintf("Restoring the archive with MongoRestore %s: %s", name, restore.Status.Message))
+	}
+	return nil
+}
+
+// seedFromCluster fills the claim of the first member before the StatefulSet exists. A temporary
+// seed member mounting the claim joins the source replica set as a hidden, non-voting member and
+// leaves it once its initial sync is over. The first member then starts on the synced data and
+// drops the configuration of the source, see first_run.sh.
+func (m *MongoClusterService) seedFromCluster(sourceName string) (bool, error) {
+	source := &appsv1beta1.MongoCluster{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: sourceName, Namespace: m.Namespace}, source)
+	if err != nil && errors.IsNotFound(err) {
+		m.setBootstrapStatus(appsv1beta1.BootstrapRunning, fmt.Sprintf("Waiting for MongoCluster %s", sourceName))
+		return false, nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting source MongoCluster")
+		return false, err
+	}
+	if source.Spec.Sharding != nil {
+		m.setBootstrapStatus(appsv1beta1.BootstrapFailed, fmt.Sprintf("MongoCluster %s is sharded, cloning sharded clusters is not supported", sourceName))
+		return true, nil
+	}
+	if source.Spec.TLS != nil && source.Spec.TLS.ExistingSecretName != "" {
+		m.setBootstrapStatus(appsv1beta1.BootstrapFailed, fmt.Sprintf("MongoCluster %s mounts an existing TLS secret, no certificate can be issued to the seed member", sourceName))
+		return true, nil
+	}
+	issued, err := m.createOrUpdateSeedCertificate(source)
+	if err != nil {
+		return false, err
+	} else if !issued {
+		m.setBootstrapStatus(appsv1beta1.BootstrapRunning, fmt.Sprintf("Waiting for the certificate of the seed member of MongoCluster %s", sourceName))
+		return false, nil
+	}
+	if err := m.createSeed(source); err != nil {
+		return false, err
+	}
+
+	adminClient, err := m.newSourceAdminClient(source)
+	if err != nil {
+		return false, err
+	}
+	defer adminClient.Disconnect(*m.Context)
+	seedHost := m.getSeedHost()
+	config, err := adminClient.GetReplicaSetConfig(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting source replica set configuration")
+		return false, err
+	}
+	if !hasMember(*config, seedHost) {
+		committed, err := adminClient.IsReplicaSetConfigCommitted(*m.Context)
+		if err != nil {
+			m.Logger.Error(err, "Error getting source replica set configuration commitment status")
+			return false, err
+		}
+		if !committed {
+			m.Logger.Info("Waiting for the source replica set configuration to be committed by a majority")
+			return false, nil
+		}
+		seed := mongoadmin.NewMember(0, seedHost)
+		seed.Hidden = true
+		seed.Priority = 0
+		seed.Votes = 0
+		nextConfig, _ := mongoadmin.NextConfig(*config, append(append([]mongoadmin.Member{}, config.Members...), seed))
+		m.Logger.Info(fmt.Sprintf("Adding seed member %s to replica set %s", seedHost, sourceName))
+		if err := adminClient.ReconfigureReplicaSet(*m.Context, nextConfig); err != nil {
+			m.Logger.Error(err, "Error adding seed member")
+			return false, err
+		}
+		m.setBootstrapStatus(appsv1beta1.BootstrapRunning, fmt.Sprintf("Seed member added to MongoCluster %s", sourceName))
+		return false, nil
+	}
+	status, err := adminClient.GetReplicaSetStatus(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting source replica set status")
+		return false, err
+	}
+	if member := status.Member(seedHost); member == nil || member.State != mongoadmin.MEMBER_STATE_SECONDARY {
+		state := "UNKNOWN"
+		if member != nil {
+			state = member.StateStr
+		}
+		m.setBootstrapStatus(appsv1beta1.BootstrapRunning, fmt.Sprintf("Initial sync from MongoCluster %s in progress, seed member is %s", sourceName, state))
+		return false, nil
+	}
+	m.setBootstrapStatus(appsv1beta1.BootstrapCompleted, fmt.Sprintf("First member initially synced from MongoCluster %s", sourceName))
+	return m.deleteSeed(sourceName)
+}
+
+// createSeed creates the claim of the first member, the headless service resolving the seed host and
+// the seed pod when they are missing.
+func (m *MongoClusterService) createSeed(source *appsv1beta1.MongoCluster) error {
+	claim, err := m.createPersistentVolumeClaim(getPersistentVolumeClaimName(m.ReplicaSet.Name, 0), m.AppConfig.Spec.Storage.StorageClassName)
+	if err != nil {
+		return err
+	}
+	if !m.pvcExists(*claim) {
+		m.Logger.Info(fmt.Sprintf("Creating PVC %s", claim.Name))
+		if err := m.Reconciler.Client.Create(*m.Context, claim); err != nil {
+			m.Logger.Error(err, "Error creating PVC")
+			return err
+		}
+	}
+	if err := m.createOrUpdateService(m.createSeedService()); err != nil {
+		return err
+	}
+	pod := &v1api.Pod{}
+	err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: getSeedName(m.ReplicaSet.Name), Namespace: m.Namespace}, pod)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting seed pod")
+		return err
+	} else if err == nil {
+		return nil
+	}
+	pod, err = m.createSeedPod(source, claim.Name)
+	if err != nil {
+		return err
+	}
+	m.Logger.Info(fmt.Sprintf("Creating seed pod %s", pod.Name))
+	if err := m.Reconciler.Client.Create(*m.Context, pod); err != nil {
+		m.Logger.Error(err, "Error creating seed pod")
+		return err
+	}
+	return nil
+}
+
+func (m *MongoClusterService) createSeedPod(source *appsv1beta1.MongoCluster, claimName string) (*v1api.Pod, error) {
+	resources, err := m.getResourceRequirements()
+	if err != nil {
+		m.Logger.Error(err, "Error parsing resources")
+		return nil, err
+	}
+	image := m.AppConfig.Spec.Image
+	if image == "" {
+		image = MONGO_CONTAINER_IMAGE
+	}
+	name := getSeedName(m.ReplicaSet.Name)
+	pod := &v1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			Labels:    map[string]string{"app": name},
+		},
+		Spec: v1api.PodSpec{
+			Hostname:  MONGO_SEED_HOSTNAME,
+			Subdomain: name,
+			Containers: []v1api.Container{
+				{
+					Name:      MONGO_CONTAINER_NAME,
+					Image:     image,
+					Resources: resources,
+					Env:       m.createSeedEnvVariables(source),
+					Ports:     []v1api.ContainerPort{{ContainerPort: MONGO_CONTAINER_PORT}},
+					Command:   []string{"/bin/bash", "-c"},
+					Args:      []string{MONGO_SEED_SCRIPT},
+					VolumeMounts: []v1api.VolumeMount{
+						{
+							Name:      MONGO_KEY_VOLUME_NAME,
+							MountPath: MONGO_KEY_MOUNT_PATH,
+							ReadOnly:  true,
+						},
+						{
+							Name:      MONGO_STORAGE_VOLUME_NAME,
+							MountPath: MONGO_STORAGE_MOUNT_PATH,
+						},
+					},
+				},
+			},
+			Volumes: []v1api.Volume{
+				getKeyfileVolume(source.Name),
+				{
+					Name: MONGO_STORAGE_VOLUME_NAME,
+					VolumeSource: v1api.VolumeSource{
+						PersistentVolumeClaim: &v1api.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+					},
+				},
+			},
+		},
+	}
+	if getTLSMode(source) != "" {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1api.Volume{
+			Name: MONGO_TLS_VOLUME_NAME,
+			VolumeSource: v1api.VolumeSource{
+				Secret: &v1api.SecretVolumeSource{
+					SecretName:  getCertificateName(name),
+					DefaultMode: &MONGO_KEY_SECRET_DEFAULT_MODE,
+				},
+			},
+		})
+		container := &pod.Spec.Containers[0]
+		container.VolumeMounts = append(container.VolumeMounts, v1api.VolumeMount{
+			Name:      MONGO_TLS_VOLUME_NAME,
+			MountPath: MONGO_TLS_MOUNT_PATH,
+			ReadOnly:  true,
+		})
+	}
+	if err := ctrl.SetControllerReference(m.AppConfig, pod, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting seed pod owner reference")
+		return nil, err
+	}
+	return pod, nil
+}
+
+// createSeedEnvVariables passes the replica set, the TLS mode and the authentication mechanisms of the
+// source cluster to the seed script.
+func (m *MongoClusterService) createSeedEnvVariables(source *appsv1beta1.MongoCluster) []v1api.EnvVar {
+	env := []v1api.EnvVar{{Name: "MONGODB_REPLICA_SET", Value: source.Name}}
+	if mode := getTLSMode(source); mode != "" {
+		env = append(env, v1api.EnvVar{Name: "MONGODB_TLS_MODE", Value: string(mode)})
+	}
+	return append(env, getAuthMechanismEnv(source)...)
+}
+
+// createOrUpdateSeedCertificate requests the certificate of the seed from the issuer or the CA of the
+// source cluster, whose members only trust the certificates it signs. It tells whether the certificate
+// has been issued, which is always the case when the source runs without TLS.
+func (m *MongoClusterService) createOrUpdateSeedCertificate(source *appsv1beta1.MongoCluster) (bool, error) {
+	name := getSeedName(m.ReplicaSet.Name)
+	sourceService := m.Reconciler.NewService(*m.Context, source, m.Namespace)
+	var requests []certificateRequest
+	if sourceService.issuesCertificates() {
+		seedHost := m.getSeedHost()
+		requests = append(requests, certificateRequest{
+			Name:               name,
+			CommonName:         name,
+			OrganizationalUnit: MONGO_MEMBER_ORGANIZATIONAL_UNIT,
+			DNSNames:           append([]string{seedHost[:strings.LastIndex(seedHost, ":")]}, getServiceDNSNames(name, m.Namespace)...),
+		})
+	}
+	return sourceService.createOrUpdateCertificates(name, requests)
+}
+
+// deleteSeedCertificate deletes the certificate of the seed, it belongs to the source cluster.
+func (m *MongoClusterService) deleteSeedCertificate(source *appsv1beta1.MongoCluster) error {
+	sourceService := m.Reconciler.NewService(*m.Context, source, m.Namespace)
+	_, err := sourceService.createOrUpdateCertificates(getSeedName(m.ReplicaSet.Name), nil)
+	return err
+}
+
+// createSeedService resolves the seed host before the seed is ready, the source members have to
+// reach it to sync it.
+func (m *MongoClusterService) createSeedService() *v1api.Service {
+	name := getSeedName(m.ReplicaSet.Name)
+	return &v1api.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+		},
+		Spec: v1api.ServiceSpec{
+			Type:                     v1api.ServiceTypeClusterIP,
+			ClusterIP:                v1api.ClusterIPNone,
+			PublishNotReadyAddresses: true,
+			Ports: []v1api.ServicePort{
+				{
+					Name:       MONGO_CONTAINER_NAME,
+					Port:       MONGO_CONTAINER_PORT,
+					TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: MONGO_CONTAINER_PORT},
+					Protocol:   v1api.ProtocolTCP,
+				},
+			},
+			Selector: map[string]string{"app": name},
+		},
+	}
+}
+
+// deleteSeed removes the seed member from the source replica set, then deletes the seed pod and its
+// service. It returns false until the pod is gone, the first member cannot mount the claim before.
+func (m *MongoClusterService) deleteSeed(sourceName string) (bool, error) {
+	pod := &v1api.Pod{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: getSeedName(m.ReplicaSet.Name), Namespace: m.Namespace}, pod)
+	if err != nil && errors.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting seed pod")
+		return false, err
+	}
+	if pod.DeletionTimestamp != nil {
+		return false, nil
+	}
+	source := &appsv1beta1.MongoCluster{}
+	err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: sourceName, Namespace: m.Namespace}, source)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting source MongoCluster")
+		return false, err
+	} else if err == nil {
+		if removed, err := m.removeSeedMember(source); err != nil || !removed {
+			return false, err
+		}
+		if err := m.deleteSeedCertificate(source); err != nil {
+			return false, err
+		}
+	}
+	m.Logger.Info(fmt.Sprintf("Deleting seed pod %s", pod.Name))
+	if err := m.Reconciler.Client.Delete(*m.Context, pod); client.IgnoreNotFound(err) != nil {
+		m.Logger.Error(err, "Error deleting seed pod")
+		return false, err
+	}
+	if err := m.Reconciler.Client.Delete(*m.Context, m.createSeedService()); client.IgnoreNotFound(err) != nil {
+		m.Logger.Error(err, "Error deleting seed service")
+		return false, err
+	}
+	return false, nil
+}
+
+// removeSeedMember returns true once the seed is not part of the source configuration any more.
+func (m *MongoClusterService) removeSeedMember(source *appsv1beta1.MongoCluster) (bool, error) {
+	adminClient, err := m.newSourceAdminClient(source)
+	if err != nil {
+		return false, err
+	}
+	defer adminClient.Disconnect(*m.Context)
+	config, err := adminClient.GetReplicaSetConfig(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting source replica set configuration")
+		return false, err
+	}
+	seedHost := m.getSeedHost()
+	if !hasMember(*config, seedHost) {
+		return true, nil
+	}
+	committed, err := adminClient.IsReplicaSetConfigCommitted(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting source replica set configuration commitment status")
+		return false, err
+	}
+	if !committed {
+		m.Logger.Info("Waiting for the source replica set configuration to be committed by a majority")
+		return false, nil
+	}
+	var members []mongoadmin.Member
+	for _, member := range config.Members {
+		if member.Host != seedHost {
+			members = append(members, member)
+		}
+	}
+	nextConfig, _ := mongoadmin.NextConfig(*config, members)
+	m.Logger.Info(fmt.Sprintf("Removing seed member %s from replica set %s", seedHost, source.Name))
+	if err := adminClient.ReconfigureReplicaSet(*m.Context, nextConfig); err != nil {
+		m.Logger.Error(err, "Error removing seed member")
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *MongoClusterService) newSourceAdminClient(source *appsv1beta1.MongoCluster) (mongoadmin.Client, error) {
+	var hosts []string
+	for i := 0; int32(i) < source.Spec.Replicas; i++ {
+		hosts = append(hosts, getMemberHost(source.Name, source.Namespace, i))
+	}
+	adminClient, err := newClusterAdminClient(*m.Context, m.Reconciler.Client, m.Reconciler.MongoAdmin, source, hosts, source.Name)
+	if err != nil {
+		m.Logger.Error(err, "Error connecting to the source cluster")
+		return nil, err
+	}
+	return adminClient, nil
+}
+
+func (m *MongoClusterService) getSeedHost() string {
+	return fmt.Sprintf("%s.%s.%s.svc.%s:%d", MONGO_SEED_HOSTNAME, getSeedName(m.ReplicaSet.Name), m.Namespace, MONGO_CLUSTER_DOMAIN, MONGO_CONTAINER_PORT)
+}
+
+func getSeedName(clusterName string) string {
+	return fmt.Sprintf(MONGO_SEED_FORMAT, clusterName)
+}
+
+// setBootstrapStatus records the progress of the bootstrap, the completion time is set when it is over.
+func (m *MongoClusterService) setBootstrapStatus(phase appsv1beta1.BootstrapPhase, message string) {
+	status := &appsv1beta1.BootstrapStatus{
+		Phase:   phase,
+		Message: message,
+	}
+	if phase == appsv1beta1.BootstrapCompleted || phase == appsv1beta1.BootstrapFailed {
+		now := metav1.Now()
+		status.CompletionTime = &now
+	}
+	m.BootstrapStatus = status
+}
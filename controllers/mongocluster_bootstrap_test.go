@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("bootstrap", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Name = "copy"
+		cluster.Spec.Storage.Size = "1Gi"
+		mongo = mongofake.NewClient()
+	})
+
+	get := func(service *MongoClusterService, name string, object client.Object) error {
+		return service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, object)
+	}
+
+	It("provisions the claims of the members from the snapshot", func() {
+		cluster.Spec.Bootstrap = &appsv1beta1.Bootstrap{VolumeSnapshotName: "nightly-snapshot"}
+		service := newTestService(cluster, mongo)
+		ready, err := service.bootstrap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+		Expect(service.BootstrapStatus.Phase).To(Equal(appsv1beta1.BootstrapCompleted))
+
+		claim, err := service.createPersistentVolumeClaim(getPersistentVolumeClaimName(cluster.Name, 0), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claim.Spec.DataSource.Kind).To(Equal("VolumeSnapshot"))
+		Expect(claim.Spec.DataSource.Name).To(Equal("nightly-snapshot"))
+	})
+
+	Context("from an archive", func() {
+		BeforeEach(func() {
+			cluster.Spec.Bootstrap = &appsv1beta1.Bootstrap{Archive: &appsv1beta1.RestoreSource{BackupName: "nightly"}}
+		})
+
+		It("restores the archive without its users and roles", func() {
+			service := newTestService(cluster, mongo)
+			ready, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeTrue())
+			Expect(service.BootstrapStatus.Phase).To(Equal(appsv1beta1.BootstrapRunning))
+			restore := &appsv1beta1.MongoRestore{}
+			Expect(get(service, "copy-bootstrap", restore)).To(Succeed())
+			Expect(restore.Spec.ClusterName).To(Equal(cluster.Name))
+			Expect(restore.Spec.Source.BackupName).To(Equal("nightly"))
+			Expect(restore.Spec.NsExclude).To(Equal([]string{"admin.system.users", "admin.system.roles"}))
+			Expect(restore.OwnerReferences).To(HaveLen(1))
+		})
+
+		It("follows the MongoRestore until it is over", func() {
+			restore := &appsv1beta1.MongoRestore{
+				ObjectMeta: metav1.ObjectMeta{Name: "copy-bootstrap", Namespace: testNamespace},
+				Status:     appsv1beta1.MongoRestoreStatus{Phase: appsv1beta1.MongoRestoreFailed, Message: "archive not found"},
+			}
+			service := newTestService(cluster, mongo, restore)
+			_, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.BootstrapStatus.Phase).To(Equal(appsv1beta1.BootstrapFailed))
+			Expect(service.BootstrapStatus.Message).To(ContainSubstring("archive not found"))
+
+			restore.Status = appsv1beta1.MongoRestoreStatus{Phase: appsv1beta1.MongoRestoreCompleted}
+			service = newTestService(cluster, mongo, restore)
+			_, err = service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.BootstrapStatus.Phase).To(Equal(appsv1beta1.BootstrapCompleted))
+			Expect(service.BootstrapStatus.CompletionTime).NotTo(BeNil())
+		})
+	})
+
+	Context("from a live cluster", func() {
+		var source *appsv1beta1.MongoCluster
+		var sourceSecret *v1api.Secret
+
+		BeforeEach(func() {
+			cluster.Spec.Bootstrap = &appsv1beta1.Bootstrap{ClusterName: "mongo"}
+			source = newTestCluster(3)
+			sourceSecret = &v1api.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: getPasswordSecretName(source), Namespace: testNamespace},
+				Data:       map[string][]byte{"password": []byte("secret")},
+			}
+			mongo.Config = newTestConfig(source, 3)
+		})
+
+		It("waits for the source cluster", func() {
+			service := newTestService(cluster, mongo)
+			ready, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeFalse())
+			Expect(service.BootstrapStatus.Message).To(Equal("Waiting for MongoCluster mongo"))
+		})
+
+		It("rejects sharded sources", func() {
+			source.Spec.Sharding = &appsv1beta1.Sharding{Shards: 2, MembersPerShard: 3, ConfigServers: 3, Routers: 1}
+			service := newTestService(cluster, mongo, source)
+			ready, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeTrue())
+			Expect(service.BootstrapStatus.Phase).To(Equal(appsv1beta1.BootstrapFailed))
+		})
+
+		It("joins the seed to the source as a hidden member without vote", func() {
+			service := newTestService(cluster, mongo, source, sourceSecret)
+			ready, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeFalse())
+			Expect(get(service, getPersistentVolumeClaimName(cluster.Name, 0), &v1api.PersistentVolumeClaim{})).To(Succeed())
+			Expect(get(service, "copy-mongo-seed", &v1api.Service{})).To(Succeed())
+			pod := &v1api.Pod{}
+			Expect(get(service, "copy-mongo-seed", pod)).To(Succeed())
+			Expect(pod.Spec.Containers[0].Env).To(ContainElement(v1api.EnvVar{Name: "MONGODB_REPLICA_SET", Value: "mongo"}))
+
+			Expect(mongo.Config.Members).To(HaveLen(4))
+			seed := mongo.Config.Members[3]
+			Expect(seed.Host).To(Equal(service.getSeedHost()))
+			Expect(seed.Hidden).To(BeTrue())
+			Expect(seed.Priority).To(BeZero())
+			Expect(seed.Votes).To(BeZero())
+		})
+
+		It("waits for the configuration of the source to be committed", func() {
+			mongo.Uncommitted = true
+			service := newTestService(cluster, mongo, source, sourceSecret)
+			ready, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeFalse())
+			Expect(mongo.Config.Members).To(HaveLen(3))
+		})
+
+		It("removes the seed once it is synced and starts the members on its claim", func() {
+			service := newTestService(cluster, mongo, source, sourceSecret)
+			_, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+
+			// The fake reports every member but the primary as SECONDARY, the seed is synced.
+			ready, err := service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeFalse())
+			Expect(service.BootstrapStatus.Phase).To(Equal(appsv1beta1.BootstrapCompleted))
+			Expect(memberHosts(mongo.Config)).NotTo(ContainElement(service.getSeedHost()))
+			Expect(errors.IsNotFound(get(service, "copy-mongo-seed", &v1api.Pod{}))).To(BeTrue())
+			Expect(errors.IsNotFound(get(service, "copy-mongo-seed", &v1api.Service{}))).To(BeTrue())
+			Expect(get(service, getPersistentVolumeClaimName(cluster.Name, 0), &v1api.PersistentVolumeClaim{})).To(Succeed())
+
+			cluster.Status.Bootstrap = service.BootstrapStatus
+			ready, err = service.bootstrap()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ready).To(BeTrue())
+		})
+	})
+})
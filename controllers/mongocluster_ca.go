@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"math/big"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+const (
+	MONGO_CA_SECRET_FORMAT = "%s-ca"
+	// MONGO_CA_VALIDITY is the lifetime of the CA of a cluster, it is generated once and not renewed
+	MONGO_CA_VALIDITY = 10 * 365 * 24 * time.Hour
+	// MONGO_CERTIFICATE_VALIDITY is the lifetime of the certificates issued from the CA, they are
+	// renewed once less than MONGO_CERTIFICATE_RENEW_BEFORE is left
+	MONGO_CERTIFICATE_VALIDITY     = 90 * 24 * time.Hour
+	MONGO_CERTIFICATE_RENEW_BEFORE = 30 * 24 * time.Hour
+)
+
+func getCASecretName(clusterName string) string {
+	return fmt.Sprintf(MONGO_CA_SECRET_FORMAT, clusterName)
+}
+
+// certificateAuthority is the CA the operator issues the certificates of a cluster from, when no
+// cert-manager issuer is referenced.
+type certificateAuthority struct {
+	Certificate    *x509.Certificate
+	CertificatePEM []byte
+	Key            crypto.Signer
+}
+
+// getClusterCA reads the CA of the cluster from its secret, nil when it has not been generated yet.
+func getClusterCA(ctx context.Context, c client.Client, mongoCluster *appsv1beta1.MongoCluster) (*certificateAuthority, error) {
+	secret := &v1api.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: getCASecretName(mongoCluster.Name), Namespace: mongoCluster.Namespace}, secret)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseCertificateAuthority(secret.Data[MONGO_TLS_CERTIFICATE_KEY], secret.Data[MONGO_TLS_PRIVATE_KEY_KEY])
+}
+
+// getOrCreateCA reads the CA of the cluster from its secret, generating it on first use. The secret
+// is owned by the cluster, the CA goes away with it.
+func (m *MongoClusterService) getOrCreateCA() (*certificateAuthority, error) {
+	ca, err := getClusterCA(*m.Context, m.Reconciler.Client, m.AppConfig)
+	if err != nil {
+		m.Logger.Error(err, "Error getting CA secret")
+		return nil, err
+	} else if ca != nil {
+		return ca, nil
+	}
+	m.Logger.Info(fmt.Sprintf("Generating the CA of cluster %s", m.AppConfig.Name))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   fmt.Sprintf("%s CA", m.AppConfig.Name),
+			Organization: []string{m.AppConfig.Name},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(MONGO_CA_VALIDITY),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER})
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	secret := &v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getCASecretName(m.AppConfig.Name),
+			Namespace: m.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: m.AppConfig.Name},
+		},
+		Type: v1api.SecretTypeTLS,
+		Data: map[string][]byte{
+			MONGO_TLS_CERTIFICATE_KEY: certificatePEM,
+			MONGO_TLS_PRIVATE_KEY_KEY: keyPEM,
+			MONGO_TLS_CA_KEY:          certificatePEM,
+		},
+	}
+	if err := ctrl.SetControllerReference(m.AppConfig, secret, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting CA secret owner reference")
+		return nil, err
+	}
+	if err := m.Reconciler.Client.Create(*m.Context, secret); err != nil {
+		m.Logger.Error(err, "Error creating CA secret")
+		return nil, err
+	}
+	return parseCertificateAuthority(certificatePEM, keyPEM)
+}
+
+func parseCertificateAuthority(certificatePEM []byte, keyPEM []byte) (*certificateAuthority, error) {
+	certificate, err := parseCertificate(certificatePEM)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no private key found in the CA secret")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("the CA private key cannot sign")
+	}
+	return &certificateAuthority{Certificate: certificate, CertificatePEM: certificatePEM, Key: signer}, nil
+}
+
+// createOrUpdateIssuedCertificate issues the certificate of the request from the CA of the cluster
+// and keeps it in its secret, labelled with the component it belongs to. The certificate is issued
+// again when it is about to expire, was not issued by the CA or no longer matches the request. The
+// pods mounting it pick the new certificate up through MONGO_TLS_HASH_ANNOTATION and are restarted.
+func (m *MongoClusterService) createOrUpdateIssuedCertificate(component string, request certificateRequest) error {
+	ca, err := m.getOrCreateCA()
+	if err != nil {
+		return err
+	}
+	secretName := getCertificateName(request.Name)
+	secret := &v1api.Secret{}
+	found, err := m.objectExists(secretName, secret)
+	if err != nil {
+		return err
+	}
+	if found && issuedCertificateUpToDate(ca, m.AppConfig.Name, request, secret) {
+		m.Logger.Info(fmt.Sprintf("Certificate %s is up to date. Nothing to do.", secretName))
+		return nil
+	}
+	m.Logger.Info(fmt.Sprintf("Issuing certificate %s", secretName))
+	certificatePEM, keyPEM, err := issueCertificate(ca, m.AppConfig.Name, request)
+	if err != nil {
+		m.Logger.Error(err, "Error issuing certificate")
+		return err
+	}
+	return m.createOrUpdateOwnedSecret(&v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: m.Namespace,
+			Labels: map[string]string{
+				MONGO_CLUSTER_LABEL:       m.AppConfig.Name,
+				MONGO_TLS_COMPONENT_LABEL: component,
+			},
+		},
+		Type: v1api.SecretTypeTLS,
+		Data: map[string][]byte{
+			MONGO_TLS_CERTIFICATE_KEY: certificatePEM,
+			MONGO_TLS_PRIVATE_KEY_KEY: keyPEM,
+			MONGO_TLS_CA_KEY:          ca.CertificatePEM,
+		},
+	})
+}
+
+// issuedCertificateUpToDate tells whether the certificate of the secret can be kept: it was issued by
+// the CA for the request and is not about to expire.
+func issuedCertificateUpToDate(ca *certificateAuthority, clusterName string, request certificateRequest, secret *v1api.Secret) bool {
+	if !bytes.Equal(secret.Data[MONGO_TLS_CA_KEY], ca.CertificatePEM) {
+		return false
+	}
+	certificate, err := parseCertificate(secret.Data[MONGO_TLS_CERTIFICATE_KEY])
+	if err != nil || certificate.CheckSignatureFrom(ca.Certificate) != nil {
+		return false
+	}
+	// A certificate already valid until the end of the CA cannot be renewed any further.
+	renewed := time.Until(certificate.NotAfter) > MONGO_CERTIFICATE_RENEW_BEFORE || !certificate.NotAfter.Before(ca.Certificate.NotAfter)
+	return renewed &&
+		reflect.DeepEqual(certificate.Subject.ToRDNSequence(), getCertificateSubject(clusterName, request).ToRDNSequence()) &&
+		reflect.DeepEqual(certificate.DNSNames, request.DNSNames)
+}
+
+// issueCertificate signs a new certificate and key for the request with the CA.
+func issueCertificate(ca *certificateAuthority, clusterName string, request certificateRequest) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Members use their certificate both to serve clients and to authenticate to the other members.
+	extKeyUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if request.ClientOnly {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	now := time.Now()
+	notAfter := now.Add(MONGO_CERTIFICATE_VALIDITY)
+	if notAfter.After(ca.Certificate.NotAfter) {
+		notAfter = ca.Certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               getCertificateSubject(clusterName, request),
+		DNSNames:              request.DNSNames,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, key.Public(), ca.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}), keyPEM, nil
+}
+
+// deleteStaleIssuedCertificates deletes the secrets of the certificates of the component issued by the
+// operator that are not expected anymore.
+func (m *MongoClusterService) deleteStaleIssuedCertificates(component string, expected map[string]bool) error {
+	secrets := &v1api.SecretList{}
+	err := m.Reconciler.Client.List(*m.Context, secrets, client.InNamespace(m.Namespace), client.MatchingLabels{
+		MONGO_CLUSTER_LABEL:       m.AppConfig.Name,
+		MONGO_TLS_COMPONENT_LABEL: component,
+	})
+	if err != nil {
+		m.Logger.Error(err, "Error listing certificate secrets")
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if expected[secret.Name] {
+			continue
+		}
+		m.Logger.Info(fmt.Sprintf("Deleting certificate secret %s", secret.Name))
+		if err := m.Reconciler.Client.Delete(*m.Context, secret); err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting certificate secret")
+			return err
+		}
+	}
+	return nil
+}
+
+func getCertificateSubject(clusterName string, request certificateRequest) pkix.Name {
+	return pkix.Name{
+		CommonName:         request.CommonName,
+		Organization:       []string{clusterName},
+		OrganizationalUnit: []string{request.OrganizationalUnit},
+	}
+}
+
+func parseCertificate(certificatePEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("certificate authority", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var service *MongoClusterService
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModeRequire}
+		service = newTestService(cluster, mongofake.NewClient())
+	})
+
+	getSecret := func(name string) (*v1api.Secret, error) {
+		secret := &v1api.Secret{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, secret)
+		return secret, err
+	}
+
+	memberSecretName := func(index string) string {
+		return getCertificateName(getResourceGenericName(cluster.Name, index))
+	}
+
+	getCertificate := func(secretName string) *x509.Certificate {
+		secret, err := getSecret(secretName)
+		Expect(err).NotTo(HaveOccurred())
+		certificate, err := parseCertificate(secret.Data[MONGO_TLS_CERTIFICATE_KEY])
+		Expect(err).NotTo(HaveOccurred())
+		return certificate
+	}
+
+	// storeCertificate replaces the certificate of the secret with one signed by the CA from the
+	// template.
+	storeCertificate := func(secretName string, ca *certificateAuthority, template *x509.Certificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		template.SerialNumber, err = newSerialNumber()
+		Expect(err).NotTo(HaveOccurred())
+		certificateDER, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, key.Public(), ca.Key)
+		Expect(err).NotTo(HaveOccurred())
+		secret, err := getSecret(secretName)
+		Expect(err).NotTo(HaveOccurred())
+		secret.Data[MONGO_TLS_CERTIFICATE_KEY] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER})
+		Expect(service.Reconciler.Client.Update(context.Background(), secret)).To(Succeed())
+	}
+
+	It("generates the CA of the cluster once", func() {
+		ca, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ca.Certificate.IsCA).To(BeTrue())
+		Expect(ca.Certificate.Subject.Organization).To(Equal([]string{cluster.Name}))
+		Expect(ca.Certificate.NotAfter).To(BeTemporally("~", time.Now().Add(MONGO_CA_VALIDITY), time.Minute))
+
+		secret, err := getSecret(getCASecretName(cluster.Name))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Type).To(Equal(v1api.SecretTypeTLS))
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.Data[MONGO_TLS_CA_KEY]).To(Equal(ca.CertificatePEM))
+
+		again, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.CertificatePEM).To(Equal(ca.CertificatePEM))
+	})
+
+	It("issues the certificates of the members from the CA", func() {
+		issued, err := service.createOrUpdateMemberCertificates(3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issued).To(BeTrue())
+		ca, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		secret, err := getSecret(memberSecretName("1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secret.Labels).To(HaveKeyWithValue(MONGO_TLS_COMPONENT_LABEL, cluster.Name))
+		Expect(secret.Data[MONGO_TLS_CA_KEY]).To(Equal(ca.CertificatePEM))
+		certificate := getCertificate(memberSecretName("1"))
+		Expect(certificate.CheckSignatureFrom(ca.Certificate)).To(Succeed())
+		Expect(certificate.Subject.CommonName).To(Equal(getResourceGenericName(cluster.Name, "1")))
+		Expect(certificate.Subject.Organization).To(Equal([]string{cluster.Name}))
+		Expect(certificate.Subject.OrganizationalUnit).To(Equal([]string{MONGO_MEMBER_ORGANIZATIONAL_UNIT}))
+		Expect(certificate.DNSNames).To(Equal(getMemberDNSNames(cluster.Name, testNamespace, 1)))
+		Expect(certificate.ExtKeyUsage).To(ConsistOf(x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth))
+		Expect(certificate.NotAfter).To(BeTemporally("~", time.Now().Add(MONGO_CERTIFICATE_VALIDITY), time.Minute))
+	})
+
+	It("issues a client only certificate to the operator", func() {
+		issued, err := service.createOrUpdateClientCertificate()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issued).To(BeTrue())
+		certificate := getCertificate(getCertificateName(getClientCertificateName(cluster.Name)))
+		Expect(certificate.Subject.CommonName).To(Equal(MONGODB_DEFAULT_USER))
+		Expect(certificate.Subject.OrganizationalUnit).To(Equal([]string{MONGO_OPERATOR_ORGANIZATIONAL_UNIT}))
+		Expect(certificate.ExtKeyUsage).To(Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}))
+	})
+
+	It("keeps the certificates until they are about to expire", func() {
+		_, err := service.createOrUpdateMemberCertificates(1)
+		Expect(err).NotTo(HaveOccurred())
+		ca, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		first := getCertificate(memberSecretName("0"))
+
+		_, err = service.createOrUpdateMemberCertificates(1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getCertificate(memberSecretName("0")).SerialNumber).To(Equal(first.SerialNumber))
+
+		template := *first
+		template.NotAfter = time.Now().Add(MONGO_CERTIFICATE_RENEW_BEFORE - time.Hour)
+		storeCertificate(memberSecretName("0"), ca, &template)
+		_, err = service.createOrUpdateMemberCertificates(1)
+		Expect(err).NotTo(HaveOccurred())
+		renewed := getCertificate(memberSecretName("0"))
+		Expect(renewed.SerialNumber).NotTo(Equal(first.SerialNumber))
+		Expect(renewed.NotAfter).To(BeTemporally("~", time.Now().Add(MONGO_CERTIFICATE_VALIDITY), time.Minute))
+	})
+
+	It("issues the certificates again when they no longer match their request", func() {
+		_, err := service.createOrUpdateMemberCertificates(1)
+		Expect(err).NotTo(HaveOccurred())
+		ca, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		first := getCertificate(memberSecretName("0"))
+
+		template := *first
+		template.DNSNames = []string{"elsewhere"}
+		storeCertificate(memberSecretName("0"), ca, &template)
+		_, err = service.createOrUpdateMemberCertificates(1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getCertificate(memberSecretName("0")).DNSNames).To(Equal(getMemberDNSNames(cluster.Name, testNamespace, 0)))
+	})
+
+	It("deletes the certificates of the removed members", func() {
+		_, err := service.createOrUpdateMemberCertificates(3)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = service.createOrUpdateMemberCertificates(2)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = getSecret(memberSecretName("1"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = getSecret(memberSecretName("2"))
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("connects with the CA bundle and the certificate of the operator", func() {
+		_, err := service.createOrUpdateMemberCertificates(3)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = service.createOrUpdateClientCertificate()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getTLSCASecretName(cluster)).To(Equal(getCASecretName(cluster.Name)))
+
+		config, err := getClusterTLSConfig(context.Background(), service.Reconciler.Client, cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Certificates).To(HaveLen(1))
+		memberHost := getMemberHost(cluster.Name, testNamespace, 2)
+		_, err = getCertificate(memberSecretName("2")).Verify(x509.VerifyOptions{
+			Roots:   config.RootCAs,
+			DNSName: memberHost[:strings.LastIndex(memberHost, ":")],
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/url"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strconv"
+	"strings"
+)
+
+const (
+	MONGO_CONNECTION_SECRET_FORMAT = "%s-connection"
+	// MONGO_PORT_NAME names the service ports so that they publish the _mongodb._tcp SRV records
+	MONGO_PORT_NAME = "mongodb"
+)
+
+func getConnectionSecretName(clusterName string) string {
+	return fmt.Sprintf(MONGO_CONNECTION_SECRET_FORMAT, clusterName)
+}
+
+// createOrUpdateConnectionSecret publishes the hosts and the admin credentials of the cluster, and its
+// CA bundle with TLS, so that applications can mount them instead of assembling the member addresses.
+// The secret is owned by the cluster and rewritten whenever the replicas or the password change.
+func (m *MongoClusterService) createOrUpdateConnectionSecret() error {
+	passwordSecret, err := m.createPasswordSecret()
+	if err != nil {
+		return err
+	}
+	password := string(passwordSecret.Data["password"])
+	hosts, replicaSet := getClientHosts(m.AppConfig)
+	expectedSecret := &v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getConnectionSecretName(m.AppConfig.Name),
+			Namespace: m.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: m.AppConfig.Name},
+		},
+		Data: map[string][]byte{
+			"username":   []byte(MONGODB_DEFAULT_USER),
+			"password":   []byte(password),
+			"hosts":      []byte(strings.Join(hosts, ",")),
+			"replicaSet": []byte(replicaSet),
+			"uri":        []byte(getConnectionURI(hosts, replicaSet, MONGODB_DEFAULT_USER, password, "", mongoadmin.ADMIN_DATABASE, useClientTLS(m.AppConfig))),
+			"srvUri":     []byte(getSrvConnectionURI(getSrvHost(m.AppConfig), replicaSet, MONGODB_DEFAULT_USER, password, mongoadmin.ADMIN_DATABASE, useClientTLS(m.AppConfig))),
+		},
+	}
+	// Clients outside of Kubernetes reach the members through their external hostname, the members
+	// answer them with the addresses of their horizon.
+	if externalHosts := getExternalHosts(m.AppConfig); externalHosts != nil {
+		expectedSecret.Data["externalHosts"] = []byte(strings.Join(externalHosts, ","))
+		expectedSecret.Data["externalUri"] = []byte(getConnectionURI(externalHosts, replicaSet, MONGODB_DEFAULT_USER, password, "", mongoadmin.ADMIN_DATABASE, true))
+	}
+	if err := m.addTLSCA(expectedSecret); err != nil {
+		return err
+	}
+	if err := m.createOrUpdateOwnedSecret(expectedSecret); err != nil {
+		return err
+	}
+	m.ConnectionSecretName = expectedSecret.Name
+	return nil
+}
+
+// addTLSCA adds the CA bundle of the cluster to a secret clients read, for them to verify the members,
+// once it is available.
+func (m *MongoClusterService) addTLSCA(secret *v1api.Secret) error {
+	if m.AppConfig.Spec.TLS == nil {
+		return nil
+	}
+	caSecret := &v1api.Secret{}
+	found, err := m.objectExists(getTLSCASecretName(m.AppConfig), caSecret)
+	if err != nil {
+		return err
+	}
+	if found && len(caSecret.Data[MONGO_TLS_CA_KEY]) > 0 {
+		secret.Data[MONGO_TLS_CA_KEY] = caSecret.Data[MONGO_TLS_CA_KEY]
+	}
+	return nil
+}
+
+// createOrUpdateOwnedSecret writes a secret derived from the cluster, owned by it so that it goes
+// away with it.
+func (m *MongoClusterService) createOrUpdateOwnedSecret(expectedSecret *v1api.Secret) error {
+	if err := ctrl.SetControllerReference(m.AppConfig, expectedSecret, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting secret owner reference")
+		return err
+	}
+	actualSecret := &v1api.Secret{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: expectedSecret.Name, Namespace: m.Namespace}, actualSecret)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting secret")
+		return err
+	} else if errors.IsNotFound(err) {
+		m.Logger.Info(fmt.Sprintf("Creating secret %s", expectedSecret.Name))
+		if err := m.Reconciler.Client.Create(*m.Context, expectedSecret); err != nil {
+			m.Logger.Error(err, "Error creating secret")
+			return err
+		}
+		return nil
+	} else if equality.Semantic.DeepEqual(actualSecret.Data, expectedSecret.Data) {
+		m.Logger.Info(fmt.Sprintf("Secret %s is up to date. Nothing to do.", expectedSecret.Name))
+		return nil
+	}
+	m.Logger.Info(fmt.Sprintf("Updating secret %s", expectedSecret.Name))
+	actualSecret.Data = expectedSecret.Data
+	actualSecret.OwnerReferences = expectedSecret.OwnerReferences
+	if err := m.Reconciler.Client.Update(*m.Context, actualSecret); err != nil {
+		m.Logger.Error(err, "Error updating secret")
+		return err
+	}
+	return nil
+}
+
+// findClustersForSecret requeues the clusters whose admin password or certificates are held by the
+// secret, so that their connection secret follows a new password and their pods a renewed certificate.
+func (r *MongoClusterReconciler) findClustersForSecret(secret client.Object) []reconcile.Request {
+	clusters := &appsv1beta1.MongoClusterList{}
+	if err := r.List(context.Background(), clusters, client.InNamespace(secret.GetNamespace())); err != nil {
+		logger.Error(err, "Error listing MongoClusters")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, cluster := range clusters.Items {
+		tls := cluster.Spec.TLS
+		if getPasswordSecretName(&cluster) == secret.GetName() ||
+			(tls != nil && tls.ExistingSecretName == secret.GetName()) ||
+			(tls != nil && secret.GetLabels()[MONGO_CLUSTER_LABEL] == cluster.Name) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: cluster.Name, Namespace: cluster.Namespace}})
+		}
+	}
+	return requests
+}
+
+// getClientHosts returns the hosts clients connect to and the replica set name to pass along, which
+// is empty for the routers of a sharded cluster.
+func getClientHosts(mongoCluster *appsv1beta1.MongoCluster) ([]string, string) {
+	if mongoCluster.Spec.Sharding != nil {
+		return []string{getRouterHost(mongoCluster.Name, mongoCluster.Namespace)}, ""
+	}
+	var hosts []string
+	for i := 0; int32(i) < mongoCluster.Spec.Replicas; i++ {
+		hosts = append(hosts, getMemberHost(mongoCluster.Name, mongoCluster.Namespace, i))
+	}
+	return hosts, mongoCluster.Name
+}
+
+// getSrvHost returns the service whose _mongodb._tcp records list the hosts of the cluster: the
+// headless service of the members, or the router service of a sharded cluster.
+func getSrvHost(mongoCluster *appsv1beta1.MongoCluster) string {
+	serviceName := getHeadlessServiceName(mongoCluster.Name)
+	if mongoCluster.Spec.Sharding != nil {
+		serviceName = getRouterName(mongoCluster.Name)
+	}
+	return fmt.Sprintf("%s.%s.svc.%s", serviceName, mongoCluster.Namespace, MONGO_CLUSTER_DOMAIN)
+}
+
+// getConnectionURI builds a mongodb:// URI, the credentials are escaped. The database is the default
+// database of the clients, empty for none.
+func getConnectionURI(hosts []string, replicaSet string, username string, password string, database string, authSource string, useTLS bool) string {
+	query := url.Values{}
+	query.Set("authSource", authSource)
+	if replicaSet != "" {
+		query.Set("replicaSet", replicaSet)
+	}
+	if useTLS {
+		query.Set("tls", "true")
+	}
+	uri := url.URL{
+		Scheme:   "mongodb",
+		User:     url.UserPassword(username, password),
+		Host:     strings.Join(hosts, ","),
+		Path:     "/" + database,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// getSrvConnectionURI builds a mongodb+srv:// URI. The services publish no TXT record, so the options
+// are passed along, and TLS, which SRV URIs turn on by default, is turned off explicitly when the
+// cluster does not use it.
+func getSrvConnectionURI(srvHost string, replicaSet string, username string, password string, authSource string, useTLS bool) string {
+	query := url.Values{}
+	query.Set("authSource", authSource)
+	if replicaSet != "" {
+		query.Set("replicaSet", replicaSet)
+	}
+	query.Set("tls", strconv.FormatBool(useTLS))
+	uri := url.URL{
+		Scheme:   "mongodb+srv",
+		User:     url.UserPassword(username, password),
+		Host:     srvHost,
+		Path:     "/",
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("createOrUpdateConnectionSecret", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(2)
+		cluster.Spec.Auth.Password = "p@ss"
+		mongo = mongofake.NewClient()
+	})
+
+	getSecret := func(service *MongoClusterService) *v1api.Secret {
+		secret := &v1api.Secret{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: "mongo-connection", Namespace: testNamespace}, secret)).To(Succeed())
+		return secret
+	}
+
+	It("publishes the hosts and the admin credentials of the replica set", func() {
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		Expect(service.ConnectionSecretName).To(Equal("mongo-connection"))
+
+		secret := getSecret(service)
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.OwnerReferences[0].Name).To(Equal(cluster.Name))
+		hosts := getMemberHost(cluster.Name, testNamespace, 0) + "," + getMemberHost(cluster.Name, testNamespace, 1)
+		Expect(secret.Data).To(HaveKeyWithValue("username", []byte(MONGODB_DEFAULT_USER)))
+		Expect(secret.Data).To(HaveKeyWithValue("password", []byte("p@ss")))
+		Expect(secret.Data).To(HaveKeyWithValue("hosts", []byte(hosts)))
+		Expect(secret.Data).To(HaveKeyWithValue("replicaSet", []byte("mongo")))
+		Expect(string(secret.Data["uri"])).To(Equal("mongodb://" + MONGODB_DEFAULT_USER + ":p%40ss@" + hosts + "/?authSource=admin&replicaSet=mongo"))
+		Expect(string(secret.Data["srvUri"])).To(Equal("mongodb+srv://" + MONGODB_DEFAULT_USER + ":p%40ss@" + getSrvHost(cluster) + "/?authSource=admin&replicaSet=mongo&tls=false"))
+		Expect(secret.Data).NotTo(HaveKey(MONGO_TLS_CA_KEY))
+	})
+
+	It("points the clients of a sharded cluster to its routers", func() {
+		cluster.Spec.Sharding = &appsv1beta1.Sharding{Shards: 2, MembersPerShard: 3, ConfigServers: 3, Routers: 2}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+
+		secret := getSecret(service)
+		Expect(secret.Data).To(HaveKeyWithValue("hosts", []byte(getRouterHost(cluster.Name, testNamespace))))
+		Expect(secret.Data).To(HaveKeyWithValue("replicaSet", []byte("")))
+		Expect(string(secret.Data["uri"])).NotTo(ContainSubstring("replicaSet"))
+		Expect(string(secret.Data["srvUri"])).To(ContainSubstring("@" + getRouterName(cluster.Name) + "."))
+	})
+
+	It("adds the CA bundle and turns TLS on once the clients must use it", func() {
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModeRequire}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		secret := getSecret(service)
+		Expect(string(secret.Data["uri"])).To(ContainSubstring("tls=true"))
+		Expect(string(secret.Data["srvUri"])).To(ContainSubstring("tls=true"))
+		Expect(secret.Data).NotTo(HaveKey(MONGO_TLS_CA_KEY))
+
+		caSecret := &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: getTLSCASecretName(cluster), Namespace: testNamespace},
+			Data:       map[string][]byte{MONGO_TLS_CA_KEY: []byte("ca")},
+		}
+		Expect(service.Reconciler.Client.Create(context.Background(), caSecret)).To(Succeed())
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		Expect(getSecret(service).Data).To(HaveKeyWithValue(MONGO_TLS_CA_KEY, []byte("ca")))
+	})
+
+	It("leaves TLS off while the members still accept clients without it", func() {
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModeAllow}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		secret := getSecret(service)
+		Expect(string(secret.Data["uri"])).NotTo(ContainSubstring("tls"))
+		Expect(string(secret.Data["srvUri"])).To(ContainSubstring("tls=false"))
+	})
+
+	It("follows the replicas and the password of the cluster", func() {
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+
+		cluster.Spec.Replicas = 3
+		cluster.Spec.Auth.Password = "n3w"
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		secret := getSecret(service)
+		hosts, _ := getClientHosts(cluster)
+		Expect(hosts).To(HaveLen(3))
+		Expect(secret.Data).To(HaveKeyWithValue("hosts", []byte(strings.Join(hosts, ","))))
+		Expect(secret.Data).To(HaveKeyWithValue("password", []byte("n3w")))
+	})
+
+	It("requeues the clusters of a changed password secret", func() {
+		cluster.Spec.Auth.ExistingSecretName = "shared-password"
+		other := newTestCluster(1)
+		other.Name = "other"
+		service := newTestService(cluster, mongo, other)
+		secret := &v1api.Secret{ObjectMeta: metav1.ObjectMeta{Name: "shared-password", Namespace: testNamespace}}
+		requests := service.Reconciler.findClustersForSecret(secret)
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Name).To(Equal(cluster.Name))
+	})
+})
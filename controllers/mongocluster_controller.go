@@ -19,11 +19,17 @@ package controllers
 import (
 	"context"
 	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
@@ -33,7 +39,8 @@ const (
 // MongoClusterReconciler reconciles a MongoCluster object
 type MongoClusterReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme     *runtime.Scheme
+	MongoAdmin mongoadmin.Factory
 }
 
 var logger = logf.Log.WithName("controller_mongocluster")
@@ -41,14 +48,16 @@ var logger = logf.Log.WithName("controller_mongocluster")
 //+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoclusters,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoclusters/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoclusters/finalizers,verbs=update
-//+kubebuilder:rbac:groups=*,resources=deployments;services;secrets;persistentvolumeclaims;configmaps,verbs=get;list;create;update;watch;delete
+//+kubebuilder:rbac:groups=*,resources=deployments;statefulsets;services;secrets;persistentvolumeclaims;configmaps,verbs=get;list;create;update;watch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;watch;update
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;delete;patch
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongorestores,verbs=get;list;watch;create
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the MongoCluster object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.13.0/pkg/reconcile
@@ -77,6 +86,7 @@ func (r *MongoClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 				return ctrl.Result{}, err
 			}
 		}
+		return ctrl.Result{}, nil
 	} else {
 		if !thereIsFinalizer {
 			controllerutil.AddFinalizer(&mongoCluster, finalizerName)
@@ -85,16 +95,31 @@ func (r *MongoClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request
 			}
 		}
 	}
-	if err := mongoService.CreateOrUpdate(); err != nil {
+	paused, err := mongoService.isPausedByRestore()
+	if err != nil {
 		return ctrl.Result{}, err
 	}
-
-	return ctrl.Result{}, nil
+	if paused {
+		logger.Info("A restore is running against the cluster. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	result, err := mongoService.CreateOrUpdate()
+	if statusErr := mongoService.UpdateStatus(result, err); statusErr != nil && err == nil {
+		return ctrl.Result{}, statusErr
+	}
+	return result, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *MongoClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&appsv1beta1.MongoCluster{}).
+		Owns(&v1.StatefulSet{}).
+		Owns(&v1.Deployment{}).
+		Owns(&v1api.Service{}).
+		Owns(&batchv1.CronJob{}).
+		Owns(&appsv1beta1.MongoRestore{}).
+		Owns(&v1api.Secret{}).
+		Watches(&source.Kind{Type: &v1api.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.findClustersForSecret)).
 		Complete(r)
 }
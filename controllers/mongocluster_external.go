@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"strings"
+)
+
+const (
+	MONGO_EXTERNAL_SERVICE_FORMAT = "%d-external"
+)
+
+func getExternalServiceName(replicaSet string, index int) string {
+	return getResourceGenericName(replicaSet, fmt.Sprintf(MONGO_EXTERNAL_SERVICE_FORMAT, index))
+}
+
+// createOrUpdateExternalServices exposes every member of m.ReplicaSet outside of Kubernetes when
+// spec.externalAccess is set, and records the external address of the members known so far in
+// m.ExternalHosts. The services of the removed members, or of every member once the external access
+// is disabled, are deleted.
+func (m *MongoClusterService) createOrUpdateExternalServices() error {
+	m.ExternalHosts = map[int]string{}
+	externalAccess := m.AppConfig.Spec.ExternalAccess
+	if externalAccess == nil {
+		return m.deleteExternalServices(0)
+	}
+	for i := 0; int32(i) < m.ReplicaSet.Replicas; i++ {
+		expectedService := m.createExternalService(i)
+		if err := m.createOrUpdateService(expectedService); err != nil {
+			return err
+		}
+		service := m.getStackService(expectedService.Name)
+		if service == nil {
+			continue
+		}
+		if host := getExternalHost(externalAccess, i, service); host != "" {
+			m.ExternalHosts[i] = host
+		} else {
+			m.Logger.Info(fmt.Sprintf("Waiting for service %s to be allocated a node port", service.Name))
+		}
+	}
+	return m.deleteExternalServices(int(m.ReplicaSet.Replicas))
+}
+
+// createExternalService exposes a single member on the type of service asked by spec.externalAccess.
+func (m *MongoClusterService) createExternalService(index int) *v1api.Service {
+	externalAccess := m.AppConfig.Spec.ExternalAccess
+	serviceType := v1api.ServiceType(externalAccess.Type)
+	if serviceType == "" {
+		serviceType = v1api.ServiceTypeLoadBalancer
+	}
+	return m.newService(
+		getExternalServiceName(m.ReplicaSet.Name, index),
+		map[string]string{
+			"app":                                getStatefulSetName(m.ReplicaSet.Name),
+			"statefulset.kubernetes.io/pod-name": getResourceGenericName(m.ReplicaSet.Name, fmt.Sprintf("%d", index)),
+		},
+		serviceType,
+		nil,
+		externalAccess.Annotations,
+		externalAccess.LoadBalancerSourceRanges,
+	)
+}
+
+// getExternalHost returns the address of a member outside of Kubernetes, its hostname from the spec
+// and the port of its service. It is empty until the node port of the service is allocated.
+func getExternalHost(externalAccess *appsv1beta1.ExternalAccess, index int, service *v1api.Service) string {
+	if index >= len(externalAccess.Hostnames) {
+		return ""
+	}
+	port := MONGO_CONTAINER_PORT
+	if service.Spec.Type == v1api.ServiceTypeNodePort {
+		if len(service.Spec.Ports) == 0 || service.Spec.Ports[0].NodePort == 0 {
+			return ""
+		}
+		port = service.Spec.Ports[0].NodePort
+	}
+	return fmt.Sprintf("%s:%d", externalAccess.Hostnames[index], port)
+}
+
+// getExternalHostname strips the port of the external address of a member, for its certificate.
+func (m *MongoClusterService) getExternalHostname(index int) string {
+	host, found := m.ExternalHosts[index]
+	if !found {
+		return ""
+	}
+	return host[:strings.LastIndex(host, ":")]
+}
+
+// getHorizons returns the horizons of a member, nil when the cluster has no external access or the
+// external address of the member is not known yet.
+func (m *MongoClusterService) getHorizons(index int) map[string]string {
+	externalAccess := m.AppConfig.Spec.ExternalAccess
+	host, found := m.ExternalHosts[index]
+	if externalAccess == nil || !found {
+		return nil
+	}
+	horizonName := externalAccess.HorizonName
+	if horizonName == "" {
+		horizonName = appsv1beta1.DEFAULT_HORIZON_NAME
+	}
+	return map[string]string{horizonName: host}
+}
+
+// keepConsistentHorizons falls back to the configured horizons of every member while the external
+// address of one of them is missing: MongoDB refuses a configuration whose members do not all have
+// the same horizon names.
+func (m *MongoClusterService) keepConsistentHorizons(members []mongoadmin.Member, config *mongoadmin.ReplicaSetConfig) []mongoadmin.Member {
+	consistent := true
+	for _, member := range members {
+		consistent = consistent && len(member.Horizons) == len(members[0].Horizons)
+		for name := range members[0].Horizons {
+			_, found := member.Horizons[name]
+			consistent = consistent && found
+		}
+	}
+	if consistent {
+		return members
+	}
+	m.Logger.Info("Waiting for the external address of every member before changing the horizons")
+	configuredHorizons := map[string]map[string]string{}
+	for _, member := range config.Members {
+		configuredHorizons[member.Host] = member.Horizons
+	}
+	for i := range members {
+		members[i].Horizons = configuredHorizons[members[i].Host]
+	}
+	return members
+}
+
+// getExternalHosts lists the external addresses of the members recorded in the status, nil until
+// every member has one.
+func getExternalHosts(cluster *appsv1beta1.MongoCluster) []string {
+	if cluster.Spec.ExternalAccess == nil || cluster.Spec.Sharding != nil {
+		return nil
+	}
+	externalHosts := map[string]string{}
+	for _, member := range cluster.Status.Members {
+		externalHosts[member.Name] = member.ExternalHost
+	}
+	var hosts []string
+	for i := 0; int32(i) < cluster.Spec.Replicas; i++ {
+		host := externalHosts[getResourceGenericName(cluster.Name, fmt.Sprintf("%d", i))]
+		if host == "" {
+			return nil
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// deleteExternalServices deletes the external services of the members from the given index on.
+func (m *MongoClusterService) deleteExternalServices(from int) error {
+	for i := from; ; i++ {
+		service := &v1api.Service{}
+		found, err := m.objectExists(getExternalServiceName(m.ReplicaSet.Name, i), service)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		m.Logger.Info(fmt.Sprintf("Deleting external service %s", service.Name))
+		if err := m.Reconciler.Client.Delete(*m.Context, service); err != nil && !apierrors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting external service")
+			return err
+		}
+	}
+}
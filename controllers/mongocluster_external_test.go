@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("external access", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	hostnames := []string{"a.example.com", "b.example.com", "c.example.com"}
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModeRequire}
+		cluster.Spec.ExternalAccess = &appsv1beta1.ExternalAccess{Type: appsv1beta1.ServiceTypeLoadBalancer, Hostnames: hostnames}
+		mongo = mongofake.NewClient()
+	})
+
+	getService := func(service *MongoClusterService, index int) (*v1api.Service, error) {
+		actual := &v1api.Service{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: getExternalServiceName(cluster.Name, index), Namespace: testNamespace}, actual)
+		return actual, err
+	}
+
+	readyMembers := func(count int) []client.Object {
+		var pods []client.Object
+		for i := 0; i < count; i++ {
+			pods = append(pods, newMemberPod(cluster, i, true, "v1"))
+		}
+		return pods
+	}
+
+	It("exposes every member on a load balancer of its own", func() {
+		cluster.Spec.ExternalAccess.Annotations = map[string]string{"external-dns.alpha.kubernetes.io/hostname": "mongo.example.com"}
+		cluster.Spec.ExternalAccess.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+
+		for i := 0; i < 3; i++ {
+			external, err := getService(service, i)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(external.Spec.Type).To(Equal(v1api.ServiceTypeLoadBalancer))
+			Expect(external.Spec.Selector).To(HaveKeyWithValue("statefulset.kubernetes.io/pod-name", getResourceGenericName(cluster.Name, fmt.Sprintf("%d", i))))
+			Expect(external.Spec.LoadBalancerSourceRanges).To(Equal([]string{"10.0.0.0/8"}))
+			Expect(external.Annotations).To(HaveKeyWithValue("external-dns.alpha.kubernetes.io/hostname", "mongo.example.com"))
+		}
+		Expect(service.ExternalHosts).To(Equal(map[int]string{
+			0: "a.example.com:27017",
+			1: "b.example.com:27017",
+			2: "c.example.com:27017",
+		}))
+		Expect(service.getExternalHostname(1)).To(Equal("b.example.com"))
+	})
+
+	It("waits for the node ports to advertise the members", func() {
+		cluster.Spec.ExternalAccess.Type = appsv1beta1.ServiceTypeNodePort
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+		Expect(service.ExternalHosts).To(BeEmpty())
+		Expect(service.getHorizons(0)).To(BeNil())
+
+		allocated, err := getService(service, 0)
+		Expect(err).NotTo(HaveOccurred())
+		allocated.Spec.Ports[0].NodePort = 31000
+		Expect(service.Reconciler.Client.Update(context.Background(), allocated)).To(Succeed())
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+		Expect(service.ExternalHosts).To(Equal(map[int]string{0: "a.example.com:31000"}))
+		Expect(service.getNodePorts()).To(ContainElement(appsv1beta1.ServiceNodePort{Name: getExternalServiceName(cluster.Name, 0), NodePort: 31000}))
+	})
+
+	It("deletes the services of the removed members and of a disabled access", func() {
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+
+		cluster.Spec.Replicas = 2
+		service.ReplicaSet.Replicas = 2
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+		_, err := getService(service, 1)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = getService(service, 2)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+
+		cluster.Spec.ExternalAccess = nil
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+		_, err = getService(service, 0)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		Expect(service.ExternalHosts).To(BeEmpty())
+	})
+
+	It("sets the horizons of every member in a single reconfig", func() {
+		mongo.Config = newTestConfig(cluster, 3)
+		service := newTestService(cluster, mongo, readyMembers(3)...)
+		_, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		service.ExternalHosts = map[int]string{0: "a.example.com:27017", 1: "b.example.com:27017"}
+		_, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Commands).NotTo(ContainElement("replSetReconfig"))
+
+		cluster.Spec.ExternalAccess.HorizonName = "public"
+		service.ExternalHosts[2] = "c.example.com:27017"
+		_, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Config.Version).To(BeEquivalentTo(2))
+		for i, member := range mongo.Config.Members {
+			Expect(member.Horizons).To(Equal(map[string]string{"public": hostnames[i] + ":27017"}))
+		}
+	})
+
+	It("only adds a member once its external address is known", func() {
+		mongo.Config = newTestConfig(cluster, 2)
+		for i := range mongo.Config.Members {
+			mongo.Config.Members[i].Horizons = map[string]string{appsv1beta1.DEFAULT_HORIZON_NAME: hostnames[i] + ":27017"}
+		}
+		service := newTestService(cluster, mongo, readyMembers(3)...)
+		_, err := service.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		service.ExternalHosts = map[int]string{0: "a.example.com:27017", 1: "b.example.com:27017"}
+		_, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Config.Members).To(HaveLen(2))
+
+		service.ExternalHosts[2] = "c.example.com:27017"
+		_, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Config.Members).To(HaveLen(3))
+		Expect(mongo.Config.Members[2].Horizons).To(Equal(map[string]string{appsv1beta1.DEFAULT_HORIZON_NAME: "c.example.com:27017"}))
+	})
+
+	It("adds the external hostname to the certificate of the member", func() {
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateExternalServices()).To(Succeed())
+		_, err := service.createOrUpdateMemberCertificates(3)
+		Expect(err).NotTo(HaveOccurred())
+		secret := &v1api.Secret{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: getCertificateName(getResourceGenericName(cluster.Name, "2")), Namespace: testNamespace}, secret)).To(Succeed())
+		certificate, err := parseCertificate(secret.Data[MONGO_TLS_CERTIFICATE_KEY])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certificate.DNSNames).To(ContainElement("c.example.com"))
+		Expect(certificate.DNSNames).To(ContainElements(getMemberDNSNames(cluster.Name, testNamespace, 2)))
+	})
+
+	It("publishes the external addresses once every member has one", func() {
+		for i := 0; i < 2; i++ {
+			cluster.Status.Members = append(cluster.Status.Members, appsv1beta1.MemberStatus{
+				Name:         getResourceGenericName(cluster.Name, fmt.Sprintf("%d", i)),
+				ExternalHost: hostnames[i] + ":27017",
+			})
+		}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		secret := &v1api.Secret{}
+		key := types.NamespacedName{Name: getConnectionSecretName(cluster.Name), Namespace: testNamespace}
+		Expect(service.Reconciler.Client.Get(context.Background(), key, secret)).To(Succeed())
+		Expect(secret.Data).NotTo(HaveKey("externalHosts"))
+
+		cluster.Status.Members = append(cluster.Status.Members, appsv1beta1.MemberStatus{
+			Name:         getResourceGenericName(cluster.Name, "2"),
+			ExternalHost: "c.example.com:27017",
+		})
+		Expect(service.createOrUpdateConnectionSecret()).To(Succeed())
+		Expect(service.Reconciler.Client.Get(context.Background(), key, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue("externalHosts", []byte("a.example.com:27017,b.example.com:27017,c.example.com:27017")))
+		Expect(string(secret.Data["externalUri"])).To(HavePrefix("mongodb://" + MONGODB_DEFAULT_USER + ":"))
+		Expect(string(secret.Data["externalUri"])).To(ContainSubstring("@a.example.com:27017,b.example.com:27017,c.example.com:27017/"))
+		Expect(string(secret.Data["externalUri"])).To(ContainSubstring("tls=true"))
+	})
+})
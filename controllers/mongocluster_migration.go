@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+)
+
+const (
+	MONGO_ORIGINAL_RECLAIM_POLICY_ANNOTATION = "apps.esgi.fr/original-reclaim-policy"
+)
+
+// migrateLegacyMembers moves clusters created with one Deployment and one claim per member over to
+// the StatefulSet layout. The legacy Deployments are removed and the volume bound to each legacy
+// `<name>-mongo-<i>` claim is re-bound to the claim the StatefulSet expects for the same ordinal, so
+// members restart on their existing data. It returns true once there is nothing left to migrate.
+func (m *MongoClusterService) migrateLegacyMembers() (bool, error) {
+	migrated := true
+	for i := 0; ; i++ {
+		legacyName := getResourceGenericName(m.AppConfig.Name, strconv.Itoa(i))
+		deploymentFound, err := m.deleteLegacyDeployment(legacyName)
+		if err != nil {
+			return false, err
+		}
+		legacyPVC := &v1api.PersistentVolumeClaim{}
+		err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: legacyName, Namespace: m.Namespace}, legacyPVC)
+		if err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error getting legacy PVC")
+			return false, err
+		}
+		legacyPVCFound := err == nil
+		if !deploymentFound && !legacyPVCFound && int32(i) >= m.AppConfig.Spec.Replicas {
+			break
+		}
+		if deploymentFound {
+			migrated = false
+		}
+		done, err := m.adoptLegacyVolume(i, legacyPVC, legacyPVCFound)
+		if err != nil {
+			return false, err
+		}
+		migrated = migrated && done
+	}
+	return migrated, nil
+}
+
+func (m *MongoClusterService) deleteLegacyDeployment(name string) (bool, error) {
+	deployment := &v1.Deployment{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name, Namespace: m.Namespace}, deployment)
+	if err != nil && errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting legacy deployment")
+		return false, err
+	}
+	if deployment.DeletionTimestamp.IsZero() {
+		m.Logger.Info(fmt.Sprintf("Deleting legacy deployment %s", name))
+		if err := m.Reconciler.Client.Delete(*m.Context, deployment); err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting legacy deployment")
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// adoptLegacyVolume walks one member through the re-binding steps. Each call performs the next step
+// only, so the migration survives operator restarts and resumes from the state found in the cluster.
+func (m *MongoClusterService) adoptLegacyVolume(index int, legacyPVC *v1api.PersistentVolumeClaim, legacyPVCFound bool) (bool, error) {
+	pvcName := getPersistentVolumeClaimName(m.AppConfig.Name, index)
+	pvc := &v1api.PersistentVolumeClaim{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: pvcName, Namespace: m.Namespace}, pvc)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting PVC")
+		return false, err
+	}
+	pvcFound := err == nil
+
+	if legacyPVCFound {
+		if legacyPVC.Spec.VolumeName == "" {
+			// Never bound, there is no data to carry over.
+			m.Logger.Info(fmt.Sprintf("Deleting unbound legacy PVC %s", legacyPVC.Name))
+			return false, client.IgnoreNotFound(m.Reconciler.Client.Delete(*m.Context, legacyPVC))
+		}
+		volume, err := m.getPersistentVolume(legacyPVC.Spec.VolumeName)
+		if err != nil {
+			return false, err
+		}
+		if err := m.retainPersistentVolume(volume); err != nil {
+			return false, err
+		}
+		if !pvcFound {
+			m.Logger.Info(fmt.Sprintf("Creating PVC %s for legacy volume %s", pvcName, volume.Name))
+			pvc = &v1api.PersistentVolumeClaim{}
+			pvc.Name = pvcName
+			pvc.Namespace = m.Namespace
+			pvc.Spec = *legacyPVC.Spec.DeepCopy()
+			pvc.Spec.StorageClassName = &volume.Spec.StorageClassName
+			if err := m.Reconciler.Client.Create(*m.Context, pvc); err != nil {
+				m.Logger.Error(err, "Error creating PVC")
+				return false, err
+			}
+		}
+		if legacyPVC.DeletionTimestamp.IsZero() {
+			m.Logger.Info(fmt.Sprintf("Deleting legacy PVC %s", legacyPVC.Name))
+			if err := m.Reconciler.Client.Delete(*m.Context, legacyPVC); err != nil && !errors.IsNotFound(err) {
+				m.Logger.Error(err, "Error deleting legacy PVC")
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	if !pvcFound || pvc.Spec.VolumeName == "" {
+		return true, nil
+	}
+	volume, err := m.getPersistentVolume(pvc.Spec.VolumeName)
+	if err != nil {
+		return false, err
+	}
+	if pvc.Status.Phase != v1api.ClaimBound {
+		if volume.Spec.ClaimRef == nil || volume.Spec.ClaimRef.Name != pvc.Name || volume.Spec.ClaimRef.UID != pvc.UID {
+			m.Logger.Info(fmt.Sprintf("Binding volume %s to PVC %s", volume.Name, pvc.Name))
+			volume.Spec.ClaimRef = &v1api.ObjectReference{
+				Kind:       "PersistentVolumeClaim",
+				APIVersion: "v1",
+				Namespace:  pvc.Namespace,
+				Name:       pvc.Name,
+				UID:        pvc.UID,
+			}
+			if err := m.Reconciler.Client.Update(*m.Context, volume); err != nil {
+				m.Logger.Error(err, "Error updating persistent volume")
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	return true, m.restorePersistentVolumeReclaimPolicy(volume)
+}
+
+func (m *MongoClusterService) getPersistentVolume(name string) (*v1api.PersistentVolume, error) {
+	volume := &v1api.PersistentVolume{}
+	if err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name}, volume); err != nil {
+		m.Logger.Error(err, fmt.Sprintf("Error getting persistent volume %s", name))
+		return nil, err
+	}
+	return volume, nil
+}
+
+// retainPersistentVolume prevents the volume from being recycled while it is briefly released
+// between the deletion of the legacy claim and the binding of the new one.
+func (m *MongoClusterService) retainPersistentVolume(volume *v1api.PersistentVolume) error {
+	if volume.Spec.PersistentVolumeReclaimPolicy == v1api.PersistentVolumeReclaimRetain {
+		return nil
+	}
+	if volume.Annotations == nil {
+		volume.Annotations = map[string]string{}
+	}
+	volume.Annotations[MONGO_ORIGINAL_RECLAIM_POLICY_ANNOTATION] = string(volume.Spec.PersistentVolumeReclaimPolicy)
+	volume.Spec.PersistentVolumeReclaimPolicy = v1api.PersistentVolumeReclaimRetain
+	m.Logger.Info(fmt.Sprintf("Retaining persistent volume %s during migration", volume.Name))
+	if err := m.Reconciler.Client.Update(*m.Context, volume); err != nil {
+		m.Logger.Error(err, "Error updating persistent volume")
+		return err
+	}
+	return nil
+}
+
+func (m *MongoClusterService) restorePersistentVolumeReclaimPolicy(volume *v1api.PersistentVolume) error {
+	policy, found := volume.Annotations[MONGO_ORIGINAL_RECLAIM_POLICY_ANNOTATION]
+	if !found {
+		return nil
+	}
+	delete(volume.Annotations, MONGO_ORIGINAL_RECLAIM_POLICY_ANNOTATION)
+	volume.Spec.PersistentVolumeReclaimPolicy = v1api.PersistentVolumeReclaimPolicy(policy)
+	m.Logger.Info(fmt.Sprintf("Restoring reclaim policy %s on persistent volume %s", policy, volume.Name))
+	if err := m.Reconciler.Client.Update(*m.Context, volume); err != nil {
+		m.Logger.Error(err, "Error updating persistent volume")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	MONGO_OPLOG_CRON_JOB_FORMAT       = "%s-oplog"
+	MONGO_OPLOG_ARCHIVE_LABEL         = "apps.esgi.fr/oplog-archive"
+	MONGO_OPLOG_POSITION_CONTAINER    = "oplog-position"
+	MONGO_OPLOG_DUMP_CONTAINER        = "oplog-dump"
+	MONGO_OPLOG_UPLOAD_CONTAINER      = "upload"
+	MONGO_OPLOG_WORK_VOLUME_NAME      = "oplog"
+	MONGO_OPLOG_WORK_MOUNT_PATH       = "/oplog"
+	MONGO_OPLOG_DIRECTORY             = "oplog"
+	REASON_OPLOG_ARCHIVED             = "OplogArchived"
+	REASON_OPLOG_GAP                  = "OplogGap"
+	MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL = 4294967295
+)
+
+// The oplog archive is made of chunks named <first>-<last>.bson.gz after the timestamps of the first
+// and last entries they hold, and of empty gap markers named <from>-<to> after the entries archived
+// right before and right after entries that were dropped from the oplog before being archived. The
+// timestamps are formatted as <t>.<i> with both parts padded to 10 digits, so that names sort in
+// timestamp order.
+
+// MONGO_OPLOG_S3_POSITION_SCRIPT finds the last entry archived in the bucket.
+const MONGO_OPLOG_S3_POSITION_SCRIPT = `set -e
+mc alias set store "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+LAST=$(mc ls "store/$S3_BUCKET/$OPLOG_DIR/chunks/" 2> /dev/null | while read -r line; do echo "${line##* }"; done | grep '\.bson\.gz$' | sort | tail -n 1 || true)
+LAST=${LAST%.bson.gz}
+echo "${LAST#*-}" > "$WORK_DIR/position"
+`
+
+// MONGO_OPLOG_PVC_POSITION_SCRIPT finds the last entry archived in the claim.
+const MONGO_OPLOG_PVC_POSITION_SCRIPT = `set -eo pipefail
+LAST=$(ls -1 "$OPLOG_PATH/chunks" 2> /dev/null | grep '\.bson\.gz$' | sort | tail -n 1 || true)
+LAST=${LAST%.bson.gz}
+echo "${LAST#*-}" > "$WORK_DIR/position"
+`
+
+// MONGO_OPLOG_DUMP_SCRIPT dumps the oplog entries following the last one archived from a secondary.
+// When that entry is no longer in the oplog, the entries following it were dropped before being
+// archived and a gap marker is written. The last entry archived and the gap found are left in the
+// termination message of the container.
+const MONGO_OPLOG_DUMP_SCRIPT = "set -eo pipefail\n" + MONGO_CLIENT_AUTH_SCRIPT + `ts_fmt() { printf '%010d.%010d' "$1" "$2"; }
+ts_json() { printf '{"t":%d,"i":%d}' "$((10#${1%.*}))" "$((10#${1#*.}))"; }
+ts_parse() { sed -n 's/.*"ts":{"$timestamp":{"t":\([0-9]*\),"i":\([0-9]*\)}}.*/\1 \2/p'; }
+POSITION=$(cat "$WORK_DIR/position")
+mkdir -p "$WORK_DIR/out/chunks" "$WORK_DIR/out/gaps" "$WORK_DIR/dump"
+OLDEST=$(ts_fmt $(mongo --quiet --host "$MONGODB_HOSTS" "${SHELL_OPTIONS[@]}" --eval "$SHELL_LOGIN"'db.getMongo().setReadPref("secondaryPreferred"); var ts = db.getSiblingDB("local").oplog.rs.find().sort({$natural: 1}).limit(1).next().ts; print(ts.t + " " + ts.i)'))
+QUERY='{}'
+GAP=""
+if [ -z "$POSITION" ]; then
+  touch "$WORK_DIR/out/gaps/$(ts_fmt 0 0)-$OLDEST"
+else
+  T=$((10#${POSITION%.*}))
+  I=$((10#${POSITION#*.}))
+  QUERY="{\"ts\":{\"\$gt\":{\"\$timestamp\":{\"t\":$T,\"i\":$I}}}}"
+  FOUND=$(mongo --quiet --host "$MONGODB_HOSTS" "${SHELL_OPTIONS[@]}" --eval "$SHELL_LOGIN db.getMongo().setReadPref('secondaryPreferred'); print(db.getSiblingDB('local').oplog.rs.find({ts: Timestamp($T, $I)}).count())")
+  if [ "$FOUND" = "0" ]; then
+    touch "$WORK_DIR/out/gaps/$POSITION-$OLDEST"
+    GAP=",\"gapFrom\":$(ts_json "$POSITION"),\"gapTo\":$(ts_json "$OLDEST")"
+  fi
+fi
+mongodump --host "$MONGODB_HOSTS" "${AUTH[@]}" --readPreference secondaryPreferred --db local --collection oplog.rs --query "$QUERY" --out "$WORK_DIR/dump"
+FILE="$WORK_DIR/dump/local/oplog.rs.bson"
+LAST="$POSITION"
+if [ -s "$FILE" ]; then
+  FIRST=$(ts_fmt $(bsondump --quiet "$FILE" | ts_parse | sed -n 1p))
+  LAST=$(ts_fmt $(bsondump --quiet "$FILE" | ts_parse | tail -n 1))
+  gzip -c "$FILE" > "$WORK_DIR/out/chunks/$FIRST-$LAST.bson.gz"
+fi
+rm -rf "$WORK_DIR/dump"
+if [ -n "$LAST" ]; then
+  printf '{"last":%s%s}' "$(ts_json "$LAST")" "$GAP" > /dev/termination-log
+fi
+`
+
+// MONGO_OPLOG_S3_UPLOAD_SCRIPT copies the new chunk and gap marker to the bucket.
+const MONGO_OPLOG_S3_UPLOAD_SCRIPT = `set -e
+mc alias set store "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+mc cp --recursive "$WORK_DIR/out/" "store/$S3_BUCKET/$OPLOG_DIR/"
+`
+
+// MONGO_OPLOG_PVC_STORE_SCRIPT copies the new chunk and gap marker to the claim.
+const MONGO_OPLOG_PVC_STORE_SCRIPT = `mkdir -p "$OPLOG_PATH"
+cp -r "$WORK_DIR/out/." "$OPLOG_PATH/"
+`
+
+// oplogArchiveResult is the termination message of the oplog dump container.
+type oplogArchiveResult struct {
+	Last    *appsv1beta1.OplogTimestamp `json:"last,omitempty"`
+	GapFrom *appsv1beta1.OplogTimestamp `json:"gapFrom,omitempty"`
+	GapTo   *appsv1beta1.OplogTimestamp `json:"gapTo,omitempty"`
+}
+
+func getOplogCronJobName(clusterName string) string {
+	return fmt.Sprintf(MONGO_OPLOG_CRON_JOB_FORMAT, clusterName)
+}
+
+// getOplogArchiveDir is the directory of the oplog archive of a cluster in the bucket or in the claim.
+func getOplogArchiveDir(storage appsv1beta1.BackupStorage, namespace string, clusterName string) string {
+	prefix := ""
+	if storage.S3 != nil {
+		prefix = storage.S3.Prefix
+	}
+	return path.Join(prefix, namespace, clusterName, MONGO_OPLOG_DIRECTORY)
+}
+
+// formatOplogTimestamp formats a timestamp the way the oplog archive names its chunks and gap markers.
+func formatOplogTimestamp(t uint32, i uint32) string {
+	return fmt.Sprintf("%010d.%010d", t, i)
+}
+
+// createOrUpdateOplogArchive reconciles the CronJob archiving the oplog and records its progress, the
+// CronJob is deleted when the archiving is turned off, the archive is kept.
+func (m *MongoClusterService) createOrUpdateOplogArchive() error {
+	oplogArchive := m.AppConfig.Spec.Backup.OplogArchive
+	if oplogArchive == nil {
+		return m.deleteOplogArchive()
+	}
+	if m.isSharded() {
+		return &invalidSpecError{Field: "backup.oplogArchive", Err: fmt.Errorf("oplog archiving of sharded clusters is not supported")}
+	}
+	labels := map[string]string{
+		MONGO_CLUSTER_LABEL:       m.AppConfig.Name,
+		MONGO_OPLOG_ARCHIVE_LABEL: "true",
+	}
+	spec := batchv1.CronJobSpec{
+		Schedule:                   oplogArchive.Schedule,
+		ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+		SuccessfulJobsHistoryLimit: &MONGO_BACKUP_JOBS_HISTORY_LIMIT,
+		FailedJobsHistoryLimit:     &MONGO_BACKUP_JOBS_HISTORY_LIMIT,
+		JobTemplate: batchv1.JobTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: labels,
+			},
+			Spec: batchv1.JobSpec{
+				BackoffLimit: &MONGO_BACKUP_BACKOFF_LIMIT,
+				Template: v1api.PodTemplateSpec{
+					Spec: m.createOplogArchivePodSpec(oplogArchive.Storage),
+				},
+			},
+		},
+	}
+	expectedCronJob, err := m.newCronJob(getOplogCronJobName(m.AppConfig.Name), labels, spec)
+	if err != nil {
+		return err
+	}
+	if _, err := m.createOrUpdateCronJob(expectedCronJob); err != nil {
+		return err
+	}
+	return m.setOplogArchiveStatus()
+}
+
+// createOplogArchivePodSpec finds the last entry archived, dumps the following ones and stores them.
+// With a bucket each step runs in its own container, the mongo tools and the MinIO client not being
+// shipped in the same image.
+func (m *MongoClusterService) createOplogArchivePodSpec(storage appsv1beta1.BackupStorage) v1api.PodSpec {
+	image := m.AppConfig.Spec.Image
+	if image == "" {
+		image = MONGO_CONTAINER_IMAGE
+	}
+	oplogDir := getOplogArchiveDir(storage, m.Namespace, m.AppConfig.Name)
+	workMount := v1api.VolumeMount{
+		Name:      MONGO_OPLOG_WORK_VOLUME_NAME,
+		MountPath: MONGO_OPLOG_WORK_MOUNT_PATH,
+	}
+	workEnv := v1api.EnvVar{Name: "WORK_DIR", Value: MONGO_OPLOG_WORK_MOUNT_PATH}
+	podSpec := v1api.PodSpec{
+		RestartPolicy: v1api.RestartPolicyNever,
+		Volumes: []v1api.Volume{
+			{
+				Name:         MONGO_OPLOG_WORK_VOLUME_NAME,
+				VolumeSource: v1api.VolumeSource{EmptyDir: &v1api.EmptyDirVolumeSource{}},
+			},
+		},
+	}
+	dumpContainer := v1api.Container{
+		Name:         MONGO_OPLOG_DUMP_CONTAINER,
+		Image:        image,
+		Command:      []string{"/bin/bash", "-c"},
+		Args:         []string{MONGO_OPLOG_DUMP_SCRIPT},
+		Env:          append([]v1api.EnvVar{workEnv}, getConnectionEnv(m.AppConfig)...),
+		VolumeMounts: []v1api.VolumeMount{workMount},
+	}
+	if s3 := storage.S3; s3 != nil {
+		s3Env := []v1api.EnvVar{
+			workEnv,
+			{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+			{Name: "S3_BUCKET", Value: s3.Bucket},
+			{Name: "OPLOG_DIR", Value: oplogDir},
+		}
+		s3EnvFrom := []v1api.EnvFromSource{
+			{
+				SecretRef: &v1api.SecretEnvSource{
+					LocalObjectReference: v1api.LocalObjectReference{Name: s3.CredentialsSecret},
+				},
+			},
+		}
+		podSpec.InitContainers = []v1api.Container{
+			{
+				Name:         MONGO_OPLOG_POSITION_CONTAINER,
+				Image:        MONGO_BACKUP_UPLOAD_IMAGE,
+				Command:      []string{"/bin/sh", "-c"},
+				Args:         []string{MONGO_OPLOG_S3_POSITION_SCRIPT},
+				Env:          s3Env,
+				EnvFrom:      s3EnvFrom,
+				VolumeMounts: []v1api.VolumeMount{workMount},
+			},
+			dumpContainer,
+		}
+		podSpec.Containers = []v1api.Container{
+			{
+				Name:         MONGO_OPLOG_UPLOAD_CONTAINER,
+				Image:        MONGO_BACKUP_UPLOAD_IMAGE,
+				Command:      []string{"/bin/sh", "-c"},
+				Args:         []string{MONGO_OPLOG_S3_UPLOAD_SCRIPT},
+				Env:          s3Env,
+				EnvFrom:      s3EnvFrom,
+				VolumeMounts: []v1api.VolumeMount{workMount},
+			},
+		}
+		return podSpec
+	}
+	dumpContainer.Args = []string{MONGO_OPLOG_PVC_POSITION_SCRIPT + MONGO_OPLOG_DUMP_SCRIPT + MONGO_OPLOG_PVC_STORE_SCRIPT}
+	dumpContainer.Env = append(dumpContainer.Env, v1api.EnvVar{
+		Name:  "OPLOG_PATH",
+		Value: path.Join(MONGO_BACKUP_MOUNT_PATH, oplogDir),
+	})
+	dumpContainer.VolumeMounts = append(dumpContainer.VolumeMounts, v1api.VolumeMount{
+		Name:      MONGO_BACKUP_VOLUME_NAME,
+		MountPath: MONGO_BACKUP_MOUNT_PATH,
+	})
+	podSpec.Containers = []v1api.Container{dumpContainer}
+	podSpec.Volumes = append(podSpec.Volumes, v1api.Volume{
+		Name: MONGO_BACKUP_VOLUME_NAME,
+		VolumeSource: v1api.VolumeSource{
+			PersistentVolumeClaim: &v1api.PersistentVolumeClaimVolumeSource{
+				ClaimName: storage.PersistentVolumeClaim.ClaimName,
+			},
+		},
+	})
+	return podSpec
+}
+
+// setOplogArchiveStatus reports the last archiving Job that finished, a Job already reported is not
+// read again. A failed Job does not change the status, the next run archives the entries it missed.
+func (m *MongoClusterService) setOplogArchiveStatus() error {
+	status := &appsv1beta1.OplogArchiveStatus{}
+	if m.AppConfig.Status.OplogArchive != nil {
+		status = m.AppConfig.Status.OplogArchive.DeepCopy()
+	}
+	m.OplogArchiveStatus = status
+	lastJob, lastFailure, err := m.getLastFinishedJob(client.MatchingLabels{
+		MONGO_CLUSTER_LABEL:       m.AppConfig.Name,
+		MONGO_OPLOG_ARCHIVE_LABEL: "true",
+	})
+	if err != nil {
+		return err
+	}
+	if lastJob == nil || lastJob.Name == status.LastJobName {
+		return nil
+	}
+	status.LastJobName = lastJob.Name
+	if lastFailure != nil {
+		m.Logger.Info(fmt.Sprintf("Oplog archive Job %s failed: %s", lastJob.Name, lastFailure.Message))
+		return nil
+	}
+	// The dump container leaves no termination message when the oplog was empty, the last entry
+	// archived is kept as is then, as when the pod of the Job is gone.
+	result := &oplogArchiveResult{}
+	found, err := m.getJobResult(lastJob, MONGO_OPLOG_DUMP_CONTAINER, result)
+	if err != nil || !found {
+		return err
+	}
+	status.LastTimestamp = result.Last
+	generation := m.AppConfig.Generation
+	if result.GapFrom != nil && result.GapTo != nil {
+		status.LastGapFrom, status.LastGapTo = result.GapFrom, result.GapTo
+		message := fmt.Sprintf("Oplog entries between %s and %s were dropped before being archived",
+			formatOplogTimestamp(result.GapFrom.T, result.GapFrom.I), formatOplogTimestamp(result.GapTo.T, result.GapTo.I))
+		condition := newCondition(appsv1beta1.ConditionOplogArchiveContinuous, false, REASON_OPLOG_GAP, message, generation)
+		m.OplogArchiveCondition = &condition
+	} else if result.Last != nil {
+		message := fmt.Sprintf("Oplog archived up to %s", formatOplogTimestamp(result.Last.T, result.Last.I))
+		condition := newCondition(appsv1beta1.ConditionOplogArchiveContinuous, true, REASON_OPLOG_ARCHIVED, message, generation)
+		m.OplogArchiveCondition = &condition
+	}
+	return nil
+}
+
+func (m *MongoClusterService) deleteOplogArchive() error {
+	cronJob := &batchv1.CronJob{}
+	found, err := m.objectExists(getOplogCronJobName(m.AppConfig.Name), cronJob)
+	if err != nil || !found {
+		return err
+	}
+	m.Logger.Info(fmt.Sprintf("Deleting oplog archive CronJob %s", cronJob.Name))
+	if err := m.Reconciler.Client.Delete(*m.Context, cronJob, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error deleting oplog archive CronJob")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// podListFailingClient fails to list pods, as when the API server is unavailable.
+type podListFailingClient struct {
+	client.Client
+}
+
+func (c podListFailingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*v1api.PodList); ok {
+		return errors.NewServiceUnavailable("etcd is unavailable")
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+var _ = Describe("createOrUpdateOplogArchive", func() {
+	var cluster *appsv1beta1.MongoCluster
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Backup.OplogArchive = &appsv1beta1.OplogArchive{
+			Schedule: "*/5 * * * *",
+			Storage:  appsv1beta1.BackupStorage{S3: &appsv1beta1.S3Storage{Endpoint: "http://minio:9000", Bucket: "oplog", Prefix: "prod", CredentialsSecret: "s3"}},
+		}
+	})
+
+	getCronJob := func(service *MongoClusterService) (*batchv1.CronJob, error) {
+		cronJob := &batchv1.CronJob{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: "mongo-oplog", Namespace: testNamespace}, cronJob)
+		return cronJob, err
+	}
+
+	newArchiveJob := func(name string, message string) (*batchv1.Job, *v1api.Pod) {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         testNamespace,
+				CreationTimestamp: metav1.NewTime(time.Now()),
+				Labels:            map[string]string{MONGO_CLUSTER_LABEL: cluster.Name, MONGO_OPLOG_ARCHIVE_LABEL: "true"},
+			},
+			Status: batchv1.JobStatus{Succeeded: 1},
+		}
+		pod := newJobPod(name, v1api.PodSucceeded, MONGO_OPLOG_DUMP_CONTAINER, message)
+		pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses = pod.Status.ContainerStatuses, nil
+		return job, pod
+	}
+
+	It("archives the oplog to the bucket on the schedule", func() {
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		cronJob, err := getCronJob(service)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cronJob.Spec.Schedule).To(Equal("*/5 * * * *"))
+		Expect(cronJob.Spec.ConcurrencyPolicy).To(Equal(batchv1.ForbidConcurrent))
+		spec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+		Expect(spec.InitContainers).To(HaveLen(2))
+		Expect(spec.InitContainers[0].Name).To(Equal(MONGO_OPLOG_POSITION_CONTAINER))
+		Expect(spec.InitContainers[1].Name).To(Equal(MONGO_OPLOG_DUMP_CONTAINER))
+		Expect(spec.Containers[0].Name).To(Equal(MONGO_OPLOG_UPLOAD_CONTAINER))
+		Expect(spec.Containers[0].Env).To(ContainElement(v1api.EnvVar{Name: "OPLOG_DIR", Value: "prod/default/mongo/oplog"}))
+	})
+
+	It("archives the oplog to a claim from a single container", func() {
+		cluster.Spec.Backup.OplogArchive.Storage = appsv1beta1.BackupStorage{PersistentVolumeClaim: &appsv1beta1.PersistentVolumeClaimStorage{ClaimName: "oplog"}}
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		cronJob, err := getCronJob(service)
+		Expect(err).NotTo(HaveOccurred())
+		spec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+		Expect(spec.InitContainers).To(BeEmpty())
+		Expect(spec.Containers).To(HaveLen(1))
+		Expect(spec.Containers[0].Args[0]).To(Equal(MONGO_OPLOG_PVC_POSITION_SCRIPT + MONGO_OPLOG_DUMP_SCRIPT + MONGO_OPLOG_PVC_STORE_SCRIPT))
+		Expect(spec.Containers[0].Env).To(ContainElement(v1api.EnvVar{Name: "OPLOG_PATH", Value: "/backup/default/mongo/oplog"}))
+	})
+
+	It("deletes the CronJob when the archiving is turned off", func() {
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		cluster.Spec.Backup.OplogArchive = nil
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		_, err := getCronJob(service)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports the last entry archived", func() {
+		job, pod := newArchiveJob("mongo-oplog-1", `{"last":{"t":1700000000,"i":2}}`)
+		service := newTestService(cluster, mongofake.NewClient(), job, pod)
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		Expect(*service.OplogArchiveStatus.LastTimestamp).To(Equal(appsv1beta1.OplogTimestamp{T: 1700000000, I: 2}))
+		Expect(service.OplogArchiveCondition.Status).To(Equal(metav1.ConditionTrue))
+	})
+
+	It("keeps the last entry archived when the oplog was empty or the pod of the Job is gone", func() {
+		cluster.Status.OplogArchive = &appsv1beta1.OplogArchiveStatus{LastJobName: "mongo-oplog-1", LastTimestamp: &appsv1beta1.OplogTimestamp{T: 1700000000, I: 2}}
+		empty, pod := newArchiveJob("mongo-oplog-2", "")
+		service := newTestService(cluster, mongofake.NewClient(), empty, pod)
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		Expect(service.OplogArchiveStatus.LastJobName).To(Equal(empty.Name))
+		Expect(*service.OplogArchiveStatus.LastTimestamp).To(Equal(appsv1beta1.OplogTimestamp{T: 1700000000, I: 2}))
+
+		gone, _ := newArchiveJob("mongo-oplog-3", `{"last":{"t":1700000300,"i":1}}`)
+		gone.CreationTimestamp = metav1.NewTime(time.Now().Add(time.Minute))
+		Expect(service.Reconciler.Client.Create(context.Background(), gone)).To(Succeed())
+		cluster.Status.OplogArchive = service.OplogArchiveStatus
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		Expect(service.OplogArchiveStatus.LastJobName).To(Equal(gone.Name))
+		Expect(*service.OplogArchiveStatus.LastTimestamp).To(Equal(appsv1beta1.OplogTimestamp{T: 1700000000, I: 2}))
+	})
+
+	It("returns the errors of the API server", func() {
+		job, pod := newArchiveJob("mongo-oplog-1", `{"last":{"t":1700000000,"i":2}}`)
+		service := newTestService(cluster, mongofake.NewClient(), job, pod)
+		service.Reconciler.Client = podListFailingClient{Client: service.Reconciler.Client}
+		Expect(service.createOrUpdateOplogArchive()).To(MatchError(ContainSubstring("etcd is unavailable")))
+	})
+
+	It("reports the entries dropped before being archived", func() {
+		job, pod := newArchiveJob("mongo-oplog-1", `{"last":{"t":1700000300,"i":1},"gapFrom":{"t":1700000000,"i":2},"gapTo":{"t":1700000100,"i":1}}`)
+		service := newTestService(cluster, mongofake.NewClient(), job, pod)
+		Expect(service.createOrUpdateOplogArchive()).To(Succeed())
+		Expect(service.OplogArchiveCondition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(service.OplogArchiveCondition.Reason).To(Equal(REASON_OPLOG_GAP))
+		Expect(service.OplogArchiveCondition.Message).To(ContainSubstring("1700000000.0000000002 and 1700000100.0000000001"))
+	})
+})
+
+var _ = Describe("getSource with a target time", func() {
+	It("rejects a target time before the backup", func() {
+		cluster := newTestCluster(3)
+		cluster.Spec.Backup.OplogArchive = &appsv1beta1.OplogArchive{
+			Storage: appsv1beta1.BackupStorage{PersistentVolumeClaim: &appsv1beta1.PersistentVolumeClaimStorage{ClaimName: "oplog"}},
+		}
+		backup := &appsv1beta1.MongoBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: testNamespace},
+			Spec: appsv1beta1.MongoBackupSpec{
+				ClusterName: cluster.Name,
+				Storage:     appsv1beta1.BackupStorage{PersistentVolumeClaim: &appsv1beta1.PersistentVolumeClaimStorage{ClaimName: "backups"}},
+			},
+			Status: appsv1beta1.MongoBackupStatus{Phase: appsv1beta1.MongoBackupCompleted, OplogTimestamp: &appsv1beta1.OplogTimestamp{T: 1700000000}},
+		}
+		targetTime := metav1.NewTime(time.Unix(1699999999, 0))
+		restore := &appsv1beta1.MongoRestore{
+			ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: testNamespace},
+			Spec: appsv1beta1.MongoRestoreSpec{
+				ClusterName: cluster.Name,
+				Source:      appsv1beta1.RestoreSource{BackupName: backup.Name},
+				TargetTime:  &targetTime,
+			},
+		}
+		service := newTestRestoreService(restore, cluster, backup)
+		_, ready, err := service.getSource(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoRestoreFailed))
+		Expect(service.Status.Message).To(Equal("The archive is more recent than the target time"))
+
+		targetTime = metav1.NewTime(time.Unix(1700000100, 0))
+		service = newTestRestoreService(restore, cluster, backup)
+		source, _, err := service.getSource(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.OplogStorage.PersistentVolumeClaim.ClaimName).To(Equal("oplog"))
+		Expect(service.Status.Phase).To(BeEmpty())
+	})
+})
+
+// MONGO_RESTORE_SCRIPT is run against an oplog archive laid out in a temporary directory, mongorestore
+// is replaced by a stub recording its arguments and the oplog it was given to replay.
+var _ = Describe("MONGO_RESTORE_SCRIPT with a target time", func() {
+	const mongorestoreStub = `#!/bin/bash
+echo "$*" >> "$TEST_DIR/mongorestore.args"
+while [ $# -gt 0 ]; do
+  if [ "$1" = --dir ]; then dir=$2; fi
+  shift
+done
+if [ -f "$dir/oplog.bson" ]; then cat "$dir/oplog.bson" >> "$TEST_DIR/replayed"; fi
+echo "done. 10 document(s) restored successfully. 0 document(s) failed to restore."
+`
+	var dir string
+
+	ts := formatOplogTimestamp
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		for _, subdir := range []string{"bin", "dump/app", "oplog/chunks", "oplog/gaps"} {
+			Expect(os.MkdirAll(filepath.Join(dir, subdir), 0o755)).To(Succeed())
+		}
+		Expect(os.WriteFile(filepath.Join(dir, "bin/mongorestore"), []byte(mongorestoreStub), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "dump/app/users.bson"), nil, 0o644)).To(Succeed())
+		Expect(exec.Command("tar", "czf", filepath.Join(dir, "backup.tar.gz"), "-C", filepath.Join(dir, "dump"), ".").Run()).To(Succeed())
+	})
+
+	addChunk := func(first string, last string) {
+		name := filepath.Join(dir, "oplog/chunks", first+"-"+last+".bson")
+		Expect(os.WriteFile(name, []byte(first+"-"+last+"\n"), 0o644)).To(Succeed())
+		Expect(exec.Command("gzip", name).Run()).To(Succeed())
+	}
+
+	addChunks := func() {
+		addChunk(ts(50, 1), ts(90, 3))
+		addChunk(ts(90, 4), ts(100, 5))
+		addChunk(ts(100, 6), ts(200, 1))
+		addChunk(ts(200, 2), ts(300, 7))
+		addChunk(ts(300, 8), ts(400, 1))
+		addChunk(ts(400, 2), ts(500, 1))
+	}
+
+	run := func(baseTS string, targetTS string) (string, error) {
+		script := strings.ReplaceAll(MONGO_RESTORE_SCRIPT, "/dev/termination-log", filepath.Join(dir, "termination-log"))
+		command := exec.Command("bash", "-c", script)
+		command.Env = []string{
+			"PATH=" + filepath.Join(dir, "bin") + ":" + os.Getenv("PATH"),
+			"TMPDIR=" + dir,
+			"TEST_DIR=" + dir,
+			"BACKUP_FILE=" + filepath.Join(dir, "backup.tar.gz"),
+			"RESTORE_DIR=" + filepath.Join(dir, "restore"),
+			"OPLOG_PATH=" + filepath.Join(dir, "oplog"),
+			"MONGODB_HOSTS=mongo/mongo-0",
+			"MONGODB_USERNAME=admin",
+			"MONGODB_PASSWORD=secret",
+			"BASE_TS=" + baseTS,
+			"TARGET_TS=" + targetTS,
+		}
+		_, err := command.CombinedOutput()
+		message, _ := os.ReadFile(filepath.Join(dir, "termination-log"))
+		return string(message), err
+	}
+
+	readFile := func(name string) string {
+		content, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(content)
+	}
+
+	It("replays the chunks between the archive and the end of the target second", func() {
+		addChunks()
+		message, err := run(ts(100, 5), ts(300, MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(message).To(Equal(`{"restoredDocuments":10,"failedDocuments":0}`))
+		Expect(strings.Fields(readFile("replayed"))).To(Equal([]string{
+			ts(100, 6) + "-" + ts(200, 1),
+			ts(200, 2) + "-" + ts(300, 7),
+			ts(300, 8) + "-" + ts(400, 1),
+		}))
+		Expect(readFile("mongorestore.args")).To(ContainSubstring("--oplogReplay --oplogLimit 301 --dir " + filepath.Join(dir, "restore/replay")))
+	})
+
+	It("replays the chunk overlapping the archive", func() {
+		addChunks()
+		_, err := run(ts(95, 0), ts(150, MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Fields(readFile("replayed"))).To(Equal([]string{
+			ts(90, 4) + "-" + ts(100, 5),
+			ts(100, 6) + "-" + ts(200, 1),
+		}))
+		Expect(readFile("mongorestore.args")).To(ContainSubstring("--oplogLimit 151 "))
+	})
+
+	It("rejects a target time before the archive", func() {
+		addChunks()
+		message, err := run(ts(400, 1), ts(300, MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL))
+		Expect(err).To(HaveOccurred())
+		Expect(message).To(ContainSubstring("is more recent than the target time"))
+		Expect(readFile("mongorestore.args")).To(BeEmpty())
+	})
+
+	It("rejects a gap between the archive and the target time", func() {
+		addChunks()
+		Expect(os.WriteFile(filepath.Join(dir, "oplog/gaps", ts(60, 1)+"-"+ts(70, 1)), nil, 0o644)).To(Succeed())
+		_, err := run(ts(100, 5), ts(300, MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.WriteFile(filepath.Join(dir, "oplog/gaps", ts(150, 1)+"-"+ts(160, 1)), nil, 0o644)).To(Succeed())
+		message, err := run(ts(100, 5), ts(300, MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL))
+		Expect(err).To(HaveOccurred())
+		Expect(message).To(ContainSubstring("are missing from the archive"))
+		Expect(message).To(HaveSuffix(`,"oplogGap":true}`))
+	})
+
+	It("rejects a target time the archive has not reached", func() {
+		addChunk(ts(100, 6), ts(200, 1))
+		message, err := run(ts(100, 5), ts(300, MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL))
+		Expect(err).To(HaveOccurred())
+		Expect(message).To(Equal(`{"error":"The oplog is only archived up to ` + ts(200, 1) + `","oplogGap":true}`))
+	})
+})
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"fmt"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
 	v1 "k8s.io/api/apps/v1"
 	v1api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -26,8 +27,8 @@ func (m *MongoClusterService) getPersistentVolumeClaims() *[]v1api.PersistentVol
 	}
 	var pvcs []v1api.PersistentVolumeClaim
 
-	for i := 0; int32(i) < m.AppConfig.Spec.Replicas; i++ {
-		resourceName := getResourceGenericName(m.AppConfig.Name, fmt.Sprintf("%d", i))
+	for i := 0; int32(i) < m.ReplicaSet.Replicas; i++ {
+		resourceName := getPersistentVolumeClaimName(m.ReplicaSet.Name, i)
 		err, pvc := getOne(resourceName)
 		if err != nil {
 			m.Logger.Info(fmt.Sprintf("PVC %s does not exist", resourceName))
@@ -38,47 +39,11 @@ func (m *MongoClusterService) getPersistentVolumeClaims() *[]v1api.PersistentVol
 	return &pvcs
 }
 
-func (m *MongoClusterService) createOrUpdatePersistentVolumeClaim(pvcName string) error {
-	actualPVC := &v1api.PersistentVolumeClaim{}
-	expectedPVC, err := m.createPersistentVolumeClaim(pvcName, m.AppConfig.Spec.Storage.StorageClassName)
-	if err != nil {
-		m.Logger.Error(err, "Error creating PVC")
-		return err
-	}
-	err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: pvcName, Namespace: m.Namespace}, actualPVC)
-	pvcUpToDate := !reflect.DeepEqual((*expectedPVC).Spec, (*actualPVC).Spec) && m.pvcExists(*expectedPVC)
-
-	if err != nil && !errors.IsNotFound(err) {
-		m.Logger.Error(err, "Error getting pvc")
-		return err
-	} else if errors.IsNotFound(err) {
-		m.Logger.Info(fmt.Sprintf("Creating pvc %s", expectedPVC.Name))
-		err = m.Reconciler.Client.Create(*m.Context, expectedPVC)
-		if err != nil {
-			m.Logger.Error(err, "Error creating pvc")
-			return err
-		}
-	} else if pvcUpToDate {
-		m.Logger.Info(fmt.Sprintf("PVC %s is up to date. Nothing to do.", expectedPVC.Name))
-		return nil
-	} else {
-		m.Logger.Info(fmt.Sprintf("Updating PVC %s", expectedPVC.Name))
-		actualPVC.Spec = expectedPVC.Spec
-		err = m.Reconciler.Client.Update(*m.Context, actualPVC)
-		if err != nil {
-			m.Logger.Error(err, "Error updating PVC")
-			return err
-		}
-	}
-	m.updateStack(*expectedPVC)
-	return nil
-}
-
 func (m *MongoClusterService) createPersistentVolumeClaim(name string, storageClassName string) (*v1api.PersistentVolumeClaim, error) {
 	quantity, err := resource.ParseQuantity(m.AppConfig.Spec.Storage.Size)
 	if err != nil {
 		m.Logger.Error(err, "Error parsing quantity")
-		return nil, err
+		return nil, &invalidSpecError{Field: "storage.size", Err: err}
 	}
 	pvc := v1api.PersistentVolumeClaim{
 		ObjectMeta: ctrl.ObjectMeta{
@@ -94,16 +59,25 @@ func (m *MongoClusterService) createPersistentVolumeClaim(name string, storageCl
 			StorageClassName: &storageClassName,
 		},
 	}
+	if bootstrap := m.AppConfig.Spec.Bootstrap; bootstrap != nil && bootstrap.VolumeSnapshotName != "" {
+		apiGroup := snapshotv1.GroupName
+		pvc.Spec.DataSource = &v1api.TypedLocalObjectReference{
+			APIGroup: &apiGroup,
+			Kind:     "VolumeSnapshot",
+			Name:     bootstrap.VolumeSnapshotName,
+		}
+	}
 	return &pvc, nil
 }
 
 func (m *MongoClusterService) deletePersistentVolumeClaims(persistentVolumeClaims []v1api.PersistentVolumeClaim) error {
 	for _, persistentVolumeClaim := range persistentVolumeClaims {
-		if !reflect.DeepEqual(persistentVolumeClaim, v1api.PersistentVolumeClaim{}) {
-			break
+		if reflect.DeepEqual(persistentVolumeClaim, v1api.PersistentVolumeClaim{}) {
+			continue
 		}
+		m.Logger.Info(fmt.Sprintf("Deleting persistent volume claim %s", persistentVolumeClaim.Name))
 		err := m.Reconciler.Client.Delete(*m.Context, &persistentVolumeClaim)
-		if err != nil {
+		if err != nil && !errors.IsNotFound(err) {
 			m.Logger.Error(err, "Error deleting persistent volume claim")
 			return err
 		}
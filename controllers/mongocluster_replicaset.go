@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+)
+
+const (
+	MONGO_STEP_DOWN_SECONDS = 60
+)
+
+// reconcileReplicaSet initiates the replica set from the first member, which is the one holding the
+// admin user created on first run, then adds or removes one member per pass until the configuration
+// lists exactly the members of the StatefulSet. It returns false while changes are still pending.
+func (m *MongoClusterService) reconcileReplicaSet() (bool, error) {
+	if !m.isMemberReady(0) {
+		m.Logger.Info("Waiting for the first member to be ready before initiating the replica set")
+		return false, nil
+	}
+	directClient, err := m.newAdminClient([]string{getMemberHost(m.ReplicaSet.Name, m.Namespace, 0)}, "")
+	if err != nil {
+		return false, err
+	}
+	defer directClient.Disconnect(*m.Context)
+
+	status, err := directClient.GetReplicaSetStatus(*m.Context)
+	if errors.Is(err, mongoadmin.ErrNotYetInitialized) {
+		m.Logger.Info(fmt.Sprintf("Initiating replica set %s", m.ReplicaSet.Name))
+		config := mongoadmin.ReplicaSetConfig{
+			ID:      m.ReplicaSet.Name,
+			Version: 1,
+			Members: []mongoadmin.Member{m.getDesiredMember(0)},
+		}
+		if err := directClient.InitiateReplicaSet(*m.Context, config); err != nil {
+			m.Logger.Error(err, "Error initiating replica set")
+			return false, err
+		}
+		return false, nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting replica set status")
+		return false, err
+	}
+	m.ReplicaSetStatus = status
+
+	primaryClient, err := m.newAdminClient(m.getReadyMemberHosts(), m.ReplicaSet.Name)
+	if err != nil {
+		return false, err
+	}
+	defer primaryClient.Disconnect(*m.Context)
+	config, err := primaryClient.GetReplicaSetConfig(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting replica set configuration")
+		return false, err
+	}
+	nextConfig, changed := mongoadmin.NextConfig(*config, m.getDesiredMembers(config))
+	if !changed {
+		return len(config.Members) == int(m.ReplicaSet.Replicas), nil
+	}
+	committed, err := primaryClient.IsReplicaSetConfigCommitted(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting replica set configuration commitment status")
+		return false, err
+	}
+	if !committed {
+		m.Logger.Info("Waiting for the current replica set configuration to be committed by a majority")
+		return false, nil
+	}
+	if primary := m.ReplicaSetStatus.Primary(); primary != nil && !hasMember(nextConfig, primary.Name) {
+		// The primary cannot remove itself from the set, hand its role over first.
+		m.Logger.Info(fmt.Sprintf("Stepping down primary %s before removing it", primary.Name))
+		if err := primaryClient.StepDown(*m.Context, MONGO_STEP_DOWN_SECONDS); err != nil {
+			m.Logger.Error(err, "Error stepping down primary")
+			return false, err
+		}
+		return false, nil
+	}
+	m.Logger.Info(fmt.Sprintf("Reconfiguring replica set %s to version %d", m.ReplicaSet.Name, nextConfig.Version))
+	if err := primaryClient.ReconfigureReplicaSet(*m.Context, nextConfig); err != nil {
+		m.Logger.Error(err, "Error reconfiguring replica set")
+		return false, err
+	}
+	return false, nil
+}
+
+// getDesiredMembers lists the members the replica set should have. A member is only added once its
+// pod is ready, adding an unreachable voting member could cost the set its majority, but members
+// already in the configuration are kept while their pod restarts. With external access, a member is
+// also only added once its external address is known, so that it gets the horizons of the others.
+func (m *MongoClusterService) getDesiredMembers(config *mongoadmin.ReplicaSetConfig) []mongoadmin.Member {
+	configuredHosts := map[string]bool{}
+	for _, member := range config.Members {
+		configuredHosts[member.Host] = true
+	}
+	var members []mongoadmin.Member
+	for i := 0; int32(i) < m.ReplicaSet.Replicas; i++ {
+		member := m.getDesiredMember(i)
+		if !configuredHosts[member.Host] && m.AppConfig.Spec.ExternalAccess != nil && member.Horizons == nil {
+			m.Logger.Info(fmt.Sprintf("Waiting for the external address of %s before adding it", member.Host))
+			continue
+		}
+		if configuredHosts[member.Host] || m.isMemberReady(i) {
+			members = append(members, member)
+		}
+	}
+	return m.keepConsistentHorizons(members, config)
+}
+
+// getDesiredMember applies the spec.members overrides of the member. Hidden, delayed, arbiter and non
+// voting members cannot be elected, their priority defaults to 0.
+func (m *MongoClusterService) getDesiredMember(index int) mongoadmin.Member {
+	member := mongoadmin.NewMember(index, getMemberHost(m.ReplicaSet.Name, m.Namespace, index))
+	member.Horizons = m.getHorizons(index)
+	options := m.getMemberOptions(index)
+	if options == nil {
+		return member
+	}
+	member.ArbiterOnly = options.Arbiter
+	member.Hidden = options.Hidden
+	member.SecondaryDelaySecs = options.SecondaryDelaySecs
+	member.Tags = options.Tags
+	if options.Votes != nil {
+		member.Votes = int(*options.Votes)
+	}
+	if options.Hidden || options.Arbiter || options.SecondaryDelaySecs > 0 || member.Votes == 0 {
+		member.Priority = 0
+	}
+	if options.Priority != nil {
+		member.Priority = float64(*options.Priority)
+	}
+	return member
+}
+
+// getMemberOptions returns the spec.members entry of the member, they apply to the shards of a
+// sharded cluster but not to its config servers.
+func (m *MongoClusterService) getMemberOptions(index int) *appsv1beta1.MemberOptions {
+	if m.ReplicaSet.ClusterRole == CLUSTER_ROLE_CONFIG_SERVER {
+		return nil
+	}
+	for i := range m.AppConfig.Spec.Members {
+		if int(m.AppConfig.Spec.Members[i].Index) == index {
+			return &m.AppConfig.Spec.Members[i]
+		}
+	}
+	return nil
+}
+
+// getReadyMemberHosts lists the ready members, including the ones above the desired count a scale down
+// has not removed yet.
+func (m *MongoClusterService) getReadyMemberHosts() []string {
+	var hosts []string
+	for i := 0; int32(i) < m.getMemberCount(); i++ {
+		if m.isMemberReady(i) {
+			hosts = append(hosts, getMemberHost(m.ReplicaSet.Name, m.Namespace, i))
+		}
+	}
+	return hosts
+}
+
+func (m *MongoClusterService) getMemberCount() int32 {
+	statefulSet := m.getStatefulSet()
+	if statefulSet.Spec.Replicas != nil && *statefulSet.Spec.Replicas > m.ReplicaSet.Replicas {
+		return *statefulSet.Spec.Replicas
+	}
+	return m.ReplicaSet.Replicas
+}
+
+func hasMember(config mongoadmin.ReplicaSetConfig, host string) bool {
+	for _, member := range config.Members {
+		if member.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MongoClusterService) isMemberReady(index int) bool {
+	pod := &v1api.Pod{}
+	name := getResourceGenericName(m.ReplicaSet.Name, strconv.Itoa(index))
+	if err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name, Namespace: m.Namespace}, pod); err != nil {
+		return false
+	}
+	return isPodReady(pod)
+}
+
+// newAdminClient connects to the given hosts with the admin user. An empty replica set name opens a
+// direct connection to the first host.
+func (m *MongoClusterService) newAdminClient(hosts []string, replicaSet string) (mongoadmin.Client, error) {
+	secret, err := m.createPasswordSecret()
+	if err != nil {
+		m.Logger.Error(err, "Error getting password secret")
+		return nil, err
+	}
+	return m.newAdminClientWithPassword(hosts, replicaSet, string(secret.Data["password"]))
+}
+
+// newAdminClientWithPassword connects with another password than the one of the admin secret, while
+// the password is rotated.
+func (m *MongoClusterService) newAdminClientWithPassword(hosts []string, replicaSet string, password string) (mongoadmin.Client, error) {
+	tlsConfig, err := getClusterTLSConfig(*m.Context, m.Reconciler.Client, m.AppConfig)
+	if err != nil {
+		m.Logger.Error(err, "Error getting the TLS configuration")
+		return nil, err
+	}
+	adminClient, err := m.Reconciler.MongoAdmin(*m.Context, mongoadmin.Options{
+		Hosts:      hosts,
+		ReplicaSet: replicaSet,
+		Username:   MONGODB_DEFAULT_USER,
+		Password:   password,
+		AuthSource: mongoadmin.ADMIN_DATABASE,
+		TLSConfig:  tlsConfig,
+	})
+	if err != nil {
+		m.Logger.Error(err, "Error connecting to the cluster")
+		return nil, err
+	}
+	return adminClient, nil
+}
+
+// newClusterAdminClient connects as the admin user of another cluster than the one of a
+// MongoClusterService, reading its password from the secret of that cluster.
+func newClusterAdminClient(ctx context.Context, c client.Client, factory mongoadmin.Factory, mongoCluster *appsv1beta1.MongoCluster, hosts []string, replicaSet string) (mongoadmin.Client, error) {
+	secret := &v1api.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: getPasswordSecretName(mongoCluster), Namespace: mongoCluster.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := getClusterTLSConfig(ctx, c, mongoCluster)
+	if err != nil {
+		return nil, err
+	}
+	return factory(ctx, mongoadmin.Options{
+		Hosts:      hosts,
+		ReplicaSet: replicaSet,
+		Username:   MONGODB_DEFAULT_USER,
+		Password:   string(secret.Data["password"]),
+		AuthSource: mongoadmin.ADMIN_DATABASE,
+		TLSConfig:  tlsConfig,
+	})
+}
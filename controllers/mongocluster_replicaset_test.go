@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("reconcileReplicaSet", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		mongo = mongofake.NewClient()
+	})
+
+	readyMembers := func(count int) []client.Object {
+		var pods []client.Object
+		for i := 0; i < count; i++ {
+			pods = append(pods, newMemberPod(cluster, i, true, "v1"))
+		}
+		return pods
+	}
+
+	It("waits for the first member to be ready", func() {
+		service := newTestService(cluster, mongo)
+		reconciled, err := service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeFalse())
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("initiates the replica set with the first member only", func() {
+		service := newTestService(cluster, mongo, readyMembers(3)...)
+		reconciled, err := service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeFalse())
+		Expect(mongo.Config).NotTo(BeNil())
+		Expect(mongo.Config.ID).To(Equal(cluster.Name))
+		Expect(memberHosts(mongo.Config)).To(Equal([]string{getMemberHost(cluster.Name, testNamespace, 0)}))
+	})
+
+	It("adds one ready member per pass until the configuration matches", func() {
+		mongo.Config = newTestConfig(cluster, 1)
+		service := newTestService(cluster, mongo, readyMembers(3)...)
+
+		reconciled, err := service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeFalse())
+		Expect(mongo.Config.Members).To(HaveLen(2))
+
+		reconciled, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeFalse())
+		Expect(mongo.Config.Members).To(HaveLen(3))
+
+		reconciled, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeTrue())
+		Expect(mongo.Config.Version).To(BeEquivalentTo(3))
+	})
+
+	It("does not add a member whose pod is not ready", func() {
+		mongo.Config = newTestConfig(cluster, 2)
+		service := newTestService(cluster, mongo, append(readyMembers(2), newMemberPod(cluster, 2, false, "v1"))...)
+		reconciled, err := service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeFalse())
+		Expect(mongo.Config.Members).To(HaveLen(2))
+		Expect(mongo.Commands).NotTo(ContainElement("replSetReconfig"))
+	})
+
+	It("waits for the current configuration to be committed before reconfiguring", func() {
+		mongo.Config = newTestConfig(cluster, 1)
+		mongo.Uncommitted = true
+		service := newTestService(cluster, mongo, readyMembers(3)...)
+		reconciled, err := service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reconciled).To(BeFalse())
+		Expect(mongo.Commands).NotTo(ContainElement("replSetReconfig"))
+	})
+
+	It("steps the primary down before removing it", func() {
+		cluster.Spec.Replicas = 2
+		mongo.Config = newTestConfig(cluster, 3)
+		mongo.Primary = getMemberHost(cluster.Name, testNamespace, 2)
+		service := newTestService(cluster, mongo, readyMembers(3)...)
+
+		_, err := service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Commands).To(ContainElement("replSetStepDown"))
+		Expect(mongo.Config.Members).To(HaveLen(3))
+		Expect(mongo.Primary).To(Equal(getMemberHost(cluster.Name, testNamespace, 0)))
+
+		_, err = service.reconcileReplicaSet()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(memberHosts(mongo.Config)).To(Equal([]string{
+			getMemberHost(cluster.Name, testNamespace, 0),
+			getMemberHost(cluster.Name, testNamespace, 1),
+		}))
+	})
+})
+
+var _ = Describe("getDesiredMember", func() {
+	int32Ptr := func(value int32) *int32 { return &value }
+
+	It("defaults the priority of non voting members to 0", func() {
+		cluster := newTestCluster(3)
+		cluster.Spec.Members = []appsv1beta1.MemberOptions{{Index: 2, Votes: int32Ptr(0)}}
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.getDesiredMember(1).Priority).To(BeEquivalentTo(1))
+		member := service.getDesiredMember(2)
+		Expect(member.Votes).To(Equal(0))
+		Expect(member.Priority).To(BeEquivalentTo(0))
+	})
+
+	It("defaults the priority of hidden members to 0 unless it is set", func() {
+		cluster := newTestCluster(3)
+		cluster.Spec.Members = []appsv1beta1.MemberOptions{{Index: 1, Hidden: true}, {Index: 2, Hidden: true, Priority: int32Ptr(2)}}
+		service := newTestService(cluster, mongofake.NewClient())
+		Expect(service.getDesiredMember(1).Priority).To(BeEquivalentTo(0))
+		Expect(service.getDesiredMember(2).Priority).To(BeEquivalentTo(2))
+	})
+})
+
+// newMemberPod returns the pod of a member running the given StatefulSet revision.
+func newMemberPod(cluster *appsv1beta1.MongoCluster, index int, ready bool, revision string) *v1api.Pod {
+	status := v1api.ConditionFalse
+	if ready {
+		status = v1api.ConditionTrue
+	}
+	return &v1api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getResourceGenericName(cluster.Name, strconv.Itoa(index)),
+			Namespace: testNamespace,
+			Labels:    map[string]string{appsv1.ControllerRevisionHashLabelKey: revision},
+		},
+		Status: v1api.PodStatus{Conditions: []v1api.PodCondition{{Type: v1api.PodReady, Status: status}}},
+	}
+}
+
+// newTestConfig returns a replica set configuration listing the first members of the cluster.
+func newTestConfig(cluster *appsv1beta1.MongoCluster, members int) *mongoadmin.ReplicaSetConfig {
+	config := &mongoadmin.ReplicaSetConfig{ID: cluster.Name, Version: 1}
+	for i := 0; i < members; i++ {
+		config.Members = append(config.Members, mongoadmin.NewMember(i, getMemberHost(cluster.Name, testNamespace, i)))
+	}
+	return config
+}
+
+// memberHosts returns the hosts of the members of the configuration, in order.
+func memberHosts(config *mongoadmin.ReplicaSetConfig) []string {
+	var hosts []string
+	for _, member := range config.Members {
+		hosts = append(hosts, member.Host)
+	}
+	return hosts
+}
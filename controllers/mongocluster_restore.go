@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// isPausedByRestore tells whether a MongoRestore is running against the cluster. The pause is lifted
+// when the restore it names finished or was deleted without resuming the cluster.
+func (m *MongoClusterService) isPausedByRestore() (bool, error) {
+	restoreName := m.AppConfig.Annotations[MONGO_RESTORE_ANNOTATION]
+	if restoreName == "" {
+		return false, nil
+	}
+	restore := &appsv1beta1.MongoRestore{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: restoreName, Namespace: m.Namespace}, restore)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting MongoRestore")
+		return false, err
+	}
+	if err == nil && restore.Status.Phase != appsv1beta1.MongoRestoreCompleted && restore.Status.Phase != appsv1beta1.MongoRestoreFailed {
+		return true, nil
+	}
+	m.Logger.Info(fmt.Sprintf("MongoRestore %s is over, resuming MongoCluster %s", restoreName, m.AppConfig.Name))
+	delete(m.AppConfig.Annotations, MONGO_RESTORE_ANNOTATION)
+	if err := m.Reconciler.Client.Update(*m.Context, m.AppConfig); err != nil {
+		m.Logger.Error(err, "Error resuming MongoCluster")
+		return false, err
+	}
+	return false, nil
+}
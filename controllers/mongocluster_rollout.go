@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+)
+
+const (
+	// MONGO_ROLLOUT_MAX_LAG_SECONDS is how far behind the primary a secondary may be for the rolling
+	// update to restart the next member.
+	MONGO_ROLLOUT_MAX_LAG_SECONDS = 10
+)
+
+// rollOutMembers restarts the members whose pod does not run the current StatefulSet revision, or
+// was started with a certificate that has since been renewed. The StatefulSet uses the OnDelete
+// strategy, so pods are only replaced when deleted here: secondaries first, one at a time and only
+// once every member is back in the set and caught up on the oplog, then the primary after it stepped
+// down. It returns false while members are still outdated.
+func (m *MongoClusterService) rollOutMembers() (bool, error) {
+	statefulSet := m.Stack.StatefulSet
+	if statefulSet.Spec.Replicas == nil || statefulSet.Status.ObservedGeneration < statefulSet.Generation {
+		m.Logger.Info("Waiting for the StatefulSet controller to observe the last StatefulSet update")
+		return false, nil
+	}
+	updateRevision := statefulSet.Status.UpdateRevision
+	var pods []*v1api.Pod
+	var outdated []int
+	for i := 0; int32(i) < *statefulSet.Spec.Replicas; i++ {
+		pod := &v1api.Pod{}
+		found, err := m.objectExists(getResourceGenericName(m.ReplicaSet.Name, strconv.Itoa(i)), pod)
+		if err != nil {
+			return false, err
+		}
+		if !found || !pod.DeletionTimestamp.IsZero() {
+			m.Logger.Info(fmt.Sprintf("Waiting for member %d to be recreated", i))
+			return false, nil
+		}
+		pods = append(pods, pod)
+		tlsUpToDate, err := m.memberTLSUpToDate(pod)
+		if err != nil {
+			return false, err
+		}
+		if pod.Labels[v1.ControllerRevisionHashLabelKey] != updateRevision || !tlsUpToDate {
+			outdated = append(outdated, i)
+		}
+	}
+	m.RolloutMessage = ""
+	if len(outdated) == 0 {
+		return true, nil
+	}
+	m.RolloutMessage = fmt.Sprintf("%d/%d members updated", len(pods)-len(outdated), len(pods))
+
+	// A member that is not ready does not count towards the majority, restarting it costs nothing and
+	// is the only way out when the previous revision cannot start.
+	for i := len(outdated) - 1; i >= 0; i-- {
+		if !isPodReady(pods[outdated[i]]) {
+			return false, m.restartMember(pods[outdated[i]])
+		}
+	}
+	if m.ReplicaSetStatus == nil {
+		return false, m.restartMember(pods[outdated[len(outdated)-1]])
+	}
+	if !m.isReplicaSetSettled(len(pods)) {
+		m.Logger.Info("Waiting for every member to be healthy and caught up before restarting the next one")
+		return false, nil
+	}
+
+	primary := m.ReplicaSetStatus.Primary()
+	for i := len(outdated) - 1; i >= 0; i-- {
+		host := getMemberHost(m.ReplicaSet.Name, m.Namespace, outdated[i])
+		if primary == nil || primary.Name != host {
+			return false, m.restartMember(pods[outdated[i]])
+		}
+	}
+	if len(pods) == 1 {
+		return false, m.restartMember(pods[0])
+	}
+	// Only the primary is left, hand its role over to an updated secondary before restarting it.
+	m.Logger.Info(fmt.Sprintf("Stepping down primary %s before restarting it", primary.Name))
+	primaryClient, err := m.newAdminClient(m.getReadyMemberHosts(), m.ReplicaSet.Name)
+	if err != nil {
+		return false, err
+	}
+	defer primaryClient.Disconnect(*m.Context)
+	if err := primaryClient.StepDown(*m.Context, MONGO_STEP_DOWN_SECONDS); err != nil {
+		m.Logger.Error(err, "Error stepping down primary")
+		return false, err
+	}
+	return false, nil
+}
+
+// isReplicaSetSettled tells whether every member is healthy, either primary, secondary or arbiter,
+// and no secondary lags more than MONGO_ROLLOUT_MAX_LAG_SECONDS behind the primary on top of its
+// configured delay.
+func (m *MongoClusterService) isReplicaSetSettled(memberCount int) bool {
+	primary := m.ReplicaSetStatus.Primary()
+	if primary == nil || len(m.ReplicaSetStatus.Members) < memberCount {
+		return false
+	}
+	for _, member := range m.ReplicaSetStatus.Members {
+		if member.Health != 1 {
+			return false
+		}
+		switch member.State {
+		case mongoadmin.MEMBER_STATE_PRIMARY, mongoadmin.MEMBER_STATE_ARBITER:
+		case mongoadmin.MEMBER_STATE_SECONDARY:
+			maxLag := float64(MONGO_ROLLOUT_MAX_LAG_SECONDS)
+			if index, found := getMemberIndex(m.ReplicaSet.Name, member.Name); found {
+				maxLag += float64(m.getDesiredMember(index).SecondaryDelaySecs)
+			}
+			if primary.OptimeDate.Sub(member.OptimeDate).Seconds() > maxLag {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// memberTLSUpToDate tells whether the pod runs the current certificate of its member, as recorded by
+// MONGO_TLS_HASH_ANNOTATION. A pod is recorded with the certificate current when it is first seen, the
+// init container copied it when the pod started.
+func (m *MongoClusterService) memberTLSUpToDate(pod *v1api.Pod) (bool, error) {
+	hash, found := m.MemberTLSHashes[pod.Name]
+	if !found {
+		return true, nil
+	}
+	if recorded, found := pod.Annotations[MONGO_TLS_HASH_ANNOTATION]; found {
+		return recorded == hash, nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[MONGO_TLS_HASH_ANNOTATION] = hash
+	if err := m.Reconciler.Client.Patch(*m.Context, pod, patch); err != nil {
+		m.Logger.Error(err, "Error recording the certificate of the pod")
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *MongoClusterService) restartMember(pod *v1api.Pod) error {
+	m.Logger.Info(fmt.Sprintf("Restarting member %s to apply the StatefulSet update or its new certificate", pod.Name))
+	if err := m.Reconciler.Client.Delete(*m.Context, pod); err != nil && !apierrors.IsNotFound(err) {
+		m.Logger.Error(err, "Error deleting pod")
+		return err
+	}
+	return nil
+}
+
+func isPodReady(pod *v1api.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1api.PodReady {
+			return condition.Status == v1api.ConditionTrue
+		}
+	}
+	return false
+}
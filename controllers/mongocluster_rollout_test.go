@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("rollOutMembers", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		mongo = mongofake.NewClient()
+		mongo.Config = newTestConfig(cluster, 3)
+	})
+
+	// newRollout returns the service of a pass that queried the replica set, with the StatefulSet at
+	// revision v2 and the members at the given revisions.
+	newRollout := func(revisions ...string) *MongoClusterService {
+		var pods []client.Object
+		for i, revision := range revisions {
+			pods = append(pods, newMemberPod(cluster, i, true, revision))
+		}
+		service := newTestService(cluster, mongo, pods...)
+		replicas := int32(len(revisions))
+		service.Stack.StatefulSet = &appsv1.StatefulSet{
+			Spec:   appsv1.StatefulSetSpec{Replicas: &replicas},
+			Status: appsv1.StatefulSetStatus{UpdateRevision: "v2"},
+		}
+		status, err := mongo.GetReplicaSetStatus(*service.Context)
+		Expect(err).NotTo(HaveOccurred())
+		service.ReplicaSetStatus = status
+		return service
+	}
+
+	restarted := func(service *MongoClusterService) []int {
+		var indexes []int
+		for i := 0; int32(i) < *service.Stack.StatefulSet.Spec.Replicas; i++ {
+			name := getResourceGenericName(cluster.Name, strconv.Itoa(i))
+			err := service.Reconciler.Client.Get(*service.Context, types.NamespacedName{Name: name, Namespace: testNamespace}, &v1api.Pod{})
+			if client.IgnoreNotFound(err) == nil && err != nil {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes
+	}
+
+	It("is done when every member runs the update revision", func() {
+		service := newRollout("v2", "v2", "v2")
+		rolledOut, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledOut).To(BeTrue())
+	})
+
+	It("restarts the secondaries first, from the highest ordinal", func() {
+		service := newRollout("v1", "v1", "v1")
+		rolledOut, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledOut).To(BeFalse())
+		Expect(restarted(service)).To(Equal([]int{2}))
+		Expect(service.RolloutMessage).To(Equal("0/3 members updated"))
+	})
+
+	It("skips the primary when it is the highest outdated ordinal", func() {
+		mongo.Primary = getMemberHost(cluster.Name, testNamespace, 2)
+		service := newRollout("v1", "v1", "v1")
+		_, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restarted(service)).To(Equal([]int{1}))
+	})
+
+	It("waits for the secondaries to catch up before restarting the next one", func() {
+		service := newRollout("v1", "v1", "v2")
+		now := time.Now()
+		service.ReplicaSetStatus.Members[0].OptimeDate = now
+		service.ReplicaSetStatus.Members[1].OptimeDate = now
+		service.ReplicaSetStatus.Members[2].OptimeDate = now.Add(-time.Minute)
+		rolledOut, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledOut).To(BeFalse())
+		Expect(restarted(service)).To(BeEmpty())
+	})
+
+	It("steps the primary down once it is the only outdated member", func() {
+		service := newRollout("v1", "v2", "v2")
+		rolledOut, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledOut).To(BeFalse())
+		Expect(restarted(service)).To(BeEmpty())
+		Expect(mongo.Commands).To(ContainElement("replSetStepDown"))
+
+		status, err := mongo.GetReplicaSetStatus(*service.Context)
+		Expect(err).NotTo(HaveOccurred())
+		service.ReplicaSetStatus = status
+		Expect(status.Primary().Name).NotTo(Equal(getMemberHost(cluster.Name, testNamespace, 0)))
+		_, err = service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restarted(service)).To(Equal([]int{0}))
+	})
+
+	It("restarts an outdated member that is not ready first", func() {
+		service := newRollout("v1", "v1", "v1")
+		Expect(service.Reconciler.Client.Update(*service.Context, newMemberPod(cluster, 0, false, "v1"))).To(Succeed())
+		_, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restarted(service)).To(Equal([]int{0}))
+	})
+
+	It("waits for the member states to settle", func() {
+		service := newRollout("v1", "v1", "v1")
+		service.ReplicaSetStatus.Members[1].State = mongoadmin.MEMBER_STATE_STARTUP2
+		_, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restarted(service)).To(BeEmpty())
+	})
+})
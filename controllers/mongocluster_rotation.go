@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"time"
+)
+
+const (
+	MONGO_KEYFILE_HASH_ANNOTATION = "apps.esgi.fr/keyfile-hash"
+	// MONGO_PENDING_PASSWORD_KEY holds the password a rotation is applying, until every replica set uses it
+	MONGO_PENDING_PASSWORD_KEY = "pendingPassword"
+)
+
+// rotateCredentials runs the rotation of spec.auth.rotation once the cluster is reconciled. The new
+// admin password is applied with updateUser, then the keyfile goes through the two keys transition:
+// members restart with both the previous and the new key, so that restarted and not yet restarted
+// members still authenticate each other, then restart again with the new key only. Each step is
+// recorded in the status, the keyfile secret tells which key step is in progress if it is lost.
+func (m *MongoClusterService) rotateCredentials() (ctrl.Result, error) {
+	rotation := m.AppConfig.Spec.Auth.Rotation
+	if rotation == nil {
+		return ctrl.Result{}, nil
+	}
+	status := &appsv1beta1.CredentialRotationStatus{}
+	if m.AppConfig.Status.Rotation != nil {
+		status = m.AppConfig.Status.Rotation.DeepCopy()
+	}
+	m.RotationStatus = status
+	keyfileSecret, err := m.createKeyfileSecret()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	keys := mongoadmin.ParseKeyfile(string(keyfileSecret.Data[MONGO_KEYFILE_KEY]))
+
+	if status.Phase == appsv1beta1.RotationIdle {
+		trigger := m.AppConfig.Annotations[appsv1beta1.RotateCredentialsAnnotation]
+		due, untilDue := m.isRotationDue(status, trigger)
+		if len(keys) > 1 {
+			m.Logger.Info("Resuming the keyfile rotation")
+			status.Phase = appsv1beta1.RotationAddingKey
+		} else if !due {
+			return ctrl.Result{RequeueAfter: untilDue}, nil
+		} else {
+			m.Logger.Info("Starting the rotation of the credentials")
+			status.Phase = appsv1beta1.RotationPassword
+			status.LastTrigger = trigger
+		}
+	}
+	if status.Phase != appsv1beta1.RotationPassword && !m.routersRolledOut() {
+		m.Logger.Info("Waiting for the routers to restart with the current keyfile")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+
+	switch status.Phase {
+	case appsv1beta1.RotationPassword:
+		if err := m.rotatePassword(); err != nil {
+			return ctrl.Result{}, err
+		}
+		newKey, err := generateRandomString(MONGO_KEYFILE_RANDOM_BYTES, base64.StdEncoding)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		m.Logger.Info("Adding the new key to the keyfile")
+		if err := m.updateKeyfile(keyfileSecret, []string{keys[len(keys)-1], newKey}); err != nil {
+			return ctrl.Result{}, err
+		}
+		status.Phase = appsv1beta1.RotationAddingKey
+	case appsv1beta1.RotationAddingKey:
+		// Every member runs with both keys, the rollout of the two keys keyfile is complete.
+		if len(keys) > 1 {
+			m.Logger.Info("Removing the previous key from the keyfile")
+			if err := m.updateKeyfile(keyfileSecret, keys[len(keys)-1:]); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		status.Phase = appsv1beta1.RotationRemovingKey
+	case appsv1beta1.RotationRemovingKey:
+		now := metav1.Now()
+		m.Logger.Info("Rotation of the credentials completed")
+		status.Phase = appsv1beta1.RotationIdle
+		status.LastRotationTime = &now
+		_, untilDue := m.isRotationDue(status, status.LastTrigger)
+		return ctrl.Result{RequeueAfter: untilDue}, nil
+	}
+	return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+}
+
+// isRotationDue tells whether a rotation is due, and otherwise how long until the next one when an
+// interval is set. A new value of the annotation makes a rotation due right away.
+func (m *MongoClusterService) isRotationDue(status *appsv1beta1.CredentialRotationStatus, trigger string) (bool, time.Duration) {
+	if trigger != "" && trigger != status.LastTrigger {
+		return true, 0
+	}
+	interval := m.AppConfig.Spec.Auth.Rotation.Interval
+	if interval == nil || interval.Duration <= 0 {
+		return false, 0
+	}
+	last := m.AppConfig.CreationTimestamp.Time
+	if status.LastRotationTime != nil {
+		last = status.LastRotationTime.Time
+	}
+	untilDue := time.Until(last.Add(interval.Duration))
+	return untilDue <= 0, untilDue
+}
+
+// rotatePassword applies a new admin password to every replica set of the cluster, the routers read
+// the users of the config servers. The new password is stored in the admin secret before it is
+// applied, so that a rotation interrupted in between resumes with the same password.
+func (m *MongoClusterService) rotatePassword() error {
+	adminSecret := &v1api.Secret{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: getAdminSecretName(m.AppConfig.Name), Namespace: m.Namespace}, adminSecret)
+	if err != nil {
+		m.Logger.Error(err, "Error getting admin secret")
+		return err
+	}
+	pendingPassword := string(adminSecret.Data[MONGO_PENDING_PASSWORD_KEY])
+	if pendingPassword == "" {
+		pendingPassword, err = generateRandomString(MONGO_PASSWORD_RANDOM_BYTES, base64.RawURLEncoding)
+		if err != nil {
+			return err
+		}
+		adminSecret.Data[MONGO_PENDING_PASSWORD_KEY] = []byte(pendingPassword)
+		if err := m.Reconciler.Client.Update(*m.Context, adminSecret); err != nil {
+			m.Logger.Error(err, "Error storing the new admin password")
+			return err
+		}
+	}
+	currentPassword := string(adminSecret.Data[MONGO_PASSWORD_KEY])
+	for _, replicaSet := range m.getReplicaSetServices() {
+		if err := replicaSet.changeAdminPassword(currentPassword, pendingPassword); err != nil {
+			return err
+		}
+	}
+	m.Logger.Info("Swapping in the new admin password")
+	adminSecret.Data[MONGO_PASSWORD_KEY] = []byte(pendingPassword)
+	delete(adminSecret.Data, MONGO_PENDING_PASSWORD_KEY)
+	if err := m.Reconciler.Client.Update(*m.Context, adminSecret); err != nil {
+		m.Logger.Error(err, "Error updating admin secret")
+		return err
+	}
+	return nil
+}
+
+// changeAdminPassword runs updateUser on the primary of m.ReplicaSet. When the current password is
+// rejected, the new one may already be in place from an interrupted rotation, which is checked by
+// connecting with it.
+func (m *MongoClusterService) changeAdminPassword(currentPassword string, newPassword string) error {
+	hosts := m.getReadyMemberHosts()
+	m.Logger.Info(fmt.Sprintf("Changing the admin password of replica set %s", m.ReplicaSet.Name))
+	err := m.runWithPassword(hosts, currentPassword, func(adminClient mongoadmin.Client) error {
+		return adminClient.ChangeUserPassword(*m.Context, mongoadmin.ADMIN_DATABASE, MONGODB_DEFAULT_USER, newPassword)
+	})
+	if err == nil {
+		return nil
+	}
+	checkErr := m.runWithPassword(hosts, newPassword, func(adminClient mongoadmin.Client) error {
+		_, err := adminClient.GetUser(*m.Context, mongoadmin.ADMIN_DATABASE, MONGODB_DEFAULT_USER)
+		return err
+	})
+	if checkErr != nil {
+		m.Logger.Error(err, "Error changing the admin password")
+		return err
+	}
+	return nil
+}
+
+func (m *MongoClusterService) runWithPassword(hosts []string, password string, command func(mongoadmin.Client) error) error {
+	adminClient, err := m.newAdminClientWithPassword(hosts, m.ReplicaSet.Name, password)
+	if err != nil {
+		return err
+	}
+	defer adminClient.Disconnect(*m.Context)
+	return command(adminClient)
+}
+
+// updateKeyfile writes the keys to the keyfile secret. The StatefulSets and the routers pick the
+// change up through MONGO_KEYFILE_HASH_ANNOTATION on the next pass and roll their pods.
+func (m *MongoClusterService) updateKeyfile(keyfileSecret *v1api.Secret, keys []string) error {
+	keyfileSecret.Data[MONGO_KEYFILE_KEY] = []byte(mongoadmin.FormatKeyfile(keys))
+	return m.createOrUpdateOwnedSecret(keyfileSecret)
+}
+
+// getKeyfileHash identifies the content of the keyfile the pods are started with.
+func (m *MongoClusterService) getKeyfileHash() (string, error) {
+	keyfileSecret, err := m.createKeyfileSecret()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(keyfileSecret.Data[MONGO_KEYFILE_KEY])
+	return hex.EncodeToString(hash[:])[:16], nil
+}
+
+// getPendingPassword returns the password a rotation is applying, empty when there is none.
+func (m *MongoClusterService) getPendingPassword() (string, error) {
+	adminSecret := &v1api.Secret{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: getAdminSecretName(m.AppConfig.Name), Namespace: m.Namespace}, adminSecret)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting admin secret")
+		return "", err
+	}
+	return string(adminSecret.Data[MONGO_PENDING_PASSWORD_KEY]), nil
+}
+
+// routersRolledOut tells whether every router runs the current template, always true outside of a
+// sharded cluster.
+func (m *MongoClusterService) routersRolledOut() bool {
+	if !m.isSharded() {
+		return true
+	}
+	deployment := m.Stack.Routers
+	return deployment.Spec.Replicas != nil &&
+		deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.UpdatedReplicas == *deployment.Spec.Replicas &&
+		deployment.Status.Replicas == deployment.Status.UpdatedReplicas &&
+		deployment.Status.AvailableReplicas == deployment.Status.UpdatedReplicas
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// authenticatingFactory only opens the fake client with the current password of the admin user.
+func authenticatingFactory(mongo *mongofake.Client) mongoadmin.Factory {
+	return func(ctx context.Context, options mongoadmin.Options) (mongoadmin.Client, error) {
+		if options.Password != mongo.Passwords[mongoadmin.ADMIN_DATABASE][MONGODB_DEFAULT_USER] {
+			return nil, fmt.Errorf("authentication failed")
+		}
+		return mongo, nil
+	}
+}
+
+var _ = Describe("rotateCredentials", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+	var adminSecret *v1api.Secret
+	var keyfileSecret *v1api.Secret
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Auth.Rotation = &appsv1beta1.CredentialRotation{}
+		mongo = mongofake.NewClient()
+		Expect(mongo.CreateUser(context.Background(), mongoadmin.ADMIN_DATABASE, MONGODB_DEFAULT_USER, "old", nil)).To(Succeed())
+		mongo.Commands = nil
+		adminSecret = &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: getAdminSecretName(cluster.Name), Namespace: testNamespace},
+			Data:       map[string][]byte{MONGO_PASSWORD_KEY: []byte("old")},
+		}
+		keyfileSecret = &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: getKeyfileSecretName(cluster.Name), Namespace: testNamespace},
+			Data:       map[string][]byte{MONGO_KEYFILE_KEY: []byte("previous-key")},
+		}
+	})
+
+	newRotationService := func() *MongoClusterService {
+		service := newTestService(cluster, mongo, adminSecret, keyfileSecret)
+		service.Reconciler.MongoAdmin = authenticatingFactory(mongo)
+		return service
+	}
+
+	// rotate runs a pass of the rotation and records its progress in the status of the cluster, as
+	// UpdateStatus does.
+	rotate := func(service *MongoClusterService) ctrl.Result {
+		result, err := service.rotateCredentials()
+		Expect(err).NotTo(HaveOccurred())
+		cluster.Status.Rotation = service.RotationStatus
+		return result
+	}
+
+	getSecret := func(service *MongoClusterService, name string) *v1api.Secret {
+		secret := &v1api.Secret{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, secret)).To(Succeed())
+		return secret
+	}
+
+	getKeys := func(service *MongoClusterService) []string {
+		return mongoadmin.ParseKeyfile(string(getSecret(service, keyfileSecret.Name).Data[MONGO_KEYFILE_KEY]))
+	}
+
+	It("does nothing without spec.auth.rotation", func() {
+		cluster.Spec.Auth.Rotation = nil
+		service := newRotationService()
+		Expect(rotate(service)).To(Equal(ctrl.Result{}))
+		Expect(service.RotationStatus).To(BeNil())
+	})
+
+	It("waits for the annotation without an interval", func() {
+		service := newRotationService()
+		Expect(rotate(service)).To(Equal(ctrl.Result{}))
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationIdle))
+		Expect(mongo.Commands).To(BeEmpty())
+		Expect(getKeys(service)).To(Equal([]string{"previous-key"}))
+	})
+
+	It("rotates the password, then adds the new key, then removes the previous one", func() {
+		cluster.Annotations = map[string]string{appsv1beta1.RotateCredentialsAnnotation: "1"}
+		service := newRotationService()
+
+		Expect(rotate(service)).To(Equal(ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}))
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationAddingKey))
+		Expect(cluster.Status.Rotation.LastTrigger).To(Equal("1"))
+		password := string(getSecret(service, adminSecret.Name).Data[MONGO_PASSWORD_KEY])
+		Expect(password).NotTo(Equal("old"))
+		Expect(mongo.Passwords[mongoadmin.ADMIN_DATABASE][MONGODB_DEFAULT_USER]).To(Equal(password))
+		Expect(getSecret(service, adminSecret.Name).Data).NotTo(HaveKey(MONGO_PENDING_PASSWORD_KEY))
+		keys := getKeys(service)
+		Expect(keys).To(HaveLen(2))
+		Expect(keys[0]).To(Equal("previous-key"))
+		Expect(keys[1]).To(HaveLen(756))
+
+		Expect(rotate(service)).To(Equal(ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}))
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationRemovingKey))
+		Expect(getKeys(service)).To(Equal(keys[1:]))
+
+		Expect(rotate(service)).To(Equal(ctrl.Result{}))
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationIdle))
+		Expect(cluster.Status.Rotation.LastRotationTime).NotTo(BeNil())
+
+		mongo.Commands = nil
+		Expect(rotate(service)).To(Equal(ctrl.Result{}))
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationIdle))
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("starts a rotation once the interval has elapsed", func() {
+		cluster.Spec.Auth.Rotation.Interval = &metav1.Duration{Duration: time.Hour}
+		cluster.CreationTimestamp = metav1.NewTime(time.Now().Add(-30 * time.Minute))
+		service := newRotationService()
+		result := rotate(service)
+		Expect(result.RequeueAfter).To(BeNumerically("~", 30*time.Minute, time.Minute))
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationIdle))
+
+		cluster.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+		rotate(service)
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationAddingKey))
+		rotate(service)
+		result = rotate(service)
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationIdle))
+		Expect(result.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+	})
+
+	It("resumes with the pending password the primary already took", func() {
+		cluster.Status.Rotation = &appsv1beta1.CredentialRotationStatus{Phase: appsv1beta1.RotationPassword}
+		adminSecret.Data[MONGO_PENDING_PASSWORD_KEY] = []byte("pending")
+		mongo.Passwords[mongoadmin.ADMIN_DATABASE][MONGODB_DEFAULT_USER] = "pending"
+		service := newRotationService()
+		rotate(service)
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationAddingKey))
+		Expect(getSecret(service, adminSecret.Name).Data).To(Equal(map[string][]byte{MONGO_PASSWORD_KEY: []byte("pending")}))
+	})
+
+	It("resumes with the pending password the primary has not taken yet", func() {
+		cluster.Status.Rotation = &appsv1beta1.CredentialRotationStatus{Phase: appsv1beta1.RotationPassword}
+		adminSecret.Data[MONGO_PENDING_PASSWORD_KEY] = []byte("pending")
+		service := newRotationService()
+		rotate(service)
+		Expect(mongo.Passwords[mongoadmin.ADMIN_DATABASE][MONGODB_DEFAULT_USER]).To(Equal("pending"))
+		Expect(getSecret(service, adminSecret.Name).Data).To(Equal(map[string][]byte{MONGO_PASSWORD_KEY: []byte("pending")}))
+	})
+
+	It("fails when neither password is accepted", func() {
+		cluster.Status.Rotation = &appsv1beta1.CredentialRotationStatus{Phase: appsv1beta1.RotationPassword}
+		adminSecret.Data[MONGO_PENDING_PASSWORD_KEY] = []byte("pending")
+		mongo.Passwords[mongoadmin.ADMIN_DATABASE][MONGODB_DEFAULT_USER] = "other"
+		service := newRotationService()
+		_, err := service.rotateCredentials()
+		Expect(err).To(HaveOccurred())
+		Expect(getSecret(service, adminSecret.Name).Data).To(HaveKeyWithValue(MONGO_PENDING_PASSWORD_KEY, []byte("pending")))
+	})
+
+	It("resumes the removal of the previous key from a two keys keyfile", func() {
+		keyfileSecret.Data[MONGO_KEYFILE_KEY] = []byte(mongoadmin.FormatKeyfile([]string{"previous-key", "new-key"}))
+		service := newRotationService()
+		rotate(service)
+		Expect(cluster.Status.Rotation.Phase).To(Equal(appsv1beta1.RotationRemovingKey))
+		Expect(getKeys(service)).To(Equal([]string{"new-key"}))
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+})
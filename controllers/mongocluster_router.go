@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"fmt"
+	v1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	MONGO_ROUTER_FORMAT = "%s-mongos"
+	MONGO_ROUTER_SCRIPT = "/scripts/run_mongos.sh"
+)
+
+func getRouterName(clusterName string) string {
+	return fmt.Sprintf(MONGO_ROUTER_FORMAT, clusterName)
+}
+
+// createOrUpdateRouters reconciles the mongos Deployment of a sharded cluster and the service clients
+// connect through.
+func (m *MongoClusterService) createOrUpdateRouters() error {
+	issued, err := m.createOrUpdateRouterCertificate()
+	if err != nil {
+		return err
+	}
+	if !issued {
+		m.Logger.Info("Waiting for the router certificate to be issued")
+		return nil
+	}
+	err = m.createOrUpdateRouterDeployment()
+	if err != nil {
+		return err
+	}
+	name := getRouterName(m.AppConfig.Name)
+	return m.createOrUpdateService(m.createService(name, map[string]string{"app": name}))
+}
+
+func (m *MongoClusterService) createOrUpdateRouterDeployment() error {
+	actualDeployment := &v1.Deployment{}
+	expectedDeployment, err := m.createRouterDeployment()
+	if err != nil {
+		m.Logger.Error(err, "Error creating router Deployment")
+		return err
+	}
+	err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: expectedDeployment.Name, Namespace: m.Namespace}, actualDeployment)
+
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting router Deployment")
+		return err
+	} else if errors.IsNotFound(err) {
+		m.Logger.Info(fmt.Sprintf("Creating router Deployment %s", expectedDeployment.Name))
+		err = m.Reconciler.Client.Create(*m.Context, expectedDeployment)
+		if err != nil {
+			m.Logger.Error(err, "Error creating router Deployment")
+			return err
+		}
+	} else if actualDeployment.Annotations[MONGO_TEMPLATE_HASH_ANNOTATION] == expectedDeployment.Annotations[MONGO_TEMPLATE_HASH_ANNOTATION] &&
+		*actualDeployment.Spec.Replicas == *expectedDeployment.Spec.Replicas {
+		m.Logger.Info(fmt.Sprintf("Router Deployment %s is up to date. Nothing to do.", expectedDeployment.Name))
+		m.updateStack(*actualDeployment)
+		return nil
+	} else {
+		// Routers hold no data, the Deployment rolling update can restart them on its own.
+		m.Logger.Info(fmt.Sprintf("Updating router Deployment %s", expectedDeployment.Name))
+		actualDeployment.Annotations = expectedDeployment.Annotations
+		actualDeployment.Spec.Replicas = expectedDeployment.Spec.Replicas
+		actualDeployment.Spec.Template = expectedDeployment.Spec.Template
+		err = m.Reconciler.Client.Update(*m.Context, actualDeployment)
+		if err != nil {
+			m.Logger.Error(err, "Error updating router Deployment")
+			return err
+		}
+		m.updateStack(*actualDeployment)
+		return nil
+	}
+	m.updateStack(*expectedDeployment)
+	return nil
+}
+
+func (m *MongoClusterService) createRouterDeployment() (*v1.Deployment, error) {
+	name := getRouterName(m.AppConfig.Name)
+	resources, err := m.getResourceRequirements()
+	if err != nil {
+		m.Logger.Error(err, "Error parsing resources")
+		return nil, err
+	}
+	image := m.AppConfig.Spec.Image
+	if image == "" {
+		image = MONGO_CONTAINER_IMAGE
+	}
+	replicas := m.AppConfig.Spec.Sharding.Routers
+	labels := map[string]string{
+		"app": name,
+	}
+	// Routers only read the keyfile when they start, they are restarted whenever it changes.
+	keyfileHash, err := m.getKeyfileHash()
+	if err != nil {
+		return nil, err
+	}
+	template := v1api.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      labels,
+			Annotations: map[string]string{MONGO_KEYFILE_HASH_ANNOTATION: keyfileHash},
+		},
+		Spec: v1api.PodSpec{
+			Containers: []v1api.Container{
+				{
+					Name:      MONGO_CONTAINER_NAME,
+					Image:     image,
+					Resources: resources,
+					Env: append([]v1api.EnvVar{
+						{
+							Name:  "MONGODB_CONFIG_DB",
+							Value: m.getConfigServerConnectionString(),
+						},
+					}, getAuthMechanismEnv(m.AppConfig)...),
+					Ports: []v1api.ContainerPort{
+						{
+							ContainerPort: MONGO_CONTAINER_PORT,
+						},
+					},
+					Command: []string{"/bin/bash"},
+					Args:    []string{MONGO_ROUTER_SCRIPT},
+					ReadinessProbe: &v1api.Probe{
+						ProbeHandler: v1api.ProbeHandler{
+							TCPSocket: &v1api.TCPSocketAction{
+								Port: intstr.IntOrString{Type: intstr.Int, IntVal: MONGO_CONTAINER_PORT},
+							},
+						},
+						InitialDelaySeconds: 5,
+						PeriodSeconds:       10,
+					},
+					VolumeMounts: []v1api.VolumeMount{
+						{
+							Name:      MONGO_KEY_VOLUME_NAME,
+							MountPath: MONGO_KEY_MOUNT_PATH,
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+			Volumes: []v1api.Volume{
+				getKeyfileVolume(m.AppConfig.Name),
+			},
+		},
+	}
+	if m.AppConfig.Spec.TLS != nil {
+		tlsVolume, tlsHash, err := m.getRouterTLSVolume()
+		if err != nil {
+			return nil, err
+		}
+		m.addTLS(&template, tlsVolume, tlsHash)
+	}
+	templateHash, err := getTemplateHash(template)
+	if err != nil {
+		return nil, err
+	}
+	deployment := &v1.Deployment{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			Annotations: map[string]string{
+				MONGO_TEMPLATE_HASH_ANNOTATION: templateHash,
+			},
+		},
+		Spec: v1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: template,
+		},
+	}
+	if err := ctrl.SetControllerReference(m.AppConfig, deployment, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting router Deployment owner reference")
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// deleteRouters deletes the mongos Deployment and its service, nothing is left when the cluster is
+// not sharded.
+func (m *MongoClusterService) deleteRouters() error {
+	name := getRouterName(m.AppConfig.Name)
+	deployment := &v1.Deployment{}
+	found, err := m.objectExists(name, deployment)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := m.Reconciler.Client.Delete(*m.Context, deployment); err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting router Deployment")
+			return err
+		}
+	}
+	service := &v1api.Service{}
+	found, err = m.objectExists(name, service)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := m.Reconciler.Client.Delete(*m.Context, service); err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting router service")
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+)
+
+// getStatefulSetReplicas returns the replica count to give to the StatefulSet. On scale down the
+// current count is kept until the members above the desired count have been removed from the replica set
+// and the configuration without them has been committed by a majority, so that no pod is deleted
+// while it still counts as a voting member.
+func (m *MongoClusterService) getStatefulSetReplicas() (int32, error) {
+	desiredReplicas := m.ReplicaSet.Replicas
+	statefulSet := m.getStatefulSet()
+	if statefulSet.Spec.Replicas == nil || *statefulSet.Spec.Replicas <= desiredReplicas {
+		return desiredReplicas, nil
+	}
+	currentReplicas := *statefulSet.Spec.Replicas
+	removed, err := m.areRemovedMembersOutOfReplicaSet()
+	if err != nil {
+		return currentReplicas, err
+	}
+	if !removed {
+		m.Logger.Info(fmt.Sprintf("Keeping %d members until the removed ones have left the replica set", currentReplicas))
+		return currentReplicas, nil
+	}
+	m.Logger.Info(fmt.Sprintf("Scaling down from %d to %d members", currentReplicas, desiredReplicas))
+	return desiredReplicas, nil
+}
+
+func (m *MongoClusterService) areRemovedMembersOutOfReplicaSet() (bool, error) {
+	hosts := m.getReadyMemberHosts()
+	if len(hosts) == 0 {
+		m.Logger.Info("No member ready, cannot check the replica set configuration before scaling down")
+		return false, nil
+	}
+	primaryClient, err := m.newAdminClient(hosts, m.ReplicaSet.Name)
+	if err != nil {
+		return false, err
+	}
+	defer primaryClient.Disconnect(*m.Context)
+	config, err := primaryClient.GetReplicaSetConfig(*m.Context)
+	if errors.Is(err, mongoadmin.ErrNotYetInitialized) {
+		return true, nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting replica set configuration")
+		return false, err
+	}
+	for _, member := range config.Members {
+		index, found := getMemberIndex(m.ReplicaSet.Name, member.Host)
+		if !found || int32(index) >= m.ReplicaSet.Replicas {
+			return false, nil
+		}
+	}
+	committed, err := primaryClient.IsReplicaSetConfigCommitted(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error getting replica set configuration commitment status")
+		return false, err
+	}
+	return committed, nil
+}
+
+// cleanupRemovedMembers deletes the services of the members the StatefulSet no longer runs, and their
+// claims when the scale down policy asks for it. Members whose pod is still running are left alone.
+func (m *MongoClusterService) cleanupRemovedMembers() error {
+	for i := int(m.ReplicaSet.Replicas); ; i++ {
+		memberName := getResourceGenericName(m.ReplicaSet.Name, strconv.Itoa(i))
+		podFound, err := m.objectExists(memberName, &v1api.Pod{})
+		if err != nil {
+			return err
+		}
+		service := &v1api.Service{}
+		serviceFound, err := m.objectExists(memberName, service)
+		if err != nil {
+			return err
+		}
+		pvc := &v1api.PersistentVolumeClaim{}
+		pvcFound, err := m.objectExists(getPersistentVolumeClaimName(m.ReplicaSet.Name, i), pvc)
+		if err != nil {
+			return err
+		}
+		if !podFound && !serviceFound && !pvcFound {
+			return nil
+		}
+		if podFound {
+			continue
+		}
+		if serviceFound {
+			m.Logger.Info(fmt.Sprintf("Deleting service %s of removed member", service.Name))
+			if err := m.Reconciler.Client.Delete(*m.Context, service); err != nil && !apierrors.IsNotFound(err) {
+				m.Logger.Error(err, "Error deleting service")
+				return err
+			}
+		}
+		if pvcFound && m.AppConfig.Spec.Storage.ScaleDownPolicy == appsv1beta1.ScaleDownDelete && pvc.DeletionTimestamp.IsZero() {
+			m.Logger.Info(fmt.Sprintf("Deleting PVC %s of removed member", pvc.Name))
+			if err := m.Reconciler.Client.Delete(*m.Context, pvc); err != nil && !apierrors.IsNotFound(err) {
+				m.Logger.Error(err, "Error deleting PVC")
+				return err
+			}
+		}
+	}
+}
+
+func (m *MongoClusterService) objectExists(name string, object client.Object) (bool, error) {
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name, Namespace: m.Namespace}, object)
+	if err != nil && apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		m.Logger.Error(err, fmt.Sprintf("Error getting %s", name))
+		return false, err
+	}
+	return true, nil
+}
+
+// getMemberIndex extracts the ordinal from a host built by getMemberHost.
+func getMemberIndex(clusterName string, host string) (int, bool) {
+	prefix := getResourceGenericName(clusterName, "")
+	podName := strings.Split(host, ".")[0]
+	if !strings.HasPrefix(podName, prefix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(podName, prefix))
+	if err != nil {
+		return 0, false
+	}
+	return index, true
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("getStatefulSetReplicas", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+	var service *MongoClusterService
+
+	BeforeEach(func() {
+		cluster = newTestCluster(2)
+		mongo = mongofake.NewClient()
+		replicas := int32(3)
+		statefulSet := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: getStatefulSetName(cluster.Name), Namespace: testNamespace},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		}
+		service = newTestService(cluster, mongo, statefulSet,
+			newMemberPod(cluster, 0, true, "v1"),
+			newMemberPod(cluster, 1, true, "v1"),
+			newMemberPod(cluster, 2, true, "v1"))
+	})
+
+	It("keeps the removed member while it is in the replica set", func() {
+		mongo.Config = newTestConfig(cluster, 3)
+		replicas, err := service.getStatefulSetReplicas()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replicas).To(BeEquivalentTo(3))
+	})
+
+	It("keeps the removed member until its removal is committed", func() {
+		mongo.Config = newTestConfig(cluster, 2)
+		mongo.Uncommitted = true
+		replicas, err := service.getStatefulSetReplicas()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replicas).To(BeEquivalentTo(3))
+	})
+
+	It("scales down once the removal is committed", func() {
+		mongo.Config = newTestConfig(cluster, 2)
+		replicas, err := service.getStatefulSetReplicas()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replicas).To(BeEquivalentTo(2))
+	})
+})
@@ -2,53 +2,62 @@ package controllers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	v1 "k8s.io/api/apps/v1"
 	v1api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
-	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
-func (m *MongoClusterService) createOrUpdateSecret() error {
-	actualSecret := &v1api.Secret{}
-	expectedSecret, err := m.createPasswordSecret()
-	if err != nil {
-		m.Logger.Error(err, "Error creating Password Secret")
-		return err
-	}
-	err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: expectedSecret.Name, Namespace: m.Namespace}, actualSecret)
-	secretUpToDate := !reflect.DeepEqual((*expectedSecret).Data, (*actualSecret).Data) && m.secretExists(*expectedSecret)
+const (
+	MONGO_ADMIN_SECRET_FORMAT   = "%s-admin"
+	MONGO_KEYFILE_SECRET_FORMAT = "%s-keyfile"
+	MONGO_PASSWORD_KEY          = "password"
+	MONGO_KEYFILE_KEY           = "keyfile"
+	// MONGO_KEYFILE_RANDOM_BYTES are encoded to a 756 characters keyfile, the largest base64 keyfile
+	// without padding under the 1024 characters mongod accepts
+	MONGO_KEYFILE_RANDOM_BYTES  = 567
+	MONGO_PASSWORD_RANDOM_BYTES = 24
+)
 
-	if err != nil && !errors.IsNotFound(err) {
-		m.Logger.Error(err, "Error getting service")
-		return err
-	} else if errors.IsNotFound(err) {
-		m.Logger.Info(fmt.Sprintf("Creating service %s", expectedSecret.Name))
-		err = m.Reconciler.Client.Create(*m.Context, expectedSecret)
+func getAdminSecretName(clusterName string) string {
+	return fmt.Sprintf(MONGO_ADMIN_SECRET_FORMAT, clusterName)
+}
+
+func getKeyfileSecretName(clusterName string) string {
+	return fmt.Sprintf(MONGO_KEYFILE_SECRET_FORMAT, clusterName)
+}
+
+// createOrUpdateSecret writes the admin password and the keyfile secrets of the cluster, owned by it.
+// The admin password of an existing secret is left to its owner.
+func (m *MongoClusterService) createOrUpdateSecret() error {
+	if m.AppConfig.Spec.Auth.ExistingSecretName == "" {
+		adminSecret, err := m.createPasswordSecret()
 		if err != nil {
-			m.Logger.Error(err, "Error creating service")
+			m.Logger.Error(err, "Error creating Password Secret")
 			return err
 		}
-	} else if secretUpToDate {
-		m.Logger.Info(fmt.Sprintf("Secret %s is up to date. Nothing to do.", expectedSecret.Name))
-		return nil
-	} else {
-		m.Logger.Info(fmt.Sprintf("Updating service %s", expectedSecret.Name))
-		actualSecret.Data = expectedSecret.Data
-		err = m.Reconciler.Client.Update(*m.Context, actualSecret)
-		if err != nil {
-			m.Logger.Error(err, "Error updating service")
+		if err := m.createOrUpdateOwnedSecret(adminSecret); err != nil {
 			return err
 		}
+		m.updateStack(*adminSecret)
 	}
-	m.updateStack(expectedSecret)
-
-	return nil
+	keyfileSecret, err := m.createKeyfileSecret()
+	if err != nil {
+		m.Logger.Error(err, "Error creating Keyfile Secret")
+		return err
+	}
+	return m.createOrUpdateOwnedSecret(keyfileSecret)
 }
 
+// createPasswordSecret returns the secret holding the admin password: the existing secret of the
+// spec, or the admin secret of the cluster holding the password of the spec, the password already
+// generated, or a new random one.
 func (m *MongoClusterService) createPasswordSecret() (*v1api.Secret, error) {
-	var password string
 	mongoCluster := m.AppConfig
 	apiSecretResult := &v1api.Secret{}
 	key := types.NamespacedName{Namespace: m.Namespace, Name: mongoCluster.Spec.Auth.ExistingSecretName}
@@ -59,48 +68,137 @@ func (m *MongoClusterService) createPasswordSecret() (*v1api.Secret, error) {
 			return nil, err
 		}
 		return apiSecretResult, nil
-	} else if mongoCluster.Spec.Auth.Password != "" {
-		password = mongoCluster.Spec.Auth.Password
-	} else {
-		m.Logger.Info(fmt.Sprintf("No password or secret name provided \n"+
-			"INSECURE: take default password [%s]"+
-			"", MONGODB_DEFAULT_PASSWORD))
-		err := m.Reconciler.Client.Get(
-			context.Background(),
-			types.NamespacedName{Namespace: m.Namespace, Name: DEFAULT_PASSWORD_SECRET_NAME},
-			apiSecretResult)
-		if err == nil {
-			return apiSecretResult, nil
+	}
+	name := getAdminSecretName(mongoCluster.Name)
+	password := mongoCluster.Spec.Auth.Password
+	if password == "" {
+		var err error
+		password, err = m.getSecretValue(name, MONGO_PASSWORD_KEY, MONGO_PASSWORD_RANDOM_BYTES, base64.RawURLEncoding)
+		if err != nil {
+			return nil, err
 		}
-		password = MONGODB_DEFAULT_PASSWORD
+	}
+	secret := &v1api.Secret{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: mongoCluster.Name},
+		},
+		Data: map[string][]byte{
+			MONGO_PASSWORD_KEY: []byte(password),
+		},
+	}
+	// The password a rotation is applying is kept until the rotation swaps it in.
+	pendingPassword, err := m.getPendingPassword()
+	if err != nil {
+		return nil, err
+	}
+	if pendingPassword != "" {
+		secret.Data[MONGO_PENDING_PASSWORD_KEY] = []byte(pendingPassword)
+	}
+	return secret, nil
+}
+
+// createKeyfileSecret returns the secret holding the key the members and the routers authenticate
+// each other with. The key is generated once and kept afterwards.
+func (m *MongoClusterService) createKeyfileSecret() (*v1api.Secret, error) {
+	name := getKeyfileSecretName(m.AppConfig.Name)
+	keyfile, err := m.getSecretValue(name, MONGO_KEYFILE_KEY, MONGO_KEYFILE_RANDOM_BYTES, base64.StdEncoding)
+	if err != nil {
+		return nil, err
 	}
 	return &v1api.Secret{
 		ObjectMeta: ctrl.ObjectMeta{
-			Name:      DEFAULT_PASSWORD_SECRET_NAME,
+			Name:      name,
 			Namespace: m.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: m.AppConfig.Name},
 		},
 		Data: map[string][]byte{
-			"password": []byte(password),
+			MONGO_KEYFILE_KEY: []byte(keyfile),
 		},
 	}, nil
 }
 
-func (m *MongoClusterService) deleteSecret(secret v1api.Secret) error {
-	if !reflect.DeepEqual(secret, v1api.Secret{}) {
-		return nil
+// getSecretValue returns the value of the key of a secret of the cluster. A missing secret gets a
+// random value, unless the cluster predates the per-cluster secrets: its members still run with the
+// shared legacy secret as both the admin password and the keyfile, so its value is carried over.
+func (m *MongoClusterService) getSecretValue(name string, key string, randomBytes int, encoding *base64.Encoding) (string, error) {
+	secret := &v1api.Secret{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name, Namespace: m.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting secret")
+		return "", err
+	} else if err == nil && len(secret.Data[key]) > 0 {
+		return string(secret.Data[key]), nil
 	}
-	err := m.Reconciler.Client.Delete(*m.Context, &secret)
+	legacy, err := m.predatesClusterSecrets()
 	if err != nil {
-		m.Logger.Error(err, "Error deleting secret")
-		return err
+		return "", err
+	}
+	if legacy {
+		m.Logger.Info(fmt.Sprintf("Migrating secret %s from the shared secret %s", name, DEFAULT_PASSWORD_SECRET_NAME))
+		return m.getLegacyPassword()
 	}
-	return nil
+	return generateRandomString(randomBytes, encoding)
 }
 
-func (m *MongoClusterService) secretExists(secret v1api.Secret) bool {
-	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: secret.Name, Namespace: m.Namespace}, &secret)
-	if err != nil {
-		return false
+// predatesClusterSecrets tells whether members of the cluster were created before it had its own
+// secrets, as a StatefulSet, or as the Deployments of the first layout.
+func (m *MongoClusterService) predatesClusterSecrets() (bool, error) {
+	statefulSetNames := []string{getStatefulSetName(m.AppConfig.Name)}
+	if m.isSharded() {
+		statefulSetNames = append(statefulSetNames, getStatefulSetName(getConfigServerName(m.AppConfig.Name)))
+	}
+	for _, name := range statefulSetNames {
+		if found, err := m.objectExists(name, &v1.StatefulSet{}); err != nil || found {
+			return found, err
+		}
+	}
+	return m.objectExists(getResourceGenericName(m.AppConfig.Name, "0"), &v1.Deployment{})
+}
+
+// getLegacyPassword returns the password of the secret the clusters of a namespace used to share, or
+// the default password it was created with. That secret is left in place, other clusters of the
+// namespace may not have been migrated yet.
+func (m *MongoClusterService) getLegacyPassword() (string, error) {
+	secret := &v1api.Secret{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: DEFAULT_PASSWORD_SECRET_NAME, Namespace: m.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting legacy password secret")
+		return "", err
+	} else if errors.IsNotFound(err) || len(secret.Data[MONGO_PASSWORD_KEY]) == 0 {
+		return MONGODB_DEFAULT_PASSWORD, nil
+	}
+	return string(secret.Data[MONGO_PASSWORD_KEY]), nil
+}
+
+func generateRandomString(randomBytes int, encoding *base64.Encoding) (string, error) {
+	buffer := make([]byte, randomBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(buffer), nil
+}
+
+// getPasswordSecretName returns the secret holding the admin password of the cluster, for the
+// resources that reference it without going through a MongoClusterService.
+func getPasswordSecretName(mongoCluster *appsv1beta1.MongoCluster) string {
+	if mongoCluster.Spec.Auth.ExistingSecretName != "" {
+		return mongoCluster.Spec.Auth.ExistingSecretName
+	}
+	return getAdminSecretName(mongoCluster.Name)
+}
+
+// getKeyfileVolume mounts the keyfile of a cluster at MONGO_KEY_MOUNT_PATH, mongod and mongos read it
+// from MONGO_KEY_MOUNT_PATH/keyfile.
+func getKeyfileVolume(clusterName string) v1api.Volume {
+	return v1api.Volume{
+		Name: MONGO_KEY_VOLUME_NAME,
+		VolumeSource: v1api.VolumeSource{
+			Secret: &v1api.SecretVolumeSource{
+				SecretName:  getKeyfileSecretName(clusterName),
+				DefaultMode: &MONGO_KEY_SECRET_DEFAULT_MODE,
+			},
+		},
 	}
-	return true
 }
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("createOrUpdateSecret", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		mongo = mongofake.NewClient()
+	})
+
+	getSecret := func(service *MongoClusterService, name string) (*v1api.Secret, error) {
+		secret := &v1api.Secret{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, secret)
+		return secret, err
+	}
+
+	legacySecret := func(password string) *v1api.Secret {
+		return &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: DEFAULT_PASSWORD_SECRET_NAME, Namespace: testNamespace},
+			Data:       map[string][]byte{MONGO_PASSWORD_KEY: []byte(password)},
+		}
+	}
+
+	It("generates a password and a keyfile of its own for a new cluster", func() {
+		service := newTestService(cluster, mongo, legacySecret("shared"))
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+
+		adminSecret, err := getSecret(service, "mongo-admin")
+		Expect(err).NotTo(HaveOccurred())
+		keyfileSecret, err := getSecret(service, "mongo-keyfile")
+		Expect(err).NotTo(HaveOccurred())
+		password := string(adminSecret.Data[MONGO_PASSWORD_KEY])
+		keyfile := string(keyfileSecret.Data[MONGO_KEYFILE_KEY])
+		Expect(password).NotTo(BeEmpty())
+		Expect(password).NotTo(Equal("shared"))
+		Expect(keyfile).To(HaveLen(756))
+		Expect(keyfile).To(MatchRegexp("^[A-Za-z0-9+/]+$"))
+		Expect(keyfile).NotTo(Equal(password))
+		for _, secret := range []*v1api.Secret{adminSecret, keyfileSecret} {
+			Expect(secret.OwnerReferences).To(HaveLen(1))
+			Expect(secret.OwnerReferences[0].Name).To(Equal(cluster.Name))
+			Expect(secret.Labels).To(HaveKeyWithValue(MONGO_CLUSTER_LABEL, cluster.Name))
+		}
+
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+		adminSecret, _ = getSecret(service, "mongo-admin")
+		keyfileSecret, _ = getSecret(service, "mongo-keyfile")
+		Expect(string(adminSecret.Data[MONGO_PASSWORD_KEY])).To(Equal(password))
+		Expect(string(keyfileSecret.Data[MONGO_KEYFILE_KEY])).To(Equal(keyfile))
+	})
+
+	It("keeps the secrets of two clusters of a namespace apart", func() {
+		other := newTestCluster(3)
+		other.Name = "other"
+		service := newTestService(cluster, mongo, other)
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+		otherService := service.Reconciler.NewService(context.Background(), other, testNamespace)
+		Expect(otherService.createOrUpdateSecret()).To(Succeed())
+
+		first, _ := getSecret(service, "mongo-keyfile")
+		second, err := getSecret(service, "other-keyfile")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Data[MONGO_KEYFILE_KEY]).NotTo(Equal(first.Data[MONGO_KEYFILE_KEY]))
+	})
+
+	It("sets the password of the spec", func() {
+		cluster.Spec.Auth.Password = "from-spec"
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+		adminSecret, _ := getSecret(service, "mongo-admin")
+		Expect(adminSecret.Data).To(HaveKeyWithValue(MONGO_PASSWORD_KEY, []byte("from-spec")))
+	})
+
+	It("leaves the password of an existing secret to its owner", func() {
+		cluster.Spec.Auth.ExistingSecretName = "my-password"
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+		_, err := getSecret(service, "mongo-admin")
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		_, err = getSecret(service, "mongo-keyfile")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("carries the shared secret over to the secrets of an existing cluster", func() {
+		statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: getStatefulSetName(cluster.Name), Namespace: testNamespace}}
+		service := newTestService(cluster, mongo, statefulSet, legacySecret("shared"))
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+
+		adminSecret, _ := getSecret(service, "mongo-admin")
+		keyfileSecret, _ := getSecret(service, "mongo-keyfile")
+		Expect(adminSecret.Data).To(HaveKeyWithValue(MONGO_PASSWORD_KEY, []byte("shared")))
+		Expect(keyfileSecret.Data).To(HaveKeyWithValue(MONGO_KEYFILE_KEY, []byte("shared")))
+		_, err := getSecret(service, DEFAULT_PASSWORD_SECRET_NAME)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("carries the default password over when the shared secret is gone", func() {
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: getResourceGenericName(cluster.Name, "0"), Namespace: testNamespace}}
+		service := newTestService(cluster, mongo, deployment)
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+		adminSecret, _ := getSecret(service, "mongo-admin")
+		Expect(adminSecret.Data).To(HaveKeyWithValue(MONGO_PASSWORD_KEY, []byte(MONGODB_DEFAULT_PASSWORD)))
+	})
+})
@@ -4,25 +4,24 @@ import (
 	"context"
 	"fmt"
 	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
 	"github.com/go-logr/logr"
 	v1 "k8s.io/api/apps/v1"
 	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"reflect"
-	"strconv"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"time"
 )
 
-var mongoMaster string
-var mongoGenericPodName string
-
 const (
 	MONGODB_DEFAULT_USER               = "admin"
 	MONGODB_DEFAULT_PASSWORD           = "mongo_pwd"
 	MONGODB_DEFAULT_ROLE               = "root"
-	MONGO_DEPLOYMENT_REPLICAS          = 1
 	MONGODB_DEFAULT_HOST               = "mongo"
 	MONGO_CONTAINER_PORT         int32 = 27017
 	MONGO_CONTAINER_NAME               = "mongo"
-	MONGO_CONTAINER_IMAGE              = "paulb314/mongo:5.0.6"
+	MONGO_CONTAINER_IMAGE              = "paulb314/mongo:5.0.6-8"
 	MONGO_KEY_VOLUME_NAME              = "mongo-key"
 	MONGO_KEY_MOUNT_PATH               = "/etc/secrets-volume/"
 	MONGO_STORAGE_VOLUME_NAME          = "mongo-persistent-storage"
@@ -34,8 +33,18 @@ const (
 
 var (
 	MONGO_KEY_SECRET_DEFAULT_MODE int32 = 0400
+	MONGO_REQUEUE_DELAY                 = 10 * time.Second
 )
 
+// MongoReplicaSet is one replica set run for a MongoCluster: the cluster itself, or the config
+// server replica set and the shards of a sharded cluster. Its name prefixes all its resources.
+type MongoReplicaSet struct {
+	Name     string
+	Replicas int32
+	// ClusterRole is the mongod --configsvr or --shardsvr option, empty outside of a sharded cluster
+	ClusterRole string
+}
+
 type MongoClusterService struct {
 	AppConfig  *appsv1beta1.MongoCluster
 	Namespace  string
@@ -43,10 +52,42 @@ type MongoClusterService struct {
 	Context    *context.Context
 	Stack      *MongoClusterStack
 	Logger     logr.Logger
+	// ReplicaSet is the replica set the member resources of this service belong to
+	ReplicaSet *MongoReplicaSet
+	// ReplicaSets are the services of the config server and of the shards of a sharded cluster
+	ReplicaSets []*MongoClusterService
+	// RegisteredShards records the shards known to the routers, nil until they have been listed
+	RegisteredShards map[string]bool
+	// ReplicaSetStatus is the last replSetGetStatus answer, nil until the replica set is initiated
+	ReplicaSetStatus *mongoadmin.ReplicaSetStatus
+	// RolloutMessage describes the progress of the rolling update, empty when every member is updated
+	RolloutMessage string
+	// StorageMessage describes the changes of spec.storage the claims of the members do not follow
+	StorageMessage string
+	// MemberTLSHashes identify the certificate of each member by pod name, nil when the members share one
+	MemberTLSHashes map[string]string
+	// BackupStatuses is the outcome of the backup schedules, nil until they have been reconciled
+	BackupStatuses []appsv1beta1.ScheduledBackupStatus
+	// OplogArchiveStatus is the progress of the oplog archiving, nil until it has been reconciled
+	OplogArchiveStatus *appsv1beta1.OplogArchiveStatus
+	// OplogArchiveCondition is set when the last oplog archiving run reported whether the archive is continuous
+	OplogArchiveCondition *metav1.Condition
+	// BootstrapStatus is the progress of spec.bootstrap, nil when it has not been reconciled
+	BootstrapStatus *appsv1beta1.BootstrapStatus
+	// ConnectionSecretName is the connection secret written during this pass, empty until it has been
+	ConnectionSecretName string
+	// Binding is the servicebinding.io secret written during this pass, nil until it has been
+	Binding *appsv1beta1.BindingReference
+	// RotationStatus is the progress of the credential rotation, nil when it has not been reconciled
+	RotationStatus *appsv1beta1.CredentialRotationStatus
+	// ExternalHosts are the addresses the members of m.ReplicaSet advertise outside of Kubernetes, keyed
+	// by member index, filled during this pass
+	ExternalHosts map[int]string
 }
 
 type MongoClusterStack struct {
-	Deployments            *[]v1.Deployment
+	StatefulSet            *v1.StatefulSet
+	Routers                *v1.Deployment
 	Services               *[]v1api.Service
 	PersistentVolumeClaims *[]v1api.PersistentVolumeClaim
 	Secret                 *v1api.Secret
@@ -59,8 +100,13 @@ func (r *MongoClusterReconciler) NewService(context context.Context, appConfig *
 		Reconciler: r,
 		Context:    &context,
 		Logger:     logger,
+		ReplicaSet: &MongoReplicaSet{
+			Name:     appConfig.Name,
+			Replicas: appConfig.Spec.Replicas,
+		},
 		Stack: &MongoClusterStack{
-			Deployments:            &[]v1.Deployment{},
+			StatefulSet:            &v1.StatefulSet{},
+			Routers:                &v1.Deployment{},
 			Services:               &[]v1api.Service{},
 			PersistentVolumeClaims: &[]v1api.PersistentVolumeClaim{},
 			Secret:                 &v1api.Secret{},
@@ -68,45 +114,127 @@ func (r *MongoClusterReconciler) NewService(context context.Context, appConfig *
 	}
 }
 
-func (m *MongoClusterService) CreateOrUpdate() error {
+func (m *MongoClusterService) CreateOrUpdate() (ctrl.Result, error) {
 	var err error
-	mongoClusterStack, err := m.getStack()
+	err = m.createOrUpdateSecret()
 	if err != nil {
-		m.Logger.Error(err, "Error getting stack")
+		return ctrl.Result{}, err
 	}
-	err = m.createOrUpdateSecret()
+	_, err = m.createOrUpdateClientCertificate()
 	if err != nil {
-		return err
+		return ctrl.Result{}, err
+	}
+	err = m.createOrUpdateConnectionSecret()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = m.createOrUpdateBindingSecret()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = m.createOrUpdateBackupSchedules()
+	if err != nil {
+		return ctrl.Result{}, err
 	}
-	givenConfigurations := m.AppConfig.Spec
+	err = m.createOrUpdateOplogArchive()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if m.isSharded() {
+		return m.createOrUpdateShardedCluster()
+	}
+	bootstrapped, err := m.bootstrap()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !bootstrapped {
+		m.Logger.Info("Bootstrap of the first member in progress. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	migrated, err := m.migrateLegacyMembers()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !migrated {
+		m.Logger.Info("Migration of the legacy members to the StatefulSet in progress. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	result, err := m.createOrUpdateReplicaSet()
+	if err != nil || result.RequeueAfter > 0 {
+		return result, err
+	}
+	return m.rotateCredentials()
+}
 
-	for i := 0; int32(i) < givenConfigurations.Replicas; i++ {
-		if len(*(mongoClusterStack.PersistentVolumeClaims)) <= i {
-			m.Logger.Info(fmt.Sprintf("No persistent volume claim already existing for %d. Create it...", i))
-			err = m.createOrUpdatePersistentVolumeClaim(getResourceGenericName(m.AppConfig.Name, strconv.Itoa(i)))
-			if err != nil {
-				return err
-			}
-		}
-		if len(*(mongoClusterStack.Deployments)) <= i {
-			m.Logger.Info(fmt.Sprintf("No deployment already existing for %d. Create it...", i))
-			err = m.createOrUpdateDeployment(i, getResourceGenericName(m.AppConfig.Name, strconv.Itoa(i)))
-			if err != nil {
-				return err
-			}
-		}
-		if len(*(mongoClusterStack.Services)) <= i {
-			m.Logger.Info(fmt.Sprintf("No service already existing for %d. Create it...", i))
-			err = m.createOrUpdateService(getResourceGenericName(m.AppConfig.Name, strconv.Itoa(i)))
-			if err != nil {
-				return err
-			}
+// createOrUpdateReplicaSet reconciles the StatefulSet, the services and the members of m.ReplicaSet.
+func (m *MongoClusterService) createOrUpdateReplicaSet() (ctrl.Result, error) {
+	err := m.createOrUpdateService(m.createHeadlessService())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = m.createOrUpdateExternalServices()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	replicas, err := m.getStatefulSetReplicas()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	issued, err := m.createOrUpdateMemberCertificates(replicas)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !issued {
+		m.Logger.Info("Waiting for the member certificates to be issued. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	err = m.createOrUpdateStatefulSet(replicas)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := 0; int32(i) < m.ReplicaSet.Replicas; i++ {
+		err = m.createOrUpdateService(m.createMemberService(i))
+		if err != nil {
+			return ctrl.Result{}, err
 		}
 	}
-	return nil
+	err = m.cleanupRemovedMembers()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	reconciled, err := m.reconcileReplicaSet()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !reconciled || replicas != m.ReplicaSet.Replicas {
+		m.Logger.Info("Replica set members are not reconciled yet. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	rolledOut, err := m.rollOutMembers()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !rolledOut {
+		m.Logger.Info("Rolling update of the members in progress. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	return ctrl.Result{}, nil
 }
 
 func (m *MongoClusterService) Delete() error {
+	for _, replicaSet := range m.getReplicaSetServices() {
+		if err := replicaSet.deleteReplicaSet(); err != nil {
+			return err
+		}
+	}
+	// The secrets are owned by the cluster and go away with it, the existing secrets of the spec are
+	// left to their owner.
+	return m.deleteRouters()
+}
+
+// deleteReplicaSet deletes the StatefulSet and the services of m.ReplicaSet, and its claims when
+// spec.storage.deletionPolicy is Delete.
+func (m *MongoClusterService) deleteReplicaSet() error {
 	var err error
 	mongoClusterStack, err := m.getStack()
 
@@ -115,8 +243,8 @@ func (m *MongoClusterService) Delete() error {
 		return err
 	}
 
-	if reflect.DeepEqual(*mongoClusterStack.Deployments, []v1.Deployment{}) {
-	} else if err := m.deleteDeployments(*mongoClusterStack.Deployments); err != nil {
+	if reflect.DeepEqual(mongoClusterStack.StatefulSet, &v1.StatefulSet{}) {
+	} else if err := m.deleteStatefulSet(*mongoClusterStack.StatefulSet); err != nil {
 		return err
 	}
 
@@ -125,16 +253,14 @@ func (m *MongoClusterService) Delete() error {
 		return err
 	}
 
-	if reflect.DeepEqual(mongoClusterStack.PersistentVolumeClaims, &[]v1api.PersistentVolumeClaim{}) {
+	// The claims hold the data of the members, they are only deleted when the spec asks for it.
+	if m.AppConfig.Spec.Storage.DeletionPolicy != appsv1beta1.DeletionDelete {
+		m.Logger.Info(fmt.Sprintf("Retaining the persistent volume claims of %s", m.ReplicaSet.Name))
+	} else if reflect.DeepEqual(mongoClusterStack.PersistentVolumeClaims, &[]v1api.PersistentVolumeClaim{}) {
 	} else if err := m.deletePersistentVolumeClaims(*mongoClusterStack.PersistentVolumeClaims); err != nil {
 		return err
 	}
 
-	if reflect.DeepEqual(mongoClusterStack.Secret, &v1api.Secret{}) {
-	} else if err := m.deleteSecret(*mongoClusterStack.Secret); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -143,14 +269,12 @@ func (m *MongoClusterService) updateStack(resource interface{}) {
 		m.Logger.Info("The provided resource is null. Nothing to update")
 		return
 	}
-	if reflect.TypeOf(resource) == reflect.TypeOf(v1.Deployment{}) {
-		for i := 0; i < len(*m.Stack.Deployments); i++ {
-			if (*m.Stack.Deployments)[i].Name == resource.(v1.Deployment).Name {
-				(*m.Stack.Deployments)[i] = resource.(v1.Deployment)
-				return
-			}
-		}
-		*m.Stack.Deployments = append(*m.Stack.Deployments, resource.(v1.Deployment))
+	if reflect.TypeOf(resource) == reflect.TypeOf(v1.StatefulSet{}) {
+		statefulSet := resource.(v1.StatefulSet)
+		m.Stack.StatefulSet = &statefulSet
+	} else if reflect.TypeOf(resource) == reflect.TypeOf(v1.Deployment{}) {
+		deployment := resource.(v1.Deployment)
+		m.Stack.Routers = &deployment
 	} else if reflect.TypeOf(resource) == reflect.TypeOf(v1api.Service{}) {
 		for i := 0; i < len(*m.Stack.Services); i++ {
 			if (*(m.Stack.Services))[i].Name == resource.(v1api.Service).Name {
@@ -176,7 +300,7 @@ func (m *MongoClusterService) updateStack(resource interface{}) {
 }
 
 func (m *MongoClusterService) getStack() (*MongoClusterStack, error) {
-	deployments := m.getDeployments()
+	statefulSet := m.getStatefulSet()
 	services := m.getServices()
 	pvcs := m.getPersistentVolumeClaims()
 
@@ -186,7 +310,7 @@ func (m *MongoClusterService) getStack() (*MongoClusterStack, error) {
 	}
 
 	mongoStack := MongoClusterStack{
-		Deployments:            deployments,
+		StatefulSet:            statefulSet,
 		Services:               services,
 		PersistentVolumeClaims: pvcs,
 		Secret:                 secret,
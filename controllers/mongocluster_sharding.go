@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	MONGO_CONFIG_SERVER_FORMAT = "%s-cfg"
+	MONGO_SHARD_FORMAT         = "%s-shard-%d"
+	CLUSTER_ROLE_CONFIG_SERVER = "configsvr"
+	CLUSTER_ROLE_SHARD         = "shardsvr"
+)
+
+func (m *MongoClusterService) isSharded() bool {
+	return m.AppConfig.Spec.Sharding != nil
+}
+
+// getReplicaSets lists the replica sets of the cluster, the config server replica set comes first
+// since the routers and the shards depend on it.
+func (m *MongoClusterService) getReplicaSets() []MongoReplicaSet {
+	sharding := m.AppConfig.Spec.Sharding
+	if sharding == nil {
+		return []MongoReplicaSet{*m.ReplicaSet}
+	}
+	replicaSets := []MongoReplicaSet{{
+		Name:        getConfigServerName(m.AppConfig.Name),
+		Replicas:    sharding.ConfigServers,
+		ClusterRole: CLUSTER_ROLE_CONFIG_SERVER,
+	}}
+	for i := 0; int32(i) < sharding.Shards; i++ {
+		replicaSets = append(replicaSets, MongoReplicaSet{
+			Name:        getShardName(m.AppConfig.Name, i),
+			Replicas:    sharding.MembersPerShard,
+			ClusterRole: CLUSTER_ROLE_SHARD,
+		})
+	}
+	return replicaSets
+}
+
+// getReplicaSetServices returns one service per replica set of the cluster, m itself when the
+// cluster is not sharded.
+func (m *MongoClusterService) getReplicaSetServices() []*MongoClusterService {
+	if !m.isSharded() {
+		return []*MongoClusterService{m}
+	}
+	if len(m.ReplicaSets) == 0 {
+		for _, replicaSet := range m.getReplicaSets() {
+			m.ReplicaSets = append(m.ReplicaSets, m.newReplicaSetService(replicaSet))
+		}
+	}
+	return m.ReplicaSets
+}
+
+func (m *MongoClusterService) newReplicaSetService(replicaSet MongoReplicaSet) *MongoClusterService {
+	service := m.Reconciler.NewService(*m.Context, m.AppConfig, m.Namespace)
+	service.ReplicaSet = &replicaSet
+	return &service
+}
+
+// createOrUpdateShardedCluster reconciles every replica set of the cluster, then the routers, and
+// registers the shards once all of them have a primary.
+func (m *MongoClusterService) createOrUpdateShardedCluster() (ctrl.Result, error) {
+	reconciled := true
+	for _, replicaSet := range m.getReplicaSetServices() {
+		result, err := replicaSet.createOrUpdateReplicaSet()
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if result.Requeue || result.RequeueAfter > 0 {
+			reconciled = false
+		}
+	}
+	err := m.createOrUpdateRouters()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !reconciled {
+		m.Logger.Info("Replica sets of the sharded cluster are not reconciled yet. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	registered, err := m.registerShards()
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !registered {
+		m.Logger.Info("Shards are not registered yet. Requeue...")
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	return m.rotateCredentials()
+}
+
+// registerShards runs addShard through the routers for every shard they do not know yet.
+func (m *MongoClusterService) registerShards() (bool, error) {
+	if m.Stack.Routers.Status.ReadyReplicas == 0 {
+		m.Logger.Info("Waiting for a router to be ready before registering the shards")
+		return false, nil
+	}
+	routerClient, err := m.newAdminClient([]string{getRouterHost(m.AppConfig.Name, m.Namespace)}, "")
+	if err != nil {
+		return false, err
+	}
+	defer routerClient.Disconnect(*m.Context)
+	shards, err := routerClient.ListShards(*m.Context)
+	if err != nil {
+		m.Logger.Error(err, "Error listing shards")
+		return false, err
+	}
+	m.RegisteredShards = map[string]bool{}
+	for _, shard := range shards {
+		m.RegisteredShards[shard.ID] = true
+	}
+	for _, replicaSet := range m.getReplicaSetServices() {
+		if replicaSet.ReplicaSet.ClusterRole != CLUSTER_ROLE_SHARD || m.RegisteredShards[replicaSet.ReplicaSet.Name] {
+			continue
+		}
+		var hosts []string
+		for i := 0; int32(i) < replicaSet.ReplicaSet.Replicas; i++ {
+			hosts = append(hosts, getMemberHost(replicaSet.ReplicaSet.Name, m.Namespace, i))
+		}
+		m.Logger.Info(fmt.Sprintf("Adding shard %s", replicaSet.ReplicaSet.Name))
+		if err := routerClient.AddShard(*m.Context, mongoadmin.ReplicaSetSeedList(replicaSet.ReplicaSet.Name, hosts)); err != nil {
+			m.Logger.Error(err, "Error adding shard")
+			return false, err
+		}
+		m.RegisteredShards[replicaSet.ReplicaSet.Name] = true
+	}
+	return true, nil
+}
+
+func getConfigServerName(clusterName string) string {
+	return fmt.Sprintf(MONGO_CONFIG_SERVER_FORMAT, clusterName)
+}
+
+func getShardName(clusterName string, index int) string {
+	return fmt.Sprintf(MONGO_SHARD_FORMAT, clusterName, index)
+}
+
+// getConfigServerConnectionString is the --configdb option of the routers.
+func (m *MongoClusterService) getConfigServerConnectionString() string {
+	name := getConfigServerName(m.AppConfig.Name)
+	var hosts []string
+	for i := 0; int32(i) < m.AppConfig.Spec.Sharding.ConfigServers; i++ {
+		hosts = append(hosts, getMemberHost(name, m.Namespace, i))
+	}
+	return mongoadmin.ReplicaSetSeedList(name, hosts)
+}
+
+func getRouterHost(clusterName string, namespace string) string {
+	return fmt.Sprintf("%s.%s.svc.%s:%d", getRouterName(clusterName), namespace, MONGO_CLUSTER_DOMAIN, MONGO_CONTAINER_PORT)
+}
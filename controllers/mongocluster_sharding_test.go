@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+)
+
+var _ = Describe("registerShards", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Sharding = &appsv1beta1.Sharding{Shards: 2, MembersPerShard: 2, ConfigServers: 3, Routers: 1}
+		mongo = mongofake.NewClient()
+	})
+
+	It("waits for a router to be ready", func() {
+		service := newTestService(cluster, mongo)
+		registered, err := service.registerShards()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registered).To(BeFalse())
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("adds the shards the routers do not know with the seed list of their replica set", func() {
+		firstShard := getShardName(cluster.Name, 0)
+		mongo.Shards = []mongoadmin.Shard{{ID: firstShard, State: 1}}
+		service := newTestService(cluster, mongo)
+		service.Stack.Routers.Status.ReadyReplicas = 1
+
+		registered, err := service.registerShards()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registered).To(BeTrue())
+		secondShard := getShardName(cluster.Name, 1)
+		Expect(mongo.Shards).To(HaveLen(2))
+		Expect(mongo.Shards[1].ID).To(Equal(secondShard))
+		Expect(mongo.Shards[1].Host).To(Equal(mongoadmin.ReplicaSetSeedList(secondShard, []string{
+			getMemberHost(secondShard, testNamespace, 0),
+			getMemberHost(secondShard, testNamespace, 1),
+		})))
+		Expect(service.RegisteredShards).To(Equal(map[string]bool{firstShard: true, secondShard: true}))
+	})
+})
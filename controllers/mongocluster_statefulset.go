@@ -0,0 +1,378 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strings"
+)
+
+const (
+	MONGO_STATEFULSET_FORMAT       = "%s-mongo"
+	MONGO_HEADLESS_SERVICE_SUFFIX  = "headless"
+	MONGO_TEMPLATE_HASH_ANNOTATION = "apps.esgi.fr/template-hash"
+)
+
+// MONGO_CLUSTER_DOMAIN is the DNS domain of the Kubernetes cluster the hosts of the members are built
+// from, set with the --cluster-domain flag of the manager.
+var MONGO_CLUSTER_DOMAIN = "cluster.local"
+
+func (m *MongoClusterService) getStatefulSet() *v1.StatefulSet {
+	statefulSet := &v1.StatefulSet{}
+	name := getStatefulSetName(m.ReplicaSet.Name)
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: name, Namespace: m.Namespace}, statefulSet)
+	if err != nil {
+		m.Logger.Info(fmt.Sprintf("StatefulSet %s does not exist yet.", name))
+		return &v1.StatefulSet{}
+	}
+	return statefulSet
+}
+
+func (m *MongoClusterService) createOrUpdateStatefulSet(replicas int32) error {
+	actualStatefulSet := &v1.StatefulSet{}
+	expectedStatefulSet, err := m.createStatefulSet(replicas)
+	if err != nil {
+		m.Logger.Error(err, "Error creating StatefulSet")
+		return err
+	}
+	err = m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: expectedStatefulSet.Name, Namespace: m.Namespace}, actualStatefulSet)
+
+	if err != nil && !errors.IsNotFound(err) {
+		m.Logger.Error(err, "Error getting StatefulSet")
+		return err
+	} else if errors.IsNotFound(err) {
+		m.Logger.Info(fmt.Sprintf("Creating StatefulSet %s", expectedStatefulSet.Name))
+		err = m.Reconciler.Client.Create(*m.Context, expectedStatefulSet)
+		if err != nil {
+			m.Logger.Error(err, "Error creating StatefulSet")
+			return err
+		}
+		m.updateStack(*expectedStatefulSet)
+		return nil
+	}
+	m.StorageMessage = getStorageMessage(expectedStatefulSet, actualStatefulSet)
+	if m.StorageMessage != "" {
+		m.Logger.Info(m.StorageMessage)
+	}
+	if statefulSetUpToDate(expectedStatefulSet, actualStatefulSet) {
+		m.Logger.Info(fmt.Sprintf("StatefulSet %s is up to date. Nothing to do.", expectedStatefulSet.Name))
+		m.updateStack(*actualStatefulSet)
+		return nil
+	}
+	// Only the replica count, the pod template and the update strategy of a StatefulSet are mutable.
+	m.Logger.Info(fmt.Sprintf("Updating StatefulSet %s", expectedStatefulSet.Name))
+	actualStatefulSet.Annotations = expectedStatefulSet.Annotations
+	actualStatefulSet.Spec.Replicas = expectedStatefulSet.Spec.Replicas
+	actualStatefulSet.Spec.Template = expectedStatefulSet.Spec.Template
+	actualStatefulSet.Spec.UpdateStrategy = expectedStatefulSet.Spec.UpdateStrategy
+	err = m.Reconciler.Client.Update(*m.Context, actualStatefulSet)
+	if err != nil {
+		m.Logger.Error(err, "Error updating StatefulSet")
+		return err
+	}
+	m.updateStack(*actualStatefulSet)
+	return nil
+}
+
+// statefulSetUpToDate compares the template hash recorded on both objects rather than the specs
+// themselves, since the API server fills in defaults that would never DeepEqual the expected spec.
+func statefulSetUpToDate(expected *v1.StatefulSet, actual *v1.StatefulSet) bool {
+	return actual.Annotations[MONGO_TEMPLATE_HASH_ANNOTATION] == expected.Annotations[MONGO_TEMPLATE_HASH_ANNOTATION] &&
+		*actual.Spec.Replicas == *expected.Spec.Replicas &&
+		actual.Spec.UpdateStrategy.Type == expected.Spec.UpdateStrategy.Type
+}
+
+// getStorageMessage describes the changes of spec.storage the claim template of the StatefulSet does
+// not follow, empty when there are none. The claims of a StatefulSet cannot be changed once created,
+// the changes are reported on the Degraded condition instead.
+func getStorageMessage(expected *v1.StatefulSet, actual *v1.StatefulSet) string {
+	if len(expected.Spec.VolumeClaimTemplates) == 0 || len(actual.Spec.VolumeClaimTemplates) == 0 {
+		return ""
+	}
+	expectedClaim, actualClaim := expected.Spec.VolumeClaimTemplates[0].Spec, actual.Spec.VolumeClaimTemplates[0].Spec
+	var changes []string
+	expectedSize, actualSize := expectedClaim.Resources.Requests[v1api.ResourceStorage], actualClaim.Resources.Requests[v1api.ResourceStorage]
+	if expectedSize.Cmp(actualSize) != 0 {
+		changes = append(changes, fmt.Sprintf("size %s to %s", actualSize.String(), expectedSize.String()))
+	}
+	expectedClass, actualClass := "", ""
+	if expectedClaim.StorageClassName != nil {
+		expectedClass = *expectedClaim.StorageClassName
+	}
+	if actualClaim.StorageClassName != nil {
+		actualClass = *actualClaim.StorageClassName
+	}
+	if expectedClass != actualClass {
+		changes = append(changes, fmt.Sprintf("storageClassName %q to %q", actualClass, expectedClass))
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("The claims of StatefulSet %s cannot be changed, storage changes from %s are not applied", actual.Name, strings.Join(changes, " and "))
+}
+
+func (m *MongoClusterService) createStatefulSet(replicas int32) (*v1.StatefulSet, error) {
+	name := getStatefulSetName(m.ReplicaSet.Name)
+	envVars, err := m.createPodEnvVariables()
+	if err != nil {
+		m.Logger.Error(err, "Error getting mongo pod env variables")
+		return nil, err
+	}
+	volumeClaimTemplate, err := m.createPersistentVolumeClaim(MONGO_STORAGE_VOLUME_NAME, m.AppConfig.Spec.Storage.StorageClassName)
+	if err != nil {
+		m.Logger.Error(err, "Error creating volume claim template")
+		return nil, err
+	}
+	volumeClaimTemplate.Namespace = ""
+	resources, err := m.getResourceRequirements()
+	if err != nil {
+		m.Logger.Error(err, "Error parsing resources")
+		return nil, err
+	}
+	image := m.AppConfig.Spec.Image
+	if image == "" {
+		image = MONGO_CONTAINER_IMAGE
+	}
+	labels := map[string]string{
+		"app": name,
+	}
+	// Members only read the keyfile when they start, they are restarted whenever it changes.
+	keyfileHash, err := m.getKeyfileHash()
+	if err != nil {
+		return nil, err
+	}
+	template := v1api.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      labels,
+			Annotations: map[string]string{MONGO_KEYFILE_HASH_ANNOTATION: keyfileHash},
+		},
+		Spec: v1api.PodSpec{
+			Containers: []v1api.Container{
+				{
+					Name:      MONGO_CONTAINER_NAME,
+					Image:     image,
+					Env:       envVars,
+					Resources: resources,
+					Ports: []v1api.ContainerPort{
+						{
+							ContainerPort: MONGO_CONTAINER_PORT,
+						},
+					},
+					Command: []string{"/bin/bash"},
+					Args:    []string{"/scripts/run.sh"},
+					ReadinessProbe: &v1api.Probe{
+						ProbeHandler: v1api.ProbeHandler{
+							TCPSocket: &v1api.TCPSocketAction{
+								Port: intstr.IntOrString{Type: intstr.Int, IntVal: MONGO_CONTAINER_PORT},
+							},
+						},
+						InitialDelaySeconds: 5,
+						PeriodSeconds:       10,
+					},
+					VolumeMounts: []v1api.VolumeMount{
+						{
+							Name:      MONGO_KEY_VOLUME_NAME,
+							MountPath: MONGO_KEY_MOUNT_PATH,
+							ReadOnly:  true,
+						},
+						{
+							Name:      MONGO_STORAGE_VOLUME_NAME,
+							MountPath: MONGO_STORAGE_MOUNT_PATH,
+						},
+					},
+				},
+			},
+			Volumes: []v1api.Volume{
+				getKeyfileVolume(m.AppConfig.Name),
+			},
+		},
+	}
+	if m.AppConfig.Spec.TLS != nil {
+		if err := m.addMemberTLS(&template); err != nil {
+			return nil, err
+		}
+	}
+	templateHash, err := getTemplateHash(template)
+	if err != nil {
+		return nil, err
+	}
+	statefulSet := &v1.StatefulSet{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      name,
+			Namespace: m.Namespace,
+			Annotations: map[string]string{
+				MONGO_TEMPLATE_HASH_ANNOTATION: templateHash,
+			},
+		},
+		Spec: v1.StatefulSetSpec{
+			ServiceName: getHeadlessServiceName(m.ReplicaSet.Name),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Replicas:             &replicas,
+			PodManagementPolicy:  v1.OrderedReadyPodManagement,
+			Template:             template,
+			VolumeClaimTemplates: []v1api.PersistentVolumeClaim{*volumeClaimTemplate},
+			// Pods are restarted by rollOutMembers, which knows which member is the primary.
+			UpdateStrategy: v1.StatefulSetUpdateStrategy{
+				Type: v1.OnDeleteStatefulSetStrategyType,
+			},
+		},
+	}
+	if err := ctrl.SetControllerReference(m.AppConfig, statefulSet, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting StatefulSet owner reference")
+		return nil, err
+	}
+	return statefulSet, nil
+}
+
+// getResourceRequirements parses the requests and limits of the spec. Empty values are left unset so
+// that clusters created without the defaulting webhook still start.
+func (m *MongoClusterService) getResourceRequirements() (v1api.ResourceRequirements, error) {
+	requirements := v1api.ResourceRequirements{
+		Requests: v1api.ResourceList{},
+		Limits:   v1api.ResourceList{},
+	}
+	spec := m.AppConfig.Spec.Resources
+	quantities := []struct {
+		field string
+		value string
+		name  v1api.ResourceName
+		list  v1api.ResourceList
+	}{
+		{"resources.cpu.request", spec.CPU.Request, v1api.ResourceCPU, requirements.Requests},
+		{"resources.cpu.limit", spec.CPU.Limit, v1api.ResourceCPU, requirements.Limits},
+		{"resources.memory.request", spec.Memory.Request, v1api.ResourceMemory, requirements.Requests},
+		{"resources.memory.limit", spec.Memory.Limit, v1api.ResourceMemory, requirements.Limits},
+	}
+	for _, quantity := range quantities {
+		if quantity.value == "" {
+			continue
+		}
+		parsed, err := resource.ParseQuantity(quantity.value)
+		if err != nil {
+			return v1api.ResourceRequirements{}, &invalidSpecError{Field: quantity.field, Err: err}
+		}
+		quantity.list[quantity.name] = parsed
+	}
+	for name, request := range requirements.Requests {
+		if limit, found := requirements.Limits[name]; found && request.Cmp(limit) > 0 {
+			return v1api.ResourceRequirements{}, &invalidSpecError{
+				Field: fmt.Sprintf("resources.%s", name),
+				Err:   fmt.Errorf("request %s is greater than limit %s", request.String(), limit.String()),
+			}
+		}
+	}
+	return requirements, nil
+}
+
+func (m *MongoClusterService) createPodEnvVariables() ([]v1api.EnvVar, error) {
+	passwordSecret, err := m.createPasswordSecret()
+	if err != nil {
+		m.Logger.Error(err, "Error creating password secret")
+		return nil, err
+	}
+	envVars := []v1api.EnvVar{
+		{
+			Name:  "MONGODB_USERNAME",
+			Value: MONGODB_DEFAULT_USER,
+		},
+		{
+			Name: "MONGODB_PASSWORD",
+			ValueFrom: &v1api.EnvVarSource{
+				SecretKeyRef: &v1api.SecretKeySelector{
+					LocalObjectReference: v1api.LocalObjectReference{
+						Name: passwordSecret.Name,
+					},
+					Key: "password",
+				},
+			},
+		},
+		{
+			Name:  "MONGODB_DBNAME",
+			Value: m.AppConfig.Spec.DatabaseName,
+		},
+		{
+			Name:  "MONGODB_ROLE",
+			Value: MONGODB_DEFAULT_ROLE,
+		},
+		{
+			Name:  "MONGODB_REPLICA_SET",
+			Value: m.ReplicaSet.Name,
+		},
+		{
+			// Every member shares the same template, the first run script compares its own
+			// hostname against the first member to decide whether it creates the admin user.
+			Name:  "HOST",
+			Value: getResourceGenericName(m.ReplicaSet.Name, "0"),
+		},
+		{
+			Name:  "DEBIAN_FRONTEND",
+			Value: "noninteractive",
+		},
+		{
+			Name:  "DEBCONF_NONINTERACTIVE_SEEN",
+			Value: "true",
+		},
+	}
+	if m.ReplicaSet.ClusterRole != "" {
+		envVars = append(envVars, v1api.EnvVar{
+			Name:  "MONGODB_CLUSTER_ROLE",
+			Value: m.ReplicaSet.ClusterRole,
+		})
+	}
+	// Volumes provisioned from a snapshot or seeded from another cluster carry the replica set of the
+	// source, the first run script resets it once per volume, see first_run.sh.
+	if bootstrap := m.AppConfig.Spec.Bootstrap; bootstrap != nil && (bootstrap.VolumeSnapshotName != "" || bootstrap.ClusterName != "") {
+		envVars = append(envVars, v1api.EnvVar{
+			Name:  "MONGODB_RESET_REPLICA_SET",
+			Value: string(m.AppConfig.UID),
+		})
+	}
+	envVars = append(envVars, getAuthMechanismEnv(m.AppConfig)...)
+	return envVars, nil
+}
+
+func (m *MongoClusterService) deleteStatefulSet(statefulSet v1.StatefulSet) error {
+	if statefulSet.Name == "" || !m.statefulSetExists(statefulSet) {
+		return nil
+	}
+	err := m.Reconciler.Client.Delete(*m.Context, &statefulSet)
+	if err != nil {
+		m.Logger.Error(err, "Error deleting StatefulSet")
+		return err
+	}
+	return nil
+}
+
+func (m *MongoClusterService) statefulSetExists(statefulSet v1.StatefulSet) bool {
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{
+		Name:      statefulSet.Name,
+		Namespace: m.Namespace,
+	}, &statefulSet)
+	if err != nil && errors.IsNotFound(err) {
+		return false
+	} else if err != nil {
+		m.Logger.Error(err, "Error getting StatefulSet")
+		return false
+	}
+	return true
+}
+
+func getTemplateHash(template v1api.PodTemplateSpec) (string, error) {
+	templateBytes, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(templateBytes)
+	return hex.EncodeToString(hash[:])[:16], nil
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("createOrUpdateStatefulSet", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var service *MongoClusterService
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Storage = appsv1beta1.Storage{Size: "1Gi", StorageClassName: "standard"}
+		service = newTestService(cluster, mongofake.NewClient())
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+		Expect(service.createOrUpdateStatefulSet(3)).To(Succeed())
+	})
+
+	It("reports the storage changes the claims cannot follow", func() {
+		Expect(service.StorageMessage).To(BeEmpty())
+		cluster.Spec.Storage.Size = "2Gi"
+		cluster.Spec.Storage.StorageClassName = "fast"
+		Expect(service.createOrUpdateStatefulSet(3)).To(Succeed())
+		Expect(service.StorageMessage).To(ContainSubstring("size 1Gi to 2Gi"))
+		Expect(service.StorageMessage).To(ContainSubstring(`storageClassName "standard" to "fast"`))
+		Expect(*service.Stack.StatefulSet.Spec.VolumeClaimTemplates[0].Spec.StorageClassName).To(Equal("standard"))
+
+		Expect(service.UpdateStatus(ctrl.Result{}, nil)).To(Succeed())
+		updated := &appsv1beta1.MongoCluster{}
+		Expect(service.Reconciler.Client.Get(*service.Context, client.ObjectKeyFromObject(cluster), updated)).To(Succeed())
+		degraded := meta.FindStatusCondition(updated.Status.Conditions, appsv1beta1.ConditionDegraded)
+		Expect(degraded.Reason).To(Equal(REASON_STORAGE_IMMUTABLE))
+		Expect(updated.Status.Phase).To(Equal(appsv1beta1.MongoClusterDegraded))
+
+		cluster.Spec.Storage.Size = "1024Mi"
+		cluster.Spec.Storage.StorageClassName = "standard"
+		Expect(service.createOrUpdateStatefulSet(3)).To(Succeed())
+		Expect(service.StorageMessage).To(BeEmpty())
+	})
+})
+
+var _ = Describe("getResourceRequirements", func() {
+	DescribeTable("parses the requests and the limits of the spec",
+		func(resources appsv1beta1.Resources, expected v1api.ResourceRequirements, field string) {
+			cluster := newTestCluster(3)
+			cluster.Spec.Resources = resources
+			requirements, err := newTestService(cluster, mongofake.NewClient()).getResourceRequirements()
+			if field != "" {
+				Expect(err).To(BeAssignableToTypeOf(&invalidSpecError{}))
+				Expect(err.(*invalidSpecError).Field).To(Equal(field))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requirements).To(Equal(expected))
+		},
+		Entry("requests and limits",
+			appsv1beta1.Resources{
+				CPU:    appsv1beta1.ResourcesRequestLimit{Request: "100m", Limit: "1"},
+				Memory: appsv1beta1.ResourcesRequestLimit{Request: "256Mi", Limit: "1Gi"},
+			},
+			v1api.ResourceRequirements{
+				Requests: v1api.ResourceList{v1api.ResourceCPU: resource.MustParse("100m"), v1api.ResourceMemory: resource.MustParse("256Mi")},
+				Limits:   v1api.ResourceList{v1api.ResourceCPU: resource.MustParse("1"), v1api.ResourceMemory: resource.MustParse("1Gi")},
+			}, ""),
+		Entry("empty values left unset",
+			appsv1beta1.Resources{Memory: appsv1beta1.ResourcesRequestLimit{Limit: "1Gi"}},
+			v1api.ResourceRequirements{
+				Requests: v1api.ResourceList{},
+				Limits:   v1api.ResourceList{v1api.ResourceMemory: resource.MustParse("1Gi")},
+			}, ""),
+		Entry("an unparsable cpu request",
+			appsv1beta1.Resources{CPU: appsv1beta1.ResourcesRequestLimit{Request: "1 core"}},
+			v1api.ResourceRequirements{}, "resources.cpu.request"),
+		Entry("an unparsable memory limit",
+			appsv1beta1.Resources{Memory: appsv1beta1.ResourcesRequestLimit{Limit: "1GB"}},
+			v1api.ResourceRequirements{}, "resources.memory.limit"),
+		Entry("a request greater than the limit",
+			appsv1beta1.Resources{Memory: appsv1beta1.ResourcesRequestLimit{Request: "2Gi", Limit: "1Gi"}},
+			v1api.ResourceRequirements{}, "resources.memory"),
+	)
+
+	It("runs the members on the image of the spec", func() {
+		cluster := newTestCluster(3)
+		cluster.Spec.Storage.Size = "1Gi"
+		service := newTestService(cluster, mongofake.NewClient())
+		statefulSet, err := service.createStatefulSet(3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statefulSet.Spec.Template.Spec.Containers[0].Image).To(Equal(MONGO_CONTAINER_IMAGE))
+
+		cluster.Spec.Image = "registry.example.com/mongo:5.0.6-custom"
+		statefulSet, err = service.createStatefulSet(3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(statefulSet.Spec.Template.Spec.Containers[0].Image).To(Equal("registry.example.com/mongo:5.0.6-custom"))
+	})
+})
@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strings"
+)
+
+// Reasons used by the MongoCluster conditions
+const (
+	REASON_RECONCILE_ERROR           = "ReconcileError"
+	REASON_INVALID_SPEC              = "InvalidSpec"
+	REASON_RECONCILE_COMPLETE        = "ReconcileComplete"
+	REASON_RECONCILING               = "Reconciling"
+	REASON_ROLLING_UPDATE            = "RollingUpdate"
+	REASON_PRIMARY_ELECTED           = "PrimaryElected"
+	REASON_NO_PRIMARY                = "NoPrimary"
+	REASON_MEMBERS_HEALTHY           = "MembersHealthy"
+	REASON_MEMBER_UNHEALTHY          = "MemberUnhealthy"
+	REASON_REPLICA_SET_INITIATED     = "Initiated"
+	REASON_REPLICA_SET_NOT_INITIATED = "NotInitiated"
+	REASON_STORAGE_IMMUTABLE         = "StorageImmutable"
+)
+
+// UpdateStatus records the outcome of the reconcile pass on the status subresource. The status is
+// only written when it changed, so that status updates do not trigger reconcile loops on their own.
+func (m *MongoClusterService) UpdateStatus(result ctrl.Result, reconcileErr error) error {
+	status := m.AppConfig.Status.DeepCopy()
+	// A failed pass has not brought the cluster to the spec of this generation.
+	if reconcileErr == nil {
+		status.ObservedGeneration = m.AppConfig.Generation
+	}
+	status.ReadyMembers = 0
+	status.UpdatedMembers = 0
+	status.Members = nil
+	var desiredMembers int32
+	var rolloutMessages []string
+	var storageMessages []string
+	initialized, available := true, true
+	for _, replicaSet := range m.getReplicaSetServices() {
+		desiredMembers += replicaSet.ReplicaSet.Replicas
+		if replicaSet.Stack.StatefulSet != nil {
+			status.ReadyMembers += replicaSet.Stack.StatefulSet.Status.ReadyReplicas
+			status.UpdatedMembers += replicaSet.Stack.StatefulSet.Status.UpdatedReplicas
+		}
+		status.Members = append(status.Members, replicaSet.getMembersStatus()...)
+		initialized = initialized && replicaSet.ReplicaSetStatus != nil
+		available = available && replicaSet.ReplicaSetStatus != nil && replicaSet.ReplicaSetStatus.Primary() != nil
+		if replicaSet.StorageMessage != "" {
+			storageMessages = append(storageMessages, replicaSet.StorageMessage)
+		}
+		if replicaSet.RolloutMessage != "" && m.isSharded() {
+			rolloutMessages = append(rolloutMessages, fmt.Sprintf("%s: %s", replicaSet.ReplicaSet.Name, replicaSet.RolloutMessage))
+		} else if replicaSet.RolloutMessage != "" {
+			rolloutMessages = append(rolloutMessages, replicaSet.RolloutMessage)
+		}
+	}
+	if m.BackupStatuses != nil || len(m.AppConfig.Spec.Backup.Schedules) == 0 {
+		status.Backups = m.BackupStatuses
+	}
+	if m.AppConfig.Spec.Backup.OplogArchive == nil {
+		status.OplogArchive = nil
+		meta.RemoveStatusCondition(&status.Conditions, appsv1beta1.ConditionOplogArchiveContinuous)
+	} else if m.OplogArchiveStatus != nil {
+		status.OplogArchive = m.OplogArchiveStatus
+	}
+	if m.BootstrapStatus != nil {
+		status.Bootstrap = m.BootstrapStatus
+	}
+	if m.ConnectionSecretName != "" {
+		status.ConnectionSecretName = m.ConnectionSecretName
+	}
+	if m.Binding != nil {
+		status.Binding = m.Binding
+	}
+	if m.AppConfig.Spec.Auth.Rotation == nil {
+		status.Rotation = nil
+	} else if m.RotationStatus != nil {
+		status.Rotation = m.RotationStatus
+	}
+	status.NodePorts = m.getNodePorts()
+	if m.OplogArchiveCondition != nil {
+		meta.SetStatusCondition(&status.Conditions, *m.OplogArchiveCondition)
+	}
+	rolloutMessage := strings.Join(rolloutMessages, ", ")
+	availableMessage := ""
+	if m.isSharded() {
+		m.setShardingStatus(status)
+		available = available && status.ReadyRouters > 0
+		for _, shard := range status.Shards {
+			available = available && shard.Registered
+		}
+		availableMessage = fmt.Sprintf("%d shards registered, %d routers ready", len(status.Shards), status.ReadyRouters)
+	} else if available {
+		availableMessage = fmt.Sprintf("%s is primary", m.ReplicaSetStatus.Primary().Name)
+	}
+
+	generation := m.AppConfig.Generation
+	if initialized {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionReplicaSetInitialized, true, REASON_REPLICA_SET_INITIATED, "Replica set initiated", generation))
+	} else if !meta.IsStatusConditionTrue(status.Conditions, appsv1beta1.ConditionReplicaSetInitialized) {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionReplicaSetInitialized, false, REASON_REPLICA_SET_NOT_INITIATED, "Replica set not initiated yet", generation))
+	}
+
+	// A pass that returned before querying the replica sets, while waiting for a certificate or on a
+	// transient error, knows nothing of the primary and keeps the previous Available condition.
+	if available {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionAvailable, true, REASON_PRIMARY_ELECTED, availableMessage, generation))
+	} else if initialized || meta.FindStatusCondition(status.Conditions, appsv1beta1.ConditionAvailable) == nil {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionAvailable, false, REASON_NO_PRIMARY, "The replica set has no primary", generation))
+	}
+	available = meta.IsStatusConditionTrue(status.Conditions, appsv1beta1.ConditionAvailable)
+
+	progressing := result.Requeue || result.RequeueAfter > 0 || status.ReadyMembers < desiredMembers ||
+		(m.isSharded() && status.ReadyRouters < m.AppConfig.Spec.Sharding.Routers)
+	if progressing && rolloutMessage != "" {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionProgressing, true, REASON_ROLLING_UPDATE, rolloutMessage, generation))
+	} else if progressing {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionProgressing, true, REASON_RECONCILING, fmt.Sprintf("%d/%d members ready", status.ReadyMembers, desiredMembers), generation))
+	} else {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionProgressing, false, REASON_RECONCILE_COMPLETE, "The cluster matches its spec", generation))
+	}
+
+	unhealthyMembers := getUnhealthyMembers(status.Members)
+	degraded := reconcileErr != nil || len(unhealthyMembers) > 0 || len(storageMessages) > 0
+	var specErr *invalidSpecError
+	if errors.As(reconcileErr, &specErr) {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionDegraded, true, REASON_INVALID_SPEC, specErr.Error(), generation))
+	} else if reconcileErr != nil {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionDegraded, true, REASON_RECONCILE_ERROR, reconcileErr.Error(), generation))
+	} else if len(storageMessages) > 0 {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionDegraded, true, REASON_STORAGE_IMMUTABLE, strings.Join(storageMessages, ", "), generation))
+	} else if len(unhealthyMembers) > 0 {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionDegraded, true, REASON_MEMBER_UNHEALTHY, fmt.Sprintf("Unhealthy members: %s", strings.Join(unhealthyMembers, ", ")), generation))
+	} else {
+		meta.SetStatusCondition(&status.Conditions, newCondition(appsv1beta1.ConditionDegraded, false, REASON_MEMBERS_HEALTHY, "All members are healthy", generation))
+	}
+
+	switch {
+	case degraded:
+		status.Phase = appsv1beta1.MongoClusterDegraded
+	case status.ReadyMembers == 0:
+		status.Phase = appsv1beta1.MongoClusterPending
+	case !available:
+		status.Phase = appsv1beta1.MongoClusterInitializing
+	case progressing:
+		status.Phase = appsv1beta1.MongoClusterUpdating
+	default:
+		status.Phase = appsv1beta1.MongoClusterRunning
+	}
+
+	if equality.Semantic.DeepEqual(*status, m.AppConfig.Status) {
+		return nil
+	}
+	m.AppConfig.Status = *status
+	if err := m.Reconciler.Status().Update(*m.Context, m.AppConfig); err != nil {
+		m.Logger.Error(err, "Error updating MongoCluster status")
+		return err
+	}
+	return nil
+}
+
+// setShardingStatus reports the config server replica set, the shards and the routers. Whether a
+// shard is registered is kept from the previous status when the routers were not queried.
+func (m *MongoClusterService) setShardingStatus(status *appsv1beta1.MongoClusterStatus) {
+	registered := map[string]bool{}
+	for _, shard := range m.AppConfig.Status.Shards {
+		registered[shard.Name] = shard.Registered
+	}
+	if m.RegisteredShards != nil {
+		registered = m.RegisteredShards
+	}
+	status.Shards = nil
+	for _, replicaSet := range m.getReplicaSetServices() {
+		shardStatus := appsv1beta1.ShardStatus{Name: replicaSet.ReplicaSet.Name}
+		if replicaSet.Stack.StatefulSet != nil {
+			shardStatus.ReadyMembers = replicaSet.Stack.StatefulSet.Status.ReadyReplicas
+		}
+		if replicaSet.ReplicaSetStatus != nil && replicaSet.ReplicaSetStatus.Primary() != nil {
+			shardStatus.Primary = replicaSet.ReplicaSetStatus.Primary().Name
+		}
+		shardStatus.Healthy = shardStatus.Primary != "" && len(getUnhealthyMembers(replicaSet.getMembersStatus())) == 0
+		if replicaSet.ReplicaSet.ClusterRole == CLUSTER_ROLE_CONFIG_SERVER {
+			status.ConfigServer = &shardStatus
+			continue
+		}
+		shardStatus.Registered = registered[shardStatus.Name]
+		status.Shards = append(status.Shards, shardStatus)
+	}
+	if m.Stack.Routers != nil {
+		status.ReadyRouters = m.Stack.Routers.Status.ReadyReplicas
+	}
+}
+
+// getMembersStatus converts the replSetGetStatus answer, the lag of every member is computed against
+// the optime of the primary. The previous status of the members of m.ReplicaSet is kept until the
+// replica set answers.
+func (m *MongoClusterService) getMembersStatus() []appsv1beta1.MemberStatus {
+	if m.ReplicaSetStatus == nil {
+		var members []appsv1beta1.MemberStatus
+		for _, member := range m.AppConfig.Status.Members {
+			if _, found := getMemberIndex(m.ReplicaSet.Name, member.Host); found {
+				members = append(members, member)
+			}
+		}
+		return members
+	}
+	primary := m.ReplicaSetStatus.Primary()
+	var members []appsv1beta1.MemberStatus
+	for _, member := range m.ReplicaSetStatus.Members {
+		memberStatus := appsv1beta1.MemberStatus{
+			Name:    strings.Split(member.Name, ".")[0],
+			Host:    member.Name,
+			State:   member.StateStr,
+			Healthy: member.Health == 1,
+		}
+		if index, found := getMemberIndex(m.ReplicaSet.Name, member.Name); found {
+			memberStatus.ExternalHost = m.ExternalHosts[index]
+		}
+		if primary != nil && member.State == mongoadmin.MEMBER_STATE_SECONDARY && primary.OptimeDate.After(member.OptimeDate) {
+			memberStatus.OptimeLagSeconds = int64(primary.OptimeDate.Sub(member.OptimeDate).Seconds())
+		}
+		members = append(members, memberStatus)
+	}
+	return members
+}
+
+func getUnhealthyMembers(members []appsv1beta1.MemberStatus) []string {
+	var unhealthy []string
+	for _, member := range members {
+		if !member.Healthy {
+			unhealthy = append(unhealthy, member.Name)
+		}
+	}
+	return unhealthy
+}
+
+func newCondition(conditionType string, status bool, reason string, message string, generation int64) metav1.Condition {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+	return metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: generation,
+	}
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("UpdateStatus", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+	var service *MongoClusterService
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Generation = 2
+		cluster.Status.ObservedGeneration = 1
+		mongo = mongofake.NewClient()
+		mongo.Config = newTestConfig(cluster, 3)
+		service = newTestService(cluster, mongo)
+		service.Stack.StatefulSet = &appsv1.StatefulSet{Status: appsv1.StatefulSetStatus{ReadyReplicas: 3, UpdatedReplicas: 3}}
+	})
+
+	queryReplicaSet := func() {
+		status, err := mongo.GetReplicaSetStatus(*service.Context)
+		Expect(err).NotTo(HaveOccurred())
+		service.ReplicaSetStatus = status
+	}
+
+	// updatedStatus returns the status written to the API server.
+	updatedStatus := func() appsv1beta1.MongoClusterStatus {
+		updated := &appsv1beta1.MongoCluster{}
+		Expect(service.Reconciler.Client.Get(*service.Context, client.ObjectKeyFromObject(cluster), updated)).To(Succeed())
+		return updated.Status
+	}
+
+	conditionReason := func(status appsv1beta1.MongoClusterStatus, conditionType string) string {
+		condition := meta.FindStatusCondition(status.Conditions, conditionType)
+		Expect(condition).NotTo(BeNil())
+		return fmt.Sprintf("%s/%s", condition.Status, condition.Reason)
+	}
+
+	It("reports a running cluster and observes its generation", func() {
+		queryReplicaSet()
+		Expect(service.UpdateStatus(ctrl.Result{}, nil)).To(Succeed())
+		status := updatedStatus()
+		Expect(status.Phase).To(Equal(appsv1beta1.MongoClusterRunning))
+		Expect(status.ObservedGeneration).To(BeEquivalentTo(2))
+		Expect(status.Members).To(HaveLen(3))
+		Expect(conditionReason(status, appsv1beta1.ConditionReplicaSetInitialized)).To(Equal("True/" + REASON_REPLICA_SET_INITIATED))
+		Expect(conditionReason(status, appsv1beta1.ConditionAvailable)).To(Equal("True/" + REASON_PRIMARY_ELECTED))
+		Expect(conditionReason(status, appsv1beta1.ConditionProgressing)).To(Equal("False/" + REASON_RECONCILE_COMPLETE))
+		Expect(conditionReason(status, appsv1beta1.ConditionDegraded)).To(Equal("False/" + REASON_MEMBERS_HEALTHY))
+	})
+
+	It("reports a replica set without primary as not available", func() {
+		queryReplicaSet()
+		for i := range service.ReplicaSetStatus.Members {
+			service.ReplicaSetStatus.Members[i].State = mongoadmin.MEMBER_STATE_SECONDARY
+		}
+		Expect(service.UpdateStatus(ctrl.Result{}, nil)).To(Succeed())
+		status := updatedStatus()
+		Expect(status.Phase).To(Equal(appsv1beta1.MongoClusterInitializing))
+		Expect(conditionReason(status, appsv1beta1.ConditionAvailable)).To(Equal("False/" + REASON_NO_PRIMARY))
+	})
+
+	It("keeps the Available condition when the replica set was not queried", func() {
+		meta.SetStatusCondition(&cluster.Status.Conditions, newCondition(appsv1beta1.ConditionAvailable, true, REASON_PRIMARY_ELECTED, "primary", 1))
+		meta.SetStatusCondition(&cluster.Status.Conditions, newCondition(appsv1beta1.ConditionReplicaSetInitialized, true, REASON_REPLICA_SET_INITIATED, "initiated", 1))
+		Expect(service.UpdateStatus(ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil)).To(Succeed())
+		status := updatedStatus()
+		Expect(conditionReason(status, appsv1beta1.ConditionAvailable)).To(Equal("True/" + REASON_PRIMARY_ELECTED))
+		Expect(conditionReason(status, appsv1beta1.ConditionReplicaSetInitialized)).To(Equal("True/" + REASON_REPLICA_SET_INITIATED))
+		Expect(conditionReason(status, appsv1beta1.ConditionProgressing)).To(Equal("True/" + REASON_RECONCILING))
+		Expect(status.Phase).To(Equal(appsv1beta1.MongoClusterUpdating))
+	})
+
+	It("does not observe the generation of a failed pass", func() {
+		queryReplicaSet()
+		Expect(service.UpdateStatus(ctrl.Result{}, fmt.Errorf("connection refused"))).To(Succeed())
+		status := updatedStatus()
+		Expect(status.ObservedGeneration).To(BeEquivalentTo(1))
+		Expect(status.Phase).To(Equal(appsv1beta1.MongoClusterDegraded))
+		Expect(conditionReason(status, appsv1beta1.ConditionDegraded)).To(Equal("True/" + REASON_RECONCILE_ERROR))
+	})
+
+	It("reports the unhealthy members", func() {
+		queryReplicaSet()
+		service.ReplicaSetStatus.Members[2].Health = 0
+		Expect(service.UpdateStatus(ctrl.Result{}, nil)).To(Succeed())
+		condition := meta.FindStatusCondition(updatedStatus().Conditions, appsv1beta1.ConditionDegraded)
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Reason).To(Equal(REASON_MEMBER_UNHEALTHY))
+		Expect(condition.Message).To(ContainSubstring(getResourceGenericName(cluster.Name, "2")))
+	})
+})
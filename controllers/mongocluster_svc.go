@@ -2,12 +2,22 @@ package controllers
 
 import (
 	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
 	v1api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MONGO_MANAGED_LABELS_ANNOTATION      = "apps.esgi.fr/managed-labels"
+	MONGO_MANAGED_ANNOTATIONS_ANNOTATION = "apps.esgi.fr/managed-annotations"
 )
 
 func (m *MongoClusterService) getServices() *[]v1api.Service {
@@ -24,8 +34,12 @@ func (m *MongoClusterService) getServices() *[]v1api.Service {
 		return &service, nil
 	}
 
-	for i := 0; int32(i) < m.AppConfig.Spec.Replicas; i++ {
-		serviceName := getResourceGenericName(m.AppConfig.Name, fmt.Sprintf("%d", i))
+	headlessService, err := getOne(getHeadlessServiceName(m.ReplicaSet.Name))
+	if err == nil {
+		services = append(services, *headlessService)
+	}
+	for i := 0; int32(i) < m.ReplicaSet.Replicas; i++ {
+		serviceName := getResourceGenericName(m.ReplicaSet.Name, fmt.Sprintf("%d", i))
 		service, err := getOne(serviceName)
 		if err != nil {
 			m.Logger.Info(fmt.Sprintf("Service %s does not exist yet.", serviceName))
@@ -36,11 +50,13 @@ func (m *MongoClusterService) getServices() *[]v1api.Service {
 	return &services
 }
 
-func (m *MongoClusterService) createOrUpdateService(serviceName string) error {
+func (m *MongoClusterService) createOrUpdateService(expectedService *v1api.Service) error {
 	actualService := &v1api.Service{}
-	expectedService := m.createService(serviceName, serviceName)
+	if err := ctrl.SetControllerReference(m.AppConfig, expectedService, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting service owner reference")
+		return err
+	}
 	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: expectedService.Name, Namespace: m.Namespace}, actualService)
-	serviceUpToDate := !reflect.DeepEqual((*expectedService).Spec, (*actualService).Spec) && m.serviceExists(*expectedService)
 
 	if err != nil && !errors.IsNotFound(err) {
 		m.Logger.Error(err, "Error getting service")
@@ -52,50 +68,264 @@ func (m *MongoClusterService) createOrUpdateService(serviceName string) error {
 			m.Logger.Error(err, "Error creating service")
 			return err
 		}
-	} else if serviceUpToDate {
-		m.Logger.Info(fmt.Sprintf("Service %s is up to date. Nothing to do.", serviceName))
+	} else if serviceUpToDate(expectedService, actualService) {
+		m.Logger.Info(fmt.Sprintf("Service %s is up to date. Nothing to do.", expectedService.Name))
+		m.updateStack(*actualService)
 		return nil
 	} else {
 		m.Logger.Info(fmt.Sprintf("Updating service %s", expectedService.Name))
-		actualService.Spec = expectedService.Spec
+		// Keep the ports allocated by the API server, only the fields set by the operator are reconciled.
+		// A ClusterIP service has no node port, they are released when switching to it.
+		for i := range expectedService.Spec.Ports {
+			if expectedService.Spec.Type != v1api.ServiceTypeClusterIP && i < len(actualService.Spec.Ports) && actualService.Spec.Ports[i].NodePort != 0 {
+				expectedService.Spec.Ports[i].NodePort = actualService.Spec.Ports[i].NodePort
+			}
+		}
+		actualService.Spec.Type = expectedService.Spec.Type
+		actualService.Spec.Ports = expectedService.Spec.Ports
+		actualService.Spec.Selector = expectedService.Spec.Selector
+		actualService.Spec.PublishNotReadyAddresses = expectedService.Spec.PublishNotReadyAddresses
+		actualService.Spec.LoadBalancerSourceRanges = expectedService.Spec.LoadBalancerSourceRanges
+		managedLabels := actualService.Annotations[MONGO_MANAGED_LABELS_ANNOTATION]
+		managedAnnotations := actualService.Annotations[MONGO_MANAGED_ANNOTATIONS_ANNOTATION]
+		actualService.Labels = mergeServiceMetadata(actualService.Labels, expectedService.Labels, managedLabels)
+		actualService.Annotations = mergeServiceMetadata(actualService.Annotations, expectedService.Annotations, managedAnnotations)
+		actualService.OwnerReferences = expectedService.OwnerReferences
 		err = m.Reconciler.Client.Update(*m.Context, actualService)
 		if err != nil {
 			m.Logger.Error(err, "Error updating service")
 			return err
 		}
+		m.updateStack(*actualService)
+		return nil
 	}
 	m.updateStack(*expectedService)
 	return nil
 }
 
-func (m *MongoClusterService) createService(serviceName string, appLabelName string) *v1api.Service {
+// getStackService returns the service reconciled during this pass under the given name, nil when it
+// has not been.
+func (m *MongoClusterService) getStackService(name string) *v1api.Service {
+	if m.Stack.Services == nil {
+		return nil
+	}
+	for i := range *m.Stack.Services {
+		if (*m.Stack.Services)[i].Name == name {
+			return &(*m.Stack.Services)[i]
+		}
+	}
+	return nil
+}
+
+// serviceUpToDate only looks at the fields the operator sets, the API server allocates cluster IPs
+// and node ports on its own.
+func serviceUpToDate(expected *v1api.Service, actual *v1api.Service) bool {
+	if expected.Spec.Type != actual.Spec.Type ||
+		expected.Spec.PublishNotReadyAddresses != actual.Spec.PublishNotReadyAddresses ||
+		!reflect.DeepEqual(expected.Spec.Selector, actual.Spec.Selector) ||
+		!reflect.DeepEqual(expected.Spec.LoadBalancerSourceRanges, actual.Spec.LoadBalancerSourceRanges) ||
+		!metadataContains(actual.Labels, expected.Labels) ||
+		!metadataContains(actual.Annotations, expected.Annotations) ||
+		len(expected.Spec.Ports) != len(actual.Spec.Ports) ||
+		len(actual.OwnerReferences) == 0 {
+		return false
+	}
+	for i := range expected.Spec.Ports {
+		if expected.Spec.Ports[i].Name != actual.Spec.Ports[i].Name ||
+			expected.Spec.Ports[i].Port != actual.Spec.Ports[i].Port ||
+			expected.Spec.Ports[i].TargetPort != actual.Spec.Ports[i].TargetPort {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataContains tells whether every expected label or annotation is set, the ones added by other
+// controllers, such as the cloud provider, are left alone. The keys removed from spec.service change
+// the managed keys recorded on the service, so they are caught as well.
+func metadataContains(actual map[string]string, expected map[string]string) bool {
+	for key, value := range expected {
+		if current, ok := actual[key]; !ok || current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeServiceMetadata sets the expected labels or annotations and drops the ones the operator set
+// before, listed in managed, that are no longer expected.
+func mergeServiceMetadata(actual map[string]string, expected map[string]string, managed string) map[string]string {
+	if actual == nil {
+		actual = map[string]string{}
+	}
+	for _, key := range strings.Split(managed, ",") {
+		if _, ok := expected[key]; !ok {
+			delete(actual, key)
+		}
+	}
+	for key, value := range expected {
+		actual[key] = value
+	}
+	return actual
+}
+
+// getManagedKeys lists the keys of the labels or annotations set by the operator, in the form they are
+// recorded on the service.
+func getManagedKeys(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// createMemberService exposes a single member of the StatefulSet under its legacy `<name>-mongo-<i>` name.
+func (m *MongoClusterService) createMemberService(index int) *v1api.Service {
+	serviceName := getResourceGenericName(m.ReplicaSet.Name, strconv.Itoa(index))
+	return m.createService(serviceName, map[string]string{
+		"app":                                getStatefulSetName(m.ReplicaSet.Name),
+		"statefulset.kubernetes.io/pod-name": serviceName,
+	})
+}
+
+// createService exposes the pods matched by the selector the way spec.service asks.
+func (m *MongoClusterService) createService(serviceName string, selector map[string]string) *v1api.Service {
+	options := m.AppConfig.Spec.Service
+	return m.newService(serviceName, selector, getServiceType(m.AppConfig), options.Labels, options.Annotations, options.LoadBalancerSourceRanges)
+}
+
+// newService builds a service for the mongodb port of the pods matched by the selector. The node port
+// is left to the API server the first time, then the one recorded in the status is requested again so
+// that clients keep their address when the service is recreated. The keys of the labels and annotations
+// are recorded on the service so that the ones removed from the spec can be dropped later on.
+func (m *MongoClusterService) newService(serviceName string, selector map[string]string, serviceType v1api.ServiceType,
+	extraLabels map[string]string, extraAnnotations map[string]string, sourceRanges []string) *v1api.Service {
+	labels := map[string]string{MONGO_CLUSTER_LABEL: m.AppConfig.Name}
+	for key, value := range extraLabels {
+		labels[key] = value
+	}
+	annotations := map[string]string{
+		MONGO_MANAGED_LABELS_ANNOTATION:      getManagedKeys(labels),
+		MONGO_MANAGED_ANNOTATIONS_ANNOTATION: getManagedKeys(extraAnnotations),
+	}
+	for key, value := range extraAnnotations {
+		annotations[key] = value
+	}
+	service := &v1api.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        serviceName,
+			Namespace:   m.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: v1api.ServiceSpec{
+			Type: serviceType,
+			Ports: []v1api.ServicePort{
+				{
+					Name:       MONGO_PORT_NAME,
+					Port:       MONGO_CONTAINER_PORT,
+					TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: MONGO_CONTAINER_PORT},
+					Protocol:   v1api.ProtocolTCP,
+				},
+			},
+			Selector: selector,
+		},
+	}
+	if serviceType != v1api.ServiceTypeClusterIP {
+		service.Spec.Ports[0].NodePort = getRecordedNodePort(m.AppConfig, serviceName)
+	}
+	if serviceType == v1api.ServiceTypeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = sourceRanges
+	}
+	return service
+}
+
+func getServiceType(cluster *appsv1beta1.MongoCluster) v1api.ServiceType {
+	if cluster.Spec.Service.Type == "" {
+		return v1api.ServiceTypeClusterIP
+	}
+	return v1api.ServiceType(cluster.Spec.Service.Type)
+}
+
+func getRecordedNodePort(cluster *appsv1beta1.MongoCluster, serviceName string) int32 {
+	for _, nodePort := range cluster.Status.NodePorts {
+		if nodePort.Name == serviceName {
+			return nodePort.NodePort
+		}
+	}
+	return 0
+}
+
+// getNodePorts merges the node ports of the services reconciled during this pass into the ones
+// already recorded, so that a pass stopped early does not forget them.
+func (m *MongoClusterService) getNodePorts() []appsv1beta1.ServiceNodePort {
+	if getServiceType(m.AppConfig) == v1api.ServiceTypeClusterIP && m.AppConfig.Spec.ExternalAccess == nil {
+		return nil
+	}
+	nodePorts := append([]appsv1beta1.ServiceNodePort{}, m.AppConfig.Status.NodePorts...)
+	stacks := []*MongoClusterStack{m.Stack}
+	for _, replicaSet := range m.getReplicaSetServices() {
+		if replicaSet != m {
+			stacks = append(stacks, replicaSet.Stack)
+		}
+	}
+	for _, stack := range stacks {
+		if stack.Services == nil {
+			continue
+		}
+		for _, service := range *stack.Services {
+			if len(service.Spec.Ports) == 0 || service.Spec.Ports[0].NodePort == 0 {
+				continue
+			}
+			nodePort := appsv1beta1.ServiceNodePort{Name: service.Name, NodePort: service.Spec.Ports[0].NodePort}
+			recorded := false
+			for i := range nodePorts {
+				if nodePorts[i].Name == service.Name {
+					nodePorts[i], recorded = nodePort, true
+				}
+			}
+			if !recorded {
+				nodePorts = append(nodePorts, nodePort)
+			}
+		}
+	}
+	sort.Slice(nodePorts, func(i, j int) bool { return nodePorts[i].Name < nodePorts[j].Name })
+	return nodePorts
+}
+
+// createHeadlessService is the governing service of the StatefulSet, it gives every member a stable
+// `<pod>.<name>-mongo-headless` DNS record, published before the member is ready so that members can
+// reach each other while the replica set forms.
+func (m *MongoClusterService) createHeadlessService() *v1api.Service {
 	return &v1api.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      serviceName,
+			Name:      getHeadlessServiceName(m.ReplicaSet.Name),
 			Namespace: m.Namespace,
 		},
 		Spec: v1api.ServiceSpec{
-			Type:       v1api.ServiceTypeLoadBalancer,
-			ClusterIP:  "",
-			ClusterIPs: nil,
+			Type:                     v1api.ServiceTypeClusterIP,
+			ClusterIP:                v1api.ClusterIPNone,
+			PublishNotReadyAddresses: true,
 			Ports: []v1api.ServicePort{
 				{
+					Name:       MONGO_PORT_NAME,
 					Port:       MONGO_CONTAINER_PORT,
 					TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: MONGO_CONTAINER_PORT},
 					Protocol:   v1api.ProtocolTCP,
-					NodePort:   getRandomPort(),
 				},
 			},
 			Selector: map[string]string{
-				"app": appLabelName,
+				"app": getStatefulSetName(m.ReplicaSet.Name),
 			},
 		},
 	}
 }
+
 func (m *MongoClusterService) deleteServices(services []v1api.Service) error {
 	for _, service := range services {
-		if !reflect.DeepEqual(service, v1api.Service{}) || !m.serviceExists(service) {
-			break
+		if reflect.DeepEqual(service, v1api.Service{}) || !m.serviceExists(service) {
+			continue
 		}
 		err := m.Reconciler.Client.Delete(*m.Context, &service)
 		if err != nil {
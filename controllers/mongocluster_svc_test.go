@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("services", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		mongo = mongofake.NewClient()
+	})
+
+	memberServiceName := func(index string) string {
+		return getResourceGenericName(cluster.Name, index)
+	}
+
+	getService := func(service *MongoClusterService, name string) *v1api.Service {
+		actual := &v1api.Service{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, actual)).To(Succeed())
+		return actual
+	}
+
+	It("only exposes the members inside of Kubernetes by default", func() {
+		service := newTestService(cluster, mongo)
+		memberService := service.createMemberService(1)
+		Expect(memberService.Name).To(Equal(memberServiceName("1")))
+		Expect(memberService.Spec.Type).To(Equal(v1api.ServiceTypeClusterIP))
+		Expect(memberService.Spec.Ports[0].Name).To(Equal(MONGO_PORT_NAME))
+		Expect(memberService.Spec.Ports[0].NodePort).To(BeZero())
+		Expect(memberService.Spec.Selector).To(HaveKeyWithValue("statefulset.kubernetes.io/pod-name", memberServiceName("1")))
+		Expect(memberService.Labels).To(HaveKeyWithValue(MONGO_CLUSTER_LABEL, cluster.Name))
+		Expect(service.getNodePorts()).To(BeNil())
+	})
+
+	It("publishes every member through the headless service before it is ready", func() {
+		service := newTestService(cluster, mongo)
+		headless := service.createHeadlessService()
+		Expect(headless.Name).To(Equal(getHeadlessServiceName(cluster.Name)))
+		Expect(headless.Spec.ClusterIP).To(Equal(v1api.ClusterIPNone))
+		Expect(headless.Spec.PublishNotReadyAddresses).To(BeTrue())
+		Expect(headless.Spec.Selector).To(Equal(map[string]string{"app": getStatefulSetName(cluster.Name)}))
+	})
+
+	It("adds the labels, the annotations and the source ranges of the spec", func() {
+		cluster.Spec.Service = appsv1beta1.ServiceOptions{
+			Type:                     appsv1beta1.ServiceTypeLoadBalancer,
+			Labels:                   map[string]string{"team": "data"},
+			Annotations:              map[string]string{"service.beta.kubernetes.io/aws-load-balancer-internal": "true"},
+			LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+		}
+		service := newTestService(cluster, mongo)
+		memberService := service.createMemberService(0)
+		Expect(memberService.Spec.Type).To(Equal(v1api.ServiceTypeLoadBalancer))
+		Expect(memberService.Labels).To(HaveKeyWithValue("team", "data"))
+		Expect(memberService.Labels).To(HaveKeyWithValue(MONGO_CLUSTER_LABEL, cluster.Name))
+		Expect(memberService.Annotations).To(HaveKeyWithValue("service.beta.kubernetes.io/aws-load-balancer-internal", "true"))
+		Expect(memberService.Spec.LoadBalancerSourceRanges).To(Equal([]string{"10.0.0.0/8"}))
+
+		cluster.Spec.Service.Type = appsv1beta1.ServiceTypeNodePort
+		Expect(service.createMemberService(0).Spec.LoadBalancerSourceRanges).To(BeNil())
+	})
+
+	It("requests the node port recorded in the status again", func() {
+		cluster.Spec.Service.Type = appsv1beta1.ServiceTypeNodePort
+		cluster.Status.NodePorts = []appsv1beta1.ServiceNodePort{{Name: memberServiceName("2"), NodePort: 30002}}
+		service := newTestService(cluster, mongo)
+		Expect(service.createMemberService(2).Spec.Ports[0].NodePort).To(BeEquivalentTo(30002))
+		Expect(service.createMemberService(1).Spec.Ports[0].NodePort).To(BeZero())
+	})
+
+	It("keeps the node port allocated by the API server when it updates a service", func() {
+		cluster.Spec.Service.Type = appsv1beta1.ServiceTypeNodePort
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateService(service.createMemberService(0))).To(Succeed())
+		allocated := getService(service, memberServiceName("0"))
+		allocated.Spec.Ports[0].NodePort = 31000
+		allocated.Labels["added-by"] = "cloud-provider"
+		Expect(service.Reconciler.Client.Update(context.Background(), allocated)).To(Succeed())
+
+		cluster.Spec.Service.Annotations = map[string]string{"owner": "data"}
+		Expect(service.createOrUpdateService(service.createMemberService(0))).To(Succeed())
+		updated := getService(service, memberServiceName("0"))
+		Expect(updated.Spec.Ports[0].NodePort).To(BeEquivalentTo(31000))
+		Expect(updated.Labels).To(HaveKeyWithValue("added-by", "cloud-provider"))
+		Expect(updated.Annotations).To(HaveKeyWithValue("owner", "data"))
+
+		cluster.Spec.Service.Type = appsv1beta1.ServiceTypeClusterIP
+		Expect(service.createOrUpdateService(service.createMemberService(0))).To(Succeed())
+		updated = getService(service, memberServiceName("0"))
+		Expect(updated.Spec.Type).To(Equal(v1api.ServiceTypeClusterIP))
+		Expect(updated.Spec.Ports[0].NodePort).To(BeZero())
+	})
+
+	It("drops the labels and annotations removed from the spec", func() {
+		cluster.Spec.Service.Labels = map[string]string{"team": "data"}
+		cluster.Spec.Service.Annotations = map[string]string{"owner": "data", "tier": "database"}
+		service := newTestService(cluster, mongo)
+		Expect(service.createOrUpdateService(service.createMemberService(0))).To(Succeed())
+		allocated := getService(service, memberServiceName("0"))
+		allocated.Labels["added-by"] = "cloud-provider"
+		allocated.Annotations["added-by"] = "cloud-provider"
+		Expect(service.Reconciler.Client.Update(context.Background(), allocated)).To(Succeed())
+
+		cluster.Spec.Service.Labels = nil
+		cluster.Spec.Service.Annotations = map[string]string{"tier": "database"}
+		Expect(service.createOrUpdateService(service.createMemberService(0))).To(Succeed())
+		updated := getService(service, memberServiceName("0"))
+		Expect(updated.Labels).NotTo(HaveKey("team"))
+		Expect(updated.Labels).To(HaveKeyWithValue(MONGO_CLUSTER_LABEL, cluster.Name))
+		Expect(updated.Labels).To(HaveKeyWithValue("added-by", "cloud-provider"))
+		Expect(updated.Annotations).NotTo(HaveKey("owner"))
+		Expect(updated.Annotations).To(HaveKeyWithValue("tier", "database"))
+		Expect(updated.Annotations).To(HaveKeyWithValue("added-by", "cloud-provider"))
+		Expect(updated.Annotations).To(HaveKeyWithValue(MONGO_MANAGED_ANNOTATIONS_ANNOTATION, "tier"))
+	})
+
+	It("records the node ports of the services along with the ones already recorded", func() {
+		cluster.Spec.Service.Type = appsv1beta1.ServiceTypeNodePort
+		cluster.Status.NodePorts = []appsv1beta1.ServiceNodePort{
+			{Name: memberServiceName("2"), NodePort: 30002},
+			{Name: memberServiceName("1"), NodePort: 30001},
+		}
+		service := newTestService(cluster, mongo)
+		memberService := service.createMemberService(0)
+		memberService.Spec.Ports[0].NodePort = 30000
+		service.updateStack(*memberService)
+		memberService = service.createMemberService(1)
+		memberService.Spec.Ports[0].NodePort = 30011
+		service.updateStack(*memberService)
+
+		Expect(service.getNodePorts()).To(Equal([]appsv1beta1.ServiceNodePort{
+			{Name: memberServiceName("0"), NodePort: 30000},
+			{Name: memberServiceName("1"), NodePort: 30011},
+			{Name: memberServiceName("2"), NodePort: 30002},
+		}))
+	})
+})
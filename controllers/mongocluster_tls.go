@@ -0,0 +1,580 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/go-logr/logr"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	MONGO_TLS_SECRET_FORMAT    = "%s-tls"
+	MONGO_TLS_VOLUME_NAME      = "mongo-tls"
+	MONGO_TLS_MOUNT_PATH       = "/etc/mongo-tls"
+	MONGO_TLS_HASH_ANNOTATION  = "apps.esgi.fr/tls-hash"
+	MONGO_TLS_CERTIFICATE_KEY  = "tls.crt"
+	MONGO_TLS_PRIVATE_KEY_KEY  = "tls.key"
+	MONGO_TLS_CA_KEY           = "ca.crt"
+	MONGO_TLS_COMPONENT_LABEL  = "apps.esgi.fr/component"
+	MONGO_CERTIFICATE_API_KIND = "Certificate"
+	// MONGO_CLIENT_CERTIFICATE_FORMAT names the client certificate of the operator
+	MONGO_CLIENT_CERTIFICATE_FORMAT  = "%s-operator"
+	MONGO_MEMBER_ORGANIZATIONAL_UNIT = "members"
+	MONGO_CLIENT_ORGANIZATIONAL_UNIT = "clients"
+	// MONGO_OPERATOR_ORGANIZATIONAL_UNIT keeps the subject of the operator apart from those of the users
+	MONGO_OPERATOR_ORGANIZATIONAL_UNIT = "operator"
+	// MONGO_MEMBERS_TLS_SECRET_FORMAT names the secret gathering the certificates of the members of a
+	// replica set, which the pod template mounts whatever the number of members
+	MONGO_MEMBERS_TLS_SECRET_FORMAT = "%s-members-tls"
+	MONGO_TLS_MEMBERS_VOLUME_NAME   = "mongo-tls-members"
+	MONGO_TLS_MEMBERS_MOUNT_PATH    = "/etc/mongo-tls-members"
+	MONGO_TLS_INIT_CONTAINER_NAME   = "tls"
+)
+
+// MONGO_TLS_INIT_SCRIPT copies the certificate of the member out of the secret of the replica set, so
+// that the mongo container only holds its own key.
+const MONGO_TLS_INIT_SCRIPT = `set -e
+for key in tls.crt tls.key ca.crt; do
+  cp "/etc/mongo-tls-members/$HOSTNAME.$key" "/etc/mongo-tls/$key"
+  chmod 0400 "/etc/mongo-tls/$key"
+done`
+
+// certificateGVK is the cert-manager Certificate. The operator does not depend on the cert-manager
+// API module, certificates are handled as unstructured objects so that the CRD is only required by the
+// clusters using an issuer.
+var certificateGVK = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: MONGO_CERTIFICATE_API_KIND}
+
+func getCertificateName(name string) string {
+	return fmt.Sprintf(MONGO_TLS_SECRET_FORMAT, name)
+}
+
+// getTLSMode returns the mode of the members and the routers, empty when TLS is disabled.
+func getTLSMode(mongoCluster *appsv1beta1.MongoCluster) appsv1beta1.TLSMode {
+	if mongoCluster.Spec.TLS == nil {
+		return ""
+	}
+	if mongoCluster.Spec.TLS.Mode == "" {
+		return appsv1beta1.TLSModeRequire
+	}
+	return mongoCluster.Spec.TLS.Mode
+}
+
+// useClientTLS tells whether clients connect with TLS. Members in allowTLS still accept connections
+// without TLS, which keeps the operator working while they are restarted with TLS enabled.
+func useClientTLS(mongoCluster *appsv1beta1.MongoCluster) bool {
+	mode := getTLSMode(mongoCluster)
+	return mode == appsv1beta1.TLSModePrefer || mode == appsv1beta1.TLSModeRequire
+}
+
+// getTLSCASecretName returns the secret whose ca.crt signs the certificates of the cluster: the
+// existing secret, the CA of the operator, or the certificate of the first member of the replica set
+// clients reach first.
+func getTLSCASecretName(mongoCluster *appsv1beta1.MongoCluster) string {
+	if mongoCluster.Spec.TLS != nil && mongoCluster.Spec.TLS.ExistingSecretName != "" {
+		return mongoCluster.Spec.TLS.ExistingSecretName
+	}
+	if mongoCluster.Spec.TLS == nil || mongoCluster.Spec.TLS.IssuerRef == nil {
+		return getCASecretName(mongoCluster.Name)
+	}
+	replicaSet := mongoCluster.Name
+	if mongoCluster.Spec.Sharding != nil {
+		replicaSet = getConfigServerName(mongoCluster.Name)
+	}
+	return getCertificateName(getResourceGenericName(replicaSet, "0"))
+}
+
+// getClusterTLSConfig returns the TLS configuration the operator connects to the cluster with, nil
+// when the cluster is reached without TLS.
+func getClusterTLSConfig(ctx context.Context, c client.Client, mongoCluster *appsv1beta1.MongoCluster) (*tls.Config, error) {
+	if !useClientTLS(mongoCluster) {
+		return nil, nil
+	}
+	secret := &v1api.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: getTLSCASecretName(mongoCluster), Namespace: mongoCluster.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(secret.Data[MONGO_TLS_CA_KEY]) {
+		return nil, fmt.Errorf("secret %s holds no %s certificate", secret.Name, MONGO_TLS_CA_KEY)
+	}
+	config := &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	// The client certificate is presented once it has been issued, the members do not require one.
+	if mongoCluster.Spec.TLS.ExistingSecretName == "" {
+		clientSecret := &v1api.Secret{}
+		err := c.Get(ctx, types.NamespacedName{Name: getCertificateName(getClientCertificateName(mongoCluster.Name)), Namespace: mongoCluster.Namespace}, clientSecret)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if certificate, err := tls.X509KeyPair(clientSecret.Data[MONGO_TLS_CERTIFICATE_KEY], clientSecret.Data[MONGO_TLS_PRIVATE_KEY_KEY]); err == nil {
+			config.Certificates = []tls.Certificate{certificate}
+		}
+	}
+	return config, nil
+}
+
+func (m *MongoClusterService) usesIssuer() bool {
+	return m.AppConfig.Spec.TLS != nil && m.AppConfig.Spec.TLS.IssuerRef != nil
+}
+
+// issuesCertificates tells whether the operator requests or issues the certificates, rather than
+// mounting an existing secret.
+func (m *MongoClusterService) issuesCertificates() bool {
+	return m.AppConfig.Spec.TLS != nil && m.AppConfig.Spec.TLS.ExistingSecretName == ""
+}
+
+// certificateRequest describes a certificate of the cluster, whether cert-manager or the CA of the
+// operator issues it. The members share their organization and unit, which sets them apart from the
+// clients.
+type certificateRequest struct {
+	// Name of the certificate, its secret is named after it
+	Name               string
+	CommonName         string
+	OrganizationalUnit string
+	DNSNames           []string
+	// ClientOnly certificates cannot serve connections
+	ClientOnly bool
+}
+
+// createOrUpdateMemberCertificates requests a certificate for each of the first replicas members of
+// m.ReplicaSet and deletes those of the members above. It tells whether every certificate has been
+// issued, the members cannot start before. Once they are, they are gathered in the secret the members
+// mount.
+func (m *MongoClusterService) createOrUpdateMemberCertificates(replicas int32) (bool, error) {
+	var requests []certificateRequest
+	if m.issuesCertificates() {
+		for i := 0; int32(i) < replicas; i++ {
+			memberName := getResourceGenericName(m.ReplicaSet.Name, fmt.Sprintf("%d", i))
+			dnsNames := getMemberDNSNames(m.ReplicaSet.Name, m.Namespace, i)
+			if hostname := m.getExternalHostname(i); hostname != "" {
+				dnsNames = append(dnsNames, hostname)
+			}
+			requests = append(requests, certificateRequest{
+				Name:               memberName,
+				CommonName:         memberName,
+				OrganizationalUnit: MONGO_MEMBER_ORGANIZATIONAL_UNIT,
+				DNSNames:           dnsNames,
+			})
+		}
+	}
+	issued, err := m.createOrUpdateCertificates(m.ReplicaSet.Name, requests)
+	if err != nil || !issued || !m.issuesCertificates() {
+		return issued, err
+	}
+	return true, m.createOrUpdateMembersTLSSecret(replicas)
+}
+
+func getMembersTLSSecretName(replicaSet string) string {
+	return fmt.Sprintf(MONGO_MEMBERS_TLS_SECRET_FORMAT, replicaSet)
+}
+
+// createOrUpdateMembersTLSSecret copies the certificate of each member under its pod name, and records
+// the hash of each of them in m.MemberTLSHashes. A single secret keeps the pod template the same when
+// members are added, and each member only restarts when its own certificate is renewed.
+func (m *MongoClusterService) createOrUpdateMembersTLSSecret(replicas int32) error {
+	data := map[string][]byte{}
+	m.MemberTLSHashes = map[string]string{}
+	for i := 0; int32(i) < replicas; i++ {
+		memberName := getResourceGenericName(m.ReplicaSet.Name, fmt.Sprintf("%d", i))
+		secret := &v1api.Secret{}
+		err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: getCertificateName(memberName), Namespace: m.Namespace}, secret)
+		if err != nil {
+			m.Logger.Error(err, fmt.Sprintf("Error getting TLS secret %s", getCertificateName(memberName)))
+			return err
+		}
+		for _, key := range []string{MONGO_TLS_CERTIFICATE_KEY, MONGO_TLS_PRIVATE_KEY_KEY, MONGO_TLS_CA_KEY} {
+			data[fmt.Sprintf("%s.%s", memberName, key)] = secret.Data[key]
+		}
+		m.MemberTLSHashes[memberName] = getCertificateHash(secret)
+	}
+	return m.createOrUpdateOwnedSecret(&v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getMembersTLSSecretName(m.ReplicaSet.Name),
+			Namespace: m.Namespace,
+			Labels:    map[string]string{MONGO_CLUSTER_LABEL: m.AppConfig.Name},
+		},
+		Data: data,
+	})
+}
+
+// createOrUpdateRouterCertificate requests the certificate shared by the routers.
+func (m *MongoClusterService) createOrUpdateRouterCertificate() (bool, error) {
+	name := getRouterName(m.AppConfig.Name)
+	var requests []certificateRequest
+	if m.issuesCertificates() {
+		requests = append(requests, certificateRequest{
+			Name:               name,
+			CommonName:         name,
+			OrganizationalUnit: MONGO_MEMBER_ORGANIZATIONAL_UNIT,
+			DNSNames:           getServiceDNSNames(name, m.Namespace),
+		})
+	}
+	return m.createOrUpdateCertificates(name, requests)
+}
+
+// createOrUpdateClientCertificate requests the certificate the operator presents to the members.
+func (m *MongoClusterService) createOrUpdateClientCertificate() (bool, error) {
+	name := getClientCertificateName(m.AppConfig.Name)
+	var requests []certificateRequest
+	if m.issuesCertificates() {
+		requests = append(requests, certificateRequest{
+			Name:               name,
+			CommonName:         MONGODB_DEFAULT_USER,
+			OrganizationalUnit: MONGO_OPERATOR_ORGANIZATIONAL_UNIT,
+			ClientOnly:         true,
+		})
+	}
+	return m.createOrUpdateCertificates(name, requests)
+}
+
+func getClientCertificateName(clusterName string) string {
+	return fmt.Sprintf(MONGO_CLIENT_CERTIFICATE_FORMAT, clusterName)
+}
+
+// createOrUpdateCertificates reconciles the certificates of a component of the cluster, the members of
+// a replica set, the routers or the client of the operator, from cert-manager or from the CA of the
+// operator. The other certificates of the component are deleted along with their secret. It tells
+// whether every certificate has been issued.
+func (m *MongoClusterService) createOrUpdateCertificates(component string, requests []certificateRequest) (bool, error) {
+	expected := map[string]bool{}
+	issued := true
+	for _, request := range requests {
+		secretName := getCertificateName(request.Name)
+		expected[secretName] = true
+		if !m.usesIssuer() {
+			if err := m.createOrUpdateIssuedCertificate(component, request); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err := m.createOrUpdateCertificate(m.createCertificate(component, request)); err != nil {
+			return false, err
+		}
+		secret := &v1api.Secret{}
+		found, err := m.objectExists(secretName, secret)
+		if err != nil {
+			return false, err
+		}
+		if !found || len(secret.Data[MONGO_TLS_CERTIFICATE_KEY]) == 0 || len(secret.Data[MONGO_TLS_CA_KEY]) == 0 {
+			m.Logger.Info(fmt.Sprintf("Certificate %s is not issued yet", secretName))
+			issued = false
+		}
+	}
+	certificates := expected
+	if !m.usesIssuer() {
+		certificates = map[string]bool{}
+	}
+	if err := m.deleteStaleCertificates(component, certificates); err != nil {
+		return false, err
+	}
+	if err := m.deleteStaleIssuedCertificates(component, expected); err != nil {
+		return false, err
+	}
+	return issued, nil
+}
+
+func (m *MongoClusterService) createOrUpdateCertificate(expected *unstructured.Unstructured) error {
+	if err := ctrl.SetControllerReference(m.AppConfig, expected, m.Reconciler.Scheme); err != nil {
+		m.Logger.Error(err, "Error setting certificate owner reference")
+		return err
+	}
+	return applyCertificate(*m.Context, m.Reconciler.Client, m.Logger, expected)
+}
+
+// applyCertificate creates the cert-manager Certificate, or updates it when it differs.
+func applyCertificate(ctx context.Context, c client.Client, logger logr.Logger, expected *unstructured.Unstructured) error {
+	actual := &unstructured.Unstructured{}
+	actual.SetGroupVersionKind(certificateGVK)
+	err := c.Get(ctx, types.NamespacedName{Name: expected.GetName(), Namespace: expected.GetNamespace()}, actual)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Error getting certificate")
+		return err
+	} else if errors.IsNotFound(err) {
+		logger.Info(fmt.Sprintf("Creating certificate %s", expected.GetName()))
+		if err := c.Create(ctx, expected); err != nil {
+			logger.Error(err, "Error creating certificate")
+			return err
+		}
+		return nil
+	} else if certificateUpToDate(expected, actual) {
+		logger.Info(fmt.Sprintf("Certificate %s is up to date. Nothing to do.", expected.GetName()))
+		return nil
+	}
+	logger.Info(fmt.Sprintf("Updating certificate %s", expected.GetName()))
+	actual.Object["spec"] = expected.Object["spec"]
+	actual.SetLabels(expected.GetLabels())
+	actual.SetOwnerReferences(expected.GetOwnerReferences())
+	if err := c.Update(ctx, actual); err != nil {
+		logger.Error(err, "Error updating certificate")
+		return err
+	}
+	return nil
+}
+
+// certificateUpToDate only compares the fields set by the operator, cert-manager may default others.
+func certificateUpToDate(expected *unstructured.Unstructured, actual *unstructured.Unstructured) bool {
+	expectedSpec, _, _ := unstructured.NestedMap(expected.Object, "spec")
+	actualSpec, _, _ := unstructured.NestedMap(actual.Object, "spec")
+	for key, value := range expectedSpec {
+		if !equality.Semantic.DeepEqual(value, actualSpec[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteStaleCertificates deletes the certificates of the component that are not expected, and their
+// secret which cert-manager leaves behind. Nothing is left to delete when cert-manager is not installed.
+func (m *MongoClusterService) deleteStaleCertificates(component string, expected map[string]bool) error {
+	certificates := &unstructured.UnstructuredList{}
+	certificates.SetGroupVersionKind(certificateGVK.GroupVersion().WithKind(MONGO_CERTIFICATE_API_KIND + "List"))
+	err := m.Reconciler.Client.List(*m.Context, certificates, client.InNamespace(m.Namespace), client.MatchingLabels{
+		MONGO_CLUSTER_LABEL:       m.AppConfig.Name,
+		MONGO_TLS_COMPONENT_LABEL: component,
+	})
+	if meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		m.Logger.Error(err, "Error listing certificates")
+		return err
+	}
+	for i := range certificates.Items {
+		certificate := &certificates.Items[i]
+		if expected[certificate.GetName()] {
+			continue
+		}
+		m.Logger.Info(fmt.Sprintf("Deleting certificate %s", certificate.GetName()))
+		if err := m.Reconciler.Client.Delete(*m.Context, certificate); err != nil && !errors.IsNotFound(err) {
+			m.Logger.Error(err, "Error deleting certificate")
+			return err
+		}
+		secret := &v1api.Secret{}
+		found, err := m.objectExists(certificate.GetName(), secret)
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := m.Reconciler.Client.Delete(*m.Context, secret); err != nil && !errors.IsNotFound(err) {
+				m.Logger.Error(err, "Error deleting certificate secret")
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createCertificate builds the cert-manager Certificate of a request for a component of the cluster.
+func (m *MongoClusterService) createCertificate(component string, request certificateRequest) *unstructured.Unstructured {
+	return newCertificate(m.AppConfig, map[string]string{
+		MONGO_CLUSTER_LABEL:       m.AppConfig.Name,
+		MONGO_TLS_COMPONENT_LABEL: component,
+	}, request)
+}
+
+// newCertificate builds the cert-manager Certificate of a request, from the issuer of the cluster.
+func newCertificate(mongoCluster *appsv1beta1.MongoCluster, labels map[string]string, request certificateRequest) *unstructured.Unstructured {
+	issuerRef := mongoCluster.Spec.TLS.IssuerRef
+	kind, group := issuerRef.Kind, issuerRef.Group
+	if kind == "" {
+		kind = "Issuer"
+	}
+	if group == "" {
+		group = certificateGVK.Group
+	}
+	// Members use their certificate both to serve clients and to authenticate to the other members.
+	usages := []string{"server auth", "client auth", "digital signature", "key encipherment"}
+	if request.ClientOnly {
+		usages = []string{"client auth", "digital signature", "key encipherment"}
+	}
+	spec := map[string]interface{}{
+		"secretName": getCertificateName(request.Name),
+		"commonName": request.CommonName,
+		"subject": map[string]interface{}{
+			"organizations":       toInterfaceSlice([]string{mongoCluster.Name}),
+			"organizationalUnits": toInterfaceSlice([]string{request.OrganizationalUnit}),
+		},
+		"usages": toInterfaceSlice(usages),
+		"issuerRef": map[string]interface{}{
+			"name":  issuerRef.Name,
+			"kind":  kind,
+			"group": group,
+		},
+		// The label lets the cluster follow the renewals of the secret.
+		"secretTemplate": map[string]interface{}{
+			"labels": map[string]interface{}{MONGO_CLUSTER_LABEL: mongoCluster.Name},
+		},
+	}
+	if len(request.DNSNames) > 0 {
+		spec["dnsNames"] = toInterfaceSlice(request.DNSNames)
+	}
+	certificate := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(getCertificateName(request.Name))
+	certificate.SetNamespace(mongoCluster.Namespace)
+	certificate.SetLabels(labels)
+	return certificate
+}
+
+// getMemberDNSNames lists the names a member is reached by: its address in the replica set
+// configuration, through the headless service, and the names of its own service.
+func getMemberDNSNames(replicaSet string, namespace string, index int) []string {
+	memberName := getResourceGenericName(replicaSet, fmt.Sprintf("%d", index))
+	memberHost := getMemberHost(replicaSet, namespace, index)
+	return append([]string{memberHost[:strings.LastIndex(memberHost, ":")]}, getServiceDNSNames(memberName, namespace)...)
+}
+
+func getServiceDNSNames(serviceName string, namespace string) []string {
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc.%s", serviceName, namespace, MONGO_CLUSTER_DOMAIN),
+	}
+}
+
+func toInterfaceSlice(values []string) []interface{} {
+	var result []interface{}
+	for _, value := range values {
+		result = append(result, value)
+	}
+	return result
+}
+
+// addMemberTLS mounts the certificates of the members in the template. The secret of
+// spec.tls.existingSecret is shared by every member, the pods are restarted when it changes. Otherwise
+// only an init container mounts the certificates of every member, the mongo container gets its own
+// through an emptyDir. The template is left the same on renewals, rollOutMembers restarts the member
+// whose certificate changed.
+func (m *MongoClusterService) addMemberTLS(template *v1api.PodTemplateSpec) error {
+	if !m.issuesCertificates() {
+		volume, hash, err := m.getExistingTLSVolume()
+		if err != nil {
+			return err
+		}
+		m.addTLS(template, volume, hash)
+		return nil
+	}
+	m.addTLS(template, v1api.Volume{
+		Name:         MONGO_TLS_VOLUME_NAME,
+		VolumeSource: v1api.VolumeSource{EmptyDir: &v1api.EmptyDirVolumeSource{Medium: v1api.StorageMediumMemory}},
+	}, "")
+	template.Spec.Volumes = append(template.Spec.Volumes, v1api.Volume{
+		Name: MONGO_TLS_MEMBERS_VOLUME_NAME,
+		VolumeSource: v1api.VolumeSource{
+			Secret: &v1api.SecretVolumeSource{
+				SecretName:  getMembersTLSSecretName(m.ReplicaSet.Name),
+				DefaultMode: &MONGO_KEY_SECRET_DEFAULT_MODE,
+			},
+		},
+	})
+	container := template.Spec.Containers[0]
+	template.Spec.InitContainers = append(template.Spec.InitContainers, v1api.Container{
+		Name:    MONGO_TLS_INIT_CONTAINER_NAME,
+		Image:   container.Image,
+		Command: []string{"/bin/bash", "-c"},
+		Args:    []string{MONGO_TLS_INIT_SCRIPT},
+		VolumeMounts: []v1api.VolumeMount{
+			{Name: MONGO_TLS_MEMBERS_VOLUME_NAME, MountPath: MONGO_TLS_MEMBERS_MOUNT_PATH, ReadOnly: true},
+			{Name: MONGO_TLS_VOLUME_NAME, MountPath: MONGO_TLS_MOUNT_PATH},
+		},
+	})
+	return nil
+}
+
+// getRouterTLSVolume mounts the certificate shared by the routers.
+func (m *MongoClusterService) getRouterTLSVolume() (v1api.Volume, string, error) {
+	if !m.issuesCertificates() {
+		return m.getExistingTLSVolume()
+	}
+	return m.getTLSSecretVolume(getCertificateName(getRouterName(m.AppConfig.Name)))
+}
+
+// getExistingTLSVolume mounts the secret of spec.tls.existingSecret, shared by every member and router.
+func (m *MongoClusterService) getExistingTLSVolume() (v1api.Volume, string, error) {
+	return m.getTLSSecretVolume(m.AppConfig.Spec.TLS.ExistingSecretName)
+}
+
+func (m *MongoClusterService) getTLSSecretVolume(secretName string) (v1api.Volume, string, error) {
+	hash, err := m.getTLSHash(secretName)
+	if err != nil {
+		return v1api.Volume{}, "", err
+	}
+	return v1api.Volume{
+		Name: MONGO_TLS_VOLUME_NAME,
+		VolumeSource: v1api.VolumeSource{
+			Secret: &v1api.SecretVolumeSource{
+				SecretName:  secretName,
+				DefaultMode: &MONGO_KEY_SECRET_DEFAULT_MODE,
+			},
+		},
+	}, hash, nil
+}
+
+// getTLSHash identifies the certificate of the secret the pods are started with.
+func (m *MongoClusterService) getTLSHash(secretName string) (string, error) {
+	secret := &v1api.Secret{}
+	err := m.Reconciler.Client.Get(*m.Context, types.NamespacedName{Name: secretName, Namespace: m.Namespace}, secret)
+	if err != nil {
+		m.Logger.Error(err, fmt.Sprintf("Error getting TLS secret %s", secretName))
+		return "", err
+	}
+	return getCertificateHash(secret), nil
+}
+
+func getCertificateHash(secret *v1api.Secret) string {
+	hash := sha256.New()
+	hash.Write(secret.Data[MONGO_TLS_CERTIFICATE_KEY])
+	hash.Write(secret.Data[MONGO_TLS_CA_KEY])
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// addTLS mounts the certificates in the mongo container of the template and turns TLS on with the
+// mode of the spec. The hash of the certificates, if any, restarts the pods when it changes.
+func (m *MongoClusterService) addTLS(template *v1api.PodTemplateSpec, volume v1api.Volume, hash string) {
+	if hash != "" {
+		template.Annotations[MONGO_TLS_HASH_ANNOTATION] = hash
+	}
+	template.Spec.Volumes = append(template.Spec.Volumes, volume)
+	container := &template.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, v1api.VolumeMount{
+		Name:      MONGO_TLS_VOLUME_NAME,
+		MountPath: MONGO_TLS_MOUNT_PATH,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, v1api.EnvVar{
+		Name:  "MONGODB_TLS_MODE",
+		Value: string(getTLSMode(m.AppConfig)),
+	})
+}
+
+// getAuthMechanismEnv passes the mechanisms of spec.auth to the run scripts, with the x509 membership
+// authentication when MONGODB-X509 is listed. Nothing is passed when the defaults apply.
+func getAuthMechanismEnv(mongoCluster *appsv1beta1.MongoCluster) []v1api.EnvVar {
+	if len(mongoCluster.Spec.Auth.Mechanisms) == 0 {
+		return nil
+	}
+	var mechanisms []string
+	for _, mechanism := range mongoCluster.Spec.Auth.Mechanisms {
+		mechanisms = append(mechanisms, string(mechanism))
+	}
+	env := []v1api.EnvVar{{Name: "MONGODB_AUTH_MECHANISMS", Value: strings.Join(mechanisms, ",")}}
+	if mongoCluster.Spec.Auth.HasMechanism(appsv1beta1.AuthMechanismX509) {
+		env = append(env, v1api.EnvVar{Name: "MONGODB_CLUSTER_AUTH_MODE", Value: "x509"})
+	}
+	return env
+}
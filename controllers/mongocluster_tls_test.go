@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("member certificates", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var mongo *mongofake.Client
+	var service *MongoClusterService
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Spec.Storage.Size = "1Gi"
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModeRequire}
+		mongo = mongofake.NewClient()
+		mongo.Config = newTestConfig(cluster, 3)
+		service = newTestService(cluster, mongo)
+		Expect(service.createOrUpdateSecret()).To(Succeed())
+	})
+
+	issue := func(replicas int32) {
+		issued, err := service.createOrUpdateMemberCertificates(replicas)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issued).To(BeTrue())
+	}
+
+	getTemplate := func(replicas int32) v1api.PodTemplateSpec {
+		statefulSet, err := service.createStatefulSet(replicas)
+		Expect(err).NotTo(HaveOccurred())
+		return statefulSet.Spec.Template
+	}
+
+	// startMembers creates the pods of the members at the update revision, recording the certificate
+	// they were started with.
+	startMembers := func(replicas int32) {
+		for i := 0; int32(i) < replicas; i++ {
+			pod := newMemberPod(cluster, i, true, "v1")
+			pod.Annotations = map[string]string{MONGO_TLS_HASH_ANNOTATION: service.MemberTLSHashes[pod.Name]}
+			Expect(service.Reconciler.Client.Create(context.Background(), pod)).To(Succeed())
+		}
+		service.Stack.StatefulSet = &appsv1.StatefulSet{
+			Spec:   appsv1.StatefulSetSpec{Replicas: &replicas},
+			Status: appsv1.StatefulSetStatus{UpdateRevision: "v1"},
+		}
+		status, err := mongo.GetReplicaSetStatus(*service.Context)
+		Expect(err).NotTo(HaveOccurred())
+		service.ReplicaSetStatus = status
+	}
+
+	getPod := func(index int) (*v1api.Pod, error) {
+		pod := &v1api.Pod{}
+		name := getResourceGenericName(cluster.Name, strconv.Itoa(index))
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, pod)
+		return pod, err
+	}
+
+	It("only gives the mongo container the certificate of its own member", func() {
+		issue(3)
+		secret := &v1api.Secret{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: getMembersTLSSecretName(cluster.Name), Namespace: testNamespace}, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveLen(9))
+		Expect(secret.Data).To(HaveKey(getResourceGenericName(cluster.Name, "2") + "." + MONGO_TLS_PRIVATE_KEY_KEY))
+
+		template := getTemplate(3)
+		Expect(template.Annotations).NotTo(HaveKey(MONGO_TLS_HASH_ANNOTATION))
+		for _, mount := range template.Spec.Containers[0].VolumeMounts {
+			Expect(mount.Name).NotTo(Equal(MONGO_TLS_MEMBERS_VOLUME_NAME))
+		}
+		Expect(template.Spec.InitContainers).To(HaveLen(1))
+		Expect(template.Spec.InitContainers[0].VolumeMounts).To(ContainElement(HaveField("Name", MONGO_TLS_MEMBERS_VOLUME_NAME)))
+	})
+
+	It("keeps the pod template when members are added", func() {
+		issue(3)
+		template := getTemplate(3)
+		issue(4)
+		Expect(getTemplate(4)).To(Equal(template))
+		Expect(service.MemberTLSHashes).To(HaveLen(4))
+	})
+
+	It("restarts only the member whose certificate was renewed", func() {
+		issue(3)
+		startMembers(3)
+		memberSecret := &v1api.Secret{}
+		name := getCertificateName(getResourceGenericName(cluster.Name, "1"))
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, memberSecret)).To(Succeed())
+		memberSecret.Data[MONGO_TLS_CERTIFICATE_KEY] = []byte("expired")
+		Expect(service.Reconciler.Client.Update(context.Background(), memberSecret)).To(Succeed())
+		issue(3)
+
+		rolledOut, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledOut).To(BeFalse())
+		for i, restarted := range []bool{false, true, false} {
+			_, err := getPod(i)
+			Expect(client.IgnoreNotFound(err)).To(Succeed())
+			Expect(err != nil).To(Equal(restarted))
+		}
+	})
+
+	It("records the certificate a new pod was started with", func() {
+		issue(3)
+		startMembers(3)
+		pod, err := getPod(2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Reconciler.Client.Delete(context.Background(), pod)).To(Succeed())
+		Expect(service.Reconciler.Client.Create(context.Background(), newMemberPod(cluster, 2, true, "v1"))).To(Succeed())
+
+		rolledOut, err := service.rollOutMembers()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledOut).To(BeTrue())
+		pod, err = getPod(2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[MONGO_TLS_HASH_ANNOTATION]).To(Equal(service.MemberTLSHashes[pod.Name]))
+	})
+})
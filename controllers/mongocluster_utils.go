@@ -2,35 +2,49 @@ package controllers
 
 import (
 	"fmt"
-	"k8s.io/apimachinery/pkg/util/json"
-	"k8s.io/apimachinery/pkg/util/rand"
+	"strconv"
 )
 
 func getResourceGenericName(prefix, suffix string) string {
 	return fmt.Sprintf(MONGO_RESOURCE_FORMAT, prefix, suffix)
 }
 
-func getRandomPort() int32 {
-	return int32(rand.IntnRange(30000, 32767))
+func getStatefulSetName(clusterName string) string {
+	return fmt.Sprintf(MONGO_STATEFULSET_FORMAT, clusterName)
 }
 
-type ClusterMembers struct {
-	Id   int    `json:"Id"`
-	Host string `json:"Host"`
+func getHeadlessServiceName(clusterName string) string {
+	return getResourceGenericName(clusterName, MONGO_HEADLESS_SERVICE_SUFFIX)
 }
 
-func getClusterMembers(resourceName string, clusterSize int) string {
-	var members []ClusterMembers
-	for i := 0; i < clusterSize; i++ {
-		member := ClusterMembers{
-			Id:   i,
-			Host: getResourceGenericName(resourceName, fmt.Sprintf("%d", i)),
-		}
-		members = append(members, member)
-	}
-	membersBytes, err := json.Marshal(members)
-	if err != nil {
-		return ""
-	}
-	return string(membersBytes[:])
+// getPersistentVolumeClaimName returns the name the StatefulSet controller gives to the claim
+// created from the volume claim template for the member at the given index.
+func getPersistentVolumeClaimName(clusterName string, index int) string {
+	return fmt.Sprintf("%s-%s-%d", MONGO_STORAGE_VOLUME_NAME, getStatefulSetName(clusterName), index)
+}
+
+// getMemberHost returns the address a member advertises in the replica set configuration, resolved
+// through the headless service so that it stays valid whatever the way members are exposed.
+func getMemberHost(clusterName string, namespace string, index int) string {
+	return fmt.Sprintf("%s.%s.%s.svc.%s:%d",
+		getResourceGenericName(clusterName, strconv.Itoa(index)),
+		getHeadlessServiceName(clusterName),
+		namespace,
+		MONGO_CLUSTER_DOMAIN,
+		MONGO_CONTAINER_PORT)
+}
+
+// invalidSpecError flags errors caused by the MongoCluster spec itself, they are reported with their
+// own condition reason since retrying will not fix them.
+type invalidSpecError struct {
+	Field string
+	Err   error
+}
+
+func (e *invalidSpecError) Error() string {
+	return fmt.Sprintf("invalid spec.%s: %s", e.Field, e.Err)
+}
+
+func (e *invalidSpecError) Unwrap() error {
+	return e.Err
 }
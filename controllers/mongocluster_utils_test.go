@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("getMemberHost", func() {
+	It("resolves the member through the headless service", func() {
+		Expect(getMemberHost("mongo", "db", 1)).To(Equal("mongo-mongo-1.mongo-mongo-headless.db.svc.cluster.local:27017"))
+	})
+
+	It("uses the DNS domain of the cluster", func() {
+		domain := MONGO_CLUSTER_DOMAIN
+		DeferCleanup(func() { MONGO_CLUSTER_DOMAIN = domain })
+		MONGO_CLUSTER_DOMAIN = "example.org"
+		Expect(getMemberHost("mongo", "db", 1)).To(Equal("mongo-mongo-1.mongo-mongo-headless.db.svc.example.org:27017"))
+		Expect(getRouterHost("mongo", "db")).To(Equal(getRouterName("mongo") + ".db.svc.example.org:27017"))
+	})
+})
@@ -0,0 +1,67 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// MongoRestoreReconciler reconciles a MongoRestore object
+type MongoRestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+var restoreLogger = logf.Log.WithName("controller_mongorestore")
+
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongorestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongorestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongorestores/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;delete
+
+// Reconcile runs the restore Job of a MongoRestore and records its outcome. A restore runs once, it is
+// not retried after it completed or failed.
+func (r *MongoRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mongoRestore appsv1beta1.MongoRestore
+	if err := r.Get(ctx, req.NamespacedName, &mongoRestore); err != nil {
+		restoreLogger.Error(err, "unable to fetch MongoRestore")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if mongoRestore.Status.Phase == appsv1beta1.MongoRestoreCompleted || mongoRestore.Status.Phase == appsv1beta1.MongoRestoreFailed {
+		return ctrl.Result{}, nil
+	}
+	restoreService := r.NewService(ctx, &mongoRestore, req.Namespace)
+	result, err := restoreService.Run()
+	if statusErr := restoreService.UpdateStatus(); statusErr != nil && err == nil {
+		return ctrl.Result{}, statusErr
+	}
+	return result, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MongoRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appsv1beta1.MongoRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
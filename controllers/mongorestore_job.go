@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	MONGO_RESTORE_JOB_FORMAT               = "%s-restore"
+	MONGO_RESTORE_CONTAINER                = "mongorestore"
+	MONGO_RESTORE_DOWNLOAD_CONTAINER       = "download"
+	MONGO_RESTORE_SCRATCH_VOLUME_NAME      = "restore"
+	MONGO_RESTORE_SCRATCH_MOUNT_PATH       = "/restore"
+	MONGO_RESTORE_OPLOG_DOWNLOAD_CONTAINER = "download-oplog"
+	MONGO_RESTORE_OPLOG_VOLUME_NAME        = "oplog-archive"
+	MONGO_RESTORE_OPLOG_MOUNT_PATH         = "/oplog-archive"
+)
+
+var MONGO_RESTORE_BACKOFF_LIMIT int32 = 0
+
+// MONGO_RESTORE_SCRIPT extracts the archive and restores it. The oplog the dump recorded is replayed
+// unless namespaces are filtered, mongorestore does not filter the oplog entries. With a target time,
+// the archived oplog is first checked to cover the time from the archive to the target, then the
+// chunks of that period are replayed up to the end of the target second once the archive is restored.
+// The number of documents restored and failed, or the error, is left in the termination message.
+const MONGO_RESTORE_SCRIPT = "set -eo pipefail\n" + MONGO_CLIENT_AUTH_SCRIPT + `fail() { printf '{"error":"%s"%s}' "$1" "$2" > /dev/termination-log; echo "$1" >&2; exit 1; }
+ts_fmt() { printf '%010d.%010d' "$1" "$2"; }
+ts_parse() { sed -n 's/.*"ts":{"$timestamp":{"t":\([0-9]*\),"i":\([0-9]*\)}}.*/\1 \2/p'; }
+DUMP_DIR="$RESTORE_DIR/dump"
+mkdir -p "$DUMP_DIR"
+tar xzf "$BACKUP_FILE" -C "$DUMP_DIR"
+if [ -n "$TARGET_TS" ]; then
+  if [ -z "$BASE_TS" ] && [ -s "$DUMP_DIR/oplog.bson" ]; then
+    BASE_TS=$(ts_fmt $(bsondump --quiet "$DUMP_DIR/oplog.bson" | ts_parse | tail -n 1))
+  fi
+  if [ -z "$BASE_TS" ]; then
+    fail "The point in time of the archive is unknown"
+  fi
+  if [[ "$BASE_TS" > "$TARGET_TS" ]]; then
+    fail "The archive, consistent with $BASE_TS, is more recent than the target time"
+  fi
+  for gap in "$OPLOG_PATH"/gaps/*; do
+    [ -e "$gap" ] || continue
+    name=$(basename "$gap")
+    from=${name%-*}
+    to=${name#*-}
+    if [[ "$to" > "$BASE_TS" && "$from" < "$TARGET_TS" ]]; then
+      fail "Oplog entries between $from and $to are missing from the archive" ',"oplogGap":true'
+    fi
+  done
+  POSITION=$(cat "$OPLOG_PATH/position" 2> /dev/null || true)
+  if [ -z "$POSITION" ]; then
+    POSITION=$(ls -1 "$OPLOG_PATH/chunks" 2> /dev/null | grep '\.bson\.gz$' | sort | tail -n 1 || true)
+    POSITION=${POSITION%.bson.gz}
+    POSITION=${POSITION#*-}
+  fi
+  if [[ "$POSITION" < "$TARGET_TS" ]]; then
+    fail "The oplog is only archived up to ${POSITION:-its start}" ',"oplogGap":true'
+  fi
+fi
+read -r -a INCLUDE <<< "$RESTORE_NS_INCLUDE"
+read -r -a EXCLUDE <<< "$RESTORE_NS_EXCLUDE"
+OPTIONS=()
+if [ "$RESTORE_DROP" = "true" ]; then
+  OPTIONS+=(--drop)
+fi
+for ns in "${INCLUDE[@]}"; do
+  OPTIONS+=(--nsInclude "$ns")
+done
+for ns in "${EXCLUDE[@]}"; do
+  OPTIONS+=(--nsExclude "$ns")
+done
+if [ ${#INCLUDE[@]} -eq 0 ] && [ ${#EXCLUDE[@]} -eq 0 ] && [ -f "$DUMP_DIR/oplog.bson" ]; then
+  OPTIONS+=(--oplogReplay)
+fi
+mongorestore --host "$MONGODB_HOSTS" "${AUTH[@]}" "${OPTIONS[@]}" --dir "$DUMP_DIR" 2>&1 | tee "$RESTORE_DIR/mongorestore.log"
+if [ -n "$TARGET_TS" ]; then
+  REPLAY_DIR="$RESTORE_DIR/replay"
+  mkdir -p "$REPLAY_DIR"
+  for name in $(ls -1 "$OPLOG_PATH/chunks" | grep '\.bson\.gz$' | sort); do
+    first=${name%%-*}
+    last=${name#*-}
+    last=${last%.bson.gz}
+    if [[ "$last" > "$BASE_TS" && ! "$first" > "$TARGET_TS" ]]; then
+      gunzip -c "$OPLOG_PATH/chunks/$name" >> "$REPLAY_DIR/oplog.bson"
+    fi
+  done
+  if [ -s "$REPLAY_DIR/oplog.bson" ]; then
+    mongorestore --host "$MONGODB_HOSTS" "${AUTH[@]}" --oplogReplay --oplogLimit "$((10#${TARGET_TS%.*} + 1))" --dir "$REPLAY_DIR"
+  fi
+fi
+COUNTS=$(sed -n 's/.* \([0-9]*\) document(s) restored successfully\. \([0-9]*\) document(s) failed to restore\..*/\1 \2/p' "$RESTORE_DIR/mongorestore.log" | tail -n 1)
+COUNTS=${COUNTS:-0 0}
+printf '{"restoredDocuments":%s,"failedDocuments":%s}' "${COUNTS% *}" "${COUNTS#* }" > /dev/termination-log
+`
+
+// MONGO_RESTORE_OPLOG_DOWNLOAD_SCRIPT copies the gap markers and the chunks of the oplog archive that
+// hold entries between the archive and the target time from the bucket, and records the last entry
+// archived.
+const MONGO_RESTORE_OPLOG_DOWNLOAD_SCRIPT = `set -e
+mc alias set store "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+mkdir -p "$OPLOG_PATH/chunks" "$OPLOG_PATH/gaps"
+mc cp --recursive "store/$S3_BUCKET/$OPLOG_DIR/gaps/" "$OPLOG_PATH/gaps/"
+mc ls "store/$S3_BUCKET/$OPLOG_DIR/chunks/" | while read -r line; do echo "${line##* }"; done | grep '\.bson\.gz$' | sort > "$OPLOG_PATH/chunks.txt"
+LAST=$(tail -n 1 "$OPLOG_PATH/chunks.txt")
+LAST=${LAST%.bson.gz}
+echo "${LAST#*-}" > "$OPLOG_PATH/position"
+while read -r name; do
+  first=${name%%-*}
+  last=${name#*-}
+  last=${last%.bson.gz}
+  if [ -n "$BASE_TS" ] && [ ! "$last" \> "$BASE_TS" ]; then
+    continue
+  fi
+  if [ "$first" \> "$TARGET_TS" ]; then
+    continue
+  fi
+  mc cp "store/$S3_BUCKET/$OPLOG_DIR/chunks/$name" "$OPLOG_PATH/chunks/$name"
+done < "$OPLOG_PATH/chunks.txt"
+`
+
+// MONGO_RESTORE_DOWNLOAD_SCRIPT copies the archive from the bucket with the MinIO client.
+const MONGO_RESTORE_DOWNLOAD_SCRIPT = `set -e
+mc alias set store "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+mc cp "store/$S3_BUCKET/$S3_KEY" "$BACKUP_FILE"
+`
+
+func getRestoreJobName(restoreName string) string {
+	return fmt.Sprintf(MONGO_RESTORE_JOB_FORMAT, restoreName)
+}
+
+// createRestoreJob restores the archive of the source. An archive in a bucket is first downloaded to a
+// scratch volume by an init container, an archive in a claim is read in place. The oplog archive is
+// handled the same way when the source has to be rolled forward.
+func (r *MongoRestoreService) createRestoreJob(mongoCluster *appsv1beta1.MongoCluster, source *restoreSource) (*batchv1.Job, error) {
+	storage, key := *source.Storage, source.Key
+	image := mongoCluster.Spec.Image
+	if image == "" {
+		image = MONGO_CONTAINER_IMAGE
+	}
+	scratchMount := v1api.VolumeMount{
+		Name:      MONGO_RESTORE_SCRATCH_VOLUME_NAME,
+		MountPath: MONGO_RESTORE_SCRATCH_MOUNT_PATH,
+	}
+	volumes := []v1api.Volume{
+		{
+			Name:         MONGO_RESTORE_SCRATCH_VOLUME_NAME,
+			VolumeSource: v1api.VolumeSource{EmptyDir: &v1api.EmptyDirVolumeSource{}},
+		},
+	}
+	backupFile := path.Join(MONGO_RESTORE_SCRATCH_MOUNT_PATH, path.Base(key))
+	restoreMounts := []v1api.VolumeMount{scratchMount}
+	var initContainers []v1api.Container
+	if s3 := storage.S3; s3 != nil {
+		initContainers = []v1api.Container{
+			{
+				Name:    MONGO_RESTORE_DOWNLOAD_CONTAINER,
+				Image:   MONGO_BACKUP_UPLOAD_IMAGE,
+				Command: []string{"/bin/sh", "-c"},
+				Args:    []string{MONGO_RESTORE_DOWNLOAD_SCRIPT},
+				Env: []v1api.EnvVar{
+					{Name: "BACKUP_FILE", Value: backupFile},
+					{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+					{Name: "S3_BUCKET", Value: s3.Bucket},
+					{Name: "S3_KEY", Value: key},
+				},
+				EnvFrom: []v1api.EnvFromSource{
+					{
+						SecretRef: &v1api.SecretEnvSource{
+							LocalObjectReference: v1api.LocalObjectReference{Name: s3.CredentialsSecret},
+						},
+					},
+				},
+				VolumeMounts: []v1api.VolumeMount{scratchMount},
+			},
+		}
+	} else {
+		backupFile = path.Join(MONGO_BACKUP_MOUNT_PATH, key)
+		restoreMounts = append(restoreMounts, v1api.VolumeMount{
+			Name:      MONGO_BACKUP_VOLUME_NAME,
+			MountPath: MONGO_BACKUP_MOUNT_PATH,
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, v1api.Volume{
+			Name: MONGO_BACKUP_VOLUME_NAME,
+			VolumeSource: v1api.VolumeSource{
+				PersistentVolumeClaim: &v1api.PersistentVolumeClaimVolumeSource{
+					ClaimName: storage.PersistentVolumeClaim.ClaimName,
+					ReadOnly:  true,
+				},
+			},
+		})
+	}
+	spec := r.Restore.Spec
+	env := append([]v1api.EnvVar{
+		{Name: "BACKUP_FILE", Value: backupFile},
+		{Name: "RESTORE_DIR", Value: MONGO_RESTORE_SCRATCH_MOUNT_PATH},
+		{Name: "RESTORE_DROP", Value: strconv.FormatBool(spec.Drop)},
+		{Name: "RESTORE_NS_INCLUDE", Value: strings.Join(spec.NsInclude, " ")},
+		{Name: "RESTORE_NS_EXCLUDE", Value: strings.Join(spec.NsExclude, " ")},
+	}, getConnectionEnv(mongoCluster)...)
+	if oplogStorage := source.OplogStorage; oplogStorage != nil {
+		targetTime := r.Restore.Spec.TargetTime
+		oplogEnv := []v1api.EnvVar{
+			{Name: "TARGET_TS", Value: formatOplogTimestamp(uint32(targetTime.Unix()), MONGO_OPLOG_TIMESTAMP_MAX_ORDINAL)},
+		}
+		if source.OplogTimestamp != nil {
+			oplogEnv = append(oplogEnv, v1api.EnvVar{Name: "BASE_TS", Value: formatOplogTimestamp(source.OplogTimestamp.T, source.OplogTimestamp.I)})
+		}
+		oplogDir := getOplogArchiveDir(*oplogStorage, r.Namespace, source.ClusterName)
+		if s3 := oplogStorage.S3; s3 != nil {
+			oplogPath := path.Join(MONGO_RESTORE_SCRATCH_MOUNT_PATH, MONGO_OPLOG_DIRECTORY)
+			oplogEnv = append(oplogEnv, v1api.EnvVar{Name: "OPLOG_PATH", Value: oplogPath})
+			initContainers = append(initContainers, v1api.Container{
+				Name:    MONGO_RESTORE_OPLOG_DOWNLOAD_CONTAINER,
+				Image:   MONGO_BACKUP_UPLOAD_IMAGE,
+				Command: []string{"/bin/sh", "-c"},
+				Args:    []string{MONGO_RESTORE_OPLOG_DOWNLOAD_SCRIPT},
+				Env: append(append([]v1api.EnvVar{}, oplogEnv...),
+					v1api.EnvVar{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+					v1api.EnvVar{Name: "S3_BUCKET", Value: s3.Bucket},
+					v1api.EnvVar{Name: "OPLOG_DIR", Value: oplogDir},
+				),
+				EnvFrom: []v1api.EnvFromSource{
+					{
+						SecretRef: &v1api.SecretEnvSource{
+							LocalObjectReference: v1api.LocalObjectReference{Name: s3.CredentialsSecret},
+						},
+					},
+				},
+				VolumeMounts: []v1api.VolumeMount{scratchMount},
+			})
+		} else {
+			oplogEnv = append(oplogEnv, v1api.EnvVar{Name: "OPLOG_PATH", Value: path.Join(MONGO_RESTORE_OPLOG_MOUNT_PATH, oplogDir)})
+			restoreMounts = append(restoreMounts, v1api.VolumeMount{
+				Name:      MONGO_RESTORE_OPLOG_VOLUME_NAME,
+				MountPath: MONGO_RESTORE_OPLOG_MOUNT_PATH,
+				ReadOnly:  true,
+			})
+			volumes = append(volumes, v1api.Volume{
+				Name: MONGO_RESTORE_OPLOG_VOLUME_NAME,
+				VolumeSource: v1api.VolumeSource{
+					PersistentVolumeClaim: &v1api.PersistentVolumeClaimVolumeSource{
+						ClaimName: oplogStorage.PersistentVolumeClaim.ClaimName,
+						ReadOnly:  true,
+					},
+				},
+			})
+		}
+		env = append(env, oplogEnv...)
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getRestoreJobName(r.Restore.Name),
+			Namespace: r.Namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &MONGO_RESTORE_BACKOFF_LIMIT,
+			Template: v1api.PodTemplateSpec{
+				Spec: v1api.PodSpec{
+					RestartPolicy:  v1api.RestartPolicyNever,
+					InitContainers: initContainers,
+					Containers: []v1api.Container{
+						{
+							Name:         MONGO_RESTORE_CONTAINER,
+							Image:        image,
+							Command:      []string{"/bin/bash", "-c"},
+							Args:         []string{MONGO_RESTORE_SCRIPT},
+							Env:          env,
+							VolumeMounts: restoreMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+	if err := ctrl.SetControllerReference(r.Restore, job, r.Reconciler.Scheme); err != nil {
+		r.Logger.Error(err, "Error setting restore Job owner reference")
+		return nil, err
+	}
+	return job, nil
+}
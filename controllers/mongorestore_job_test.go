@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("MongoRestore Job", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var restore *appsv1beta1.MongoRestore
+
+	BeforeEach(func() {
+		cluster = newTestCluster(3)
+		cluster.Status.Conditions = []metav1.Condition{{Type: appsv1beta1.ConditionAvailable, Status: metav1.ConditionTrue}}
+		restore = &appsv1beta1.MongoRestore{
+			ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: testNamespace},
+			Spec: appsv1beta1.MongoRestoreSpec{
+				ClusterName: cluster.Name,
+				Source: appsv1beta1.RestoreSource{
+					Storage: &appsv1beta1.BackupStorage{S3: &appsv1beta1.S3Storage{Endpoint: "http://minio:9000", Bucket: "backups", CredentialsSecret: "s3"}},
+					Key:     "default/mongo/nightly.tar.gz",
+				},
+				Drop:      true,
+				NsInclude: []string{"app.*", "audit.*"},
+			},
+		}
+	})
+
+	getCluster := func(service *MongoRestoreService) *appsv1beta1.MongoCluster {
+		actual := &appsv1beta1.MongoCluster{}
+		Expect(service.Reconciler.Client.Get(context.Background(), client.ObjectKeyFromObject(cluster), actual)).To(Succeed())
+		return actual
+	}
+
+	It("downloads the archive before restoring it with the options of the restore", func() {
+		service := newTestRestoreService(restore, cluster)
+		source, ready, err := service.getSource(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+		job, err := service.createRestoreJob(cluster, source)
+		Expect(err).NotTo(HaveOccurred())
+		spec := job.Spec.Template.Spec
+		Expect(spec.InitContainers).To(HaveLen(1))
+		Expect(spec.InitContainers[0].Name).To(Equal(MONGO_RESTORE_DOWNLOAD_CONTAINER))
+		Expect(spec.InitContainers[0].Env).To(ContainElement(v1api.EnvVar{Name: "S3_KEY", Value: "default/mongo/nightly.tar.gz"}))
+		Expect(spec.Containers[0].Env).To(ContainElements(
+			v1api.EnvVar{Name: "BACKUP_FILE", Value: "/restore/nightly.tar.gz"},
+			v1api.EnvVar{Name: "RESTORE_DROP", Value: "true"},
+			v1api.EnvVar{Name: "RESTORE_NS_INCLUDE", Value: "app.* audit.*"},
+		))
+		Expect(*job.Spec.BackoffLimit).To(BeEquivalentTo(0))
+	})
+
+	It("reads an archive of a claim in place", func() {
+		restore.Spec.Source.Storage = &appsv1beta1.BackupStorage{PersistentVolumeClaim: &appsv1beta1.PersistentVolumeClaimStorage{ClaimName: "backups"}}
+		service := newTestRestoreService(restore, cluster)
+		source, _, err := service.getSource(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		job, err := service.createRestoreJob(cluster, source)
+		Expect(err).NotTo(HaveOccurred())
+		spec := job.Spec.Template.Spec
+		Expect(spec.InitContainers).To(BeEmpty())
+		Expect(spec.Containers[0].Env).To(ContainElement(v1api.EnvVar{Name: "BACKUP_FILE", Value: "/backup/default/mongo/nightly.tar.gz"}))
+		Expect(spec.Volumes[1].PersistentVolumeClaim.ReadOnly).To(BeTrue())
+	})
+
+	It("waits for the MongoBackup to complete", func() {
+		restore.Spec.Source = appsv1beta1.RestoreSource{BackupName: "nightly"}
+		backup := &appsv1beta1.MongoBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: testNamespace},
+			Status:     appsv1beta1.MongoBackupStatus{Phase: appsv1beta1.MongoBackupRunning},
+		}
+		service := newTestRestoreService(restore, cluster, backup)
+		_, ready, err := service.getSource(cluster)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoRestorePending))
+	})
+
+	It("pauses the cluster while the Job runs", func() {
+		service := newTestRestoreService(restore, cluster)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoRestoreRunning))
+		Expect(getCluster(service).Annotations).To(HaveKeyWithValue(MONGO_RESTORE_ANNOTATION, restore.Name))
+		job := &batchv1.Job{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: "restore-restore", Namespace: testNamespace}, job)).To(Succeed())
+	})
+
+	It("waits for the cluster to be available", func() {
+		cluster.Status.Conditions = nil
+		service := newTestRestoreService(restore, cluster)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoRestorePending))
+		Expect(getCluster(service).Annotations).NotTo(HaveKey(MONGO_RESTORE_ANNOTATION))
+	})
+
+	It("records the documents restored and resumes the cluster", func() {
+		cluster.Annotations = map[string]string{MONGO_RESTORE_ANNOTATION: restore.Name}
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "restore-restore", Namespace: testNamespace},
+			Status:     batchv1.JobStatus{Succeeded: 1},
+		}
+		pod := newJobPod(job.Name, v1api.PodSucceeded, MONGO_RESTORE_CONTAINER, `{"restoredDocuments":10,"failedDocuments":2}`)
+		service := newTestRestoreService(restore, cluster, job, pod)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoRestoreCompleted))
+		Expect(service.Status.RestoredDocuments).To(BeEquivalentTo(10))
+		Expect(service.Status.Message).To(Equal("Restore completed, 2 documents failed to restore"))
+		Expect(getCluster(service).Annotations).NotTo(HaveKey(MONGO_RESTORE_ANNOTATION))
+	})
+
+	It("reports the error the restore left and resumes the cluster", func() {
+		cluster.Annotations = map[string]string{MONGO_RESTORE_ANNOTATION: restore.Name}
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "restore-restore", Namespace: testNamespace},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobFailed, Status: v1api.ConditionTrue, Message: "BackoffLimitExceeded"},
+			}},
+		}
+		pod := newJobPod(job.Name, v1api.PodFailed, MONGO_RESTORE_CONTAINER, `{"error":"The archive is corrupted"}`)
+		service := newTestRestoreService(restore, cluster, job, pod)
+		_, err := service.Run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.Phase).To(Equal(appsv1beta1.MongoRestoreFailed))
+		Expect(service.Status.Message).To(Equal("The archive is corrupted"))
+		Expect(getCluster(service).Annotations).NotTo(HaveKey(MONGO_RESTORE_ANNOTATION))
+	})
+})
+
+// newTestRestoreService builds the service of the restore against a fake API server holding the
+// restore and the given objects.
+func newTestRestoreService(restore *appsv1beta1.MongoRestore, objects ...client.Object) *MongoRestoreService {
+	return newReconcilerService(restore, objects, func(c client.Client, scheme *runtime.Scheme) testReconciler[*appsv1beta1.MongoRestore, MongoRestoreService] {
+		return &MongoRestoreReconciler{Client: c, Scheme: scheme}
+	})
+}
@@ -0,0 +1,327 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+// MONGO_RESTORE_ANNOTATION is set on a MongoCluster to the name of the MongoRestore running against it,
+// the cluster is not reconciled while it is set.
+const MONGO_RESTORE_ANNOTATION = "apps.esgi.fr/restore"
+
+const REASON_OPLOG_REPLAYED = "OplogReplayed"
+
+type MongoRestoreService struct {
+	Restore    *appsv1beta1.MongoRestore
+	Namespace  string
+	Reconciler *MongoRestoreReconciler
+	Context    *context.Context
+	Logger     logr.Logger
+	// Status is the status written back by UpdateStatus
+	Status *appsv1beta1.MongoRestoreStatus
+}
+
+// restoreResult is the termination message of the restore container.
+type restoreResult struct {
+	RestoredDocuments int64  `json:"restoredDocuments"`
+	FailedDocuments   int64  `json:"failedDocuments"`
+	Error             string `json:"error,omitempty"`
+	OplogGap          bool   `json:"oplogGap,omitempty"`
+}
+
+// restoreSource is the resolved location of the archive to restore.
+type restoreSource struct {
+	Storage *appsv1beta1.BackupStorage
+	Key     string
+	// ClusterName is the cluster the archive was taken from
+	ClusterName string
+	// OplogTimestamp is the point in time the archive is consistent with, nil when unknown
+	OplogTimestamp *appsv1beta1.OplogTimestamp
+	// OplogStorage holds the oplog archive to replay, nil without a target time
+	OplogStorage *appsv1beta1.BackupStorage
+}
+
+func (r *MongoRestoreReconciler) NewService(context context.Context, restore *appsv1beta1.MongoRestore, namespace string) MongoRestoreService {
+	return MongoRestoreService{
+		Restore:    restore,
+		Namespace:  namespace,
+		Reconciler: r,
+		Context:    &context,
+		Logger:     restoreLogger,
+		Status:     restore.Status.DeepCopy(),
+	}
+}
+
+// Run pauses the cluster and creates the restore Job once the cluster is available, then follows the
+// Job until it succeeds or fails and resumes the cluster.
+func (r *MongoRestoreService) Run() (ctrl.Result, error) {
+	mongoCluster := &appsv1beta1.MongoCluster{}
+	err := r.Reconciler.Client.Get(*r.Context, types.NamespacedName{Name: r.Restore.Spec.ClusterName, Namespace: r.Namespace}, mongoCluster)
+	if err != nil && errors.IsNotFound(err) {
+		r.pending(fmt.Sprintf("MongoCluster %s not found", r.Restore.Spec.ClusterName))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	} else if err != nil {
+		r.Logger.Error(err, "Error getting MongoCluster")
+		return ctrl.Result{}, err
+	}
+	if mongoCluster.Spec.Sharding != nil {
+		r.fail("Restores of sharded clusters are not supported")
+		return ctrl.Result{}, nil
+	}
+
+	job := &batchv1.Job{}
+	err = r.Reconciler.Client.Get(*r.Context, types.NamespacedName{Name: getRestoreJobName(r.Restore.Name), Namespace: r.Namespace}, job)
+	if err != nil && !errors.IsNotFound(err) {
+		r.Logger.Error(err, "Error getting restore Job")
+		return ctrl.Result{}, err
+	} else if err == nil {
+		return ctrl.Result{}, r.checkRestoreJob(mongoCluster, job)
+	}
+
+	source, ready, err := r.getSource(mongoCluster)
+	if err != nil || !ready {
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, err
+	}
+	if r.Status.Phase == appsv1beta1.MongoRestoreFailed {
+		return ctrl.Result{}, nil
+	}
+	if restore := mongoCluster.Annotations[MONGO_RESTORE_ANNOTATION]; restore != "" && restore != r.Restore.Name {
+		r.pending(fmt.Sprintf("MongoCluster %s is being restored by %s", mongoCluster.Name, restore))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	if !meta.IsStatusConditionTrue(mongoCluster.Status.Conditions, appsv1beta1.ConditionAvailable) {
+		r.pending(fmt.Sprintf("Waiting for MongoCluster %s to be available", mongoCluster.Name))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	if err := r.pauseCluster(mongoCluster); err != nil {
+		return ctrl.Result{}, err
+	}
+	job, err = r.createRestoreJob(mongoCluster, source)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Logger.Info(fmt.Sprintf("Creating restore Job %s", job.Name))
+	if err := r.Reconciler.Client.Create(*r.Context, job); err != nil {
+		r.Logger.Error(err, "Error creating restore Job")
+		return ctrl.Result{}, err
+	}
+	now := metav1.Now()
+	r.Status.Phase = appsv1beta1.MongoRestoreRunning
+	r.Status.Message = fmt.Sprintf("Restoring MongoCluster %s", mongoCluster.Name)
+	r.Status.JobName = job.Name
+	r.Status.Location = getBackupLocation(*source.Storage, source.Key)
+	r.Status.StartTime = &now
+	return ctrl.Result{}, nil
+}
+
+// getSource resolves the archive to restore and the oplog archive to replay. It is not ready while the
+// referenced MongoBackup has not completed, the restore fails when the source cannot be restored at all.
+func (r *MongoRestoreService) getSource(mongoCluster *appsv1beta1.MongoCluster) (*restoreSource, bool, error) {
+	spec := r.Restore.Spec
+	source := &restoreSource{
+		Storage:     spec.Source.Storage,
+		Key:         spec.Source.Key,
+		ClusterName: mongoCluster.Name,
+	}
+	if spec.Source.BackupName == "" {
+		if source.Storage == nil || (source.Storage.S3 == nil) == (source.Storage.PersistentVolumeClaim == nil) || source.Key == "" {
+			r.fail("Either source.backupName or source.storage with exactly one of s3 and persistentVolumeClaim and source.key must be set")
+			return nil, true, nil
+		}
+	} else {
+		backup := &appsv1beta1.MongoBackup{}
+		err := r.Reconciler.Client.Get(*r.Context, types.NamespacedName{Name: spec.Source.BackupName, Namespace: r.Namespace}, backup)
+		if err != nil && errors.IsNotFound(err) {
+			r.pending(fmt.Sprintf("MongoBackup %s not found", spec.Source.BackupName))
+			return nil, false, nil
+		} else if err != nil {
+			r.Logger.Error(err, "Error getting MongoBackup")
+			return nil, false, err
+		}
+		switch backup.Status.Phase {
+		case appsv1beta1.MongoBackupCompleted:
+			source.Storage = &backup.Spec.Storage
+			source.Key = getMongoBackupKey(backup)
+			source.ClusterName = backup.Spec.ClusterName
+			source.OplogTimestamp = backup.Status.OplogTimestamp
+		case appsv1beta1.MongoBackupFailed:
+			r.fail(fmt.Sprintf("MongoBackup %s failed", backup.Name))
+			return nil, true, nil
+		default:
+			r.pending(fmt.Sprintf("Waiting for MongoBackup %s to complete", backup.Name))
+			return nil, false, nil
+		}
+	}
+	if spec.TargetTime == nil {
+		return source, true, nil
+	}
+	if len(spec.NsInclude) > 0 || len(spec.NsExclude) > 0 {
+		r.fail("Namespaces cannot be filtered when restoring to a target time")
+		return nil, true, nil
+	}
+	if source.OplogTimestamp != nil && int64(source.OplogTimestamp.T) > spec.TargetTime.Unix() {
+		r.fail("The archive is more recent than the target time")
+		return nil, true, nil
+	}
+	source.OplogStorage = spec.Source.OplogStorage
+	if source.OplogStorage == nil && mongoCluster.Spec.Backup.OplogArchive != nil {
+		source.OplogStorage = &mongoCluster.Spec.Backup.OplogArchive.Storage
+	}
+	if source.OplogStorage == nil || (source.OplogStorage.S3 == nil) == (source.OplogStorage.PersistentVolumeClaim == nil) {
+		r.fail("Restoring to a target time needs source.oplogStorage or an oplog archive on the cluster")
+		return nil, true, nil
+	}
+	return source, true, nil
+}
+
+// checkRestoreJob reports the step of a running Job and records the outcome of a finished one, the
+// cluster is resumed once the Job finished.
+func (r *MongoRestoreService) checkRestoreJob(mongoCluster *appsv1beta1.MongoCluster, job *batchv1.Job) error {
+	if failure := getJobFailure(job); failure != nil {
+		r.fail(fmt.Sprintf("Restore Job failed: %s", failure.Message))
+		message, err := getTerminationMessage(*r.Context, r.Reconciler.Client, job, MONGO_RESTORE_CONTAINER, v1api.PodFailed)
+		result := &restoreResult{}
+		if err == nil && json.Unmarshal([]byte(message), result) == nil && result.Error != "" {
+			r.Status.Message = result.Error
+		}
+		if result.OplogGap {
+			meta.SetStatusCondition(&r.Status.Conditions, newCondition(appsv1beta1.ConditionOplogChainComplete, false, REASON_OPLOG_GAP, result.Error, r.Restore.Generation))
+		}
+		return r.resumeCluster(mongoCluster)
+	}
+	if job.Status.Succeeded == 0 {
+		return r.setRestoreStep(job)
+	}
+	result, err := r.getRestoreResult(job)
+	if err != nil {
+		return err
+	}
+	completionTime := metav1.Now()
+	if job.Status.CompletionTime != nil {
+		completionTime = *job.Status.CompletionTime
+	}
+	r.Status.Phase = appsv1beta1.MongoRestoreCompleted
+	r.Status.Message = "Restore completed"
+	if result.FailedDocuments > 0 {
+		r.Status.Message = fmt.Sprintf("Restore completed, %d documents failed to restore", result.FailedDocuments)
+	}
+	r.Status.CompletionTime = &completionTime
+	if r.Status.StartTime != nil {
+		r.Status.Duration = completionTime.Sub(r.Status.StartTime.Time).Round(time.Second).String()
+	}
+	r.Status.RestoredDocuments = result.RestoredDocuments
+	r.Status.FailedDocuments = result.FailedDocuments
+	if targetTime := r.Restore.Spec.TargetTime; targetTime != nil {
+		message := fmt.Sprintf("Oplog replayed up to %s", targetTime.UTC().Format(time.RFC3339))
+		meta.SetStatusCondition(&r.Status.Conditions, newCondition(appsv1beta1.ConditionOplogChainComplete, true, REASON_OPLOG_REPLAYED, message, r.Restore.Generation))
+	}
+	return r.resumeCluster(mongoCluster)
+}
+
+// setRestoreStep tells whether the archive is being downloaded or restored.
+func (r *MongoRestoreService) setRestoreStep(job *batchv1.Job) error {
+	pods := &v1api.PodList{}
+	if err := r.Reconciler.Client.List(*r.Context, pods, client.InNamespace(r.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		r.Logger.Error(err, "Error listing restore pods")
+		return err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.InitContainerStatuses {
+			if status.Name == MONGO_RESTORE_DOWNLOAD_CONTAINER && status.State.Running != nil {
+				r.Status.Message = fmt.Sprintf("Downloading %s", r.Status.Location)
+				return nil
+			}
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == MONGO_RESTORE_CONTAINER && status.State.Running != nil {
+				r.Status.Message = fmt.Sprintf("Running mongorestore against MongoCluster %s", r.Restore.Spec.ClusterName)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// getRestoreResult reads the termination message the restore container of the successful pod left.
+func (r *MongoRestoreService) getRestoreResult(job *batchv1.Job) (*restoreResult, error) {
+	message, err := getTerminationMessage(*r.Context, r.Reconciler.Client, job, MONGO_RESTORE_CONTAINER, v1api.PodSucceeded)
+	if err != nil {
+		r.Logger.Error(err, "Error getting restore result")
+		return nil, err
+	}
+	result := &restoreResult{}
+	if err := json.Unmarshal([]byte(message), result); err != nil {
+		r.Logger.Error(err, "Error parsing restore result")
+		return nil, err
+	}
+	return result, nil
+}
+
+// pauseCluster stops the reconciliation of the cluster, so that the operator does not restart or
+// reconfigure members while the data is restored.
+func (r *MongoRestoreService) pauseCluster(mongoCluster *appsv1beta1.MongoCluster) error {
+	if mongoCluster.Annotations[MONGO_RESTORE_ANNOTATION] == r.Restore.Name {
+		return nil
+	}
+	r.Logger.Info(fmt.Sprintf("Pausing MongoCluster %s", mongoCluster.Name))
+	if mongoCluster.Annotations == nil {
+		mongoCluster.Annotations = map[string]string{}
+	}
+	mongoCluster.Annotations[MONGO_RESTORE_ANNOTATION] = r.Restore.Name
+	if err := r.Reconciler.Client.Update(*r.Context, mongoCluster); err != nil {
+		r.Logger.Error(err, "Error pausing MongoCluster")
+		return err
+	}
+	return nil
+}
+
+func (r *MongoRestoreService) resumeCluster(mongoCluster *appsv1beta1.MongoCluster) error {
+	if mongoCluster.Annotations[MONGO_RESTORE_ANNOTATION] != r.Restore.Name {
+		return nil
+	}
+	r.Logger.Info(fmt.Sprintf("Resuming MongoCluster %s", mongoCluster.Name))
+	delete(mongoCluster.Annotations, MONGO_RESTORE_ANNOTATION)
+	if err := r.Reconciler.Client.Update(*r.Context, mongoCluster); err != nil {
+		r.Logger.Error(err, "Error resuming MongoCluster")
+		return err
+	}
+	return nil
+}
+
+func (r *MongoRestoreService) pending(message string) {
+	r.Status.Phase = appsv1beta1.MongoRestorePending
+	r.Status.Message = message
+}
+
+func (r *MongoRestoreService) fail(message string) {
+	now := metav1.Now()
+	r.Status.Phase = appsv1beta1.MongoRestoreFailed
+	r.Status.Message = message
+	r.Status.CompletionTime = &now
+}
+
+// UpdateStatus writes the status when it changed.
+func (r *MongoRestoreService) UpdateStatus() error {
+	if equality.Semantic.DeepEqual(*r.Status, r.Restore.Status) {
+		return nil
+	}
+	r.Restore.Status = *r.Status
+	if err := r.Reconciler.Status().Update(*r.Context, r.Restore); err != nil {
+		r.Logger.Error(err, "Error updating MongoRestore status")
+		return err
+	}
+	return nil
+}
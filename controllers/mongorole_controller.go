@@ -0,0 +1,88 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	roleFinalizerName = "mongorole.finalizers.esgi.fr"
+)
+
+// MongoRoleReconciler reconciles a MongoRole object
+type MongoRoleReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	MongoAdmin mongoadmin.Factory
+}
+
+var roleLogger = logf.Log.WithName("controller_mongorole")
+
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoroles,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoroles/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoroles/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoclusters,verbs=get;list;watch
+
+// Reconcile creates or updates the role on its cluster. The role is dropped from the cluster when the
+// MongoRole is deleted.
+func (r *MongoRoleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mongoRole appsv1beta1.MongoRole
+	if err := r.Get(ctx, req.NamespacedName, &mongoRole); err != nil {
+		roleLogger.Error(err, "unable to fetch MongoRole")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	roleService := r.NewService(ctx, &mongoRole, req.Namespace)
+
+	if !mongoRole.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&mongoRole, roleFinalizerName) {
+			if err := roleService.Delete(); err != nil {
+				return ctrl.Result{}, err
+			}
+			controllerutil.RemoveFinalizer(&mongoRole, roleFinalizerName)
+			if err := r.Update(ctx, &mongoRole); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if !controllerutil.ContainsFinalizer(&mongoRole, roleFinalizerName) {
+		controllerutil.AddFinalizer(&mongoRole, roleFinalizerName)
+		if err := r.Update(ctx, &mongoRole); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	result, err := roleService.Sync()
+	if statusErr := roleService.UpdateStatus(); statusErr != nil && err == nil {
+		return ctrl.Result{}, statusErr
+	}
+	return result, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MongoRoleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appsv1beta1.MongoRole{}).
+		Complete(r)
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	REASON_ROLE_SYNCED = "RoleSynced"
+)
+
+type MongoRoleService struct {
+	Role       *appsv1beta1.MongoRole
+	Namespace  string
+	Reconciler *MongoRoleReconciler
+	Context    *context.Context
+	Logger     logr.Logger
+	// Status is the status written back by UpdateStatus
+	Status *appsv1beta1.MongoRoleStatus
+}
+
+func (r *MongoRoleReconciler) NewService(context context.Context, role *appsv1beta1.MongoRole, namespace string) MongoRoleService {
+	return MongoRoleService{
+		Role:       role,
+		Namespace:  namespace,
+		Reconciler: r,
+		Context:    &context,
+		Logger:     roleLogger,
+		Status:     role.Status.DeepCopy(),
+	}
+}
+
+// Sync creates the role or brings its privileges and inherited roles in line with the spec. A renamed
+// role is dropped under its previous name.
+func (m *MongoRoleService) Sync() (ctrl.Result, error) {
+	mongoCluster, ready, err := getReadyCluster(*m.Context, m.Reconciler.Client, m.Role.Spec.ClusterName, m.Namespace)
+	if err != nil {
+		m.Logger.Error(err, "Error getting MongoCluster")
+		return ctrl.Result{}, err
+	} else if mongoCluster == nil {
+		m.setSynced(false, REASON_CLUSTER_NOT_FOUND, fmt.Sprintf("MongoCluster %s not found", m.Role.Spec.ClusterName))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	} else if !ready {
+		m.setSynced(false, REASON_CLUSTER_NOT_READY, fmt.Sprintf("Waiting for MongoCluster %s to be available", mongoCluster.Name))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+
+	adminClient, err := m.newAdminClient(mongoCluster)
+	if err != nil {
+		m.setSynced(false, REASON_SYNC_ERROR, err.Error())
+		return ctrl.Result{}, err
+	}
+	defer adminClient.Disconnect(*m.Context)
+	roleName, database := m.getRoleName(), m.getDatabase()
+	if m.Status.RoleName != "" && (m.Status.RoleName != roleName || m.Status.Database != database) {
+		m.Logger.Info(fmt.Sprintf("Dropping renamed role %s@%s", m.Status.RoleName, m.Status.Database))
+		if err := adminClient.DropRole(*m.Context, m.Status.Database, m.Status.RoleName); err != nil {
+			m.Logger.Error(err, "Error dropping renamed role")
+			m.setSynced(false, REASON_SYNC_ERROR, err.Error())
+			return ctrl.Result{}, err
+		}
+		m.Status.RoleName, m.Status.Database = "", ""
+	}
+	if err := m.applyRole(adminClient); err != nil {
+		m.setSynced(false, REASON_SYNC_ERROR, err.Error())
+		return ctrl.Result{}, err
+	}
+	m.Status.RoleName, m.Status.Database = roleName, database
+	m.Status.ObservedGeneration = m.Role.Generation
+	m.setSynced(true, REASON_ROLE_SYNCED, fmt.Sprintf("Role %s@%s is up to date", roleName, database))
+	return ctrl.Result{}, nil
+}
+
+// applyRole creates the role, or updates it when it differs from the spec.
+func (m *MongoRoleService) applyRole(adminClient mongoadmin.Client) error {
+	expectedRole := mongoadmin.Role{
+		Name:       m.getRoleName(),
+		DB:         m.getDatabase(),
+		Privileges: getPrivileges(m.Role.Spec.Privileges),
+		Roles:      getRoleReferences(m.Role.Spec.Roles),
+	}
+	actualRole, err := adminClient.GetRole(*m.Context, expectedRole.DB, expectedRole.Name)
+	if err != nil {
+		m.Logger.Error(err, "Error getting role")
+		return err
+	}
+	if actualRole == nil {
+		m.Logger.Info(fmt.Sprintf("Creating role %s@%s", expectedRole.Name, expectedRole.DB))
+		if err := adminClient.CreateRole(*m.Context, expectedRole); err != nil {
+			m.Logger.Error(err, "Error creating role")
+			return err
+		}
+		return nil
+	}
+	if mongoadmin.SameRole(*actualRole, expectedRole) {
+		m.Logger.Info(fmt.Sprintf("Role %s@%s is up to date. Nothing to do.", expectedRole.Name, expectedRole.DB))
+		return nil
+	}
+	m.Logger.Info(fmt.Sprintf("Updating role %s@%s", expectedRole.Name, expectedRole.DB))
+	if err := adminClient.UpdateRole(*m.Context, expectedRole); err != nil {
+		m.Logger.Error(err, "Error updating role")
+		return err
+	}
+	return nil
+}
+
+// Delete drops the role from its cluster. There is nothing to drop when the cluster is gone or being
+// deleted.
+func (m *MongoRoleService) Delete() error {
+	if m.Status.RoleName == "" {
+		return nil
+	}
+	mongoCluster, ready, err := getReadyCluster(*m.Context, m.Reconciler.Client, m.Role.Spec.ClusterName, m.Namespace)
+	if err != nil {
+		m.Logger.Error(err, "Error getting MongoCluster")
+		return err
+	}
+	if mongoCluster == nil || !mongoCluster.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	if !ready {
+		return fmt.Errorf("MongoCluster %s is not available, role %s cannot be dropped yet", mongoCluster.Name, m.Status.RoleName)
+	}
+	adminClient, err := m.newAdminClient(mongoCluster)
+	if err != nil {
+		return err
+	}
+	defer adminClient.Disconnect(*m.Context)
+	m.Logger.Info(fmt.Sprintf("Dropping role %s@%s", m.Status.RoleName, m.Status.Database))
+	if err := adminClient.DropRole(*m.Context, m.Status.Database, m.Status.RoleName); err != nil {
+		m.Logger.Error(err, "Error dropping role")
+		return err
+	}
+	return nil
+}
+
+func (m *MongoRoleService) newAdminClient(mongoCluster *appsv1beta1.MongoCluster) (mongoadmin.Client, error) {
+	hosts, replicaSet := getClientHosts(mongoCluster)
+	adminClient, err := newClusterAdminClient(*m.Context, m.Reconciler.Client, m.Reconciler.MongoAdmin, mongoCluster, hosts, replicaSet)
+	if err != nil {
+		m.Logger.Error(err, "Error connecting to the cluster")
+		return nil, err
+	}
+	return adminClient, nil
+}
+
+func (m *MongoRoleService) getRoleName() string {
+	if m.Role.Spec.RoleName != "" {
+		return m.Role.Spec.RoleName
+	}
+	return m.Role.Name
+}
+
+func (m *MongoRoleService) getDatabase() string {
+	if m.Role.Spec.Database != "" {
+		return m.Role.Spec.Database
+	}
+	return mongoadmin.ADMIN_DATABASE
+}
+
+func (m *MongoRoleService) setSynced(synced bool, reason string, message string) {
+	meta.SetStatusCondition(&m.Status.Conditions, newCondition(appsv1beta1.ConditionSynced, synced, reason, message, m.Role.Generation))
+}
+
+// UpdateStatus writes the status when it changed.
+func (m *MongoRoleService) UpdateStatus() error {
+	if equality.Semantic.DeepEqual(*m.Status, m.Role.Status) {
+		return nil
+	}
+	m.Role.Status = *m.Status
+	if err := m.Reconciler.Status().Update(*m.Context, m.Role); err != nil {
+		m.Logger.Error(err, "Error updating MongoRole status")
+		return err
+	}
+	return nil
+}
+
+func getPrivileges(privileges []appsv1beta1.Privilege) []mongoadmin.Privilege {
+	var result []mongoadmin.Privilege
+	for _, privilege := range privileges {
+		result = append(result, mongoadmin.Privilege{
+			Resource: mongoadmin.PrivilegeResource{
+				DB:         privilege.Resource.Database,
+				Collection: privilege.Resource.Collection,
+				Cluster:    privilege.Resource.Cluster,
+			},
+			Actions: privilege.Actions,
+		})
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("MongoRole", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var adminSecret *v1api.Secret
+	var role *appsv1beta1.MongoRole
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster, adminSecret = newAvailableCluster(3)
+		role = &appsv1beta1.MongoRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "reporting", Namespace: testNamespace, Generation: 1},
+			Spec: appsv1beta1.MongoRoleSpec{
+				ClusterName: cluster.Name,
+				Database:    "app",
+				Privileges: []appsv1beta1.Privilege{{
+					Resource: appsv1beta1.PrivilegeResource{Database: "app", Collection: "orders"},
+					Actions:  []string{"find"},
+				}},
+				Roles: []appsv1beta1.RoleReference{{Name: "read", Database: "logs"}},
+			},
+		}
+		mongo = mongofake.NewClient()
+	})
+
+	syncedCondition := func(service *MongoRoleService) *metav1.Condition {
+		return meta.FindStatusCondition(service.Status.Conditions, appsv1beta1.ConditionSynced)
+	}
+
+	It("creates the role with its privileges and inherited roles", func() {
+		service := newTestRoleService(role, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		created, err := mongo.GetRole(context.Background(), "app", "reporting")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.Privileges).To(Equal([]mongoadmin.Privilege{{
+			Resource: mongoadmin.PrivilegeResource{DB: "app", Collection: "orders"},
+			Actions:  []string{"find"},
+		}}))
+		Expect(created.Roles).To(Equal([]mongoadmin.RoleReference{{Role: "read", DB: "logs"}}))
+		Expect(syncedCondition(service).Status).To(Equal(metav1.ConditionTrue))
+		Expect(service.Status.RoleName).To(Equal("reporting"))
+		Expect(service.Status.ObservedGeneration).To(BeEquivalentTo(1))
+	})
+
+	It("updates the role only when it differs from the spec", func() {
+		service := newTestRoleService(role, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+
+		mongo.Commands = nil
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Commands).NotTo(ContainElement("updateRole"))
+
+		role.Spec.Privileges[0].Actions = []string{"find", "insert"}
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Commands).To(ContainElement("updateRole"))
+		updated, _ := mongo.GetRole(context.Background(), "app", "reporting")
+		Expect(updated.Privileges[0].Actions).To(Equal([]string{"find", "insert"}))
+	})
+
+	It("drops a renamed role under its previous name", func() {
+		service := newTestRoleService(role, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+
+		role.Spec.RoleName = "analytics"
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		previous, _ := mongo.GetRole(context.Background(), "app", "reporting")
+		Expect(previous).To(BeNil())
+		renamed, _ := mongo.GetRole(context.Background(), "app", "analytics")
+		Expect(renamed).NotTo(BeNil())
+	})
+
+	It("reports the errors of the cluster in its status", func() {
+		mongo.Err = fmt.Errorf("not authorized")
+		service := newTestRoleService(role, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).To(HaveOccurred())
+		Expect(syncedCondition(service).Status).To(Equal(metav1.ConditionFalse))
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_SYNC_ERROR))
+		Expect(syncedCondition(service).Message).To(ContainSubstring("not authorized"))
+	})
+
+	It("drops the role when it is deleted", func() {
+		service := newTestRoleService(role, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Delete()).To(Succeed())
+		dropped, _ := mongo.GetRole(context.Background(), "app", "reporting")
+		Expect(dropped).To(BeNil())
+	})
+
+	It("waits for the cluster to be available before dropping the role", func() {
+		role.Status.RoleName, role.Status.Database = "reporting", "app"
+		cluster.Status.Conditions = nil
+		service := newTestRoleService(role, mongo, cluster, adminSecret)
+		Expect(service.Delete()).NotTo(Succeed())
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+})
+
+// newTestRoleService builds the service of the role against a fake API server holding the role and the
+// given objects. Every admin client it opens is the fake mongo client.
+func newTestRoleService(role *appsv1beta1.MongoRole, mongo *mongofake.Client, objects ...client.Object) *MongoRoleService {
+	return newReconcilerService(role, objects, func(c client.Client, scheme *runtime.Scheme) testReconciler[*appsv1beta1.MongoRole, MongoRoleService] {
+		return &MongoRoleReconciler{Client: c, Scheme: scheme, MongoAdmin: mongo.Factory()}
+	})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	userFinalizerName = "mongouser.finalizers.esgi.fr"
+)
+
+// MongoUserReconciler reconciles a MongoUser object
+type MongoUserReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	MongoAdmin mongoadmin.Factory
+}
+
+var userLogger = logf.Log.WithName("controller_mongouser")
+
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongousers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongousers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongousers/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps.esgi.fr,resources=mongoclusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;delete
+
+// Reconcile creates or updates the user on its cluster and publishes its connection secret. The user
+// is dropped from the cluster when the MongoUser is deleted.
+func (r *MongoUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mongoUser appsv1beta1.MongoUser
+	if err := r.Get(ctx, req.NamespacedName, &mongoUser); err != nil {
+		userLogger.Error(err, "unable to fetch MongoUser")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	userService := r.NewService(ctx, &mongoUser, req.Namespace)
+
+	if !mongoUser.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&mongoUser, userFinalizerName) {
+			if err := userService.Delete(); err != nil {
+				return ctrl.Result{}, err
+			}
+			controllerutil.RemoveFinalizer(&mongoUser, userFinalizerName)
+			if err := r.Update(ctx, &mongoUser); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if !controllerutil.ContainsFinalizer(&mongoUser, userFinalizerName) {
+		controllerutil.AddFinalizer(&mongoUser, userFinalizerName)
+		if err := r.Update(ctx, &mongoUser); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	result, err := userService.Sync()
+	if statusErr := userService.UpdateStatus(); statusErr != nil && err == nil {
+		return ctrl.Result{}, statusErr
+	}
+	return result, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MongoUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&appsv1beta1.MongoUser{}).
+		Owns(&v1api.Secret{}).
+		Watches(&source.Kind{Type: &v1api.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.findUsersForPasswordSecret)).
+		Complete(r)
+}
+
+// findUsersForPasswordSecret requeues the users whose password is held by the secret, so that a new
+// password is applied right away.
+func (r *MongoUserReconciler) findUsersForPasswordSecret(secret client.Object) []reconcile.Request {
+	users := &appsv1beta1.MongoUserList{}
+	if err := r.List(context.Background(), users, client.InNamespace(secret.GetNamespace())); err != nil {
+		userLogger.Error(err, "Error listing MongoUsers")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, user := range users.Items {
+		if user.Spec.PasswordSecretRef.Name == secret.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: user.Name, Namespace: user.Namespace}})
+		}
+	}
+	return requests
+}
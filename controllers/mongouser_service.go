@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"github.com/go-logr/logr"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	MONGO_USER_CONNECTION_SECRET_FORMAT = "%s-%s-connection"
+
+	REASON_USER_SYNCED        = "UserSynced"
+	REASON_CLUSTER_NOT_FOUND  = "ClusterNotFound"
+	REASON_CLUSTER_NOT_READY  = "ClusterNotReady"
+	REASON_PASSWORD_NOT_FOUND = "PasswordNotFound"
+	REASON_SYNC_ERROR         = "SyncError"
+	REASON_RESERVED_USER      = "ReservedUser"
+)
+
+type MongoUserService struct {
+	User       *appsv1beta1.MongoUser
+	Namespace  string
+	Reconciler *MongoUserReconciler
+	Context    *context.Context
+	Logger     logr.Logger
+	// Status is the status written back by UpdateStatus
+	Status *appsv1beta1.MongoUserStatus
+}
+
+func (r *MongoUserReconciler) NewService(context context.Context, user *appsv1beta1.MongoUser, namespace string) MongoUserService {
+	return MongoUserService{
+		User:       user,
+		Namespace:  namespace,
+		Reconciler: r,
+		Context:    &context,
+		Logger:     userLogger,
+		Status:     user.Status.DeepCopy(),
+	}
+}
+
+// Sync creates the user or brings its roles and password in line with the spec, then writes its
+// connection secret. A renamed user is dropped under its previous name. The admin user of the operator
+// is never touched.
+func (u *MongoUserService) Sync() (ctrl.Result, error) {
+	if isOperatorUser(u.getUsername(), u.getDatabase()) {
+		u.setSynced(false, REASON_RESERVED_USER, fmt.Sprintf("User %s@%s is reserved to the operator", u.getUsername(), u.getDatabase()))
+		return ctrl.Result{}, nil
+	}
+	mongoCluster, ready, err := getReadyCluster(*u.Context, u.Reconciler.Client, u.User.Spec.ClusterName, u.Namespace)
+	if err != nil {
+		u.Logger.Error(err, "Error getting MongoCluster")
+		return ctrl.Result{}, err
+	} else if mongoCluster == nil {
+		u.setSynced(false, REASON_CLUSTER_NOT_FOUND, fmt.Sprintf("MongoCluster %s not found", u.User.Spec.ClusterName))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	} else if !ready {
+		u.setSynced(false, REASON_CLUSTER_NOT_READY, fmt.Sprintf("Waiting for MongoCluster %s to be available", mongoCluster.Name))
+		return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+	}
+	// MONGODB-X509 users have no password, they authenticate with the client certificate issued for them.
+	passwordSecret := &v1api.Secret{}
+	var password []byte
+	if u.usesX509() {
+		if !mongoCluster.Spec.Auth.HasMechanism(appsv1beta1.AuthMechanismX509) || mongoCluster.Spec.TLS == nil {
+			u.setSynced(false, REASON_MECHANISM_NOT_ALLOWED, fmt.Sprintf("MongoCluster %s does not accept %s", mongoCluster.Name, appsv1beta1.AuthMechanismX509))
+			return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+		}
+		issued, err := u.createOrUpdateClientCertificate(mongoCluster)
+		if err != nil {
+			u.setSynced(false, REASON_SYNC_ERROR, err.Error())
+			return ctrl.Result{}, err
+		}
+		if !issued {
+			u.setSynced(false, REASON_CERTIFICATE_NOT_ISSUED, fmt.Sprintf("Waiting for certificate %s to be issued", u.Status.CertificateSecretName))
+			return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+		}
+	} else {
+		if err := u.deleteClientCertificate(); err != nil {
+			u.setSynced(false, REASON_SYNC_ERROR, err.Error())
+			return ctrl.Result{}, err
+		}
+		secretRef := u.User.Spec.PasswordSecretRef
+		err = u.Reconciler.Client.Get(*u.Context, types.NamespacedName{Name: secretRef.Name, Namespace: u.Namespace}, passwordSecret)
+		if err != nil && !errors.IsNotFound(err) {
+			u.Logger.Error(err, "Error getting password secret")
+			return ctrl.Result{}, err
+		}
+		var ok bool
+		password, ok = passwordSecret.Data[getSecretKey(secretRef)]
+		if errors.IsNotFound(err) || !ok || len(password) == 0 {
+			u.setSynced(false, REASON_PASSWORD_NOT_FOUND, fmt.Sprintf("Key %s of secret %s not found", getSecretKey(secretRef), secretRef.Name))
+			return ctrl.Result{RequeueAfter: MONGO_REQUEUE_DELAY}, nil
+		}
+	}
+
+	adminClient, err := u.newAdminClient(mongoCluster)
+	if err != nil {
+		u.setSynced(false, REASON_SYNC_ERROR, err.Error())
+		return ctrl.Result{}, err
+	}
+	defer adminClient.Disconnect(*u.Context)
+	username, database := u.getUsername(), u.getDatabase()
+	if u.Status.Username != "" && (u.Status.Username != username || u.Status.Database != database) {
+		u.Logger.Info(fmt.Sprintf("Dropping renamed user %s@%s", u.Status.Username, u.Status.Database))
+		if err := adminClient.DropUser(*u.Context, u.Status.Database, u.Status.Username); err != nil {
+			u.Logger.Error(err, "Error dropping renamed user")
+			u.setSynced(false, REASON_SYNC_ERROR, err.Error())
+			return ctrl.Result{}, err
+		}
+		u.Status.Username, u.Status.Database = "", ""
+	}
+	if err := u.applyUser(adminClient, string(password), passwordSecret.ResourceVersion); err != nil {
+		u.setSynced(false, REASON_SYNC_ERROR, err.Error())
+		return ctrl.Result{}, err
+	}
+	u.Status.Username, u.Status.Database = username, database
+	u.Status.PasswordSecretVersion = passwordSecret.ResourceVersion
+
+	if err := u.createOrUpdateConnectionSecret(mongoCluster, string(password)); err != nil {
+		u.setSynced(false, REASON_SYNC_ERROR, err.Error())
+		return ctrl.Result{}, err
+	}
+	u.Status.ObservedGeneration = u.User.Generation
+	u.setSynced(true, REASON_USER_SYNCED, fmt.Sprintf("User %s@%s is up to date", username, database))
+	return ctrl.Result{}, nil
+}
+
+// applyUser creates the user, or updates it when its roles differ or its password secret changed since
+// it was last applied.
+func (u *MongoUserService) applyUser(adminClient mongoadmin.Client, password string, passwordVersion string) error {
+	username, database := u.getUsername(), u.getDatabase()
+	roles := getRoleReferences(u.User.Spec.Roles)
+	user, err := adminClient.GetUser(*u.Context, database, username)
+	if err != nil {
+		u.Logger.Error(err, "Error getting user")
+		return err
+	}
+	if user == nil {
+		u.Logger.Info(fmt.Sprintf("Creating user %s@%s", username, database))
+		if err := adminClient.CreateUser(*u.Context, database, username, password, roles); err != nil {
+			u.Logger.Error(err, "Error creating user")
+			return err
+		}
+		return nil
+	}
+	if mongoadmin.SameRoles(user.Roles, roles) && u.Status.PasswordSecretVersion == passwordVersion {
+		u.Logger.Info(fmt.Sprintf("User %s@%s is up to date. Nothing to do.", username, database))
+		return nil
+	}
+	u.Logger.Info(fmt.Sprintf("Updating user %s@%s", username, database))
+	if err := adminClient.UpdateUser(*u.Context, database, username, password, roles); err != nil {
+		u.Logger.Error(err, "Error updating user")
+		return err
+	}
+	return nil
+}
+
+// createOrUpdateConnectionSecret publishes the hosts and the credentials of the user, owned by the
+// MongoUser so that the secret goes away with it.
+func (u *MongoUserService) createOrUpdateConnectionSecret(mongoCluster *appsv1beta1.MongoCluster, password string) error {
+	hosts, replicaSet := getClientHosts(mongoCluster)
+	username, database := u.getUsername(), u.getDatabase()
+	expectedSecret := &v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      u.getConnectionSecretName(),
+			Namespace: u.Namespace,
+		},
+		Data: map[string][]byte{
+			"username":   []byte(username),
+			"password":   []byte(password),
+			"database":   []byte(database),
+			"hosts":      []byte(strings.Join(hosts, ",")),
+			"replicaSet": []byte(replicaSet),
+			"uri":        []byte(getConnectionURI(hosts, replicaSet, username, password, "", database, useClientTLS(mongoCluster))),
+		},
+	}
+	if u.usesX509() {
+		delete(expectedSecret.Data, "password")
+		expectedSecret.Data["uri"] = []byte(getX509ConnectionURI(hosts, replicaSet))
+		expectedSecret.Data["certificateSecret"] = []byte(u.Status.CertificateSecretName)
+	}
+	if err := u.createOrUpdateOwnedSecret(expectedSecret); err != nil {
+		return err
+	}
+	u.Status.ConnectionSecretName = expectedSecret.Name
+	return nil
+}
+
+// createOrUpdateOwnedSecret writes a secret owned by the MongoUser, so that it goes away with it.
+func (u *MongoUserService) createOrUpdateOwnedSecret(expectedSecret *v1api.Secret) error {
+	if err := ctrl.SetControllerReference(u.User, expectedSecret, u.Reconciler.Scheme); err != nil {
+		u.Logger.Error(err, "Error setting secret owner reference")
+		return err
+	}
+	actualSecret := &v1api.Secret{}
+	err := u.Reconciler.Client.Get(*u.Context, types.NamespacedName{Name: expectedSecret.Name, Namespace: u.Namespace}, actualSecret)
+	if err != nil && !errors.IsNotFound(err) {
+		u.Logger.Error(err, "Error getting secret")
+		return err
+	} else if errors.IsNotFound(err) {
+		u.Logger.Info(fmt.Sprintf("Creating secret %s", expectedSecret.Name))
+		if err := u.Reconciler.Client.Create(*u.Context, expectedSecret); err != nil {
+			u.Logger.Error(err, "Error creating secret")
+			return err
+		}
+		return nil
+	}
+	if equality.Semantic.DeepEqual(actualSecret.Data, expectedSecret.Data) {
+		return nil
+	}
+	u.Logger.Info(fmt.Sprintf("Updating secret %s", expectedSecret.Name))
+	actualSecret.Data = expectedSecret.Data
+	actualSecret.OwnerReferences = expectedSecret.OwnerReferences
+	if err := u.Reconciler.Client.Update(*u.Context, actualSecret); err != nil {
+		u.Logger.Error(err, "Error updating secret")
+		return err
+	}
+	return nil
+}
+
+// Delete drops the user from its cluster. There is nothing to drop when the cluster is gone or being
+// deleted.
+func (u *MongoUserService) Delete() error {
+	if u.Status.Username == "" || isOperatorUser(u.Status.Username, u.Status.Database) {
+		return nil
+	}
+	mongoCluster, ready, err := getReadyCluster(*u.Context, u.Reconciler.Client, u.User.Spec.ClusterName, u.Namespace)
+	if err != nil {
+		u.Logger.Error(err, "Error getting MongoCluster")
+		return err
+	}
+	if mongoCluster == nil || !mongoCluster.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	if !ready {
+		return fmt.Errorf("MongoCluster %s is not available, user %s cannot be dropped yet", mongoCluster.Name, u.Status.Username)
+	}
+	adminClient, err := u.newAdminClient(mongoCluster)
+	if err != nil {
+		return err
+	}
+	defer adminClient.Disconnect(*u.Context)
+	u.Logger.Info(fmt.Sprintf("Dropping user %s@%s", u.Status.Username, u.Status.Database))
+	if err := adminClient.DropUser(*u.Context, u.Status.Database, u.Status.Username); err != nil {
+		u.Logger.Error(err, "Error dropping user")
+		return err
+	}
+	return nil
+}
+
+func (u *MongoUserService) newAdminClient(mongoCluster *appsv1beta1.MongoCluster) (mongoadmin.Client, error) {
+	hosts, replicaSet := getClientHosts(mongoCluster)
+	adminClient, err := newClusterAdminClient(*u.Context, u.Reconciler.Client, u.Reconciler.MongoAdmin, mongoCluster, hosts, replicaSet)
+	if err != nil {
+		u.Logger.Error(err, "Error connecting to the cluster")
+		return nil, err
+	}
+	return adminClient, nil
+}
+
+// isOperatorUser tells whether the user is the admin user the operator manages the cluster with.
+func isOperatorUser(username string, database string) bool {
+	return username == MONGODB_DEFAULT_USER && database == mongoadmin.ADMIN_DATABASE
+}
+
+func (u *MongoUserService) getUsername() string {
+	if u.usesX509() {
+		return u.getX509Username()
+	}
+	if u.User.Spec.Username != "" {
+		return u.User.Spec.Username
+	}
+	return u.User.Name
+}
+
+func (u *MongoUserService) getDatabase() string {
+	if u.usesX509() {
+		return mongoadmin.EXTERNAL_DATABASE
+	}
+	if u.User.Spec.Database != "" {
+		return u.User.Spec.Database
+	}
+	return mongoadmin.ADMIN_DATABASE
+}
+
+func (u *MongoUserService) getConnectionSecretName() string {
+	if u.User.Spec.ConnectionSecretName != "" {
+		return u.User.Spec.ConnectionSecretName
+	}
+	return fmt.Sprintf(MONGO_USER_CONNECTION_SECRET_FORMAT, u.User.Spec.ClusterName, u.User.Name)
+}
+
+func (u *MongoUserService) setSynced(synced bool, reason string, message string) {
+	meta.SetStatusCondition(&u.Status.Conditions, newCondition(appsv1beta1.ConditionSynced, synced, reason, message, u.User.Generation))
+}
+
+// UpdateStatus writes the status when it changed.
+func (u *MongoUserService) UpdateStatus() error {
+	if equality.Semantic.DeepEqual(*u.Status, u.User.Status) {
+		return nil
+	}
+	u.User.Status = *u.Status
+	if err := u.Reconciler.Status().Update(*u.Context, u.User); err != nil {
+		u.Logger.Error(err, "Error updating MongoUser status")
+		return err
+	}
+	return nil
+}
+
+// getReadyCluster returns the cluster, nil when it does not exist, and whether it is available.
+func getReadyCluster(ctx context.Context, c client.Client, name string, namespace string) (*appsv1beta1.MongoCluster, bool, error) {
+	mongoCluster := &appsv1beta1.MongoCluster{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, mongoCluster)
+	if errors.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return mongoCluster, meta.IsStatusConditionTrue(mongoCluster.Status.Conditions, appsv1beta1.ConditionAvailable), nil
+}
+
+func getRoleReferences(roles []appsv1beta1.RoleReference) []mongoadmin.RoleReference {
+	var references []mongoadmin.RoleReference
+	for _, role := range roles {
+		references = append(references, mongoadmin.RoleReference{Role: role.Name, DB: role.Database})
+	}
+	return references
+}
+
+func getSecretKey(reference appsv1beta1.SecretKeyReference) string {
+	if reference.Key != "" {
+		return reference.Key
+	}
+	return "password"
+}
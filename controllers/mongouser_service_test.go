@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("MongoUser", func() {
+	var cluster *appsv1beta1.MongoCluster
+	var adminSecret *v1api.Secret
+	var passwordSecret *v1api.Secret
+	var user *appsv1beta1.MongoUser
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster, adminSecret = newAvailableCluster(3)
+		passwordSecret = &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice-password", Namespace: testNamespace},
+			Data:       map[string][]byte{"password": []byte("s3cret")},
+		}
+		user = &appsv1beta1.MongoUser{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: testNamespace, Generation: 1},
+			Spec: appsv1beta1.MongoUserSpec{
+				ClusterName:       cluster.Name,
+				Database:          "app",
+				Roles:             []appsv1beta1.RoleReference{{Name: "readWrite", Database: "app"}},
+				PasswordSecretRef: appsv1beta1.SecretKeyReference{Name: passwordSecret.Name},
+			},
+		}
+		mongo = mongofake.NewClient()
+	})
+
+	syncedCondition := func(service *MongoUserService) *metav1.Condition {
+		return meta.FindStatusCondition(service.Status.Conditions, appsv1beta1.ConditionSynced)
+	}
+
+	It("waits for the cluster to be available", func() {
+		service := newTestUserService(user, mongo)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_CLUSTER_NOT_FOUND))
+
+		cluster.Status.Conditions = nil
+		service = newTestUserService(user, mongo, cluster, adminSecret)
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_CLUSTER_NOT_READY))
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("waits for the password secret", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Status).To(Equal(metav1.ConditionFalse))
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_PASSWORD_NOT_FOUND))
+	})
+
+	It("creates the user and publishes its connection secret", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret, passwordSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		created, err := mongo.GetUser(context.Background(), "app", "alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.Roles).To(Equal([]mongoadmin.RoleReference{{Role: "readWrite", DB: "app"}}))
+		Expect(mongo.Passwords["app"]["alice"]).To(Equal("s3cret"))
+		Expect(syncedCondition(service).Status).To(Equal(metav1.ConditionTrue))
+		Expect(service.Status.Username).To(Equal("alice"))
+		Expect(service.Status.Database).To(Equal("app"))
+
+		secret := &v1api.Secret{}
+		Expect(service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: "mongo-alice-connection", Namespace: testNamespace}, secret)).To(Succeed())
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.OwnerReferences[0].Name).To(Equal("alice"))
+		hosts, _ := getClientHosts(cluster)
+		Expect(secret.Data).To(HaveKeyWithValue("username", []byte("alice")))
+		Expect(secret.Data).To(HaveKeyWithValue("password", []byte("s3cret")))
+		Expect(secret.Data).To(HaveKeyWithValue("database", []byte("app")))
+		Expect(secret.Data).To(HaveKeyWithValue("hosts", []byte(strings.Join(hosts, ","))))
+		Expect(secret.Data).To(HaveKeyWithValue("replicaSet", []byte("mongo")))
+		Expect(string(secret.Data["uri"])).To(HavePrefix("mongodb://alice:s3cret@" + hosts[0]))
+		Expect(string(secret.Data["uri"])).To(ContainSubstring("authSource=app"))
+	})
+
+	It("updates the user only when its roles or its password changed", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret, passwordSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		user.Status = *service.Status
+
+		mongo.Commands = nil
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Commands).NotTo(ContainElement("updateUser"))
+
+		user.Spec.Roles = append(user.Spec.Roles, appsv1beta1.RoleReference{Name: "read", Database: "logs"})
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Commands).To(ContainElement("updateUser"))
+		updated, _ := mongo.GetUser(context.Background(), "app", "alice")
+		Expect(updated.Roles).To(HaveLen(2))
+
+		passwordSecret.Data["password"] = []byte("n3w")
+		Expect(service.Reconciler.Client.Update(context.Background(), passwordSecret)).To(Succeed())
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mongo.Passwords["app"]["alice"]).To(Equal("n3w"))
+		Expect(service.Status.PasswordSecretVersion).To(Equal(passwordSecret.ResourceVersion))
+	})
+
+	It("drops a renamed user under its previous name", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret, passwordSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+
+		user.Spec.Username = "bob"
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		previous, _ := mongo.GetUser(context.Background(), "app", "alice")
+		Expect(previous).To(BeNil())
+		renamed, _ := mongo.GetUser(context.Background(), "app", "bob")
+		Expect(renamed).NotTo(BeNil())
+		Expect(service.Status.Username).To(Equal("bob"))
+	})
+
+	It("leaves the admin user of the operator alone", func() {
+		user.Name = MONGODB_DEFAULT_USER
+		user.Spec.Database = ""
+		service := newTestUserService(user, mongo, cluster, adminSecret, passwordSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Status).To(Equal(metav1.ConditionFalse))
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_RESERVED_USER))
+		Expect(mongo.Commands).To(BeEmpty())
+		Expect(service.Status.Username).To(BeEmpty())
+
+		user.Status.Username, user.Status.Database = MONGODB_DEFAULT_USER, mongoadmin.ADMIN_DATABASE
+		service = newTestUserService(user, mongo, cluster, adminSecret, passwordSecret)
+		Expect(service.Delete()).To(Succeed())
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("drops the user when it is deleted", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret, passwordSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Delete()).To(Succeed())
+		dropped, _ := mongo.GetUser(context.Background(), "app", "alice")
+		Expect(dropped).To(BeNil())
+	})
+
+	It("has nothing to drop once the cluster is gone", func() {
+		user.Status.Username, user.Status.Database = "alice", "app"
+		service := newTestUserService(user, mongo)
+		Expect(service.Delete()).To(Succeed())
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+})
+
+// newTestUserService builds the service of the user against a fake API server holding the user and the
+// given objects. Every admin client it opens is the fake mongo client.
+func newTestUserService(user *appsv1beta1.MongoUser, mongo *mongofake.Client, objects ...client.Object) *MongoUserService {
+	return newReconcilerService(user, objects, func(c client.Client, scheme *runtime.Scheme) testReconciler[*appsv1beta1.MongoUser, MongoUserService] {
+		return &MongoUserReconciler{Client: c, Scheme: scheme, MongoAdmin: mongo.Factory()}
+	})
+}
+
+// newAvailableCluster returns a cluster reporting the Available condition, along with the secret of its
+// admin password.
+func newAvailableCluster(replicas int32) (*appsv1beta1.MongoCluster, *v1api.Secret) {
+	cluster := newTestCluster(replicas)
+	cluster.Status.Conditions = []metav1.Condition{{Type: appsv1beta1.ConditionAvailable, Status: metav1.ConditionTrue}}
+	secret := &v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: getPasswordSecretName(cluster), Namespace: testNamespace},
+		Data:       map[string][]byte{"password": []byte("admin-password")},
+	}
+	return cluster, secret
+}
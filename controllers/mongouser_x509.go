@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"fmt"
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"net/url"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strings"
+)
+
+const (
+	MONGO_USER_CERTIFICATE_FORMAT = "%s-%s"
+
+	REASON_MECHANISM_NOT_ALLOWED  = "MechanismNotAllowed"
+	REASON_CERTIFICATE_NOT_ISSUED = "CertificateNotIssued"
+)
+
+func (u *MongoUserService) usesX509() bool {
+	return u.User.Spec.Mechanism == appsv1beta1.AuthMechanismX509
+}
+
+// getCertificateRequest describes the client certificate of a MONGODB-X509 user. Its subject names
+// the user in $external, it differs from the subjects of the members by its organizational unit.
+func (u *MongoUserService) getCertificateRequest() certificateRequest {
+	commonName := u.User.Spec.Username
+	if commonName == "" {
+		commonName = u.User.Name
+	}
+	return certificateRequest{
+		Name:               fmt.Sprintf(MONGO_USER_CERTIFICATE_FORMAT, u.User.Spec.ClusterName, u.User.Name),
+		CommonName:         commonName,
+		OrganizationalUnit: MONGO_CLIENT_ORGANIZATIONAL_UNIT,
+		ClientOnly:         true,
+	}
+}
+
+// getX509Username returns the subject of the client certificate, in the RFC 2253 form the members
+// name the user by.
+func (u *MongoUserService) getX509Username() string {
+	return getCertificateSubject(u.User.Spec.ClusterName, u.getCertificateRequest()).String()
+}
+
+// createOrUpdateClientCertificate requests the client certificate of the user from the issuer of the
+// cluster, or issues it from the CA of the cluster, into a secret owned by the MongoUser. It tells
+// whether the certificate has been issued.
+func (u *MongoUserService) createOrUpdateClientCertificate(mongoCluster *appsv1beta1.MongoCluster) (bool, error) {
+	request := u.getCertificateRequest()
+	secretName := getCertificateName(request.Name)
+	u.Status.CertificateSecretName = secretName
+	if mongoCluster.Spec.TLS.IssuerRef != nil {
+		certificate := newCertificate(mongoCluster, map[string]string{MONGO_CLUSTER_LABEL: mongoCluster.Name}, request)
+		if err := ctrl.SetControllerReference(u.User, certificate, u.Reconciler.Scheme); err != nil {
+			u.Logger.Error(err, "Error setting certificate owner reference")
+			return false, err
+		}
+		if err := applyCertificate(*u.Context, u.Reconciler.Client, u.Logger, certificate); err != nil {
+			return false, err
+		}
+		secret := &v1api.Secret{}
+		err := u.Reconciler.Client.Get(*u.Context, types.NamespacedName{Name: secretName, Namespace: u.Namespace}, secret)
+		if err != nil && !errors.IsNotFound(err) {
+			u.Logger.Error(err, "Error getting certificate secret")
+			return false, err
+		}
+		return len(secret.Data[MONGO_TLS_CERTIFICATE_KEY]) > 0, nil
+	}
+	ca, err := getClusterCA(*u.Context, u.Reconciler.Client, mongoCluster)
+	if err != nil {
+		u.Logger.Error(err, "Error getting the CA of the cluster")
+		return false, err
+	} else if ca == nil {
+		return false, nil
+	}
+	secret := &v1api.Secret{}
+	err = u.Reconciler.Client.Get(*u.Context, types.NamespacedName{Name: secretName, Namespace: u.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		u.Logger.Error(err, "Error getting certificate secret")
+		return false, err
+	}
+	if err == nil && issuedCertificateUpToDate(ca, mongoCluster.Name, request, secret) {
+		return true, nil
+	}
+	u.Logger.Info(fmt.Sprintf("Issuing certificate %s", secretName))
+	certificatePEM, keyPEM, err := issueCertificate(ca, mongoCluster.Name, request)
+	if err != nil {
+		u.Logger.Error(err, "Error issuing certificate")
+		return false, err
+	}
+	err = u.createOrUpdateOwnedSecret(&v1api.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: u.Namespace,
+		},
+		Type: v1api.SecretTypeTLS,
+		Data: map[string][]byte{
+			MONGO_TLS_CERTIFICATE_KEY: certificatePEM,
+			MONGO_TLS_PRIVATE_KEY_KEY: keyPEM,
+			MONGO_TLS_CA_KEY:          ca.CertificatePEM,
+		},
+	})
+	return err == nil, err
+}
+
+// deleteClientCertificate deletes the client certificate of a user no longer authenticated with it.
+func (u *MongoUserService) deleteClientCertificate() error {
+	secretName := u.Status.CertificateSecretName
+	if secretName == "" {
+		return nil
+	}
+	certificate := &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(secretName)
+	certificate.SetNamespace(u.Namespace)
+	if err := u.Reconciler.Client.Delete(*u.Context, certificate); err != nil && !errors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+		u.Logger.Error(err, "Error deleting certificate")
+		return err
+	}
+	secret := &v1api.Secret{ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: u.Namespace}}
+	if err := u.Reconciler.Client.Delete(*u.Context, secret); err != nil && !errors.IsNotFound(err) {
+		u.Logger.Error(err, "Error deleting certificate secret")
+		return err
+	}
+	u.Status.CertificateSecretName = ""
+	return nil
+}
+
+// getX509ConnectionURI builds a mongodb:// URI for a MONGODB-X509 user, the driver takes the user
+// from the client certificate.
+func getX509ConnectionURI(hosts []string, replicaSet string) string {
+	query := url.Values{}
+	query.Set("authMechanism", string(appsv1beta1.AuthMechanismX509))
+	query.Set("authSource", mongoadmin.EXTERNAL_DATABASE)
+	if replicaSet != "" {
+		query.Set("replicaSet", replicaSet)
+	}
+	query.Set("tls", "true")
+	uri := url.URL{
+		Scheme:   "mongodb",
+		Host:     strings.Join(hosts, ","),
+		Path:     "/",
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	mongofake "github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+	v1api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("MongoUser with MONGODB-X509", func() {
+	const subject = "CN=alice,OU=clients,O=mongo"
+	var cluster *appsv1beta1.MongoCluster
+	var adminSecret *v1api.Secret
+	var caSecret *v1api.Secret
+	var user *appsv1beta1.MongoUser
+	var mongo *mongofake.Client
+
+	BeforeEach(func() {
+		cluster, adminSecret = newAvailableCluster(3)
+		cluster.Spec.TLS = &appsv1beta1.TLS{Mode: appsv1beta1.TLSModeRequire}
+		cluster.Spec.Auth.Mechanisms = []appsv1beta1.AuthMechanism{appsv1beta1.AuthMechanismSCRAM, appsv1beta1.AuthMechanismX509}
+		clusterService := newTestService(cluster, mongofake.NewClient())
+		_, err := clusterService.getOrCreateCA()
+		Expect(err).NotTo(HaveOccurred())
+		caSecret = &v1api.Secret{}
+		Expect(clusterService.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: getCASecretName(cluster.Name), Namespace: testNamespace}, caSecret)).To(Succeed())
+		caSecret.ResourceVersion = ""
+
+		user = &appsv1beta1.MongoUser{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: testNamespace, Generation: 1},
+			Spec: appsv1beta1.MongoUserSpec{
+				ClusterName: cluster.Name,
+				Mechanism:   appsv1beta1.AuthMechanismX509,
+				Roles:       []appsv1beta1.RoleReference{{Name: "read", Database: "app"}},
+			},
+		}
+		mongo = mongofake.NewClient()
+	})
+
+	syncedCondition := func(service *MongoUserService) *metav1.Condition {
+		return meta.FindStatusCondition(service.Status.Conditions, appsv1beta1.ConditionSynced)
+	}
+
+	getSecret := func(service *MongoUserService, name string) (*v1api.Secret, error) {
+		secret := &v1api.Secret{}
+		err := service.Reconciler.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, secret)
+		return secret, err
+	}
+
+	It("is rejected by a cluster that does not accept the mechanism", func() {
+		cluster.Spec.Auth.Mechanisms = nil
+		service := newTestUserService(user, mongo, cluster, adminSecret, caSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_MECHANISM_NOT_ALLOWED))
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("waits for the CA of the cluster", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Reason).To(Equal(REASON_CERTIFICATE_NOT_ISSUED))
+		Expect(service.Status.CertificateSecretName).To(Equal("mongo-alice-tls"))
+		Expect(mongo.Commands).To(BeEmpty())
+	})
+
+	It("issues the client certificate and creates the user in $external", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret, caSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncedCondition(service).Status).To(Equal(metav1.ConditionTrue))
+		Expect(service.Status.Username).To(Equal(subject))
+		Expect(service.Status.Database).To(Equal(mongoadmin.EXTERNAL_DATABASE))
+		created, err := mongo.GetUser(context.Background(), mongoadmin.EXTERNAL_DATABASE, subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).NotTo(BeNil())
+		Expect(mongo.Passwords[mongoadmin.EXTERNAL_DATABASE][subject]).To(BeEmpty())
+
+		certificateSecret, err := getSecret(service, "mongo-alice-tls")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certificateSecret.Type).To(Equal(v1api.SecretTypeTLS))
+		Expect(certificateSecret.OwnerReferences[0].Name).To(Equal("alice"))
+		Expect(certificateSecret.Data[MONGO_TLS_CA_KEY]).To(Equal(caSecret.Data[MONGO_TLS_CA_KEY]))
+		certificate, err := parseCertificate(certificateSecret.Data[MONGO_TLS_CERTIFICATE_KEY])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certificate.Subject.String()).To(Equal(subject))
+		Expect(certificate.ExtKeyUsage).To(Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}))
+
+		connectionSecret, err := getSecret(service, "mongo-alice-connection")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(connectionSecret.Data).NotTo(HaveKey("password"))
+		Expect(connectionSecret.Data).To(HaveKeyWithValue("username", []byte(subject)))
+		Expect(connectionSecret.Data).To(HaveKeyWithValue("certificateSecret", []byte("mongo-alice-tls")))
+		Expect(string(connectionSecret.Data["uri"])).To(ContainSubstring("authMechanism=MONGODB-X509"))
+		Expect(string(connectionSecret.Data["uri"])).To(ContainSubstring("authSource=%24external"))
+		Expect(string(connectionSecret.Data["uri"])).To(ContainSubstring("tls=true"))
+	})
+
+	It("keeps the client certificate while it is valid", func() {
+		service := newTestUserService(user, mongo, cluster, adminSecret, caSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		first, _ := getSecret(service, "mongo-alice-tls")
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		second, _ := getSecret(service, "mongo-alice-tls")
+		Expect(second.Data[MONGO_TLS_CERTIFICATE_KEY]).To(Equal(first.Data[MONGO_TLS_CERTIFICATE_KEY]))
+	})
+
+	It("deletes the client certificate of a user moved to a password", func() {
+		passwordSecret := &v1api.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice-password", Namespace: testNamespace},
+			Data:       map[string][]byte{"password": []byte("s3cret")},
+		}
+		service := newTestUserService(user, mongo, cluster, adminSecret, caSecret, passwordSecret)
+		_, err := service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+
+		user.Spec.Mechanism = ""
+		user.Spec.PasswordSecretRef = appsv1beta1.SecretKeyReference{Name: passwordSecret.Name}
+		_, err = service.Sync()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Status.CertificateSecretName).To(BeEmpty())
+		_, err = getSecret(service, "mongo-alice-tls")
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		previous, _ := mongo.GetUser(context.Background(), mongoadmin.EXTERNAL_DATABASE, subject)
+		Expect(previous).To(BeNil())
+		Expect(mongo.Passwords[mongoadmin.ADMIN_DATABASE]["alice"]).To(Equal("s3cret"))
+	})
+})
@@ -33,6 +33,8 @@ import (
 
 	appsv1beta1 "github.com/PaulBarrie/mongo-cluster/api/v1beta1"
 	"github.com/PaulBarrie/mongo-cluster/controllers"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -44,6 +46,7 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(snapshotv1.AddToScheme(scheme))
 	utilruntime.Must(appsv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
@@ -57,6 +60,8 @@ func main() {
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&controllers.MONGO_CLUSTER_DOMAIN, "cluster-domain", controllers.MONGO_CLUSTER_DOMAIN,
+		"The DNS domain of the Kubernetes cluster, used in the hostnames the members advertise.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -90,8 +95,9 @@ func main() {
 	}
 
 	if err = (&controllers.MongoClusterReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		MongoAdmin: mongoadmin.NewClient,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MongoCluster")
 		os.Exit(1)
@@ -100,6 +106,37 @@ func main() {
 		setupLog.Error(err, "unable to create webhook", "webhook", "MongoCluster")
 		os.Exit(1)
 	}
+	if err = (&controllers.MongoBackupReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		MongoAdmin: mongoadmin.NewClient,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MongoBackup")
+		os.Exit(1)
+	}
+	if err = (&controllers.MongoRestoreReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MongoRestore")
+		os.Exit(1)
+	}
+	if err = (&controllers.MongoUserReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		MongoAdmin: mongoadmin.NewClient,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MongoUser")
+		os.Exit(1)
+	}
+	if err = (&controllers.MongoRoleReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		MongoAdmin: mongoadmin.NewClient,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MongoRole")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -5,27 +5,54 @@ DB=$MONGODB_DBNAME
 ROLE=$MONGODB_ROLE
 PRIMARY_HOST=$HOST
 
-# Start MongoDB service
-/usr/bin/mongod --dbpath /data --nojournal &
-while ! nc -vz localhost 27017; do sleep 1; done
+DATA_DIR=${MONGODB_DATA_DIR:-/data}
 
-# Create User only on the Primary Pod.
-echo "Creating user: \"$USER\"..."
+# js_string quotes a value as a JavaScript string literal, the credentials are pasted into the --eval
+# scripts below and may hold quotes or backslashes.
+js_string() {
+  local value=${1//\\/\\\\}
+  value=${value//\'/\\\'}
+  value=${value//$'\n'/\\n}
+  value=${value//$'\r'/\\r}
+  printf "'%s'" "$value"
+}
+USER_JS=$(js_string "$USER")
+PASS_JS=$(js_string "$PASS")
+ROLE_JS=$(js_string "$ROLE")
 
-a="$HOSTNAME"
-b=${a%-*-*}
+# Start MongoDB service on the same dbpath as run.sh so that the user survives the restart
+mkdir -p $DATA_DIR/db
+mongod --dbpath $DATA_DIR/db --nojournal &
+while ! nc -vz localhost 27017; do sleep 1; done
 
-if [ ! -f /data/admin-user.lock ]; then
-  sleep 60;
-  touch /data/admin-user.lock
-  if [ "$b" = "$PRIMARY_HOST" ]; then
-    mongo $DB --eval "db.createUser({ user: '$USER', pwd: '$PASS', roles: [ { role: '$ROLE', db: '$DB' } ] });"
-  fi;
+# Members of a cluster bootstrapped from a snapshot or a seed start on a volume carrying the replica
+# set configuration and the admin password of the source. The operator sets MONGODB_RESET_REPLICA_SET
+# to the uid of the cluster on them: the configuration is dropped so that the operator initiates this
+# replica set, and the admin user takes the password of this cluster. The uid is recorded on the
+# volume, each volume is reset once and not on every restart.
+RESET_MARKER=$DATA_DIR/replica-set-reset
+if [ -n "$MONGODB_RESET_REPLICA_SET" ] && [ "$(cat $RESET_MARKER 2>/dev/null)" != "$MONGODB_RESET_REPLICA_SET" ]; then
+  echo "Resetting the replica set configuration of the bootstrap source..."
+  mongo local --quiet --eval "db.dropDatabase();"
+  mongo admin --quiet --eval "if (db.getUser($USER_JS) !== null) { db.changeUserPassword($USER_JS, $PASS_JS); }"
+  echo "$MONGODB_RESET_REPLICA_SET" > $RESET_MARKER
+fi;
 
-  /usr/bin/mongod --dbpath /data --shutdown
+# Create the admin user on the first member, the operator initiates the replica set from it and
+# authenticates against the admin database. Once the replica set is initiated the user is replicated
+# from the primary. The data is checked rather than a lock file: volumes migrated from the legacy
+# layout carry a lock from a user created under another dbpath, but no admin user.
+rm -f $DATA_DIR/admin-user.lock
+if [ "$HOSTNAME" = "$PRIMARY_HOST" ]; then
+  INITIATED=$(mongo local --quiet --eval "print(db.system.replset.findOne() !== null)")
+  USER_FOUND=$(mongo admin --quiet --eval "print(db.getUser($USER_JS) !== null)")
+  if [ "$INITIATED" != "true" ] && [ "$USER_FOUND" != "true" ]; then
+    echo "Creating user: \"$USER\"..."
+    mongo admin --eval "db.createUser({ user: $USER_JS, pwd: $PASS_JS, roles: [ { role: $ROLE_JS, db: 'admin' } ] });"
+  fi;
 fi;
 
-/usr/bin/mongod --dbpath /data --shutdown
+mongod --dbpath $DATA_DIR/db --shutdown
 echo "========================================================================"
 echo "MongoDB User: \"$USER\""
 echo "MongoDB Database: \"$DB\""
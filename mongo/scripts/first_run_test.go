@@ -0,0 +1,146 @@
+package scripts_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// The stubs stand for the binaries of the image: mongo answers the queries of first_run.sh from the
+// STUB_* variables and every command is appended to STUB_LOG.
+var stubs = map[string]string{
+	"mongod": `echo "mongod $*" >> "$STUB_LOG"`,
+	"nc":     `exit 0`,
+	"mongo": `echo "mongo $*" >> "$STUB_LOG"
+case "$*" in
+  *"system.replset.findOne() !== null"*) echo "${STUB_INITIATED:-false}" ;;
+  *"getUser"*) echo "${STUB_USER_FOUND:-false}" ;;
+esac`,
+}
+
+type firstRun struct {
+	dataDir string
+	env     []string
+}
+
+func newFirstRun() *firstRun {
+	dir := GinkgoT().TempDir()
+	binDir := filepath.Join(dir, "bin")
+	Expect(os.Mkdir(binDir, 0755)).To(Succeed())
+	for name, body := range stubs {
+		Expect(os.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/bash\n"+body+"\n"), 0755)).To(Succeed())
+	}
+	dataDir := filepath.Join(dir, "data")
+	Expect(os.Mkdir(dataDir, 0755)).To(Succeed())
+	return &firstRun{
+		dataDir: dataDir,
+		env: []string{
+			"PATH=" + binDir + ":" + os.Getenv("PATH"),
+			"STUB_LOG=" + filepath.Join(dir, "commands.log"),
+			"MONGODB_DATA_DIR=" + dataDir,
+			"MONGODB_USERNAME=admin",
+			"MONGODB_PASSWORD=secret",
+			"MONGODB_ROLE=root",
+			"MONGODB_REPLICA_SET=sample",
+			"HOST=sample-mongo-0",
+		},
+	}
+}
+
+// run executes first_run.sh as the given pod and returns the mongo commands it sent.
+func (f *firstRun) run(hostname string, env ...string) []string {
+	command := exec.Command("bash", "first_run.sh")
+	command.Env = append(append(f.env, "HOSTNAME="+hostname), env...)
+	output, err := command.CombinedOutput()
+	Expect(err).NotTo(HaveOccurred(), string(output))
+	log, err := os.ReadFile(filepath.Join(filepath.Dir(f.dataDir), "commands.log"))
+	Expect(err).NotTo(HaveOccurred())
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+		if strings.HasPrefix(line, "mongo ") {
+			commands = append(commands, line)
+		}
+	}
+	return commands
+}
+
+func containing(commands []string, text string) []string {
+	var matching []string
+	for _, command := range commands {
+		if strings.Contains(command, text) {
+			matching = append(matching, command)
+		}
+	}
+	return matching
+}
+
+var _ = Describe("first_run.sh", func() {
+	It("creates the admin user in the admin database of the first member", func() {
+		commands := newFirstRun().run("sample-mongo-0")
+		created := containing(commands, "createUser")
+		Expect(created).To(HaveLen(1))
+		Expect(created[0]).To(HavePrefix("mongo admin "))
+		Expect(created[0]).To(ContainSubstring("db: 'admin'"))
+	})
+
+	It("quotes the credentials pasted into the scripts", func() {
+		commands := newFirstRun().run("sample-mongo-0", `MONGODB_USERNAME=o'neil`, `MONGODB_PASSWORD=it's\ "secret"`)
+		created := containing(commands, "createUser")
+		Expect(created).To(HaveLen(1))
+		Expect(created[0]).To(ContainSubstring(`user: 'o\'neil', pwd: 'it\'s\\ "secret"'`))
+		Expect(containing(commands, `getUser('o\'neil')`)).To(HaveLen(1))
+	})
+
+	It("creates no user on the other members", func() {
+		commands := newFirstRun().run("sample-mongo-1")
+		Expect(containing(commands, "createUser")).To(BeEmpty())
+	})
+
+	It("creates the admin user on a volume migrated from the legacy layout", func() {
+		firstRun := newFirstRun()
+		// Legacy members created their user under --dbpath /data and left a lock next to /data/db.
+		Expect(os.WriteFile(filepath.Join(firstRun.dataDir, "admin-user.lock"), nil, 0644)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(firstRun.dataDir, "db"), 0755)).To(Succeed())
+		commands := firstRun.run("sample-mongo-0")
+		Expect(containing(commands, "createUser")).To(HaveLen(1))
+		Expect(filepath.Join(firstRun.dataDir, "admin-user.lock")).NotTo(BeAnExistingFile())
+	})
+
+	It("keeps the admin user of a member restarted on its data", func() {
+		commands := newFirstRun().run("sample-mongo-0", "STUB_USER_FOUND=true")
+		Expect(containing(commands, "createUser")).To(BeEmpty())
+		Expect(containing(commands, "changeUserPassword")).To(BeEmpty())
+	})
+
+	It("leaves the user to replication once the replica set is initiated", func() {
+		commands := newFirstRun().run("sample-mongo-0", "STUB_INITIATED=true")
+		Expect(containing(commands, "createUser")).To(BeEmpty())
+	})
+
+	It("never resets the replica set of a member without the reset flag", func() {
+		commands := newFirstRun().run("sample-mongo-1", "STUB_INITIATED=true")
+		Expect(containing(commands, "dropDatabase")).To(BeEmpty())
+		Expect(containing(commands, "changeUserPassword")).To(BeEmpty())
+	})
+
+	It("resets a volume of a bootstrapped cluster once", func() {
+		firstRun := newFirstRun()
+		commands := firstRun.run("sample-mongo-1", "MONGODB_RESET_REPLICA_SET=uid-1", "STUB_INITIATED=true")
+		Expect(containing(commands, "mongo local --quiet --eval db.dropDatabase();")).To(HaveLen(1))
+		Expect(containing(commands, "changeUserPassword('admin', 'secret')")).To(HaveLen(1))
+		commands = firstRun.run("sample-mongo-1", "MONGODB_RESET_REPLICA_SET=uid-1", "STUB_INITIATED=true")
+		Expect(containing(commands, "dropDatabase")).To(HaveLen(1))
+	})
+
+	It("resets a volume restored from the snapshot of another bootstrapped cluster", func() {
+		firstRun := newFirstRun()
+		Expect(os.WriteFile(filepath.Join(firstRun.dataDir, "replica-set-reset"), []byte("uid-1\n"), 0644)).To(Succeed())
+		commands := firstRun.run("sample-mongo-0", "MONGODB_RESET_REPLICA_SET=uid-2", "STUB_USER_FOUND=true")
+		Expect(containing(commands, "dropDatabase")).To(HaveLen(1))
+		Expect(containing(commands, "createUser")).To(BeEmpty())
+	})
+})
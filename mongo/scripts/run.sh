@@ -11,6 +11,25 @@ cron
 
 echo "Starting MongoDB..."
 
-/usr/bin/mongod --replSet $MONGODB_REPLICA_ID --dbpath /data/db --bind_ip 0.0.0.0 --clusterAuthMode keyFile --keyFile /etc/secrets-volume/password --setParameter authenticationMechanisms=SCRAM-SHA-256 --auth --logpath /data/mongodb.log;
+# Members of a sharded cluster run as config servers or shards, on the default port like the others
+CLUSTER_ROLE_OPTIONS=""
+if [ -n "$MONGODB_CLUSTER_ROLE" ]; then
+    CLUSTER_ROLE_OPTIONS="--$MONGODB_CLUSTER_ROLE --port 27017"
+fi
+
+# With TLS, each member finds its own certificate, or the shared one, at the root of the TLS volume
+TLS_OPTIONS=""
+if [ -n "$MONGODB_TLS_MODE" ]; then
+    cat /etc/mongo-tls/tls.crt /etc/mongo-tls/tls.key > /tmp/mongod.pem
+    TLS_OPTIONS="--tlsMode $MONGODB_TLS_MODE --tlsCertificateKeyFile /tmp/mongod.pem --tlsCAFile /etc/mongo-tls/ca.crt --tlsAllowConnectionsWithoutCertificates"
+fi
+
+# Members authenticate each other with the keyfile, or with their certificate in x509 mode
+CLUSTER_AUTH_OPTIONS="--clusterAuthMode keyFile --keyFile /etc/secrets-volume/keyfile"
+if [ "$MONGODB_CLUSTER_AUTH_MODE" = "x509" ]; then
+    CLUSTER_AUTH_OPTIONS="--clusterAuthMode x509"
+fi
+
+/usr/bin/mongod --replSet $MONGODB_REPLICA_SET $CLUSTER_ROLE_OPTIONS $TLS_OPTIONS --dbpath /data/db --bind_ip 0.0.0.0 $CLUSTER_AUTH_OPTIONS --setParameter authenticationMechanisms=${MONGODB_AUTH_MECHANISMS:-SCRAM-SHA-256} --auth --logpath /data/mongodb.log;
 
 exec "$@"
\ No newline at end of file
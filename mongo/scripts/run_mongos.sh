@@ -0,0 +1,21 @@
+#!/bin/bash
+set -e
+
+echo "Starting mongos..."
+
+# With TLS, the routers share a single certificate
+TLS_OPTIONS=""
+if [ -n "$MONGODB_TLS_MODE" ]; then
+    cat /etc/mongo-tls/tls.crt /etc/mongo-tls/tls.key > /tmp/mongos.pem
+    TLS_OPTIONS="--tlsMode $MONGODB_TLS_MODE --tlsCertificateKeyFile /tmp/mongos.pem --tlsCAFile /etc/mongo-tls/ca.crt --tlsAllowConnectionsWithoutCertificates"
+fi
+
+# Routers authenticate to the members with the keyfile, or with their certificate in x509 mode
+CLUSTER_AUTH_OPTIONS="--keyFile /etc/secrets-volume/keyfile"
+if [ "$MONGODB_CLUSTER_AUTH_MODE" = "x509" ]; then
+    CLUSTER_AUTH_OPTIONS="--clusterAuthMode x509"
+fi
+
+/usr/bin/mongos --configdb $MONGODB_CONFIG_DB $TLS_OPTIONS --bind_ip 0.0.0.0 --port 27017 $CLUSTER_AUTH_OPTIONS --setParameter authenticationMechanisms=${MONGODB_AUTH_MECHANISMS:-SCRAM-SHA-256};
+
+exec "$@"
@@ -0,0 +1,14 @@
+package scripts_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestScripts(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Scripts Suite")
+}
@@ -0,0 +1,206 @@
+// Package mongoadmin holds the administration commands the operator runs against the members of a
+// MongoCluster. Controllers only depend on the Client interface so that tests can swap the driver
+// backed implementation for a fake.
+package mongoadmin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const (
+	ADMIN_DATABASE          = "admin"
+	DEFAULT_CONNECT_TIMEOUT = 10 * time.Second
+
+	// EXTERNAL_DATABASE holds the users authenticated outside of the cluster, by their x509 subject
+	EXTERNAL_DATABASE = "$external"
+
+	errorCodeNotYetInitialized = 94
+)
+
+// ErrNotYetInitialized is returned by GetReplicaSetStatus when replSetInitiate has not been run yet.
+var ErrNotYetInitialized = errors.New("replica set not yet initialized")
+
+// Options describes how to reach the members of a cluster.
+type Options struct {
+	// Hosts to connect to, as host:port.
+	Hosts []string
+	// ReplicaSet is the name of the replica set. Leave it empty to talk to Hosts[0] directly, which is
+	// required before the replica set is initiated.
+	ReplicaSet string
+	Username   string
+	Password   string
+	AuthSource string
+	Timeout    time.Duration
+	// TLSConfig turns TLS on when it is set.
+	TLSConfig *tls.Config
+}
+
+// Client runs the administration commands needed to manage a replica set.
+type Client interface {
+	GetReplicaSetStatus(ctx context.Context) (*ReplicaSetStatus, error)
+	GetReplicaSetConfig(ctx context.Context) (*ReplicaSetConfig, error)
+	InitiateReplicaSet(ctx context.Context, config ReplicaSetConfig) error
+	ReconfigureReplicaSet(ctx context.Context, config ReplicaSetConfig) error
+	// IsReplicaSetConfigCommitted tells whether the current configuration has been replicated to a
+	// majority of the voting members, a new reconfig is only safe once it has.
+	IsReplicaSetConfigCommitted(ctx context.Context) (bool, error)
+	// StepDown asks the primary to become a secondary and not to run for election for the given time.
+	StepDown(ctx context.Context, stepDownSeconds int) error
+	// FsyncLock flushes the writes of the member to disk and blocks new ones until FsyncUnlock, so
+	// that its volume can be snapshotted. Both must be run over a direct connection to the member.
+	FsyncLock(ctx context.Context) error
+	FsyncUnlock(ctx context.Context) error
+	// ListShards and AddShard must be run against a mongos router.
+	ListShards(ctx context.Context) ([]Shard, error)
+	AddShard(ctx context.Context, connectionString string) error
+	// GetUser returns nil when the user does not exist in the database.
+	GetUser(ctx context.Context, db string, name string) (*User, error)
+	// CreateUser creates a user without password when password is empty, which only $external allows.
+	CreateUser(ctx context.Context, db string, name string, password string, roles []RoleReference) error
+	// UpdateUser keeps the password of the user when password is empty.
+	UpdateUser(ctx context.Context, db string, name string, password string, roles []RoleReference) error
+	// ChangeUserPassword runs updateUser with the password only, the roles of the user are kept.
+	ChangeUserPassword(ctx context.Context, db string, name string, password string) error
+	// DropUser succeeds when the user does not exist.
+	DropUser(ctx context.Context, db string, name string) error
+	// GetRole returns nil when the role does not exist in the database.
+	GetRole(ctx context.Context, db string, name string) (*Role, error)
+	CreateRole(ctx context.Context, role Role) error
+	UpdateRole(ctx context.Context, role Role) error
+	// DropRole succeeds when the role does not exist.
+	DropRole(ctx context.Context, db string, name string) error
+	Disconnect(ctx context.Context) error
+}
+
+// Factory opens a Client, NewClient is the implementation used outside of tests.
+type Factory func(ctx context.Context, options Options) (Client, error)
+
+type driverClient struct {
+	client *mongo.Client
+}
+
+var _ Factory = NewClient
+
+// NewClient connects to the cluster with the official MongoDB driver.
+func NewClient(ctx context.Context, opts Options) (Client, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_CONNECT_TIMEOUT
+	}
+	authSource := opts.AuthSource
+	if authSource == "" {
+		authSource = ADMIN_DATABASE
+	}
+	clientOptions := options.Client().
+		SetHosts(opts.Hosts).
+		SetConnectTimeout(timeout).
+		SetServerSelectionTimeout(timeout)
+	if opts.Username != "" {
+		clientOptions.SetAuth(options.Credential{
+			Username:   opts.Username,
+			Password:   opts.Password,
+			AuthSource: authSource,
+		})
+	}
+	if opts.TLSConfig != nil {
+		clientOptions.SetTLSConfig(opts.TLSConfig)
+	}
+	if opts.ReplicaSet == "" {
+		clientOptions.SetDirect(true)
+	} else {
+		clientOptions.SetReplicaSet(opts.ReplicaSet)
+	}
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &driverClient{client: client}, nil
+}
+
+func (c *driverClient) runAdminCommand(ctx context.Context, command bson.D, result interface{}) error {
+	return c.runCommand(ctx, ADMIN_DATABASE, command, result)
+}
+
+func (c *driverClient) runCommand(ctx context.Context, db string, command bson.D, result interface{}) error {
+	res := c.client.Database(db).RunCommand(ctx, command)
+	if res.Err() != nil {
+		return res.Err()
+	}
+	if result == nil {
+		return nil
+	}
+	return res.Decode(result)
+}
+
+func (c *driverClient) GetReplicaSetStatus(ctx context.Context) (*ReplicaSetStatus, error) {
+	status := &ReplicaSetStatus{}
+	err := c.runAdminCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}, status)
+	if hasErrorCode(err, errorCodeNotYetInitialized) {
+		return nil, ErrNotYetInitialized
+	} else if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *driverClient) GetReplicaSetConfig(ctx context.Context) (*ReplicaSetConfig, error) {
+	result := struct {
+		Config ReplicaSetConfig `bson:"config"`
+	}{}
+	err := c.runAdminCommand(ctx, bson.D{{Key: "replSetGetConfig", Value: 1}}, &result)
+	if hasErrorCode(err, errorCodeNotYetInitialized) {
+		return nil, ErrNotYetInitialized
+	} else if err != nil {
+		return nil, err
+	}
+	return &result.Config, nil
+}
+
+func (c *driverClient) InitiateReplicaSet(ctx context.Context, config ReplicaSetConfig) error {
+	return c.runAdminCommand(ctx, bson.D{{Key: "replSetInitiate", Value: config}}, nil)
+}
+
+func (c *driverClient) ReconfigureReplicaSet(ctx context.Context, config ReplicaSetConfig) error {
+	return c.runAdminCommand(ctx, bson.D{{Key: "replSetReconfig", Value: config}}, nil)
+}
+
+func (c *driverClient) IsReplicaSetConfigCommitted(ctx context.Context) (bool, error) {
+	result := struct {
+		CommitmentStatus bool `bson:"commitmentStatus"`
+	}{}
+	err := c.runAdminCommand(ctx, bson.D{
+		{Key: "replSetGetConfig", Value: 1},
+		{Key: "commitmentStatus", Value: true},
+	}, &result)
+	if err != nil {
+		return false, err
+	}
+	return result.CommitmentStatus, nil
+}
+
+func (c *driverClient) StepDown(ctx context.Context, stepDownSeconds int) error {
+	return c.runAdminCommand(ctx, bson.D{{Key: "replSetStepDown", Value: stepDownSeconds}}, nil)
+}
+
+func (c *driverClient) FsyncLock(ctx context.Context) error {
+	return c.runAdminCommand(ctx, bson.D{{Key: "fsync", Value: 1}, {Key: "lock", Value: true}}, nil)
+}
+
+func (c *driverClient) FsyncUnlock(ctx context.Context) error {
+	return c.runAdminCommand(ctx, bson.D{{Key: "fsyncUnlock", Value: 1}}, nil)
+}
+
+func (c *driverClient) Disconnect(ctx context.Context) error {
+	return c.client.Disconnect(ctx)
+}
+
+func hasErrorCode(err error, code int32) bool {
+	var commandError mongo.CommandError
+	return errors.As(err, &commandError) && commandError.Code == code
+}
@@ -0,0 +1,8 @@
+package mongoadmin
+
+// The command builders are exported to the tests of the mongoadmin_test package.
+var (
+	CreateUserCommand         = createUserCommand
+	UpdateUserCommand         = updateUserCommand
+	ChangeUserPasswordCommand = changeUserPasswordCommand
+)
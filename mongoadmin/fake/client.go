@@ -0,0 +1,386 @@
+// Package fake provides an in-memory mongoadmin.Client for tests.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"strings"
+	"sync"
+)
+
+// Client keeps the replica set configuration in memory and records the commands it receives.
+type Client struct {
+	mutex sync.Mutex
+	// Config is the current replica set configuration, nil until the set is initiated.
+	Config *mongoadmin.ReplicaSetConfig
+	// Status overrides the status derived from Config when set.
+	Status *mongoadmin.ReplicaSetStatus
+	// Err is returned by every command when set.
+	Err error
+	// Uncommitted makes IsReplicaSetConfigCommitted report the configuration as not yet committed.
+	Uncommitted bool
+	// Primary is the host of the primary, the first member of Config when empty.
+	Primary string
+	// Shards lists the shards added with AddShard.
+	Shards []mongoadmin.Shard
+	// Users are the users created with CreateUser, keyed by database then name.
+	Users map[string]map[string]mongoadmin.User
+	// Passwords are the passwords of the users, keyed by database then name.
+	Passwords map[string]map[string]string
+	// Roles are the roles created with CreateRole, keyed by database then name.
+	Roles map[string]map[string]mongoadmin.Role
+	// Locks counts the FsyncLock calls not matched by a FsyncUnlock yet.
+	Locks int
+	// Commands lists the name of every command received, in order.
+	Commands []string
+}
+
+var _ mongoadmin.Client = &Client{}
+
+// NewClient returns a fake client for a replica set that is not initiated yet.
+func NewClient() *Client {
+	return &Client{}
+}
+
+// Factory returns a mongoadmin.Factory that always hands out this client.
+func (c *Client) Factory() mongoadmin.Factory {
+	return func(ctx context.Context, options mongoadmin.Options) (mongoadmin.Client, error) {
+		return c, nil
+	}
+}
+
+func (c *Client) record(command string) error {
+	c.Commands = append(c.Commands, command)
+	return c.Err
+}
+
+func (c *Client) GetReplicaSetStatus(ctx context.Context) (*mongoadmin.ReplicaSetStatus, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("replSetGetStatus"); err != nil {
+		return nil, err
+	}
+	if c.Status != nil {
+		return c.Status, nil
+	}
+	if c.Config == nil {
+		return nil, mongoadmin.ErrNotYetInitialized
+	}
+	status := &mongoadmin.ReplicaSetStatus{Set: c.Config.ID, MyState: mongoadmin.MEMBER_STATE_PRIMARY}
+	for _, member := range c.Config.Members {
+		state, stateStr := mongoadmin.MEMBER_STATE_SECONDARY, "SECONDARY"
+		if member.ArbiterOnly {
+			state, stateStr = mongoadmin.MEMBER_STATE_ARBITER, "ARBITER"
+		} else if member.Host == c.primaryHost() {
+			state, stateStr = mongoadmin.MEMBER_STATE_PRIMARY, "PRIMARY"
+		}
+		status.Members = append(status.Members, mongoadmin.MemberStatus{
+			ID:       member.ID,
+			Name:     member.Host,
+			Health:   1,
+			State:    state,
+			StateStr: stateStr,
+			Self:     member.Host == c.primaryHost(),
+		})
+	}
+	return status, nil
+}
+
+func (c *Client) GetReplicaSetConfig(ctx context.Context) (*mongoadmin.ReplicaSetConfig, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("replSetGetConfig"); err != nil {
+		return nil, err
+	}
+	if c.Config == nil {
+		return nil, mongoadmin.ErrNotYetInitialized
+	}
+	config := *c.Config
+	return &config, nil
+}
+
+func (c *Client) InitiateReplicaSet(ctx context.Context, config mongoadmin.ReplicaSetConfig) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("replSetInitiate"); err != nil {
+		return err
+	}
+	if c.Config != nil {
+		return fmt.Errorf("already initialized")
+	}
+	if err := validateHorizons(config); err != nil {
+		return err
+	}
+	c.Config = &config
+	return nil
+}
+
+func (c *Client) ReconfigureReplicaSet(ctx context.Context, config mongoadmin.ReplicaSetConfig) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("replSetReconfig"); err != nil {
+		return err
+	}
+	if c.Config == nil {
+		return mongoadmin.ErrNotYetInitialized
+	}
+	if config.Version <= c.Config.Version {
+		return fmt.Errorf("new config version %d must be greater than %d", config.Version, c.Config.Version)
+	}
+	if err := validateHorizons(config); err != nil {
+		return err
+	}
+	c.Config = &config
+	return nil
+}
+
+// validateHorizons rejects configurations whose members do not all have the same horizon names, as
+// MongoDB does.
+func validateHorizons(config mongoadmin.ReplicaSetConfig) error {
+	if len(config.Members) == 0 {
+		return nil
+	}
+	first := config.Members[0]
+	for _, member := range config.Members[1:] {
+		if len(member.Horizons) != len(first.Horizons) {
+			return fmt.Errorf("member %s does not have the same horizons as member %s", member.Host, first.Host)
+		}
+		for name := range first.Horizons {
+			if _, found := member.Horizons[name]; !found {
+				return fmt.Errorf("member %s has no horizon %s", member.Host, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) IsReplicaSetConfigCommitted(ctx context.Context) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("replSetGetConfig"); err != nil {
+		return false, err
+	}
+	return !c.Uncommitted, nil
+}
+
+// StepDown hands the primary role over to the next member of the configuration.
+func (c *Client) StepDown(ctx context.Context, stepDownSeconds int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("replSetStepDown"); err != nil {
+		return err
+	}
+	if c.Config == nil {
+		return mongoadmin.ErrNotYetInitialized
+	}
+	for i, member := range c.Config.Members {
+		if member.Host == c.primaryHost() {
+			c.Primary = c.Config.Members[(i+1)%len(c.Config.Members)].Host
+			return nil
+		}
+	}
+	return nil
+}
+
+// primaryHost defaults to the first member until a step down moved the primary role.
+func (c *Client) primaryHost() string {
+	if c.Primary != "" {
+		return c.Primary
+	}
+	if c.Config == nil || len(c.Config.Members) == 0 {
+		return ""
+	}
+	return c.Config.Members[0].Host
+}
+
+func (c *Client) ListShards(ctx context.Context) ([]mongoadmin.Shard, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("listShards"); err != nil {
+		return nil, err
+	}
+	return append([]mongoadmin.Shard{}, c.Shards...), nil
+}
+
+// AddShard names the shard after the replica set of the connection string, as mongos does.
+func (c *Client) AddShard(ctx context.Context, connectionString string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("addShard"); err != nil {
+		return err
+	}
+	replicaSet := strings.SplitN(connectionString, "/", 2)[0]
+	for _, shard := range c.Shards {
+		if shard.ID == replicaSet {
+			return fmt.Errorf("shard %s already exists", replicaSet)
+		}
+	}
+	c.Shards = append(c.Shards, mongoadmin.Shard{ID: replicaSet, Host: connectionString, State: 1})
+	return nil
+}
+
+func (c *Client) FsyncLock(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("fsync"); err != nil {
+		return err
+	}
+	c.Locks++
+	return nil
+}
+
+// FsyncUnlock fails when the member is not locked, as mongod does.
+func (c *Client) FsyncUnlock(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("fsyncUnlock"); err != nil {
+		return err
+	}
+	if c.Locks == 0 {
+		return fmt.Errorf("fsyncUnlock called when not locked")
+	}
+	c.Locks--
+	return nil
+}
+
+func (c *Client) GetUser(ctx context.Context, db string, name string) (*mongoadmin.User, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("usersInfo"); err != nil {
+		return nil, err
+	}
+	user, ok := c.Users[db][name]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+func (c *Client) CreateUser(ctx context.Context, db string, name string, password string, roles []mongoadmin.RoleReference) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("createUser"); err != nil {
+		return err
+	}
+	if _, ok := c.Users[db][name]; ok {
+		return fmt.Errorf("user %s@%s already exists", name, db)
+	}
+	if password == "" && db != mongoadmin.EXTERNAL_DATABASE {
+		return fmt.Errorf("user %s@%s requires a password outside of %s", name, db, mongoadmin.EXTERNAL_DATABASE)
+	}
+	c.setUser(db, name, password, roles)
+	return nil
+}
+
+func (c *Client) UpdateUser(ctx context.Context, db string, name string, password string, roles []mongoadmin.RoleReference) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("updateUser"); err != nil {
+		return err
+	}
+	if _, ok := c.Users[db][name]; !ok {
+		return fmt.Errorf("user %s@%s not found", name, db)
+	}
+	if password == "" {
+		password = c.Passwords[db][name]
+	}
+	c.setUser(db, name, password, roles)
+	return nil
+}
+
+func (c *Client) ChangeUserPassword(ctx context.Context, db string, name string, password string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("updateUser"); err != nil {
+		return err
+	}
+	if _, ok := c.Users[db][name]; !ok {
+		return fmt.Errorf("user %s@%s not found", name, db)
+	}
+	c.Passwords[db][name] = password
+	return nil
+}
+
+func (c *Client) setUser(db string, name string, password string, roles []mongoadmin.RoleReference) {
+	if c.Users == nil {
+		c.Users = map[string]map[string]mongoadmin.User{}
+		c.Passwords = map[string]map[string]string{}
+	}
+	if c.Users[db] == nil {
+		c.Users[db] = map[string]mongoadmin.User{}
+		c.Passwords[db] = map[string]string{}
+	}
+	c.Users[db][name] = mongoadmin.User{Name: name, DB: db, Roles: append([]mongoadmin.RoleReference{}, roles...)}
+	c.Passwords[db][name] = password
+}
+
+func (c *Client) DropUser(ctx context.Context, db string, name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("dropUser"); err != nil {
+		return err
+	}
+	delete(c.Users[db], name)
+	delete(c.Passwords[db], name)
+	return nil
+}
+
+func (c *Client) GetRole(ctx context.Context, db string, name string) (*mongoadmin.Role, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("rolesInfo"); err != nil {
+		return nil, err
+	}
+	role, ok := c.Roles[db][name]
+	if !ok {
+		return nil, nil
+	}
+	return &role, nil
+}
+
+func (c *Client) CreateRole(ctx context.Context, role mongoadmin.Role) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("createRole"); err != nil {
+		return err
+	}
+	if _, ok := c.Roles[role.DB][role.Name]; ok {
+		return fmt.Errorf("role %s@%s already exists", role.Name, role.DB)
+	}
+	if c.Roles == nil {
+		c.Roles = map[string]map[string]mongoadmin.Role{}
+	}
+	if c.Roles[role.DB] == nil {
+		c.Roles[role.DB] = map[string]mongoadmin.Role{}
+	}
+	c.Roles[role.DB][role.Name] = role
+	return nil
+}
+
+func (c *Client) UpdateRole(ctx context.Context, role mongoadmin.Role) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("updateRole"); err != nil {
+		return err
+	}
+	if _, ok := c.Roles[role.DB][role.Name]; !ok {
+		return fmt.Errorf("role %s@%s not found", role.Name, role.DB)
+	}
+	c.Roles[role.DB][role.Name] = role
+	return nil
+}
+
+func (c *Client) DropRole(ctx context.Context, db string, name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.record("dropRole"); err != nil {
+		return err
+	}
+	delete(c.Roles[db], name)
+	return nil
+}
+
+func (c *Client) Disconnect(ctx context.Context) error {
+	return nil
+}
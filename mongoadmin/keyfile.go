@@ -0,0 +1,35 @@
+package mongoadmin
+
+import (
+	"strings"
+)
+
+// ParseKeyfile returns the keys of a keyfile, which holds either a single key or, while the keys are
+// rotated, a YAML sequence of keys.
+func ParseKeyfile(content string) []string {
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "- ") {
+			continue
+		}
+		keys = append(keys, strings.TrimSpace(strings.TrimPrefix(line, "- ")))
+	}
+	if len(keys) == 0 && strings.TrimSpace(content) != "" {
+		return []string{strings.TrimSpace(content)}
+	}
+	return keys
+}
+
+// FormatKeyfile writes a single key as is and several keys as a YAML sequence, which mongod reads as
+// the keys it accepts during a key rotation.
+func FormatKeyfile(keys []string) string {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	content := ""
+	for _, key := range keys {
+		content += "- " + key + "\n"
+	}
+	return content
+}
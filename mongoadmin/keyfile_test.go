@@ -0,0 +1,25 @@
+package mongoadmin_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+)
+
+var _ = Describe("Keyfile", func() {
+	It("reads a single key", func() {
+		Expect(mongoadmin.ParseKeyfile("c2VjcmV0+/key\n")).To(Equal([]string{"c2VjcmV0+/key"}))
+		Expect(mongoadmin.ParseKeyfile("")).To(BeEmpty())
+	})
+
+	It("reads back the keys of a rotation", func() {
+		content := mongoadmin.FormatKeyfile([]string{"old", "new"})
+		Expect(content).To(Equal("- old\n- new\n"))
+		Expect(mongoadmin.ParseKeyfile(content)).To(Equal([]string{"old", "new"}))
+	})
+
+	It("writes a single key as is", func() {
+		Expect(mongoadmin.FormatKeyfile([]string{"new"})).To(Equal("new"))
+	})
+})
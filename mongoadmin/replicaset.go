@@ -0,0 +1,208 @@
+package mongoadmin
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"time"
+)
+
+// Replica set member states as reported by replSetGetStatus.
+const (
+	MEMBER_STATE_STARTUP    = 0
+	MEMBER_STATE_PRIMARY    = 1
+	MEMBER_STATE_SECONDARY  = 2
+	MEMBER_STATE_RECOVERING = 3
+	MEMBER_STATE_STARTUP2   = 5
+	MEMBER_STATE_UNKNOWN    = 6
+	MEMBER_STATE_ARBITER    = 7
+	MEMBER_STATE_DOWN       = 8
+	MEMBER_STATE_ROLLBACK   = 9
+	MEMBER_STATE_REMOVED    = 10
+)
+
+// ReplicaSetConfig is the document accepted by replSetInitiate and replSetReconfig. Fields the
+// operator does not manage are kept in Extra so that a reconfig does not reset them.
+type ReplicaSetConfig struct {
+	ID      string   `bson:"_id"`
+	Version int64    `bson:"version"`
+	Members []Member `bson:"members"`
+	Extra   bson.M   `bson:",inline"`
+}
+
+// Member is one entry of the members array of a replica set configuration. Use NewMember to get the
+// MongoDB defaults for the settings.
+type Member struct {
+	ID                 int               `bson:"_id"`
+	Host               string            `bson:"host"`
+	ArbiterOnly        bool              `bson:"arbiterOnly"`
+	Hidden             bool              `bson:"hidden"`
+	Priority           float64           `bson:"priority"`
+	Votes              int               `bson:"votes"`
+	SecondaryDelaySecs int64             `bson:"secondaryDelaySecs"`
+	Tags               map[string]string `bson:"tags,omitempty"`
+	Horizons           map[string]string `bson:"horizons,omitempty"`
+	Extra              bson.M            `bson:",inline"`
+}
+
+// NewMember returns a voting, electable member.
+func NewMember(id int, host string) Member {
+	return Member{
+		ID:       id,
+		Host:     host,
+		Priority: 1,
+		Votes:    1,
+	}
+}
+
+// sameSettings compares the settings the operator manages.
+func (m Member) sameSettings(other Member) bool {
+	if len(m.Tags) != 0 || len(other.Tags) != 0 {
+		if !reflect.DeepEqual(m.Tags, other.Tags) {
+			return false
+		}
+	}
+	return m.ArbiterOnly == other.ArbiterOnly &&
+		m.Hidden == other.Hidden &&
+		m.Priority == other.Priority &&
+		m.Votes == other.Votes &&
+		m.SecondaryDelaySecs == other.SecondaryDelaySecs
+}
+
+// sameHorizons compares the horizons of two members, a nil map and an empty one are the same.
+func sameHorizons(horizons map[string]string, other map[string]string) bool {
+	if len(horizons) == 0 && len(other) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(horizons, other)
+}
+
+// ReplicaSetStatus is the subset of the replSetGetStatus output the operator relies on.
+type ReplicaSetStatus struct {
+	Set     string         `bson:"set"`
+	MyState int            `bson:"myState"`
+	Members []MemberStatus `bson:"members"`
+}
+
+// MemberStatus is the state of one member as seen by the member that answered replSetGetStatus.
+type MemberStatus struct {
+	ID         int       `bson:"_id"`
+	Name       string    `bson:"name"`
+	Health     float64   `bson:"health"`
+	State      int       `bson:"state"`
+	StateStr   string    `bson:"stateStr"`
+	OptimeDate time.Time `bson:"optimeDate"`
+	Self       bool      `bson:"self"`
+}
+
+// Primary returns the status of the current primary, or nil when the set has none.
+func (s *ReplicaSetStatus) Primary() *MemberStatus {
+	for i := range s.Members {
+		if s.Members[i].State == MEMBER_STATE_PRIMARY {
+			return &s.Members[i]
+		}
+	}
+	return nil
+}
+
+// Member returns the status of the member with the given host, or nil when it is not part of the set.
+func (s *ReplicaSetStatus) Member(host string) *MemberStatus {
+	for i := range s.Members {
+		if s.Members[i].Name == host {
+			return &s.Members[i]
+		}
+	}
+	return nil
+}
+
+// NextConfig returns the configuration that brings current one step closer to the desired members,
+// and false when current already matches them. MongoDB refuses to add or remove more than one
+// voting member per reconfig, so a member that is not desired any more is removed first, then the
+// horizons of every member are updated at once, then one missing member is added, then the settings
+// of one member are updated. A member has to be removed and added again to become an arbiter or to
+// stop being one. The caller applies the result and calls NextConfig again once the new
+// configuration has been committed.
+func NextConfig(current ReplicaSetConfig, desired []Member) (ReplicaSetConfig, bool) {
+	desiredHosts := map[string]bool{}
+	desiredMembers := map[string]Member{}
+	for _, member := range desired {
+		desiredHosts[member.Host] = true
+		desiredMembers[member.Host] = member
+	}
+	currentHosts := map[string]bool{}
+	for _, member := range current.Members {
+		currentHosts[member.Host] = true
+	}
+
+	next := current
+	next.Extra = cleanConfigExtra(current.Extra)
+	for i, member := range current.Members {
+		if !desiredHosts[member.Host] || desiredMembers[member.Host].ArbiterOnly != member.ArbiterOnly {
+			next.Members = append(append([]Member{}, current.Members[:i]...), current.Members[i+1:]...)
+			next.Version++
+			return next, true
+		}
+	}
+	// Every member must have the same horizon names, so the horizons of all the members are set in a
+	// single reconfig, before members carrying the new horizons are added.
+	for _, member := range current.Members {
+		if !sameHorizons(member.Horizons, desiredMembers[member.Host].Horizons) {
+			next.Members = append([]Member{}, current.Members...)
+			for i := range next.Members {
+				next.Members[i].Horizons = desiredMembers[next.Members[i].Host].Horizons
+			}
+			next.Version++
+			return next, true
+		}
+	}
+	for _, member := range desired {
+		if !currentHosts[member.Host] {
+			member.ID = nextMemberID(current.Members, member.ID)
+			next.Members = append(append([]Member{}, current.Members...), member)
+			next.Version++
+			return next, true
+		}
+	}
+	for i, member := range current.Members {
+		wanted := desiredMembers[member.Host]
+		if !member.sameSettings(wanted) {
+			wanted.ID = member.ID
+			wanted.Extra = member.Extra
+			next.Members = append([]Member{}, current.Members...)
+			next.Members[i] = wanted
+			next.Version++
+			return next, true
+		}
+	}
+	return current, false
+}
+
+// nextMemberID keeps the preferred id when it is free, member ids must be unique within the set.
+func nextMemberID(members []Member, preferred int) int {
+	used := map[int]bool{}
+	maxID := -1
+	for _, member := range members {
+		used[member.ID] = true
+		if member.ID > maxID {
+			maxID = member.ID
+		}
+	}
+	if !used[preferred] {
+		return preferred
+	}
+	return maxID + 1
+}
+
+// cleanConfigExtra drops the fields replSetGetConfig returns but replSetReconfig must not be given.
+func cleanConfigExtra(extra bson.M) bson.M {
+	if extra == nil {
+		return nil
+	}
+	cleaned := bson.M{}
+	for key, value := range extra {
+		if key == "term" {
+			continue
+		}
+		cleaned[key] = value
+	}
+	return cleaned
+}
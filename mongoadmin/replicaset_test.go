@@ -0,0 +1,167 @@
+package mongoadmin_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+)
+
+func members(hosts ...string) []mongoadmin.Member {
+	var result []mongoadmin.Member
+	for i, host := range hosts {
+		result = append(result, mongoadmin.Member{ID: i, Host: host})
+	}
+	return result
+}
+
+func hosts(config mongoadmin.ReplicaSetConfig) []string {
+	var result []string
+	for _, member := range config.Members {
+		result = append(result, member.Host)
+	}
+	return result
+}
+
+var _ = Describe("NextConfig", func() {
+	It("does nothing when the members already match", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 3, Members: members("a", "b")}
+		next, changed := mongoadmin.NextConfig(current, members("a", "b"))
+		Expect(changed).To(BeFalse())
+		Expect(next.Version).To(BeEquivalentTo(3))
+	})
+
+	It("adds a single member per step", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 1, Members: members("a")}
+		next, changed := mongoadmin.NextConfig(current, members("a", "b", "c"))
+		Expect(changed).To(BeTrue())
+		Expect(hosts(next)).To(Equal([]string{"a", "b"}))
+		Expect(next.Members[1].ID).To(Equal(1))
+		Expect(next.Version).To(BeEquivalentTo(2))
+	})
+
+	It("removes members that are not desired before adding new ones", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 4, Members: members("a", "b", "c")}
+		next, changed := mongoadmin.NextConfig(current, members("a", "d"))
+		Expect(changed).To(BeTrue())
+		Expect(hosts(next)).To(Equal([]string{"a", "c"}))
+	})
+
+	It("does not reuse the id of a remaining member", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 1, Members: []mongoadmin.Member{{ID: 1, Host: "a"}}}
+		next, _ := mongoadmin.NextConfig(current, []mongoadmin.Member{{ID: 0, Host: "a"}, {ID: 1, Host: "b"}})
+		Expect(next.Members[1].ID).To(Equal(2))
+	})
+
+	It("keeps unmanaged settings but drops the term", func() {
+		current := mongoadmin.ReplicaSetConfig{
+			ID:      "rs",
+			Version: 1,
+			Members: members("a"),
+			Extra:   bson.M{"term": 4, "settings": bson.M{"chainingAllowed": true}},
+		}
+		next, _ := mongoadmin.NextConfig(current, members("a", "b"))
+		Expect(next.Extra).To(HaveKey("settings"))
+		Expect(next.Extra).NotTo(HaveKey("term"))
+	})
+
+	It("converges when applied repeatedly", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		Expect(client.InitiateReplicaSet(ctx, mongoadmin.ReplicaSetConfig{ID: "rs", Version: 1, Members: members("a")})).To(Succeed())
+		desired := members("a", "b", "c")
+		for {
+			config, err := client.GetReplicaSetConfig(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			next, changed := mongoadmin.NextConfig(*config, desired)
+			if !changed {
+				break
+			}
+			Expect(client.ReconfigureReplicaSet(ctx, next)).To(Succeed())
+		}
+		Expect(hosts(*client.Config)).To(Equal([]string{"a", "b", "c"}))
+		Expect(client.Config.Version).To(BeEquivalentTo(3))
+	})
+
+	It("removes one member per step on scale down", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		Expect(client.InitiateReplicaSet(ctx, mongoadmin.ReplicaSetConfig{ID: "rs", Version: 1, Members: members("a", "b", "c")})).To(Succeed())
+		desired := members("a")
+		for {
+			config, err := client.GetReplicaSetConfig(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			next, changed := mongoadmin.NextConfig(*config, desired)
+			if !changed {
+				break
+			}
+			Expect(len(config.Members) - len(next.Members)).To(Equal(1))
+			Expect(client.ReconfigureReplicaSet(ctx, next)).To(Succeed())
+		}
+		Expect(hosts(*client.Config)).To(Equal([]string{"a"}))
+	})
+
+	It("updates the settings of an existing member", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 2, Members: []mongoadmin.Member{mongoadmin.NewMember(0, "a"), mongoadmin.NewMember(1, "b")}}
+		hidden := mongoadmin.NewMember(1, "b")
+		hidden.Hidden = true
+		hidden.Priority = 0
+		next, changed := mongoadmin.NextConfig(current, []mongoadmin.Member{mongoadmin.NewMember(0, "a"), hidden})
+		Expect(changed).To(BeTrue())
+		Expect(next.Members[1].Hidden).To(BeTrue())
+		Expect(next.Members[1].Priority).To(BeZero())
+		Expect(next.Version).To(BeEquivalentTo(3))
+	})
+
+	It("removes a member before adding it back as an arbiter", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 2, Members: []mongoadmin.Member{mongoadmin.NewMember(0, "a"), mongoadmin.NewMember(1, "b")}}
+		arbiter := mongoadmin.NewMember(1, "b")
+		arbiter.ArbiterOnly = true
+		arbiter.Priority = 0
+		desired := []mongoadmin.Member{mongoadmin.NewMember(0, "a"), arbiter}
+		next, _ := mongoadmin.NextConfig(current, desired)
+		Expect(hosts(next)).To(Equal([]string{"a"}))
+		next, _ = mongoadmin.NextConfig(next, desired)
+		Expect(hosts(next)).To(Equal([]string{"a", "b"}))
+		Expect(next.Members[1].ArbiterOnly).To(BeTrue())
+		_, changed := mongoadmin.NextConfig(next, desired)
+		Expect(changed).To(BeFalse())
+	})
+
+	It("sets the horizons of every member at once", func() {
+		current := mongoadmin.ReplicaSetConfig{ID: "rs", Version: 2, Members: members("a", "b")}
+		desired := members("a", "b", "c")
+		for i := range desired {
+			desired[i].Horizons = map[string]string{"external": desired[i].Host + ".example.com:27017"}
+		}
+		next, changed := mongoadmin.NextConfig(current, desired)
+		Expect(changed).To(BeTrue())
+		Expect(hosts(next)).To(Equal([]string{"a", "b"}))
+		Expect(next.Members[0].Horizons).To(HaveKeyWithValue("external", "a.example.com:27017"))
+		Expect(next.Members[1].Horizons).To(HaveKeyWithValue("external", "b.example.com:27017"))
+		next, _ = mongoadmin.NextConfig(next, desired)
+		Expect(hosts(next)).To(Equal([]string{"a", "b", "c"}))
+		Expect(next.Members[2].Horizons).To(HaveKeyWithValue("external", "c.example.com:27017"))
+		_, changed = mongoadmin.NextConfig(next, desired)
+		Expect(changed).To(BeFalse())
+	})
+
+	It("removes the horizons of every member at once", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		initial := members("a", "b")
+		for i := range initial {
+			initial[i].Horizons = map[string]string{"external": initial[i].Host + ".example.com:27017"}
+		}
+		Expect(client.InitiateReplicaSet(ctx, mongoadmin.ReplicaSetConfig{ID: "rs", Version: 1, Members: initial})).To(Succeed())
+		next, changed := mongoadmin.NextConfig(*client.Config, members("a", "b"))
+		Expect(changed).To(BeTrue())
+		Expect(client.ReconfigureReplicaSet(ctx, next)).To(Succeed())
+		Expect(client.Config.Members[0].Horizons).To(BeEmpty())
+		Expect(client.Config.Members[1].Horizons).To(BeEmpty())
+	})
+})
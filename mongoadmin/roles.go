@@ -0,0 +1,128 @@
+package mongoadmin
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"sort"
+)
+
+const errorCodeRoleNotFound = 31
+
+// PrivilegeResource is either a database and collection, empty for all of them, or the cluster.
+type PrivilegeResource struct {
+	DB         string `bson:"db"`
+	Collection string `bson:"collection"`
+	Cluster    bool   `bson:"cluster,omitempty"`
+}
+
+// Privilege allows actions on a resource.
+type Privilege struct {
+	Resource PrivilegeResource `bson:"resource"`
+	Actions  []string          `bson:"actions"`
+}
+
+// Role is one entry of the rolesInfo output, with the privileges it grants directly.
+type Role struct {
+	Name       string          `bson:"role"`
+	DB         string          `bson:"db"`
+	Privileges []Privilege     `bson:"privileges"`
+	Roles      []RoleReference `bson:"roles"`
+}
+
+// SameRole tells whether both roles grant the same privileges and inherit the same roles, whatever
+// their order.
+func SameRole(a Role, b Role) bool {
+	if !SameRoles(a.Roles, b.Roles) || len(a.Privileges) != len(b.Privileges) {
+		return false
+	}
+	sortedA, sortedB := sortedPrivileges(a.Privileges), sortedPrivileges(b.Privileges)
+	for i := range sortedA {
+		if privilegeKey(sortedA[i]) != privilegeKey(sortedB[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedPrivileges(privileges []Privilege) []Privilege {
+	result := append([]Privilege{}, privileges...)
+	sort.Slice(result, func(i, j int) bool {
+		return privilegeKey(result[i]) < privilegeKey(result[j])
+	})
+	return result
+}
+
+// privilegeKey identifies a privilege, the actions being sorted.
+func privilegeKey(privilege Privilege) string {
+	actions := append([]string{}, privilege.Actions...)
+	sort.Strings(actions)
+	resource := privilege.Resource.DB + "." + privilege.Resource.Collection
+	if privilege.Resource.Cluster {
+		resource = "cluster"
+	}
+	key := resource + ":"
+	for _, action := range actions {
+		key += action + ","
+	}
+	return key
+}
+
+// document encodes the resource, db and collection must not be sent along with cluster.
+func (r PrivilegeResource) document() bson.D {
+	if r.Cluster {
+		return bson.D{{Key: "cluster", Value: true}}
+	}
+	return bson.D{{Key: "db", Value: r.DB}, {Key: "collection", Value: r.Collection}}
+}
+
+func privilegeDocuments(privileges []Privilege) bson.A {
+	documents := bson.A{}
+	for _, privilege := range privileges {
+		documents = append(documents, bson.D{
+			{Key: "resource", Value: privilege.Resource.document()},
+			{Key: "actions", Value: privilege.Actions},
+		})
+	}
+	return documents
+}
+
+func (c *driverClient) GetRole(ctx context.Context, db string, name string) (*Role, error) {
+	result := struct {
+		Roles []Role `bson:"roles"`
+	}{}
+	err := c.runCommand(ctx, db, bson.D{
+		{Key: "rolesInfo", Value: bson.D{{Key: "role", Value: name}, {Key: "db", Value: db}}},
+		{Key: "showPrivileges", Value: true},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Roles) == 0 {
+		return nil, nil
+	}
+	return &result.Roles[0], nil
+}
+
+func (c *driverClient) CreateRole(ctx context.Context, role Role) error {
+	return c.runCommand(ctx, role.DB, bson.D{
+		{Key: "createRole", Value: role.Name},
+		{Key: "privileges", Value: privilegeDocuments(role.Privileges)},
+		{Key: "roles", Value: nonNilRoles(role.Roles)},
+	}, nil)
+}
+
+func (c *driverClient) UpdateRole(ctx context.Context, role Role) error {
+	return c.runCommand(ctx, role.DB, bson.D{
+		{Key: "updateRole", Value: role.Name},
+		{Key: "privileges", Value: privilegeDocuments(role.Privileges)},
+		{Key: "roles", Value: nonNilRoles(role.Roles)},
+	}, nil)
+}
+
+func (c *driverClient) DropRole(ctx context.Context, db string, name string) error {
+	err := c.runCommand(ctx, db, bson.D{{Key: "dropRole", Value: name}}, nil)
+	if hasErrorCode(err, errorCodeRoleNotFound) {
+		return nil
+	}
+	return err
+}
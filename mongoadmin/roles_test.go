@@ -0,0 +1,39 @@
+package mongoadmin_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+)
+
+var _ = Describe("SameRole", func() {
+	role := func(privileges ...mongoadmin.Privilege) mongoadmin.Role {
+		return mongoadmin.Role{Name: "reporting", DB: "admin", Privileges: privileges}
+	}
+
+	It("ignores the order of the privileges and of their actions", func() {
+		a := role(
+			mongoadmin.Privilege{Resource: mongoadmin.PrivilegeResource{DB: "app", Collection: "orders"}, Actions: []string{"find", "insert"}},
+			mongoadmin.Privilege{Resource: mongoadmin.PrivilegeResource{Cluster: true}, Actions: []string{"serverStatus"}},
+		)
+		b := role(
+			mongoadmin.Privilege{Resource: mongoadmin.PrivilegeResource{Cluster: true}, Actions: []string{"serverStatus"}},
+			mongoadmin.Privilege{Resource: mongoadmin.PrivilegeResource{DB: "app", Collection: "orders"}, Actions: []string{"insert", "find"}},
+		)
+		Expect(mongoadmin.SameRole(a, b)).To(BeTrue())
+	})
+
+	It("tells apart privileges on different collections", func() {
+		a := role(mongoadmin.Privilege{Resource: mongoadmin.PrivilegeResource{DB: "app", Collection: "orders"}, Actions: []string{"find"}})
+		b := role(mongoadmin.Privilege{Resource: mongoadmin.PrivilegeResource{DB: "app"}, Actions: []string{"find"}})
+		Expect(mongoadmin.SameRole(a, b)).To(BeFalse())
+	})
+
+	It("compares the inherited roles", func() {
+		a := role()
+		b := role()
+		b.Roles = []mongoadmin.RoleReference{{Role: "read", DB: "app"}}
+		Expect(mongoadmin.SameRole(a, b)).To(BeFalse())
+	})
+})
@@ -0,0 +1,34 @@
+package mongoadmin
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"strings"
+)
+
+// Shard is one entry of the listShards output.
+type Shard struct {
+	ID    string `bson:"_id"`
+	Host  string `bson:"host"`
+	State int    `bson:"state"`
+}
+
+// ReplicaSetSeedList returns the replicaSet/host,host seed list taken by addShard and mongos --configdb.
+func ReplicaSetSeedList(replicaSet string, hosts []string) string {
+	return fmt.Sprintf("%s/%s", replicaSet, strings.Join(hosts, ","))
+}
+
+func (c *driverClient) ListShards(ctx context.Context) ([]Shard, error) {
+	result := struct {
+		Shards []Shard `bson:"shards"`
+	}{}
+	if err := c.runAdminCommand(ctx, bson.D{{Key: "listShards", Value: 1}}, &result); err != nil {
+		return nil, err
+	}
+	return result.Shards, nil
+}
+
+func (c *driverClient) AddShard(ctx context.Context, connectionString string) error {
+	return c.runAdminCommand(ctx, bson.D{{Key: "addShard", Value: connectionString}}, nil)
+}
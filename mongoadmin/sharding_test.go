@@ -0,0 +1,28 @@
+package mongoadmin_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+)
+
+var _ = Describe("ReplicaSetSeedList", func() {
+	It("prefixes the hosts with the replica set name", func() {
+		Expect(mongoadmin.ReplicaSetSeedList("shard-0", []string{"a:27017", "b:27017"})).To(Equal("shard-0/a:27017,b:27017"))
+	})
+
+	It("names the shard after its replica set", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		Expect(client.AddShard(ctx, mongoadmin.ReplicaSetSeedList("shard-0", []string{"a:27017"}))).To(Succeed())
+		shards, err := client.ListShards(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shards).To(HaveLen(1))
+		Expect(shards[0].ID).To(Equal("shard-0"))
+		Expect(client.AddShard(ctx, "shard-0/a:27017")).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,14 @@
+package mongoadmin_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMongoAdmin(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "MongoAdmin Suite")
+}
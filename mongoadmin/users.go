@@ -0,0 +1,111 @@
+package mongoadmin
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"sort"
+)
+
+const errorCodeUserNotFound = 11
+
+// RoleReference grants the role defined in a database.
+type RoleReference struct {
+	Role string `bson:"role"`
+	DB   string `bson:"db"`
+}
+
+// User is one entry of the usersInfo output.
+type User struct {
+	Name  string          `bson:"user"`
+	DB    string          `bson:"db"`
+	Roles []RoleReference `bson:"roles"`
+}
+
+// SameRoles tells whether both lists grant the same roles, whatever their order.
+func SameRoles(a []RoleReference, b []RoleReference) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := func(roles []RoleReference) []RoleReference {
+		result := append([]RoleReference{}, roles...)
+		sort.Slice(result, func(i, j int) bool {
+			if result[i].DB != result[j].DB {
+				return result[i].DB < result[j].DB
+			}
+			return result[i].Role < result[j].Role
+		})
+		return result
+	}
+	sortedA, sortedB := sorted(a), sorted(b)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *driverClient) GetUser(ctx context.Context, db string, name string) (*User, error) {
+	result := struct {
+		Users []User `bson:"users"`
+	}{}
+	err := c.runCommand(ctx, db, bson.D{{Key: "usersInfo", Value: bson.D{{Key: "user", Value: name}, {Key: "db", Value: db}}}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Users) == 0 {
+		return nil, nil
+	}
+	return &result.Users[0], nil
+}
+
+func (c *driverClient) CreateUser(ctx context.Context, db string, name string, password string, roles []RoleReference) error {
+	return c.runCommand(ctx, db, createUserCommand(name, password, roles), nil)
+}
+
+func (c *driverClient) UpdateUser(ctx context.Context, db string, name string, password string, roles []RoleReference) error {
+	return c.runCommand(ctx, db, updateUserCommand(name, password, roles), nil)
+}
+
+func (c *driverClient) ChangeUserPassword(ctx context.Context, db string, name string, password string) error {
+	return c.runCommand(ctx, db, changeUserPasswordCommand(name, password), nil)
+}
+
+func (c *driverClient) DropUser(ctx context.Context, db string, name string) error {
+	err := c.runCommand(ctx, db, bson.D{{Key: "dropUser", Value: name}}, nil)
+	if hasErrorCode(err, errorCodeUserNotFound) {
+		return nil
+	}
+	return err
+}
+
+// createUserCommand leaves the password out when it is empty, for the users of $external.
+func createUserCommand(name string, password string, roles []RoleReference) bson.D {
+	command := bson.D{{Key: "createUser", Value: name}}
+	if password != "" {
+		command = append(command, bson.E{Key: "pwd", Value: password})
+	}
+	return append(command, bson.E{Key: "roles", Value: nonNilRoles(roles)})
+}
+
+// updateUserCommand leaves the password out when it is empty, MongoDB then keeps the current one.
+func updateUserCommand(name string, password string, roles []RoleReference) bson.D {
+	command := bson.D{{Key: "updateUser", Value: name}}
+	if password != "" {
+		command = append(command, bson.E{Key: "pwd", Value: password})
+	}
+	return append(command, bson.E{Key: "roles", Value: nonNilRoles(roles)})
+}
+
+// changeUserPasswordCommand leaves the roles out, MongoDB then keeps the current ones.
+func changeUserPasswordCommand(name string, password string) bson.D {
+	return bson.D{{Key: "updateUser", Value: name}, {Key: "pwd", Value: password}}
+}
+
+// nonNilRoles encodes a missing list as an empty array, the roles field is required.
+func nonNilRoles(roles []RoleReference) []RoleReference {
+	if roles == nil {
+		return []RoleReference{}
+	}
+	return roles
+}
@@ -0,0 +1,105 @@
+package mongoadmin_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin"
+	"github.com/PaulBarrie/mongo-cluster/mongoadmin/fake"
+)
+
+var _ = Describe("SameRoles", func() {
+	It("ignores the order of the roles", func() {
+		a := []mongoadmin.RoleReference{{Role: "read", DB: "app"}, {Role: "readWrite", DB: "logs"}}
+		b := []mongoadmin.RoleReference{{Role: "readWrite", DB: "logs"}, {Role: "read", DB: "app"}}
+		Expect(mongoadmin.SameRoles(a, b)).To(BeTrue())
+	})
+
+	It("tells apart the same role in different databases", func() {
+		a := []mongoadmin.RoleReference{{Role: "read", DB: "app"}}
+		b := []mongoadmin.RoleReference{{Role: "read", DB: "logs"}}
+		Expect(mongoadmin.SameRoles(a, b)).To(BeFalse())
+		Expect(mongoadmin.SameRoles(a, nil)).To(BeFalse())
+	})
+
+	It("keeps the password of a user updated without one", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		Expect(client.CreateUser(ctx, "app", "alice", "secret", nil)).To(Succeed())
+		Expect(client.UpdateUser(ctx, "app", "alice", "", []mongoadmin.RoleReference{{Role: "read", DB: "app"}})).To(Succeed())
+		Expect(client.Passwords["app"]["alice"]).To(Equal("secret"))
+		user, err := client.GetUser(ctx, "app", "alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(user.Roles).To(HaveLen(1))
+		Expect(client.DropUser(ctx, "app", "alice")).To(Succeed())
+		user, err = client.GetUser(ctx, "app", "alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(user).To(BeNil())
+	})
+
+	It("changes the password of a user without touching its roles", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		roles := []mongoadmin.RoleReference{{Role: "root", DB: "admin"}}
+		Expect(client.CreateUser(ctx, "admin", "admin", "old", roles)).To(Succeed())
+		Expect(client.ChangeUserPassword(ctx, "admin", "admin", "new")).To(Succeed())
+		Expect(client.Passwords["admin"]["admin"]).To(Equal("new"))
+		user, err := client.GetUser(ctx, "admin", "admin")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(user.Roles).To(Equal(roles))
+	})
+
+	It("only creates users without password in $external", func() {
+		ctx := context.Background()
+		client := fake.NewClient()
+		subject := "CN=alice,OU=clients,O=cluster"
+		Expect(client.CreateUser(ctx, mongoadmin.EXTERNAL_DATABASE, subject, "", nil)).To(Succeed())
+		Expect(client.CreateUser(ctx, "app", "alice", "", nil)).NotTo(Succeed())
+		user, err := client.GetUser(ctx, mongoadmin.EXTERNAL_DATABASE, subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(user.Name).To(Equal(subject))
+	})
+})
+
+var _ = Describe("user commands", func() {
+	roles := []mongoadmin.RoleReference{{Role: "read", DB: "app"}}
+
+	It("creates a user with its password and roles", func() {
+		Expect(mongoadmin.CreateUserCommand("alice", "secret", roles)).To(Equal(bson.D{
+			{Key: "createUser", Value: "alice"},
+			{Key: "pwd", Value: "secret"},
+			{Key: "roles", Value: roles},
+		}))
+	})
+
+	It("creates the users of $external without password", func() {
+		subject := "CN=alice,OU=clients,O=cluster"
+		Expect(mongoadmin.CreateUserCommand(subject, "", nil)).To(Equal(bson.D{
+			{Key: "createUser", Value: subject},
+			{Key: "roles", Value: []mongoadmin.RoleReference{}},
+		}))
+	})
+
+	It("keeps the password of a user updated without one", func() {
+		Expect(mongoadmin.UpdateUserCommand("alice", "", roles)).To(Equal(bson.D{
+			{Key: "updateUser", Value: "alice"},
+			{Key: "roles", Value: roles},
+		}))
+		Expect(mongoadmin.UpdateUserCommand("alice", "secret", nil)).To(Equal(bson.D{
+			{Key: "updateUser", Value: "alice"},
+			{Key: "pwd", Value: "secret"},
+			{Key: "roles", Value: []mongoadmin.RoleReference{}},
+		}))
+	})
+
+	It("changes the password of a user without touching its roles", func() {
+		Expect(mongoadmin.ChangeUserPasswordCommand("admin", "new")).To(Equal(bson.D{
+			{Key: "updateUser", Value: "admin"},
+			{Key: "pwd", Value: "new"},
+		}))
+	})
+})